@@ -11,6 +11,7 @@ package auth
 
 import (
 	"encoding/json"
+	"net/http"
 
 	"github.com/couchbase/go-couchbase"
 
@@ -31,6 +32,11 @@ type ChannelComputer interface {
 	ComputeRolesForUser(User) (ch.TimedSet, error)
 }
 
+// A ChannelComputer can also implement this to give roles the roles that documents grant them.
+type RoleComputer interface {
+	ComputeRolesForRole(Role) (ch.TimedSet, error)
+}
+
 type userByEmailInfo struct {
 	Username string
 }
@@ -90,9 +96,11 @@ func (auth *Authenticator) GetRole(name string) (Role, error) {
 // Common implementation of GetUser and GetRole. factory() parameter returns a new empty instance.
 func (auth *Authenticator) getPrincipal(docID string, factory func() Principal) (Principal, error) {
 	var princ Principal
+	var rolesRebuilt bool
 
 	err := auth.bucket.Update(docID, 0, func(currentValue []byte) ([]byte, error) {
 		// Be careful: this block can be invoked multiple times if there are races!
+		rolesRebuilt = false
 		if currentValue == nil {
 			princ = nil
 			return nil, couchbase.UpdateCancel
@@ -109,13 +117,13 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 			}
 			changed = true
 		}
-		if user, ok := princ.(User); ok {
-			if user.RoleNames() == nil {
-				if err := auth.rebuildRoles(user); err != nil {
-					return nil, err
-				}
-				changed = true
+		if princ.RoleNames() == nil {
+			// Role list has been invalidated by a doc update -- rebuild it:
+			if err := auth.rebuildRoles(princ); err != nil {
+				return nil, err
 			}
+			changed = true
+			rolesRebuilt = true
 		}
 
 		if changed {
@@ -130,6 +138,13 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 	if err != nil && err != couchbase.UpdateCancel {
 		return nil, err
 	}
+	if _, isUser := princ.(User); rolesRebuilt && princ != nil && !isUser {
+		// The roles that documents give a role aren't checked when they're granted, so check now
+		// (after saving, as the check loads the role again):
+		if err := auth.CheckRoleCycle(princ.Name(), princ.RoleNames().AsSet()); err != nil {
+			base.Warn("Roles granted to role %q by documents: %v", princ.Name(), err)
+		}
+	}
 	return princ, nil
 }
 
@@ -151,13 +166,17 @@ func (auth *Authenticator) rebuildChannels(princ Principal) error {
 	return nil
 }
 
-func (auth *Authenticator) rebuildRoles(user User) error {
+func (auth *Authenticator) rebuildRoles(princ Principal) error {
 	var roles ch.TimedSet
 	if auth.channelComputer != nil {
 		var err error
-		roles, err = auth.channelComputer.ComputeRolesForUser(user)
+		if user, ok := princ.(User); ok {
+			roles, err = auth.channelComputer.ComputeRolesForUser(user)
+		} else if computer, ok := auth.channelComputer.(RoleComputer); ok {
+			roles, err = computer.ComputeRolesForRole(princ)
+		}
 		if err != nil {
-			base.Warn("channelComputer.ComputeRolesForUser failed on user %s: %v", user.Name(), err)
+			base.Warn("channelComputer failed to compute roles of %s: %v", princ.Name(), err)
 			return err
 		}
 	}
@@ -165,12 +184,64 @@ func (auth *Authenticator) rebuildRoles(user User) error {
 		roles = ch.TimedSet{} // it mustn't be nil; nil means it's unknown
 	}
 
-	if explicit := user.ExplicitRoles(); explicit != nil {
+	if explicit := princ.ExplicitRoles(); explicit != nil {
 		roles.Add(explicit)
 	}
 
-	base.LogTo("Access", "Computed roles for %q: %s", user.Name(), roles)
-	user.setRolesSince(roles)
+	base.LogTo("Access", "Computed roles for %q: %s", princ.Name(), roles)
+	princ.setRolesSince(roles)
+	return nil
+}
+
+// Resolves role inheritance. Given the roles a principal belongs to and the sequences it joined
+// them at, returns every role it belongs to directly or through other roles, along with the Role
+// objects of the ones that exist. A role reached through a chain of roles is joined at the latest
+// sequence in the chain; if there are several chains, the earliest of those wins. Cycles (which
+// the sync function can create) are harmless.
+func (auth *Authenticator) resolveRoles(rolesSince ch.TimedSet) (ch.TimedSet, []Role, error) {
+	inherited := rolesSince.Copy()
+	found := map[string]Role{}
+	pending := inherited.AllChannels()
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		role, fetched := found[name]
+		if !fetched {
+			var err error
+			if role, err = auth.GetRole(name); err != nil {
+				return nil, nil, err
+			}
+			found[name] = role
+		}
+		if role == nil {
+			continue
+		}
+		// Propagate this role's sequence to its parents; any that get an earlier sequence than
+		// before have to pass it on to their own parents:
+		if changed := inherited.AddAtSequence(role.RoleNames(), inherited[name]); changed {
+			for parent, _ := range role.RoleNames() {
+				pending = append(pending, parent)
+			}
+		}
+	}
+
+	roles := make([]Role, 0, len(found))
+	for _, role := range found {
+		if role != nil {
+			roles = append(roles, role)
+		}
+	}
+	return inherited, roles, nil
+}
+
+// Returns an error if giving a role the parent roles would make it inherit from itself.
+func (auth *Authenticator) CheckRoleCycle(roleName string, parents base.Set) error {
+	inherited, _, err := auth.resolveRoles(ch.AtSequence(parents, 1))
+	if err != nil {
+		return err
+	} else if inherited.Contains(roleName) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Role %q can't inherit from itself", roleName)
+	}
 	return nil
 }
 
@@ -224,12 +295,12 @@ func (auth *Authenticator) InvalidateChannels(p Principal) error {
 	return nil
 }
 
-// Invalidates the role list of a user by saving its Roles() property as nil.
-func (auth *Authenticator) InvalidateRoles(user User) error {
-	if user != nil && user.Channels() != nil {
-		base.LogTo("Access", "Invalidate roles of %q", user.Name())
-		user.setRolesSince(nil)
-		if err := auth.Save(user); err != nil {
+// Invalidates the role list of a user/role by saving its RoleNames() property as nil.
+func (auth *Authenticator) InvalidateRoles(p Principal) error {
+	if p != nil && p.Channels() != nil {
+		base.LogTo("Access", "Invalidate roles of %q", p.Name())
+		p.setRolesSince(nil)
+		if err := auth.Save(p); err != nil {
 			return err
 		}
 	}
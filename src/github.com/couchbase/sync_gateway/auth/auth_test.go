@@ -10,9 +10,22 @@
 package auth
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -336,6 +349,26 @@ func TestRebuildChannelsError(t *testing.T) {
 	assert.DeepEquals(t, err, computer.err)
 }
 
+func TestGetRolesError(t *testing.T) {
+	computer := mockComputer{}
+	auth := NewAuthenticator(gTestBucket, &computer)
+	role, err := auth.NewRole("testRole3", ch.SetOf("explicit1"))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, auth.InvalidateChannels(role), nil)
+	user, _ := auth.NewUser("testUser3", "letmein", ch.SetOf("britain"))
+	user.SetExplicitRoles(ch.TimedSet{"testRole3": 1})
+	assert.Equals(t, auth.Save(user), nil)
+	user2, err := auth.GetUser("testUser3")
+	assert.Equals(t, err, nil)
+
+	computer.err = fmt.Errorf("I'm sorry, Dave.")
+
+	_, err = user2.(*userImpl).GetRoles()
+	assert.DeepEquals(t, err, computer.err)
+	assert.False(t, user2.CanSeeChannel("explicit1"))
+	assert.True(t, user2.CanSeeChannel("britain"))
+}
+
 func TestRebuildUserRoles(t *testing.T) {
 	computer := mockComputer{roles: ch.AtSequence(base.SetOf("role1", "role2"), 3)}
 	auth := NewAuthenticator(gTestBucket, &computer)
@@ -376,6 +409,43 @@ func TestRoleInheritance(t *testing.T) {
 	assert.Equals(t, user2.AuthorizeAllChannels(ch.SetOf("britain", "dull", "hoopiest")), nil)
 }
 
+func TestRoleHierarchy(t *testing.T) {
+	// boss -> lead -> member -> boss (a cycle, as the sync function could create):
+	auth := NewAuthenticator(gTestBucket, nil)
+	saveRole := func(name string, channels ch.TimedSet, roles ch.TimedSet) {
+		role, _ := auth.NewRole(name, nil)
+		role.setChannels(channels)
+		role.setRolesSince(roles)
+		assert.Equals(t, auth.Save(role), nil)
+	}
+	saveRole("boss", ch.TimedSet{"budget": 1}, ch.TimedSet{"lead": 3})
+	saveRole("lead", ch.TimedSet{"plans": 2}, ch.TimedSet{"member": 7})
+	saveRole("member", ch.TimedSet{"docs": 5}, ch.TimedSet{"boss": 8})
+
+	user, _ := auth.NewUser("zaphod", "password", nil)
+	user.setRolesSince(ch.TimedSet{"boss": 2, "member": 12})
+	assert.Equals(t, auth.Save(user), nil)
+
+	user2, err := auth.GetUser("zaphod")
+	assert.Equals(t, err, nil)
+	assert.DeepEquals(t, user2.RoleNames(), ch.TimedSet{"boss": 2, "member": 12})
+	assert.DeepEquals(t, user2.InheritedRoles(), ch.TimedSet{"boss": 2, "lead": 3, "member": 7})
+	assert.DeepEquals(t, user2.InheritedChannels(), ch.TimedSet{"!": 1, "budget": 2, "plans": 3, "docs": 7})
+	assert.Equals(t, user2.CanSeeChannelSince("docs"), uint64(7))
+	assert.True(t, user2.CanSeeChannel("plans"))
+
+	// A parent role gaining a channel passes it on as of the sequence it was granted:
+	saveRole("boss", ch.TimedSet{"budget": 1, "secrets": 20}, ch.TimedSet{"lead": 3})
+	user2, err = auth.GetUser("zaphod")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, user2.InheritedChannels()["secrets"], uint64(20))
+
+	// Explicit role changes that would create a cycle are refused:
+	assert.True(t, auth.CheckRoleCycle("boss", ch.SetOf("member")) != nil)
+	assert.True(t, auth.CheckRoleCycle("lead", ch.SetOf("lead")) != nil)
+	assert.Equals(t, auth.CheckRoleCycle("intern", ch.SetOf("member", "lead")), nil)
+}
+
 func TestRegisterUser(t *testing.T) {
 	// Register user based on name, email
 	auth := NewAuthenticator(gTestBucket, nil)
@@ -408,3 +478,139 @@ func TestRegisterUser(t *testing.T) {
 	assert.Equals(t, user.Name(), "bar@example.com")
 	assert.Equals(t, err, nil)
 }
+
+// Signs a JWT with RS256.
+func makeTestJWT(key *rsa.PrivateKey, keyID string, claims JWTClaims) string {
+	header, _ := json.Marshal(JWTHeader{Algorithm: "RS256", KeyID: keyID})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equals(t, err, nil)
+
+	// Fake provider serving its discovery document and signing keys:
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscoveryDoc{Issuer: server.URL, JWKSURL: server.URL + "/jwks",
+			AuthorizationURL: server.URL + "/auth", TokenURL: server.URL + "/token"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{{
+			KeyType: "RSA",
+			KeyID:   "key1",
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+
+	provider := &OIDCProvider{Issuer: server.URL, ClientID: "sgw"}
+	claims := JWTClaims{"iss": server.URL, "aud": "sgw", "sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix()}
+	verified, err := provider.VerifyIDToken(makeTestJWT(key, "key1", claims))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, provider.Username(verified), "alice")
+
+	redirect, err := provider.AuthorizationRedirect("http://sg/db/_oidc_callback", "xyz")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, redirect, server.URL+"/auth?client_id=sgw&redirect_uri=http%3A%2F%2Fsg%2Fdb%2F_oidc_callback&response_type=code&scope=openid+email&state=xyz")
+
+	// Invalid tokens:
+	_, err = provider.VerifyIDToken(makeTestJWT(key, "key2", claims))
+	assert.True(t, err != nil)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = provider.VerifyIDToken(makeTestJWT(otherKey, "key1", claims))
+	assert.True(t, err != nil)
+	claims["aud"] = []string{"other"}
+	_, err = provider.VerifyIDToken(makeTestJWT(key, "key1", claims))
+	assert.True(t, err != nil)
+	claims["aud"] = []string{"other", "sgw"}
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = provider.VerifyIDToken(makeTestJWT(key, "key1", claims))
+	assert.True(t, err != nil)
+	_, err = provider.VerifyIDToken("not.a.token")
+	assert.True(t, err != nil)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	hsKey, err := NewJWTKey("", "HS256", "sekrit")
+	assert.Equals(t, err, nil)
+	esKey, err := NewJWTKey("ec", "ES256", ecPEM)
+	assert.Equals(t, err, nil)
+	_, err = NewJWTKey("ec", "RS256", ecPEM)
+	assert.True(t, err != nil)
+	verifier := &JWTVerifier{Keys: []*JWTKey{hsKey, esKey}, Issuer: "backend", ChannelsClaim: "channels"}
+
+	makeToken := func(alg, keyID string, claims JWTClaims) string {
+		header, _ := json.Marshal(JWTHeader{Algorithm: alg, KeyID: keyID})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		var signature []byte
+		if alg == "HS256" {
+			mac := hmac.New(sha256.New, []byte("sekrit"))
+			mac.Write([]byte(signed))
+			signature = mac.Sum(nil)
+		} else {
+			hash := sha256.Sum256([]byte(signed))
+			r, s, _ := ecdsa.Sign(rand.Reader, ecKey, hash[:])
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	claims := JWTClaims{"iss": "backend", "sub": "jwtuser", "channels": []string{"ch1", "ch2"},
+		"exp": time.Now().Add(time.Hour).Unix()}
+
+	verified, err := verifier.Verify(makeToken("HS256", "", claims))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, verified.String("sub"), "jwtuser")
+	_, err = verifier.Verify(makeToken("ES256", "ec", claims))
+	assert.Equals(t, err, nil)
+	_, err = verifier.Verify(makeToken("ES256", "other", claims))
+	assert.Equals(t, err, ErrUnknownJWTKey)
+	_, err = verifier.Verify(makeToken("RS256", "", claims))
+	assert.Equals(t, err, ErrUnknownJWTKey)
+
+	// A token that a key without an ID fails to verify may be signed by an unknown key, but one
+	// that the key with its ID fails to verify is bad:
+	otherECKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ = x509.MarshalPKIXPublicKey(&otherECKey.PublicKey)
+	anyKey, err := NewJWTKey("", "ES256", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	assert.Equals(t, err, nil)
+	otherVerifier := &JWTVerifier{Keys: []*JWTKey{anyKey}}
+	_, err = otherVerifier.Verify(makeToken("ES256", "", claims))
+	assert.Equals(t, err, ErrUnknownJWTKey)
+	otherVerifier.Keys = append(otherVerifier.Keys, &JWTKey{ID: "ec", Algorithm: "ES256", Key: &otherECKey.PublicKey})
+	_, err = otherVerifier.Verify(makeToken("ES256", "ec", claims))
+	assert.True(t, err != nil && err != ErrUnknownJWTKey)
+
+	// Unknown users are only registered if the verifier allows it:
+	auth := NewAuthenticator(gTestBucket, nil)
+	token := makeToken("HS256", "", claims)
+	_, err = auth.AuthenticateJWT(verifier, token)
+	assert.True(t, err != nil)
+	verifier.Register = true
+	user, err := auth.AuthenticateJWT(verifier, token)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, user.Name(), "jwtuser")
+	assert.True(t, user.CanSeeChannel("ch1"))
+	assert.True(t, user.CanSeeChannel("ch2"))
+
+	// The channels from the claims aren't saved:
+	user, _ = auth.GetUser("jwtuser")
+	assert.False(t, user.CanSeeChannel("ch1"))
+
+	claims["iss"] = "someone else"
+	_, err = verifier.Verify(makeToken("HS256", "", claims))
+	assert.True(t, err != nil)
+}
@@ -0,0 +1,180 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// A key that bearer JWTs may be signed with.
+type JWTKey struct {
+	ID        string      // If nonempty, only tokens with this "kid" header use this key
+	Algorithm string      // "HS256", "RS256" or "ES256"
+	Key       interface{} // []byte, *rsa.PublicKey or *ecdsa.PublicKey, depending on Algorithm
+}
+
+// Verifies bearer JWTs issued by a trusted backend, with locally configured keys.
+type JWTVerifier struct {
+	Keys          []*JWTKey // Keys that tokens may be signed with
+	Issuer        string    // If nonempty, tokens' "iss" claim must match it
+	Audience      string    // If nonempty, tokens' "aud" claim must contain it
+	Register      bool      // If true, users that don't exist yet are created
+	RolesClaim    string    // Optional claim listing roles to grant for the request
+	ChannelsClaim string    // Optional claim listing channels to grant for the request
+}
+
+// Creates a JWTKey. For HS256 the key material is the shared secret; for RS256 and ES256 it's a
+// PEM-encoded public key.
+func NewJWTKey(keyID, algorithm, material string) (*JWTKey, error) {
+	key := &JWTKey{ID: keyID, Algorithm: algorithm}
+	switch algorithm {
+	case "HS256":
+		if material == "" {
+			return nil, fmt.Errorf("JWT key %q has no secret", keyID)
+		}
+		key.Key = []byte(material)
+		return key, nil
+	case "RS256", "ES256":
+		block, _ := pem.Decode([]byte(material))
+		if block == nil {
+			return nil, fmt.Errorf("JWT key %q is not in PEM format", keyID)
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %q is invalid: %v", keyID, err)
+		}
+		switch publicKey.(type) {
+		case *rsa.PublicKey:
+			if algorithm != "RS256" {
+				return nil, fmt.Errorf("JWT key %q is an RSA key, not %s", keyID, algorithm)
+			}
+		case *ecdsa.PublicKey:
+			if algorithm != "ES256" {
+				return nil, fmt.Errorf("JWT key %q is an EC key, not %s", keyID, algorithm)
+			}
+		default:
+			return nil, fmt.Errorf("JWT key %q has an unsupported type", keyID)
+		}
+		key.Key = publicKey
+		return key, nil
+	default:
+		return nil, fmt.Errorf("JWT key %q has unsupported algorithm %q", keyID, algorithm)
+	}
+}
+
+// Verifies a JWT's signature and claims, returning the claims if it's valid. Returns
+// ErrUnknownJWTKey if no key verifies the token, unless a key with the token's key ID failed to.
+func (verifier *JWTVerifier) Verify(token string) (JWTClaims, error) {
+	jwt, err := ParseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	err = ErrUnknownJWTKey
+	for _, key := range verifier.Keys {
+		// Only use keys meant for the token's algorithm, so a public key can't be passed off
+		// as an HMAC secret:
+		if key.Algorithm != jwt.Header.Algorithm || (key.ID != "" && key.ID != jwt.Header.KeyID) {
+			continue
+		}
+		if verifyErr := jwt.VerifySignature(key.Key); verifyErr == nil {
+			err = nil
+			break
+		} else if key.ID != "" {
+			// The token names this key, so it's a bad token rather than one signed by an
+			// unknown key (which may be for the OpenID Connect provider instead):
+			err = verifyErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = jwt.Claims.Validate(verifier.Issuer, verifier.Audience); err != nil {
+		return nil, err
+	}
+	if jwt.Claims.String("sub") == "" {
+		return nil, invalidTokenError("no subject")
+	}
+	return jwt.Claims, nil
+}
+
+// Authenticates a bearer JWT, returning the user named by its subject claim. If the verifier
+// allows, a user that doesn't exist yet is registered. The roles and channels listed in the
+// token's claims are granted to the returned User object only; they aren't saved.
+func (auth *Authenticator) AuthenticateJWT(verifier *JWTVerifier, token string) (User, error) {
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return auth.tokenUser(claims.String("sub"), claims, verifier.Register,
+		verifier.ChannelsClaim, verifier.RolesClaim)
+}
+
+// Returns the named user for a verified token, registering it if it doesn't exist yet and
+// 'register' is true, and grants the returned User object the channels and roles listed in the
+// given claims.
+func (auth *Authenticator) tokenUser(username string, claims JWTClaims, register bool, channelsClaim, rolesClaim string) (User, error) {
+	user, err := auth.GetUser(username)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		if !register {
+			return nil, base.HTTPErrorf(http.StatusUnauthorized, "No such user")
+		}
+		base.Logf("Registering new user %q from token issued by %q", username, claims.String("iss"))
+		if user, err = auth.RegisterNewUser(username, claims.String("email")); err != nil {
+			return nil, err
+		}
+	} else if user.Disabled() {
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "User is disabled")
+	}
+
+	channels, roles := base.Set{}, base.Set{}
+	if channelsClaim != "" {
+		for _, channel := range claims.Strings(channelsClaim) {
+			if !ch.IsValidChannel(channel) {
+				return nil, invalidTokenError(fmt.Sprintf("illegal channel name %q", channel))
+			}
+			channels[channel] = struct{}{}
+		}
+	}
+	if rolesClaim != "" {
+		for _, role := range claims.Strings(rolesClaim) {
+			if !IsValidPrincipalName(role) {
+				return nil, invalidTokenError(fmt.Sprintf("invalid role name %q", role))
+			}
+			roles[role] = struct{}{}
+		}
+	}
+	user.(*userImpl).grantTemporaryAccess(channels, roles)
+	return user, nil
+}
+
+// Adds channels and roles to this in-memory User object, without changing its explicit grants.
+// They're granted as of sequence 1, i.e. the user can see the channels' entire history.
+func (user *userImpl) grantTemporaryAccess(channels, roles base.Set) {
+	if len(channels) > 0 {
+		allChannels := user.Channels().Copy()
+		allChannels.Add(ch.AtSequence(channels, 1))
+		user.setChannels(allChannels)
+	}
+	if len(roles) > 0 {
+		rolesSince := user.RolesSince_.Copy()
+		rolesSince.Add(ch.AtSequence(roles, 1))
+		user.setRolesSince(rolesSince)
+	}
+}
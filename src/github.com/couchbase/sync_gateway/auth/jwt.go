@@ -0,0 +1,231 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// How far apart the clocks of a token's issuer and this server are allowed to be
+const kJWTClockSkew = time.Minute
+
+// A JSON Web Token (RFC 7519) in the JWS compact serialization. A token returned by ParseJWT
+// hasn't been verified yet; call VerifySignature and then Claims.Validate before trusting it.
+type JWT struct {
+	Header    JWTHeader
+	Claims    JWTClaims
+	signed    string // The "header.payload" prefix of the token, which the signature covers
+	signature []byte
+}
+
+type JWTHeader struct {
+	Algorithm string `json:"alg"`           // Signature algorithm, e.g. "RS256"
+	KeyID     string `json:"kid,omitempty"` // Identifies the key that signed the token
+}
+
+// The claims in a JWT's payload, such as "sub", "iss", "exp".
+type JWTClaims map[string]interface{}
+
+// Parses a JWT without verifying it.
+func ParseJWT(token string) (*JWT, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidTokenError("malformed token")
+	}
+	jwt := &JWT{signed: parts[0] + "." + parts[1]}
+	if err := decodeJWTSegment(parts[0], &jwt.Header); err != nil {
+		return nil, err
+	}
+	if err := decodeJWTSegment(parts[1], &jwt.Claims); err != nil {
+		return nil, err
+	}
+	var err error
+	if jwt.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, invalidTokenError("malformed signature")
+	}
+	return jwt, nil
+}
+
+func decodeJWTSegment(segment string, into interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return invalidTokenError("malformed token")
+	}
+	if err = json.Unmarshal(data, into); err != nil {
+		return invalidTokenError("malformed token")
+	}
+	return nil
+}
+
+// Checks the token's signature with the given key, which must be a []byte secret for the HS256
+// algorithm, an *rsa.PublicKey for RS256 or an *ecdsa.PublicKey for ES256.
+func (jwt *JWT) VerifySignature(key interface{}) error {
+	hash := sha256.Sum256([]byte(jwt.signed))
+	switch jwt.Header.Algorithm {
+	case "HS256":
+		if secret, ok := key.([]byte); ok {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(jwt.signed))
+			if hmac.Equal(mac.Sum(nil), jwt.signature) {
+				return nil
+			}
+			return invalidTokenError("bad signature")
+		}
+	case "RS256":
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			if rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash[:], jwt.signature) == nil {
+				return nil
+			}
+			return invalidTokenError("bad signature")
+		}
+	case "ES256":
+		if ecKey, ok := key.(*ecdsa.PublicKey); ok {
+			if len(jwt.signature) == 64 {
+				r := new(big.Int).SetBytes(jwt.signature[:32])
+				s := new(big.Int).SetBytes(jwt.signature[32:])
+				if ecdsa.Verify(ecKey, hash[:], r, s) {
+					return nil
+				}
+			}
+			return invalidTokenError("bad signature")
+		}
+	default:
+		return invalidTokenError(fmt.Sprintf("unsupported algorithm %q", jwt.Header.Algorithm))
+	}
+	return invalidTokenError(fmt.Sprintf("key can't verify algorithm %q", jwt.Header.Algorithm))
+}
+
+// Checks the time-based claims, and that the token was issued by the given issuer for the given
+// audience. An empty issuer or audience isn't checked.
+func (claims JWTClaims) Validate(issuer, audience string) error {
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); !ok {
+		return invalidTokenError("no expiration time")
+	} else if now.Add(-kJWTClockSkew).After(time.Unix(int64(exp), 0)) {
+		return invalidTokenError("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(kJWTClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return invalidTokenError("token is not valid yet")
+	}
+	if issuer != "" && claims.String("iss") != issuer {
+		return invalidTokenError("wrong issuer")
+	}
+	if audience != "" {
+		found := false
+		for _, aud := range claims.Strings("aud") {
+			if aud == audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return invalidTokenError("wrong audience")
+		}
+	}
+	return nil
+}
+
+// Returns the value of a string claim, or "" if it's missing or not a string.
+func (claims JWTClaims) String(name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// Returns the value of a claim that may be either a string or an array of strings.
+func (claims JWTClaims) Strings(name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// Returned when none of the known keys matches the key ID and algorithm of a token
+var ErrUnknownJWTKey = invalidTokenError("unknown signing key")
+
+func invalidTokenError(reason string) error {
+	return base.HTTPErrorf(http.StatusUnauthorized, "Invalid token: %s", reason)
+}
+
+//////// JSON WEB KEYS:
+
+// A public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType string `json:"kty"`           // "RSA" or "EC"
+	KeyID   string `json:"kid,omitempty"` // Matched against JWTHeader.KeyID
+	Use     string `json:"use,omitempty"` // "sig" for signing keys
+	N       string `json:"n,omitempty"`   // RSA modulus
+	E       string `json:"e,omitempty"`   // RSA exponent
+	Curve   string `json:"crv,omitempty"` // EC curve; only "P-256" is supported
+	X       string `json:"x,omitempty"`   // EC point coordinates
+	Y       string `json:"y,omitempty"`
+}
+
+// A set of JWKs, as published at an OpenID Connect provider's "jwks_uri".
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Converts the JWK to an *rsa.PublicKey or *ecdsa.PublicKey.
+func (key *JWK) PublicKey() (interface{}, error) {
+	switch key.KeyType {
+	case "RSA":
+		n, err1 := decodeJWKInt(key.N)
+		e, err2 := decodeJWKInt(key.E)
+		if err1 != nil || err2 != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("Invalid RSA key %q", key.KeyID)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if key.Curve != "P-256" {
+			return nil, fmt.Errorf("Unsupported curve %q in key %q", key.Curve, key.KeyID)
+		}
+		x, err1 := decodeJWKInt(key.X)
+		y, err2 := decodeJWKInt(key.Y)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Invalid EC key %q", key.KeyID)
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type %q", key.KeyType)
+	}
+}
+
+func decodeJWKInt(encoded string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	} else if len(data) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
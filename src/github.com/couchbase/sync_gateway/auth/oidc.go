@@ -0,0 +1,262 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Minimum time between refetches of a provider's keys, when a token has an unknown key ID
+const kOIDCKeyRefetchInterval = time.Minute
+
+// Max time a request to the provider (discovery, keys, token redemption) can take
+const kOIDCRequestTimeout = 30 * time.Second
+
+// HTTP client for requests to providers
+var oidcHTTPClient = &http.Client{Timeout: kOIDCRequestTimeout}
+
+// An OpenID Connect identity provider. ID tokens are verified locally, against the signing keys
+// the provider publishes at its JWKS URL. Endpoints that aren't configured are looked up in the
+// provider's discovery document the first time they're needed.
+type OIDCProvider struct {
+	Issuer           string // Issuer URL; tokens' "iss" claim must match it
+	ClientID         string // Client ID registered with the provider; tokens' "aud" must contain it
+	ClientSecret     string // Client secret, used to redeem authorization codes
+	JWKSURL          string // URL of the provider's signing keys
+	AuthorizationURL string // URL users are sent to to log in
+	TokenURL         string // URL authorization codes are redeemed at
+	CallbackURL      string // URL the provider redirects back to; required for the login flow
+	Register         bool   // If true, users that don't exist yet are created on login
+	UsernameClaim    string // Claim containing the username; defaults to "sub"
+	RolesClaim       string // Optional claim listing roles to grant the user
+	ChannelsClaim    string // Optional claim listing channels to grant the user
+
+	keys        map[string]interface{} // Signing keys from the JWKS URL, by key ID
+	keysFetched time.Time              // When keys were last fetched
+	lock        sync.Mutex             // Protects the fields above, and the discovered endpoints
+}
+
+// The subset of an OpenID Connect discovery document that we use.
+type oidcDiscoveryDoc struct {
+	Issuer           string `json:"issuer"`
+	AuthorizationURL string `json:"authorization_endpoint"`
+	TokenURL         string `json:"token_endpoint"`
+	JWKSURL          string `json:"jwks_uri"`
+}
+
+// Verifies an ID token's signature and claims, returning the claims if it's valid.
+func (provider *OIDCProvider) VerifyIDToken(token string) (JWTClaims, error) {
+	jwt, err := ParseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := provider.signingKey(jwt.Header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err = jwt.VerifySignature(key); err != nil {
+		return nil, err
+	}
+	if err = jwt.Claims.Validate(provider.Issuer, provider.ClientID); err != nil {
+		return nil, err
+	}
+	if provider.Username(jwt.Claims) == "" {
+		return nil, invalidTokenError("no username claim")
+	}
+	return jwt.Claims, nil
+}
+
+// Returns the username that an ID token's claims identify.
+func (provider *OIDCProvider) Username(claims JWTClaims) string {
+	if provider.UsernameClaim != "" {
+		return claims.String(provider.UsernameClaim)
+	}
+	return claims.String("sub")
+}
+
+// Returns the user identified by a verified ID token's claims, registering it if it doesn't exist
+// yet (if the provider allows that.) As with AuthenticateJWT, the roles and channels listed in
+// the claims are granted to the returned User object only; they aren't saved.
+func (auth *Authenticator) AuthenticateOIDC(provider *OIDCProvider, claims JWTClaims) (User, error) {
+	return auth.tokenUser(provider.Username(claims), claims, provider.Register,
+		provider.ChannelsClaim, provider.RolesClaim)
+}
+
+// Returns the URL to redirect a user to in order to log in, in the authorization code flow.
+func (provider *OIDCProvider) AuthorizationRedirect(redirectURI, state string) (string, error) {
+	endpoints, err := provider.endpoints()
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {provider.ClientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {"openid email"},
+		"state":         {state},
+	}
+	separator := "?"
+	if strings.Contains(endpoints.AuthorizationURL, "?") {
+		separator = "&"
+	}
+	return endpoints.AuthorizationURL + separator + params.Encode(), nil
+}
+
+// Redeems an authorization code at the provider's token endpoint, returning the ID token.
+func (provider *OIDCProvider) RedeemCode(code, redirectURI string) (string, error) {
+	endpoints, err := provider.endpoints()
+	if err != nil {
+		return "", err
+	}
+	res, err := oidcHTTPClient.PostForm(endpoints.TokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {provider.ClientID},
+		"client_secret": {provider.ClientSecret},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return "", base.HTTPErrorf(http.StatusUnauthorized,
+			"OpenID Connect token endpoint status %d", res.StatusCode)
+	}
+	var response struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&response); err != nil || response.IDToken == "" {
+		return "", base.HTTPErrorf(http.StatusBadGateway, "Invalid response from OpenID Connect token endpoint")
+	}
+	return response.IDToken, nil
+}
+
+// Returns the provider's endpoint URLs. Any that weren't configured are filled in from the
+// provider's discovery document, which is fetched without holding the lock.
+func (provider *OIDCProvider) endpoints() (oidcDiscoveryDoc, error) {
+	provider.lock.Lock()
+	endpoints := oidcDiscoveryDoc{
+		Issuer:           provider.Issuer,
+		AuthorizationURL: provider.AuthorizationURL,
+		TokenURL:         provider.TokenURL,
+		JWKSURL:          provider.JWKSURL,
+	}
+	provider.lock.Unlock()
+	if endpoints.JWKSURL != "" && endpoints.AuthorizationURL != "" && endpoints.TokenURL != "" {
+		return endpoints, nil
+	}
+
+	var doc oidcDiscoveryDoc
+	discoveryURL := strings.TrimSuffix(provider.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(discoveryURL, &doc); err != nil {
+		return endpoints, err
+	}
+	if doc.Issuer != provider.Issuer {
+		return endpoints, base.HTTPErrorf(http.StatusBadGateway, "OpenID Connect discovery returned issuer %q", doc.Issuer)
+	}
+
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	if provider.JWKSURL == "" {
+		provider.JWKSURL = doc.JWKSURL
+	}
+	if provider.AuthorizationURL == "" {
+		provider.AuthorizationURL = doc.AuthorizationURL
+	}
+	if provider.TokenURL == "" {
+		provider.TokenURL = doc.TokenURL
+	}
+	endpoints.AuthorizationURL = provider.AuthorizationURL
+	endpoints.TokenURL = provider.TokenURL
+	endpoints.JWKSURL = provider.JWKSURL
+	return endpoints, nil
+}
+
+// Returns the provider's signing key with the given ID, fetching the keys if they haven't been
+// fetched yet or don't include that ID (the provider may have rotated its keys.) The keys are
+// fetched without holding the lock; meanwhile other requests use the current keys.
+func (provider *OIDCProvider) signingKey(keyID string) (interface{}, error) {
+	provider.lock.Lock()
+	key := provider.keys[keyID]
+	refetch := key == nil && time.Since(provider.keysFetched) > kOIDCKeyRefetchInterval
+	if refetch {
+		provider.keysFetched = time.Now()
+	}
+	provider.lock.Unlock()
+
+	if refetch {
+		keys, err := provider.fetchKeys()
+		if err != nil {
+			return nil, err
+		}
+		provider.lock.Lock()
+		provider.keys = keys
+		provider.lock.Unlock()
+		key = keys[keyID]
+	}
+	if key == nil {
+		return nil, ErrUnknownJWTKey
+	}
+	return key, nil
+}
+
+// Fetches the provider's signing keys from its JWKS URL.
+func (provider *OIDCProvider) fetchKeys() (map[string]interface{}, error) {
+	provider.lock.Lock()
+	jwksURL := provider.JWKSURL
+	provider.lock.Unlock()
+	if jwksURL == "" {
+		endpoints, err := provider.endpoints()
+		if err != nil {
+			return nil, err
+		}
+		jwksURL = endpoints.JWKSURL
+	}
+	var keySet JWKSet
+	if err := getJSON(jwksURL, &keySet); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		publicKey, err := jwk.PublicKey()
+		if err != nil {
+			base.Warn("OpenID Connect: Ignoring key from %s: %v", jwksURL, err)
+			continue
+		}
+		keys[jwk.KeyID] = publicKey
+	}
+	return keys, nil
+}
+
+func getJSON(url string, into interface{}) error {
+	res, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return base.HTTPErrorf(http.StatusBadGateway, "%s returned status %d", url, res.StatusCode)
+	}
+	if err = json.NewDecoder(res.Body).Decode(into); err != nil {
+		return base.HTTPErrorf(http.StatusBadGateway, "Invalid JSON from %s", url)
+	}
+	return nil
+}
@@ -32,6 +32,16 @@ type Principal interface {
 	// Sets the explicit channels the Principal has access to.
 	SetExplicitChannels(ch.TimedSet)
 
+	// The set of Roles the Principal belongs to directly (including ones given to it by the
+	// sync function), and what sequence it joined each one.
+	RoleNames() ch.TimedSet
+
+	// The roles the Principal was explicitly granted access to thru the admin API.
+	ExplicitRoles() ch.TimedSet
+
+	// Sets the explicit roles the Principal belongs to.
+	SetExplicitRoles(ch.TimedSet)
+
 	// Returns true if the Principal has access to the given channel.
 	CanSeeChannel(channel string) bool
 
@@ -53,9 +63,11 @@ type Principal interface {
 	accessViewKey() string
 	validate() error
 	setChannels(ch.TimedSet)
+	setRolesSince(ch.TimedSet)
 }
 
-// Role is basically the same as Principal, just concrete. Users can inherit channels from Roles.
+// Role is basically the same as Principal, just concrete. Users can inherit channels from Roles,
+// and Roles can belong to other Roles, passing their channels on to users.
 type Role interface {
 	Principal
 }
@@ -82,14 +94,9 @@ type User interface {
 	// Changes the user's password.
 	SetPassword(password string)
 
-	// The set of Roles the user belongs to (including ones given to it by the sync function)
-	RoleNames() ch.TimedSet
-
-	// The roles the user was explicitly granted access to thru the admin API.
-	ExplicitRoles() ch.TimedSet
-
-	// Sets the explicit roles the user belongs to.
-	SetExplicitRoles(ch.TimedSet)
+	// Every Role the user belongs to, directly or through other Roles, and what sequence it
+	// joined each one.
+	InheritedRoles() ch.TimedSet
 
 	// Every channel the user has access to, including those inherited from Roles.
 	InheritedChannels() ch.TimedSet
@@ -105,6 +112,4 @@ type User interface {
 	// Returns a Set containing channels that the user has access to, that aren't present in the
 	// input set
 	GetAddedChannels(channels ch.TimedSet) base.Set
-
-	setRolesSince(ch.TimedSet)
 }
@@ -25,6 +25,8 @@ type roleImpl struct {
 	ExplicitChannels_ ch.TimedSet `json:"admin_channels,omitempty"`
 	Channels_         ch.TimedSet `json:"all_channels"`
 	Sequence_         uint64      `json:"sequence"`
+	ExplicitRoles_    ch.TimedSet `json:"explicit_roles,omitempty"`
+	RolesSince_       ch.TimedSet `json:"rolesSince"`
 }
 
 var kValidNameRegexp *regexp.Regexp
@@ -58,6 +60,9 @@ func (auth *Authenticator) NewRole(name string, channels base.Set) (Role, error)
 	if err := auth.rebuildChannels(role); err != nil {
 		return nil, err
 	}
+	if err := auth.rebuildRoles(role); err != nil {
+		return nil, err
+	}
 	return role, nil
 }
 
@@ -126,11 +131,33 @@ func (role *roleImpl) SetExplicitChannels(channels ch.TimedSet) {
 	role.setChannels(nil)
 }
 
+func (role *roleImpl) RoleNames() ch.TimedSet {
+	return role.RolesSince_
+}
+
+func (role *roleImpl) setRolesSince(rolesSince ch.TimedSet) {
+	role.RolesSince_ = rolesSince
+}
+
+func (role *roleImpl) ExplicitRoles() ch.TimedSet {
+	return role.ExplicitRoles_
+}
+
+func (role *roleImpl) SetExplicitRoles(roles ch.TimedSet) {
+	role.ExplicitRoles_ = roles
+	role.setRolesSince(nil) // invalidate persistent cache of role names
+}
+
 // Checks whether this role object contains valid data; if not, returns an error.
 func (role *roleImpl) validate() error {
 	if !IsValidPrincipalName(role.Name_) {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid name %q", role.Name_)
 	}
+	for roleName, _ := range role.ExplicitRoles_ {
+		if !IsValidPrincipalName(roleName) {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid role name %q", roleName)
+		}
+	}
 	return role.ExplicitChannels_.Validate()
 }
 
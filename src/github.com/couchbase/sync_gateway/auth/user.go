@@ -28,8 +28,9 @@ const kBcryptCostFactor = bcrypt.DefaultCost
 type userImpl struct {
 	roleImpl // userImpl "inherits from" Role
 	userImplBody
-	auth  *Authenticator
-	roles []Role
+	auth           *Authenticator
+	roles          []Role
+	inheritedRoles ch.TimedSet
 }
 
 // Marshalable data is stored in separate struct from userImpl,
@@ -39,8 +40,6 @@ type userImplBody struct {
 	Disabled_        bool        `json:"disabled,omitempty"`
 	PasswordHash_    []byte      `json:"passwordhash_bcrypt,omitempty"`
 	OldPasswordHash_ interface{} `json:"passwordhash,omitempty"` // For pre-beta compatibility
-	ExplicitRoles_   ch.TimedSet `json:"explicit_roles,omitempty"`
-	RolesSince_      ch.TimedSet `json:"rolesSince"`
 
 	OldExplicitRoles_ []string `json:"admin_roles,omitempty"` // obsolete; declared for migration
 }
@@ -75,10 +74,7 @@ func (auth *Authenticator) defaultGuestUser() User {
 
 // Creates a new User object.
 func (auth *Authenticator) NewUser(username string, password string, channels base.Set) (User, error) {
-	user := &userImpl{
-		auth:         auth,
-		userImplBody: userImplBody{RolesSince_: ch.TimedSet{}},
-	}
+	user := &userImpl{auth: auth}
 	if err := user.initRole(username, channels); err != nil {
 		return nil, err
 	}
@@ -122,11 +118,6 @@ func (user *userImpl) validate() error {
 	} else if user.OldPasswordHash_ != nil {
 		return base.HTTPErrorf(http.StatusBadRequest, "Obsolete password hash present")
 	}
-	for roleName, _ := range user.ExplicitRoles_ {
-		if !IsValidPrincipalName(roleName) {
-			return base.HTTPErrorf(http.StatusBadRequest, "Invalid role name %q", roleName)
-		}
-	}
 	return nil
 }
 
@@ -166,17 +157,10 @@ func (user *userImpl) SetEmail(email string) error {
 	return nil
 }
 
-func (user *userImpl) RoleNames() ch.TimedSet {
-	return user.RolesSince_
-}
-
 func (user *userImpl) setRolesSince(rolesSince ch.TimedSet) {
 	user.RolesSince_ = rolesSince
 	user.roles = nil // invalidate in-memory cache list of Role objects
-}
-
-func (user *userImpl) ExplicitRoles() ch.TimedSet {
-	return user.ExplicitRoles_
+	user.inheritedRoles = nil
 }
 
 func (user *userImpl) SetExplicitRoles(roles ch.TimedSet) {
@@ -216,28 +200,39 @@ func (user *userImpl) SetPassword(password string) {
 
 //////// CHANNEL ACCESS:
 
-func (user *userImpl) GetRoles() []Role {
+// Returns every Role the user belongs to, including ones inherited from other roles.
+func (user *userImpl) GetRoles() ([]Role, error) {
 	if user.roles == nil {
-		roles := make([]Role, 0, len(user.RolesSince_))
-		for name, _ := range user.RolesSince_ {
-			role, err := user.auth.GetRole(name)
-			//base.LogTo("Access", "User %s role %q = %v", user.Name_, name, role)
-			if err != nil {
-				panic(fmt.Sprintf("Error getting user role %q: %v", name, err))
-			} else if role != nil {
-				roles = append(roles, role)
-			}
+		inherited, roles, err := user.auth.resolveRoles(user.RolesSince_)
+		if err != nil {
+			return nil, err
 		}
 		user.roles = roles
+		user.inheritedRoles = inherited
+	}
+	return user.roles, nil
+}
+
+// Like GetRoles, for the methods that can't return an error. If the roles can't be loaded, the
+// user only gets its own channels until they can be.
+func (user *userImpl) getRolesOrWarn() []Role {
+	roles, err := user.GetRoles()
+	if err != nil {
+		base.Warn("Error getting roles of user %q: %v", user.Name_, err)
 	}
-	return user.roles
+	return roles
+}
+
+func (user *userImpl) InheritedRoles() ch.TimedSet {
+	user.getRolesOrWarn()
+	return user.inheritedRoles
 }
 
 func (user *userImpl) CanSeeChannel(channel string) bool {
 	if user.roleImpl.CanSeeChannel(channel) {
 		return true
 	}
-	for _, role := range user.GetRoles() {
+	for _, role := range user.getRolesOrWarn() {
 		if role.CanSeeChannel(channel) {
 			return true
 		}
@@ -247,8 +242,12 @@ func (user *userImpl) CanSeeChannel(channel string) bool {
 
 func (user *userImpl) CanSeeChannelSince(channel string) uint64 {
 	minSeq := user.roleImpl.CanSeeChannelSince(channel)
-	for _, role := range user.GetRoles() {
-		if seq := role.CanSeeChannelSince(channel); seq > 0 && (seq < minSeq || minSeq == 0) {
+	for _, role := range user.getRolesOrWarn() {
+		seq := role.CanSeeChannelSince(channel)
+		if roleSince := user.inheritedRoles[role.Name()]; seq > 0 && seq < roleSince {
+			seq = roleSince
+		}
+		if seq > 0 && (seq < minSeq || minSeq == 0) {
 			minSeq = seq
 		}
 	}
@@ -265,8 +264,8 @@ func (user *userImpl) AuthorizeAnyChannel(channels base.Set) error {
 
 func (user *userImpl) InheritedChannels() ch.TimedSet {
 	channels := user.Channels().Copy()
-	for _, role := range user.GetRoles() {
-		roleSince := user.RolesSince_[role.Name()]
+	for _, role := range user.getRolesOrWarn() {
+		roleSince := user.inheritedRoles[role.Name()]
 		channels.AddAtSequence(role.Channels(), roleSince)
 	}
 	return channels
@@ -0,0 +1,83 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"sync"
+	"time"
+)
+
+// Default bucket boundaries for latency histograms, from 1ms to 10sec.
+var DefaultLatencyBuckets = []time.Duration{
+	1 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// A thread-safe histogram of durations, such as request latencies. Each bucket counts the values
+// less than or equal to its upper bound (as in a Prometheus histogram.)
+type Histogram struct {
+	bounds []time.Duration // Upper bounds of the buckets, in increasing order
+	counts []uint64        // Number of values in each bucket, plus one for values above all bounds
+	sum    time.Duration   // Sum of all values
+	lock   sync.Mutex
+}
+
+// A copy of a Histogram's state at one point in time.
+type HistogramSnapshot struct {
+	Bounds []time.Duration // Upper bounds of the buckets
+	Counts []uint64        // Cumulative count of values <= each bound
+	Count  uint64          // Total number of values
+	Sum    time.Duration   // Sum of all values
+}
+
+// Creates a Histogram with the given bucket upper bounds, which must be in increasing order.
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Records a value.
+func (h *Histogram) Observe(value time.Duration) {
+	i := 0
+	for i < len(h.bounds) && value > h.bounds[i] {
+		i++
+	}
+	h.lock.Lock()
+	h.counts[i]++
+	h.sum += value
+	h.lock.Unlock()
+}
+
+// Returns the current state of the histogram.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	snapshot := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.bounds)),
+		Sum:    h.sum,
+	}
+	for i, n := range h.counts {
+		snapshot.Count += n
+		if i < len(h.bounds) {
+			snapshot.Counts[i] = snapshot.Count
+		}
+	}
+	return snapshot
+}
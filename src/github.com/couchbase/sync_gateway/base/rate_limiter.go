@@ -0,0 +1,87 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// How often a RateLimiter discards the buckets of keys that have gone idle
+const kRateLimiterPruneInterval = time.Minute
+
+// A thread-safe token-bucket rate limiter with a separate bucket for each key (such as a user
+// name or IP address.) Each bucket holds up to 'burst' tokens and refills at 'rate' tokens per
+// second; every allowed event takes one token.
+type RateLimiter struct {
+	rate       float64                 // Tokens added to each bucket per second
+	burst      float64                 // Capacity of each bucket
+	buckets    map[string]*tokenBucket // Buckets of keys seen recently
+	lastPruned time.Time               // When idle buckets were last discarded
+	lock       sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens  float64   // Tokens available as of 'updated'
+	updated time.Time // When 'tokens' was last computed
+}
+
+// Creates a RateLimiter that allows 'rate' events per second for each key, and bursts of up to
+// 'burst' events. A burst smaller than 1 is treated as 1.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:       rate,
+		burst:      math.Max(float64(burst), 1),
+		buckets:    map[string]*tokenBucket{},
+		lastPruned: time.Now(),
+	}
+}
+
+// Takes a token from the key's bucket. If the bucket is empty, returns false and how long it
+// will be until a token is available.
+func (limiter *RateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if now.Sub(limiter.lastPruned) > kRateLimiterPruneInterval {
+		limiter._prune(now)
+	}
+	bucket := limiter.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[key] = bucket
+	} else {
+		bucket.tokens = limiter._refill(bucket, now)
+		bucket.updated = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+	return false, wait
+}
+
+func (limiter *RateLimiter) _refill(bucket *tokenBucket, now time.Time) float64 {
+	tokens := bucket.tokens + now.Sub(bucket.updated).Seconds()*limiter.rate
+	return math.Min(tokens, limiter.burst)
+}
+
+// Discards buckets that have refilled completely, since they're equivalent to new ones.
+func (limiter *RateLimiter) _prune(now time.Time) {
+	for key, bucket := range limiter.buckets {
+		if limiter._refill(bucket, now) >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.lastPruned = now
+}
@@ -12,6 +12,7 @@ package base
 import (
 	"github.com/couchbaselabs/go.assert"
 	"testing"
+	"time"
 )
 
 func TestFixJSONNumbers(t *testing.T) {
@@ -53,3 +54,35 @@ func TestBackQuotedStrings(t *testing.T) {
 	output = ConvertBackQuotedStrings([]byte(input))
 	assert.Equals(t, string(output), `{"foo": "bar\n", "baz": "\nhowdy"}`)
 }
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]time.Duration{time.Millisecond, time.Second})
+	h.Observe(500 * time.Microsecond)
+	h.Observe(time.Millisecond)
+	h.Observe(20 * time.Millisecond)
+	h.Observe(time.Minute)
+	snapshot := h.Snapshot()
+	assert.DeepEquals(t, snapshot.Counts, []uint64{2, 3})
+	assert.Equals(t, snapshot.Count, uint64(4))
+	assert.Equals(t, snapshot.Sum, time.Minute+21500*time.Microsecond)
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(10, 3)
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.Allow("alice")
+		assert.True(t, ok)
+	}
+	ok, retryAfter := limiter.Allow("alice")
+	assert.False(t, ok)
+	assert.True(t, retryAfter > 0 && retryAfter <= 100*time.Millisecond)
+
+	// Other keys have their own buckets:
+	ok, _ = limiter.Allow("bob")
+	assert.True(t, ok)
+
+	// The bucket refills over time:
+	time.Sleep(retryAfter + 10*time.Millisecond)
+	ok, _ = limiter.Allow("alice")
+	assert.True(t, ok)
+}
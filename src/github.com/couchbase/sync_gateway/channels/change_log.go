@@ -17,6 +17,7 @@ type LogEntry struct {
 	TimeReceived time.Time  // Time received from tap feed
 	Channels     ChannelMap // Channels this entry is in or was removed from
 	Skipped      bool       // Late arriving entry
+	Expiry       time.Time  // Time the doc expires, if it has a TTL
 }
 
 type ChannelMap map[string]*ChannelRemoval
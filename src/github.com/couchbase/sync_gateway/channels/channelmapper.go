@@ -10,6 +10,8 @@
 package channels
 
 import (
+	"time"
+
 	_ "github.com/robertkrimen/otto/underscore"
 
 	"github.com/couchbase/sg-bucket"
@@ -21,34 +23,82 @@ type ChannelMapperOutput struct {
 	Channels  base.Set
 	Roles     AccessMap // roles granted to users via role() callback
 	Access    AccessMap
+	Expiry    ExpiryMap // expiration times of temporary access & role grants
 	Rejection error
+	Log       []string // messages logged with log() or console.log(), if the LogOutput option is set
 }
 
 type ChannelMapper struct {
 	*sgbucket.JSServer // "Superclass"
+	options            ChannelMapperOptions
+	runners            chan struct{} // Holds a token for each call in progress
+}
+
+// Tuning options for a ChannelMapper.
+type ChannelMapperOptions struct {
+	PoolSize  int             // Max number of concurrent calls (and of cached Otto contexts)
+	Timeout   time.Duration   // Max time a call can run before it's interrupted; 0 for no limit
+	WaitTimes *base.Histogram // If non-nil, records how long calls wait for a free runner
+	RunTimes  *base.Histogram // If non-nil, records how long calls take to run
+	Modules   *JSModules      // If non-nil, shared JS modules available to the function
+	LogOutput bool            // If true, the output's Log has the messages the function logged
 }
 
 // Maps user names (or role names prefixed with "role:") to arrays of channel or role names
 type AccessMap map[string]base.Set
 
-// Number of SyncRunner tasks (and Otto contexts) to cache
-const kTaskCacheSize = 4
+// Maps user names (or role names prefixed with "role:") to the channels or "role:"-prefixed role
+// names they've been temporarily granted, and the Unix time (in seconds) each grant expires
+type ExpiryMap map[string]map[string]int64
+
+// Default number of SyncRunner tasks (and Otto contexts) to cache
+const DefaultPoolSize = 4
 
 func NewChannelMapper(fnSource string) *ChannelMapper {
+	return NewChannelMapperWithOptions(fnSource, ChannelMapperOptions{})
+}
+
+func NewChannelMapperWithOptions(fnSource string, options ChannelMapperOptions) *ChannelMapper {
+	if options.PoolSize <= 0 {
+		options.PoolSize = DefaultPoolSize
+	}
 	return &ChannelMapper{
-		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+		JSServer: sgbucket.NewJSServer(fnSource, options.PoolSize,
 			func(fnSource string) (sgbucket.JSServerTask, error) {
-				return NewSyncRunner(fnSource)
+				runner, err := NewSyncRunner(fnSource)
+				if runner != nil {
+					runner.timeout = options.Timeout
+					runner.modules.Modules = options.Modules
+					runner.logOutput = options.LogOutput
+				}
+				return runner, err
 			}),
+		options: options,
+		runners: make(chan struct{}, options.PoolSize),
 	}
 }
 
+// The sync function used when a database doesn't have one
+const DefaultSyncFunction = `function(doc){channel(doc.channels);}`
+
 func NewDefaultChannelMapper() *ChannelMapper {
-	return NewChannelMapper(`function(doc){channel(doc.channels);}`)
+	return NewChannelMapper(DefaultSyncFunction)
 }
 
+// Runs the sync function. If PoolSize calls are already running, waits for one to finish.
+// Returns ErrSyncFnTimeout if the function runs longer than the Timeout.
 func (mapper *ChannelMapper) MapToChannelsAndAccess(body map[string]interface{}, oldBodyJSON string, userCtx map[string]interface{}) (*ChannelMapperOutput, error) {
+	startTime := time.Now()
+	mapper.runners <- struct{}{}
+	defer func() { <-mapper.runners }()
+	runTime := time.Now()
+	if mapper.options.WaitTimes != nil {
+		mapper.options.WaitTimes.Observe(runTime.Sub(startTime))
+	}
 	result1, err := mapper.Call(body, sgbucket.JSONString(oldBodyJSON), userCtx)
+	if mapper.options.RunTimes != nil {
+		mapper.options.RunTimes.Observe(time.Since(runTime))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"github.com/couchbaselabs/go.assert"
 	"testing"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/robertkrimen/otto"
@@ -115,6 +116,33 @@ func TestAccessFunctionTakesEmptyArrayUser(t *testing.T) {
 	assert.DeepEquals(t, res.Access, AccessMap{})
 }
 
+// Grants made with an expiry show up in the output's Expiry map.
+func TestTemporaryGrants(t *testing.T) {
+	mapper := NewChannelMapper(`function(doc) {
+		access("lee", "ginger", {expiry: 1900000000});
+		access("lee", "green", {expiry: "2030-03-17T12:00:00Z"});
+		access("lee", "green", {expiry: new Date(1800000000000)});
+		access(["lee", "nancy"], "earl_grey", {expiry: 1800000000});
+		access("nancy", "earl_grey");
+		role("lee", "role:taster", {expiry: 1900000000});
+	}`)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Access, AccessMap{"lee": SetOf("ginger", "green", "earl_grey"), "nancy": SetOf("earl_grey")})
+	assert.DeepEquals(t, res.Roles, AccessMap{"lee": SetOf("taster")})
+	assert.DeepEquals(t, res.Expiry, ExpiryMap{"lee": {"ginger": 1900000000, "green": 1899979200,
+		"earl_grey": 1800000000, "role:taster": 1900000000}})
+
+	mapper = NewChannelMapper(`function(doc) {access("lee", "ginger", {expiry: "tomorrow"});}`)
+	_, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	assert.True(t, err != nil)
+
+	// Milliseconds aren't mistaken for seconds:
+	mapper = NewChannelMapper(`function(doc) {access("lee", "ginger", {expiry: 1900000000000});}`)
+	_, err = mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
+	assert.True(t, err != nil)
+}
+
 func TestAccessFunctionTakesEmptyArrayChannels(t *testing.T) {
 	mapper := NewChannelMapper(`function(doc) {access("lee", [])}`)
 	res, err := mapper.MapToChannelsAndAccess(parse(`{}`), `{}`, noUser)
@@ -362,6 +390,81 @@ func TestSetFunction(t *testing.T) {
 	assert.DeepEquals(t, output.Channels, SetOf("all"))
 }
 
+// Verify that log() and console.log() output is captured, but only if the mapper asks for it
+func TestLogOutput(t *testing.T) {
+	fnSource := `function(doc) {log("doc is", doc.n); console.log("again");}`
+	mapper := NewChannelMapperWithOptions(fnSource, ChannelMapperOptions{LogOutput: true})
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"n": 5}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Log, []string{"doc is 5", "again"})
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"n": 6}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Log, []string{"doc is 6", "again"})
+
+	res, err = NewChannelMapper(fnSource).MapToChannelsAndAccess(parse(`{"n": 7}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.Equals(t, len(res.Log), 0)
+}
+
+// Verify that a function that runs too long is interrupted, and the runner is still usable
+func TestTimeout(t *testing.T) {
+	waitTimes := base.NewHistogram(base.DefaultLatencyBuckets)
+	runTimes := base.NewHistogram(base.DefaultLatencyBuckets)
+	mapper := NewChannelMapperWithOptions(`function(doc) {while (doc.loop) {} channel("done");}`,
+		ChannelMapperOptions{PoolSize: 1, Timeout: 50 * time.Millisecond, WaitTimes: waitTimes, RunTimes: runTimes})
+	_, err := mapper.MapToChannelsAndAccess(parse(`{"loop": true}`), `{}`, noUser)
+	assert.Equals(t, err, ErrSyncFnTimeout)
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"loop": false}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Channels, SetOf("done"))
+	assert.Equals(t, waitTimes.Snapshot().Count, uint64(2))
+	assert.Equals(t, runTimes.Snapshot().Count, uint64(2))
+	assert.True(t, runTimes.Snapshot().Sum >= 50*time.Millisecond)
+
+	// Repeated timeouts don't leave stale interrupts behind to break later calls:
+	for i := 0; i < 3; i++ {
+		_, err = mapper.MapToChannelsAndAccess(parse(`{"loop": true}`), `{}`, noUser)
+		assert.Equals(t, err, ErrSyncFnTimeout)
+	}
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"loop": false}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Channels, SetOf("done"))
+}
+
+func TestJSModules(t *testing.T) {
+	modules := NewJSModules()
+	assertNoError(t, modules.Set(map[string]string{
+		"owners": `exports.isOwner = function(doc) {return doc.owner == "alice";};`,
+		"tags":   `module.exports = {tagChannel: function(tag) {return "tag-" + tag;}};`,
+	}), "Couldn't set modules")
+	mapper := NewChannelMapperWithOptions(`function(doc) {
+		if (typeof tagChannel != "undefined" && isOwner(doc)) channel(tagChannel(doc.tag));
+		if (typeof prefix != "undefined") channel(prefix + doc.tag);
+	}`, ChannelMapperOptions{Modules: modules})
+	res, err := mapper.MapToChannelsAndAccess(parse(`{"owner": "alice", "tag": "x"}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Channels, SetOf("tag-x"))
+
+	// Changes are loaded on the next call, and the exports of removed modules go away:
+	assertNoError(t, modules.Set(map[string]string{
+		"owners": `exports.isOwner = function(doc) {return true;}; exports.prefix = "p-";`,
+	}), "Couldn't update modules")
+	res, err = mapper.MapToChannelsAndAccess(parse(`{"owner": "alice", "tag": "x"}`), `{}`, noUser)
+	assertNoError(t, err, "MapToChannelsAndAccess failed")
+	assert.DeepEquals(t, res.Channels, SetOf("p-x"))
+
+	// Modules that fail to run aren't accepted:
+	assert.True(t, modules.Set(map[string]string{"bad": `exports.x = ;`}) != nil)
+	assert.True(t, modules.Set(map[string]string{"bad": `module.exports = 1;`}) != nil)
+	assert.DeepEquals(t, modules.Sources(), map[string]string{
+		"owners": `exports.isOwner = function(doc) {return true;}; exports.prefix = "p-";`})
+
+	// Nor are modules that would replace a sync function callback, or that run too long:
+	assert.True(t, modules.Set(map[string]string{"bad": `exports.channel = function() {};`}) != nil)
+	modules.Timeout = 50 * time.Millisecond
+	assert.True(t, modules.Set(map[string]string{"slow": `while (true) {}`}) != nil)
+}
+
 func TestChangedUsers(t *testing.T) {
 	a := AccessMap{"alice": SetOf("x", "y"), "bita": SetOf("z"), "claire": SetOf("w")}
 	b := AccessMap{"alice": SetOf("x", "z"), "bita": SetOf("z"), "diana": SetOf("w")}
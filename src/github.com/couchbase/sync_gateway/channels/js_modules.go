@@ -0,0 +1,172 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package channels
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/robertkrimen/otto"
+)
+
+// Runs a module's source with "module" and "exports" in scope, returning what it exports.
+const kModuleWrapper = `(function() {
+	var module = {exports: {}}, exports = module.exports;
+	%s
+	;return module.exports;
+})()`
+
+// A set of shared JavaScript libraries ("modules"), by name, for the sync function and other
+// JS functions. Each module is run CommonJS-style, with an "exports" object in scope, and the
+// properties it exports become globals in the functions' interpreters. Thread-safe; changes
+// take effect in each interpreter the next time its function is called.
+type JSModules struct {
+	Timeout time.Duration // Max time a module's top-level code can run; 0 for no limit
+	sources map[string]string
+	version uint64
+	lock    sync.RWMutex
+}
+
+func NewJSModules() *JSModules {
+	return &JSModules{sources: map[string]string{}}
+}
+
+// Names of the sync function's callbacks, which modules can't export since exports become globals
+var kReservedModuleExports = map[string]bool{"channel": true, "access": true, "role": true, "reject": true, "log": true}
+
+// Replaces all the modules. If any module fails to run, or exports the name of a sync function
+// callback, returns an error and changes nothing.
+func (modules *JSModules) Set(sources map[string]string) error {
+	vm := otto.New()
+	for _, name := range sortedKeys(sources) {
+		exports, err := runModule(vm, sources[name], modules.Timeout)
+		if err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Error in JS module %q: %v", name, err)
+		}
+		for _, key := range exports.Keys() {
+			if kReservedModuleExports[key] {
+				return base.HTTPErrorf(http.StatusBadRequest, "JS module %q can't export %q", name, key)
+			}
+		}
+	}
+	copied := make(map[string]string, len(sources))
+	for name, source := range sources {
+		copied[name] = source
+	}
+	modules.lock.Lock()
+	defer modules.lock.Unlock()
+	modules.sources = copied
+	modules.version++
+	return nil
+}
+
+// Returns the modules' sources, by name.
+func (modules *JSModules) Sources() map[string]string {
+	modules.lock.RLock()
+	defer modules.lock.RUnlock()
+	sources := make(map[string]string, len(modules.sources))
+	for name, source := range modules.sources {
+		sources[name] = source
+	}
+	return sources
+}
+
+func runModule(vm *otto.Otto, source string, timeout time.Duration) (*otto.Object, error) {
+	result, err := runWithTimeout(vm, timeout, func() (interface{}, error) {
+		return vm.Run(fmt.Sprintf(kModuleWrapper, source))
+	})
+	if err != nil {
+		return nil, err
+	} else if exports := result.(otto.Value); !exports.IsObject() {
+		return nil, fmt.Errorf("module.exports is not an object")
+	} else {
+		return exports.Object(), nil
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Loads a JSModules into one interpreter, keeping track of which version it has.
+// Not thread-safe; it belongs to a single JS runner.
+type JSModulesLoader struct {
+	Modules *JSModules // The modules to load; may be nil
+	vm      *otto.Otto
+	version uint64
+	globals []string // Names of the globals the modules defined
+}
+
+func NewJSModulesLoader(modules *JSModules, vm *otto.Otto) *JSModulesLoader {
+	return &JSModulesLoader{Modules: modules, vm: vm}
+}
+
+// Loads the modules into the interpreter, if they've changed since they were last loaded.
+// Modules are run in order of their names.
+func (loader *JSModulesLoader) Load() error {
+	if loader.Modules == nil {
+		return nil
+	}
+	loader.Modules.lock.RLock()
+	sources, version := loader.Modules.sources, loader.Modules.version
+	loader.Modules.lock.RUnlock()
+	if version == loader.version {
+		return nil
+	}
+
+	for _, name := range loader.globals {
+		loader.vm.Set(name, otto.UndefinedValue())
+	}
+	loader.globals = nil
+	for _, name := range sortedKeys(sources) {
+		exports, err := runModule(loader.vm, sources[name], loader.Modules.Timeout)
+		if err == ErrSyncFnTimeout {
+			base.Warn("JS module %q timed out", name)
+			return err
+		} else if err != nil {
+			return fmt.Errorf("Error in JS module %q: %v", name, err)
+		}
+		for _, key := range exports.Keys() {
+			value, _ := exports.Get(key)
+			loader.vm.Set(key, value)
+			loader.globals = append(loader.globals, key)
+		}
+	}
+	loader.version = version
+	return nil
+}
+
+// Initializes a JSRunner and returns its interpreter, which is needed to load modules or to
+// interrupt a function but which JSRunner doesn't expose. The caller must then call SetFunction.
+func InitJSRunner(runner *sgbucket.JSRunner) (*otto.Otto, error) {
+	// Get the interpreter from a native function, called by a bootstrap function:
+	var vm *otto.Otto
+	if err := runner.Init(`function() {_captureVM();}`); err != nil {
+		return nil, err
+	}
+	runner.DefineNativeFunction("_captureVM", func(call otto.FunctionCall) otto.Value {
+		vm = call.Otto
+		return otto.UndefinedValue()
+	})
+	if _, err := runner.Call(); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
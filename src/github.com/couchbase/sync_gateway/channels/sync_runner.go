@@ -10,8 +10,10 @@
 package channels
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/robertkrimen/otto"
 	_ "github.com/robertkrimen/otto/underscore"
@@ -23,6 +25,9 @@ import (
 const funcWrapper = `
 	function(newDoc, oldDoc, realUserCtx) {
 
+		// Send console output to log(), so dry runs can capture it along with the results:
+		var console = {log: log, info: log, warn: log, error: log};
+
 		var v = %s;
 
 		if (oldDoc) {
@@ -93,6 +98,9 @@ const funcWrapper = `
 		}
 	}`
 
+// Returned from a call to a SyncRunner (or ChannelMapper) whose function ran too long.
+var ErrSyncFnTimeout = errors.New("Sync function timed out")
+
 // An object that runs a specific JS sync() function. Not thread-safe!
 type SyncRunner struct {
 	sgbucket.JSRunner                      // "Superclass"
@@ -100,15 +108,37 @@ type SyncRunner struct {
 	channels          []string
 	access            map[string][]string // channels granted to users via access() callback
 	roles             map[string][]string // roles granted to users via role() callback
+	expiry            ExpiryMap           // expiration of access/role grants; 0 if permanent
+	vm                *otto.Otto          // The JSRunner's interpreter
+	modules           *JSModulesLoader    // Loads shared JS modules into the interpreter
+	timeout           time.Duration       // Max time the function can run; 0 for no limit
+	logOutput         bool                // Add messages logged by the function to the output?
+	source            string              // The function's source, without funcWrapper
 }
 
 func NewSyncRunner(funcSource string) (*SyncRunner, error) {
-	funcSource = fmt.Sprintf(funcWrapper, funcSource)
 	runner := &SyncRunner{}
-	err := runner.Init(funcSource)
-	if err != nil {
+	if err := runner.init(funcSource); err != nil {
 		return nil, err
 	}
+	return runner, nil
+}
+
+// Creates the runner's interpreter, with the function and its callbacks. Also used to replace
+// an interpreter that was interrupted.
+func (runner *SyncRunner) init(funcSource string) error {
+	runner.JSRunner = sgbucket.JSRunner{}
+	var err error
+	if runner.vm, err = InitJSRunner(&runner.JSRunner); err != nil {
+		return err
+	} else if _, err = runner.SetFunction(funcSource); err != nil {
+		return err
+	}
+	var modules *JSModules
+	if runner.modules != nil {
+		modules = runner.modules.Modules
+	}
+	runner.modules = NewJSModulesLoader(modules, runner.vm)
 
 	// Implementation of the 'channel()' callback:
 	runner.DefineNativeFunction("channel", func(call otto.FunctionCall) otto.Value {
@@ -122,12 +152,26 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 
 	// Implementation of the 'access()' callback:
 	runner.DefineNativeFunction("access", func(call otto.FunctionCall) otto.Value {
-		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.access)
+		return runner.addValueForUser(call, runner.access)
 	})
 
 	// Implementation of the 'role()' callback:
 	runner.DefineNativeFunction("role", func(call otto.FunctionCall) otto.Value {
-		return runner.addValueForUser(call.Argument(0), call.Argument(1), runner.roles)
+		return runner.addValueForUser(call, runner.roles)
+	})
+
+	// Implementation of the 'log()' callback:
+	runner.DefineNativeFunction("log", func(call otto.FunctionCall) otto.Value {
+		args := make([]string, len(call.ArgumentList))
+		for i, arg := range call.ArgumentList {
+			args[i], _ = arg.ToString()
+		}
+		message := strings.Join(args, " ")
+		base.LogTo("JS", "%s", message)
+		if runner.logOutput && runner.output != nil {
+			runner.output.Log = append(runner.output.Log, message)
+		}
+		return otto.UndefinedValue()
 	})
 
 	// Implementation of the 'reject()' callback:
@@ -149,6 +193,7 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 		runner.channels = []string{}
 		runner.access = map[string][]string{}
 		runner.roles = map[string][]string{}
+		runner.expiry = ExpiryMap{}
 	}
 	runner.After = func(result otto.Value, err error) (interface{}, error) {
 		output := runner.output
@@ -159,30 +204,165 @@ func NewSyncRunner(funcSource string) (*SyncRunner, error) {
 				output.Access, err = compileAccessMap(runner.access, "")
 				if err == nil {
 					output.Roles, err = compileAccessMap(runner.roles, "role:")
+					output.Expiry = compileExpiryMap(runner.expiry)
 				}
 			}
 		}
 		return output, err
 	}
-	return runner, nil
+	return nil
+}
+
+// Calls the function, interrupting it with ErrSyncFnTimeout if it runs longer than the timeout.
+// Any changes to the shared JS modules are loaded first.
+func (runner *SyncRunner) Call(inputs ...interface{}) (result interface{}, err error) {
+	if err = runner.modules.Load(); err == nil {
+		result, err = runWithTimeout(runner.vm, runner.timeout, func() (interface{}, error) {
+			return runner.JSRunner.Call(inputs...)
+		})
+	}
+	if err == ErrSyncFnTimeout {
+		// The interrupted interpreter may be in an inconsistent state, so replace it:
+		if initErr := runner.init(runner.source); initErr != nil {
+			base.Warn("SyncRunner: Couldn't reinitialize after timeout: %v", initErr)
+		}
+	}
+	return result, err
+}
+
+// Runs fn, which calls into the interpreter, and interrupts it with ErrSyncFnTimeout if it runs
+// longer than the timeout (if that's nonzero.)
+func runWithTimeout(vm *otto.Otto, timeout time.Duration, fn func() (interface{}, error)) (result interface{}, err error) {
+	if timeout <= 0 {
+		return fn()
+	}
+	if vm.Interrupt == nil {
+		vm.Interrupt = make(chan func(), 1)
+	}
+	// Discard any interrupt left over from an earlier call that timed out just as it finished:
+	select {
+	case <-vm.Interrupt:
+	default:
+	}
+
+	running := true
+	done := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		select {
+		case vm.Interrupt <- func() {
+			// This runs on the calling goroutine, so it can safely check whether the call that
+			// timed out is still running, or if this interrupt arrived too late:
+			if running {
+				panic(ErrSyncFnTimeout)
+			}
+		}:
+		case <-done:
+		}
+	})
+	defer func() {
+		running = false
+		close(done)
+		timer.Stop()
+		if caught := recover(); caught == ErrSyncFnTimeout {
+			result, err = nil, ErrSyncFnTimeout
+		} else if caught != nil {
+			panic(caught)
+		}
+	}()
+	return fn()
 }
 
 func (runner *SyncRunner) SetFunction(funcSource string) (bool, error) {
-	funcSource = fmt.Sprintf(funcWrapper, funcSource)
-	return runner.JSRunner.SetFunction(funcSource)
+	changed, err := runner.JSRunner.SetFunction(fmt.Sprintf(funcWrapper, funcSource))
+	if err == nil {
+		runner.source = funcSource
+	}
+	return changed, err
 }
 
-// Common implementation of 'access()' and 'role()' callbacks
-func (runner *SyncRunner) addValueForUser(user otto.Value, value otto.Value, mapping map[string][]string) otto.Value {
-	valueStrings := ottoValueToStringArray(value)
+// Common implementation of 'access()' and 'role()' callbacks. The optional third argument is
+// an object whose "expiry" property makes the grant temporary.
+func (runner *SyncRunner) addValueForUser(call otto.FunctionCall, mapping map[string][]string) otto.Value {
+	expiry, err := ottoExpiryOption(call.Argument(2))
+	if err != nil {
+		panic(call.Otto.MakeTypeError(err.Error()))
+	}
+	valueStrings := ottoValueToStringArray(call.Argument(1))
 	if len(valueStrings) > 0 {
-		for _, name := range ottoValueToStringArray(user) {
+		for _, name := range ottoValueToStringArray(call.Argument(0)) {
 			mapping[name] = append(mapping[name], valueStrings...)
+			if runner.expiry[name] == nil {
+				runner.expiry[name] = map[string]int64{}
+			}
+			for _, value := range valueStrings {
+				// A permanent grant overrides temporary ones, else the latest expiry wins:
+				oldExpiry, exists := runner.expiry[name][value]
+				if !exists || (oldExpiry != 0 && (expiry == 0 || expiry > oldExpiry)) {
+					runner.expiry[name][value] = expiry
+				}
+			}
 		}
 	}
 	return otto.UndefinedValue()
 }
 
+// Largest expiry accepted as a number, in Unix seconds (the year 5138.) Larger numbers are almost
+// certainly milliseconds, as returned by JavaScript's Date.now() or Date.getTime().
+const kMaxExpirySeconds = 1e11
+
+// Parses the "expiry" property of the options passed to access() or role(), which can be a
+// Unix time in seconds (not milliseconds), an ISO-8601 date string, or a Date. Returns 0 if
+// there's no expiry.
+func ottoExpiryOption(options otto.Value) (int64, error) {
+	if !options.IsObject() {
+		return 0, nil
+	}
+	value, _ := options.Object().Get("expiry")
+	var expiry int64
+	switch {
+	case value.IsUndefined() || value.IsNull():
+		return 0, nil
+	case value.IsNumber():
+		expiry, _ = value.ToInteger()
+		if expiry > kMaxExpirySeconds {
+			return 0, fmt.Errorf("Invalid expiry %v: must be in seconds, not milliseconds", value)
+		}
+	case value.IsString():
+		t, err := time.Parse(time.RFC3339, value.String())
+		if err != nil {
+			return 0, fmt.Errorf("Invalid expiry date %q", value.String())
+		}
+		expiry = t.Unix()
+	case value.Class() == "Date":
+		millis, _ := value.Object().Call("getTime")
+		msec, _ := millis.ToInteger()
+		expiry = msec / 1000
+	}
+	if expiry <= 0 {
+		return 0, fmt.Errorf("Invalid expiry %v", value)
+	}
+	return expiry, nil
+}
+
+// Removes the permanent grants from an ExpiryMap, returning nil if there are no temporary ones.
+func compileExpiryMap(input ExpiryMap) ExpiryMap {
+	var expiry ExpiryMap
+	for name, values := range input {
+		for value, exp := range values {
+			if exp > 0 {
+				if expiry == nil {
+					expiry = ExpiryMap{}
+				}
+				if expiry[name] == nil {
+					expiry[name] = map[string]int64{}
+				}
+				expiry[name][value] = exp
+			}
+		}
+	}
+	return expiry
+}
+
 func compileAccessMap(input map[string][]string, prefix string) (AccessMap, error) {
 	access := make(AccessMap, len(input))
 	for name, values := range input {
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Longest time the background task waits between sweeps of expired access grants. It normally
+// sweeps only when a grant is due to expire; this is a fallback for grants it hasn't been told
+// about, like those made through another Sync Gateway node that has since gone away.
+const kAccessExpirySweepInterval = time.Hour
+
+// Schedule of the background sweep of expired access grants.
+type accessExpirySchedule struct {
+	lock   sync.Mutex
+	next   int64         // Unix time of the earliest known grant expiry; 0 if none
+	wakeup chan struct{} // Signaled when 'next' becomes earlier
+}
+
+// Starts a background task that invalidates the channels or roles of users and roles whose
+// temporary grants (made by access() or role() calls with an expiry) have expired. They'd
+// otherwise keep the access until the granting document changes, since their computed channels
+// and roles are cached. Reloading an invalidated user makes its _changes feeds stop sending the
+// channels it's lost. The task sweeps once at startup, then whenever the next grant expires.
+func (context *DatabaseContext) startAccessExpirySweep() {
+	context.sweepTerminator = make(chan bool)
+	context.accessExpiry.wakeup = make(chan struct{}, 1)
+	context.sweepsRunning.Add(1)
+	go func(terminator chan bool) {
+		defer context.sweepsRunning.Done()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		var since int64
+		for {
+			select {
+			case <-timer.C:
+				context.accessExpiry.lock.Lock()
+				context.accessExpiry.next = 0
+				context.accessExpiry.lock.Unlock()
+				db, _ := CreateDatabase(context)
+				if until, err := db.SweepExpiredGrants(since, time.Now().Unix()); err == nil {
+					since = until
+				} else {
+					base.Warn("Sweep of expired access grants of %q failed: %v", context.Name, err)
+				}
+			case <-context.accessExpiry.wakeup:
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+			case <-terminator:
+				return
+			}
+			timer.Reset(context.accessExpiry.untilNext())
+		}
+	}(context.sweepTerminator)
+}
+
+// Returns how long to wait until the next sweep.
+func (schedule *accessExpirySchedule) untilNext() time.Duration {
+	schedule.lock.Lock()
+	defer schedule.lock.Unlock()
+	if schedule.next == 0 {
+		return kAccessExpirySweepInterval
+	}
+	wait := time.Unix(schedule.next, 0).Sub(time.Now())
+	if wait < 0 {
+		wait = 0
+	} else if wait > kAccessExpirySweepInterval {
+		wait = kAccessExpirySweepInterval
+	}
+	return wait
+}
+
+// Makes the sweep run at the Unix time 'expiry', unless it's already going to run earlier.
+func (schedule *accessExpirySchedule) add(expiry int64) {
+	schedule.lock.Lock()
+	defer schedule.lock.Unlock()
+	if schedule.next == 0 || expiry < schedule.next {
+		schedule.next = expiry
+		select {
+		case schedule.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Makes the sweep run when the earliest of a document's temporary grants expires.
+func (context *DatabaseContext) scheduleAccessExpiry(expiry channels.ExpiryMap) {
+	var earliest int64
+	for _, grants := range expiry {
+		for _, exp := range grants {
+			if earliest == 0 || exp < earliest {
+				earliest = exp
+			}
+		}
+	}
+	if earliest > 0 {
+		context.accessExpiry.add(earliest)
+	}
+}
+
+// Invalidates the channels or roles of the users and roles whose temporary grants expired after
+// the Unix time 'since', up to 'now'. Returns the time it swept up to, to pass as 'since' next
+// time. Also schedules the next sweep, for the earliest grant that hasn't expired yet.
+func (db *Database) SweepExpiredGrants(since, now int64) (int64, error) {
+	var vres struct {
+		Rows []struct {
+			Value []string // [user or role name, granted channel or "role:"+role]
+		}
+	}
+	opts := Body{"stale": false, "startkey": since + 1, "endkey": now}
+	if err := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAccessExpiry, opts, &vres); err != nil {
+		base.Warn("access_expiry view returned %v", err)
+		return since, err
+	}
+
+	var principalNames, roleUserNames []string
+	for _, row := range vres.Rows {
+		if len(row.Value) != 2 {
+			continue
+		} else if strings.HasPrefix(row.Value[1], "role:") {
+			roleUserNames = append(roleUserNames, row.Value[0])
+		} else {
+			principalNames = append(principalNames, row.Value[0])
+		}
+	}
+	principals, roleUsers := base.SetFromArray(principalNames), base.SetFromArray(roleUserNames)
+	if len(principals) > 0 || len(roleUsers) > 0 {
+		base.LogTo("Access", "Grants expired: invalidating channels of %v, roles of %v",
+			principals, roleUsers)
+	}
+	for name := range principals {
+		db.invalUserOrRoleChannels(name)
+	}
+	for name := range roleUsers {
+		db.invalUserOrRoleRoles(name)
+	}
+
+	// The index is up to date after the query above, so this one doesn't need to update it:
+	var next struct {
+		Rows []struct {
+			Key int64 // Expiration time
+		}
+	}
+	opts = Body{"stale": "ok", "startkey": now + 1, "limit": 1}
+	if err := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAccessExpiry, opts, &next); err != nil {
+		base.Warn("access_expiry view returned %v", err)
+	} else if len(next.Rows) > 0 {
+		db.accessExpiry.add(next.Rows[0].Key)
+	}
+	return now, nil
+}
+
+// Returns the channels that temporary grants to a user, or to the given roles of it, gave it
+// until they expired, including the channels of the roles whose grants to the user expired.
+func (context *DatabaseContext) expiredGrantChannels(userName string, roles channels.TimedSet) base.Set {
+	var vres struct {
+		Rows []struct {
+			Value []string // [user or role name, granted channel or "role:"+role]
+		}
+	}
+	opts := Body{"stale": false, "endkey": context.timeNow().Unix()}
+	if err := context.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAccessExpiry, opts, &vres); err != nil {
+		base.Warn("access_expiry view returned %v", err)
+		return nil
+	}
+	expired := base.Set{}
+	for _, row := range vres.Rows {
+		if len(row.Value) != 2 {
+			continue
+		}
+		name, granted := row.Value[0], row.Value[1]
+		if strings.HasPrefix(granted, "role:") {
+			if name != userName {
+				continue
+			}
+			role, err := context.Authenticator().GetRole(granted[5:])
+			if err != nil || role == nil {
+				continue
+			}
+			for channel := range role.Channels() {
+				expired[channel] = struct{}{}
+			}
+		} else if name == userName || (strings.HasPrefix(name, "role:") && roles.Contains(name[5:])) {
+			expired[granted] = struct{}{}
+		}
+	}
+	return expired
+}
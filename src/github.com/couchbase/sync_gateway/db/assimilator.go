@@ -33,7 +33,7 @@ func (c *DatabaseContext) watchDocChanges() {
 func (c *DatabaseContext) assimilate(docid string) {
 	base.LogTo("CRUD", "Importing new doc %q", docid)
 	db := Database{DatabaseContext: c, user: nil}
-	_, err := db.updateDoc(docid, true, func(doc *document) (Body, error) {
+	_, err := db.updateDoc(docid, true, nil, func(doc *document) (Body, error) {
 		if doc.hasValidSyncData() {
 			return nil, couchbase.UpdateCancel // someone beat me to it
 		}
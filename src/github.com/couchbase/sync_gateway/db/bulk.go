@@ -0,0 +1,98 @@
+package db
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Returned by updateDoc, in place of saving the document, when the Database is validateOnly.
+var errValidateOnly = errors.New("validate only")
+
+// A revision saved by PutAllOrNothing, with what's needed to roll it back.
+type savedRevision struct {
+	docid      string
+	revid      string
+	parentBody Body // Body of the replaced revision; nil if the doc was new or deleted
+}
+
+// Saves a set of new revisions as a unit: either all of them are saved, or none are. Each body
+// is as given to Put; bodies without an "_id" are assigned a new UUID (stored in the body.)
+// First every revision is validated by running it through the sync function without saving it,
+// then they're all saved in order. If a save fails anyway, most likely because of a concurrent
+// update, the revisions already saved are rolled back by adding new revisions that restore
+// the previous bodies, or that delete documents that didn't exist before.
+// Returns the new revision IDs; or, if any revision couldn't be saved, an array with the error
+// of each document that failed, and nil for the rest.
+func (db *Database) PutAllOrNothing(docs []Body) ([]string, []error) {
+	errs := make([]error, len(docs))
+	failed := false
+	validator := &Database{DatabaseContext: db.DatabaseContext, user: db.user, validateOnly: true}
+	for i, body := range docs {
+		docid, ok := body["_id"].(string)
+		if !ok {
+			docid = base.CreateUUID()
+			body["_id"] = docid
+		}
+		// Put alters the body it's given, so validate a copy:
+		if _, err := validator.Put(docid, copyBody(body)); err != errValidateOnly {
+			errs[i] = err
+			failed = true
+		}
+	}
+	if failed {
+		return nil, errs
+	}
+
+	revids := make([]string, len(docs))
+	saved := make([]savedRevision, 0, len(docs))
+	for i, body := range docs {
+		docid := body["_id"].(string)
+		var parentBody Body
+		if parentRev, _ := body["_rev"].(string); parentRev != "" {
+			if parent, _, _, _ := db.revisionCache.Get(docid, parentRev); parent != nil && parent["_deleted"] == nil {
+				parentBody = copyBody(stripSpecialProperties(parent))
+			}
+		}
+		revid, err := db.Put(docid, body)
+		if err != nil {
+			base.LogTo("CRUD", "PutAllOrNothing: Saving %q failed (%v); rolling back %d docs",
+				docid, err, len(saved))
+			errs[i] = err
+			db.rollBackRevisions(saved, errs)
+			return nil, errs
+		}
+		revids[i] = revid
+		saved = append(saved, savedRevision{docid, revid, parentBody})
+	}
+	return revids, nil
+}
+
+// Undoes the revisions saved by PutAllOrNothing, most recent first. Any revision that can't be
+// rolled back gets an error in errs, at its document's index.
+func (db *Database) rollBackRevisions(saved []savedRevision, errs []error) {
+	dbExpvars.Add("all_or_nothing_rollbacks", 1)
+	// The user was allowed to make the changes, so they don't need access to undo them:
+	admin := &Database{DatabaseContext: db.DatabaseContext}
+	for i := len(saved) - 1; i >= 0; i-- {
+		rev := saved[i]
+		var err error
+		if rev.parentBody == nil {
+			_, err = admin.DeleteDoc(rev.docid, rev.revid)
+		} else {
+			rev.parentBody["_rev"] = rev.revid
+			_, err = admin.Put(rev.docid, rev.parentBody)
+		}
+		if err != nil {
+			base.Warn("PutAllOrNothing: Couldn't roll back %q / %q: %v", rev.docid, rev.revid, err)
+			errs[i] = base.HTTPErrorf(http.StatusInternalServerError,
+				"Revision %s was saved but couldn't be rolled back: %v", rev.revid, err)
+		}
+	}
+}
+
+// Makes a deep copy of a body, so that changes to it (or its attachments) don't affect the original.
+func copyBody(body Body) Body {
+	return Body(copyJSONValue(map[string]interface{}(body)).(map[string]interface{}))
+}
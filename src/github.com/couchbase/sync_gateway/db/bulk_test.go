@@ -0,0 +1,68 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestPutAllOrNothing(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		if (doc.qty < 0) throw({forbidden: "negative quantity"});
+	}`)
+
+	revids, errs := db.PutAllOrNothing([]Body{Body{"_id": "order", "qty": 1}, Body{"qty": 2}})
+	assert.True(t, errs == nil)
+	assert.Equals(t, len(revids), 2)
+	body, err := db.Get("order")
+	assertNoError(t, err, "Couldn't get order")
+	assert.Equals(t, body["_rev"], revids[0])
+
+	// If one doc fails validation, nothing is saved:
+	revids, errs = db.PutAllOrNothing([]Body{
+		Body{"_id": "order", "_rev": revids[0], "qty": 5},
+		Body{"_id": "item1", "qty": -1},
+		Body{"_id": "item2", "_rev": "1-bogus"}})
+	assert.Equals(t, len(revids), 0)
+	assert.Equals(t, len(errs), 3)
+	assert.Equals(t, errs[0], nil)
+	assertHTTPError(t, errs[1], 403)
+	assertHTTPError(t, errs[2], 409)
+	body, err = db.Get("order")
+	assertNoError(t, err, "Couldn't get order")
+	assert.True(t, jsonValuesEqual(body["qty"], 1))
+	_, err = db.Get("item1")
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestPutAllOrNothingRollback(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("order", Body{"qty": 1})
+	assertNoError(t, err, "Couldn't create document")
+
+	// Both creations of "item" pass validation, but the second one fails to save, so the
+	// changes to "order" and the first "item" are rolled back:
+	revids, errs := db.PutAllOrNothing([]Body{
+		Body{"_id": "order", "_rev": rev1id, "qty": 2},
+		Body{"_id": "item", "n": 1},
+		Body{"_id": "item", "n": 2}})
+	assert.Equals(t, len(revids), 0)
+	assert.Equals(t, errs[0], nil)
+	assert.Equals(t, errs[1], nil)
+	assertHTTPError(t, errs[2], 409)
+
+	body, err := db.Get("order")
+	assertNoError(t, err, "Couldn't get order")
+	assert.True(t, jsonValuesEqual(body["qty"], 1))
+	gen, _ := parseRevID(body["_rev"].(string))
+	assert.Equals(t, gen, 3)
+	_, err = db.Get("item")
+	assertHTTPError(t, err, 404)
+}
@@ -8,6 +8,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/sync_gateway/auth"
@@ -48,6 +49,7 @@ type changeCache struct {
 	lock            sync.RWMutex             // Coordinates access to struct fields
 	lateSeqLock     sync.RWMutex             // Coordinates access to late sequence caches
 	options         CacheOptions             // Cache config
+	lastFeedLag     int64                    // Lag of the latest doc from the feed (atomic; nsec)
 }
 
 type LogEntry channels.LogEntry
@@ -69,6 +71,7 @@ type CacheOptions struct {
 	CachePendingSeqMaxWait time.Duration // Max wait for pending sequence before skipping
 	CachePendingSeqMaxNum  int           // Max number of pending sequences before skipping
 	CacheSkippedSeqMaxWait time.Duration // Max wait for skipped sequence before abandoning
+	ChannelIndex           *ChannelIndex // Persistent channel index to add changes to, if any
 }
 
 //////// HOUSEKEEPING:
@@ -280,6 +283,10 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte) {
 			return
 		}
 
+		if len(docJSON) == 0 {
+			return // The doc was purged or expired, so there's no new sequence to add
+		}
+
 		// First unmarshal the doc (just its metadata, to save time/memory):
 		doc, err := unmarshalDocumentSyncData(docJSON, false)
 		if err != nil || !doc.hasValidSyncData() {
@@ -295,6 +302,7 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte) {
 		tapLag := time.Since(doc.TimeSaved) - time.Since(entryTime)
 		lagMs := int(tapLag/(100*time.Millisecond)) * 100
 		changeCacheExpvars.Add(fmt.Sprintf("lag-tap-%04dms", lagMs), 1)
+		atomic.StoreInt64(&c.lastFeedLag, int64(tapLag))
 
 		// If the doc update wasted any sequences due to conflicts, add empty entries for them:
 		for _, seq := range doc.UnusedSequences {
@@ -338,8 +346,15 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte) {
 			TimeSaved:    doc.TimeSaved,
 			Channels:     doc.Channels,
 		}
+		if doc.Expiry != nil {
+			change.Expiry = *doc.Expiry
+		}
 		base.LogTo("Cache", "Received #%d after %3dms (%q / %q)", change.Sequence, int(tapLag/time.Millisecond), change.DocID, change.RevID)
 
+		if c.context.ChannelIndex != nil {
+			c.context.ChannelIndex.AddChange(change)
+		}
+
 		changedChannels := c.processEntry(change)
 		if c.onChange != nil && len(changedChannels) > 0 {
 			c.onChange(changedChannels)
@@ -509,6 +524,15 @@ func (c *changeCache) _addPendingLogs() base.Set {
 	return changedChannels
 }
 
+// Removes all entries for a document from the channel caches; used when it's purged.
+func (c *changeCache) removeDoc(docID string) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, channelCache := range c.channelCaches {
+		channelCache.removeDoc(docID)
+	}
+}
+
 func (c *changeCache) getChannelCache(channelName string) *channelCache {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -556,6 +580,45 @@ func (c *changeCache) _allChannels() base.Set {
 	return base.SetFromArray(array)
 }
 
+// Summary of the state of a database's change cache.
+type ChangeCacheStats struct {
+	PendingSequences int            // Sequences received early, waiting for earlier ones to arrive
+	SkippedSequences int            // Sequences given up on, that might still arrive late
+	OldestSkippedAge time.Duration  // How long the oldest skipped sequence has been waiting
+	ChannelLengths   map[string]int // Number of cached entries in each channel
+	FeedLag          time.Duration  // Delay between saving the latest doc and its arrival on the feed
+}
+
+// Returns the current state of the database's change cache.
+func (context *DatabaseContext) ChangeCacheStats() ChangeCacheStats {
+	c := &context.changeCache
+	c.lock.RLock()
+	stats := ChangeCacheStats{
+		PendingSequences: len(c.pendingLogs),
+		ChannelLengths:   make(map[string]int, len(c.channelCaches)),
+		FeedLag:          time.Duration(atomic.LoadInt64(&c.lastFeedLag)),
+	}
+	caches := make([]*channelCache, 0, len(c.channelCaches))
+	for _, cache := range c.channelCaches {
+		caches = append(caches, cache)
+	}
+	c.lock.RUnlock()
+
+	for _, cache := range caches {
+		cache.lock.RLock()
+		stats.ChannelLengths[cache.channelName] = len(cache.logs)
+		cache.lock.RUnlock()
+	}
+
+	c.skippedSeqLock.RLock()
+	stats.SkippedSequences = len(c.skippedSeqs)
+	if len(c.skippedSeqs) > 0 {
+		stats.OldestSkippedAge = time.Since(c.skippedSeqs[0].timeAdded)
+	}
+	c.skippedSeqLock.RUnlock()
+	return stats
+}
+
 func (c *changeCache) getOldestSkippedSequence() uint64 {
 	c.skippedSeqLock.RLock()
 	defer c.skippedSeqLock.RUnlock()
@@ -162,7 +162,7 @@ func (listener *changeListener) NewWaiterWithChannels(chans base.Set, user auth.
 	var userKeys []string
 	if user != nil {
 		userKeys = []string{auth.UserKeyPrefix + user.Name()}
-		for role, _ := range user.RoleNames() {
+		for role, _ := range user.InheritedRoles() {
 			userKeys = append(userKeys, auth.RoleKeyPrefix+role)
 		}
 		waitKeys = append(waitKeys, userKeys...)
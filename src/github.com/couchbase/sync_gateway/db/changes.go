@@ -14,6 +14,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
@@ -21,15 +22,19 @@ import (
 
 // Options for changes-feeds
 type ChangesOptions struct {
-	Since       SequenceID // sequence # to start _after_
-	Limit       int        // Max number of changes to return, if nonzero
-	Conflicts   bool       // Show all conflicting revision IDs, not just winning one?
-	IncludeDocs bool       // Include doc body of each change?
-	Wait        bool       // Wait for results, instead of immediately returning empty result?
-	Continuous  bool       // Run continuously until terminated?
-	Terminator  chan bool  // Caller can close this channel to terminate the feed
-	HeartbeatMs uint64     // How often to send a heartbeat to the client
-	TimeoutMs   uint64     // After this amount of time, close the longpoll connection
+	Since       SequenceID          // sequence # to start _after_
+	Limit       int                 // Max number of changes to return, if nonzero
+	Conflicts   bool                // Show all conflicting revision IDs, not just winning one?
+	IncludeDocs bool                // Include doc body of each change?
+	Wait        bool                // Wait for results, instead of immediately returning empty result?
+	Continuous  bool                // Run continuously until terminated?
+	Terminator  chan bool           // Caller can close this channel to terminate the feed
+	HeartbeatMs uint64              // How often to send a heartbeat to the client
+	TimeoutMs   uint64              // After this amount of time, close the longpoll connection
+	Filter      *DocFilter          // If non-nil, only changes to docs that pass this filter are sent
+	DocIDs      base.Set            // If non-nil, only changes to docs with these IDs are sent
+	ActiveOnly  bool                // Leave out deletions and removals from channels?
+	DeltasFrom  map[string][]string // Known revs by doc ID; included docs are sent as deltas from them
 }
 
 // A changes entry; Database.GetChanges returns an array of these.
@@ -76,7 +81,11 @@ func (db *Database) addDocToChangeEntry(entry *ChangeEntry, options ChangesOptio
 	}
 	if options.IncludeDocs {
 		var err error
-		entry.Doc, err = db.getRevFromDoc(doc, revID, false)
+		if deltasFrom := options.DeltasFrom[entry.ID]; len(deltasFrom) > 0 {
+			entry.Doc, err = db.GetRevWithDelta(doc.ID, revID, false, nil, deltasFrom)
+		} else {
+			entry.Doc, err = db.getRevFromDoc(doc, revID, false)
+		}
 		if err != nil {
 			base.Warn("Changes feed: error getting doc %q/%q: %v", doc.ID, revID, err)
 		}
@@ -134,6 +143,81 @@ func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan
 	return feed, nil
 }
 
+// Creates a Go-channel of removal entries for the documents in channels the user has lost access
+// to because temporary grants of them expired. It only includes the documents the feed may
+// already have sent (up to options.Since), and not ones the user can still see through the
+// channels it has. Each removal has the sequence of the change that put its doc in the channel,
+// so they come in order, before any newer changes, and don't move the feed ahead. A goroutine
+// finds them, since that takes a query per channel and a read per doc.
+func (db *Database) lostChannelsFeed(lost base.Set, previousRoles channels.TimedSet, available channels.TimedSet, options ChangesOptions) <-chan *ChangeEntry {
+	feed := make(chan *ChangeEntry, 1)
+	if options.Since.Seq == 0 {
+		close(feed) // Nothing has been sent yet
+		return feed
+	}
+	context, userName := db.DatabaseContext, db.user.Name()
+	go func() {
+		defer close(feed)
+		expired := context.expiredGrantChannels(userName, previousRoles)
+		removed := map[string]base.Set{} // Lost channels of each doc
+		var docs LogPriorityQueue        // One entry per doc, to sort by sequence
+		for channel := range lost {
+			if !expired.Contains(channel) {
+				continue
+			}
+			log, err := context.getChangesInChannelFromStorage(channel, options.Since.Seq, ChangesOptions{})
+			if err != nil {
+				base.Warn("Error reading changes of lost channel %q: %v", channel, err)
+				continue
+			}
+			for _, logEntry := range log {
+				if logEntry.Flags&channels.Removed != 0 {
+					continue
+				}
+				if removed[logEntry.DocID] == nil {
+					removed[logEntry.DocID] = base.Set{}
+					docs = append(docs, logEntry)
+				}
+				removed[logEntry.DocID][channel] = struct{}{}
+			}
+		}
+		sort.Sort(docs)
+
+		for _, logEntry := range docs {
+			if context.docIsInChannels(logEntry.DocID, available) {
+				continue // The user can still see the doc through another channel
+			}
+			change := &ChangeEntry{
+				Seq:     SequenceID{Seq: logEntry.Sequence},
+				ID:      logEntry.DocID,
+				Removed: removed[logEntry.DocID],
+				Changes: []ChangeRev{{"rev": logEntry.RevID}},
+			}
+			select {
+			case <-options.Terminator:
+				base.LogTo("Changes+", "Aborting lostChannelsFeed")
+				return
+			case feed <- change:
+			}
+		}
+	}()
+	return feed
+}
+
+// Returns true if the document is currently in any of the channels.
+func (context *DatabaseContext) docIsInChannels(docid string, chans channels.TimedSet) bool {
+	doc, err := context.GetDoc(docid)
+	if err != nil {
+		return false
+	}
+	for channel, removal := range doc.Channels {
+		if removal == nil && chans.Contains(channel) {
+			return true
+		}
+	}
+	return false
+}
+
 func makeChangeEntry(logEntry *LogEntry, seqID SequenceID, channelName string) ChangeEntry {
 	change := ChangeEntry{
 		Seq:      seqID,
@@ -144,6 +228,10 @@ func makeChangeEntry(logEntry *LogEntry, seqID SequenceID, channelName string) C
 	}
 	if logEntry.Flags&channels.Removed != 0 {
 		change.Removed = channels.SetOf(channelName)
+	} else if !logEntry.Expiry.IsZero() && !logEntry.Expiry.After(time.Now()) {
+		// The doc has expired, so it's effectively been deleted and removed from the channel:
+		change.Deleted = true
+		change.Removed = channels.SetOf(channelName)
 	}
 	return change
 }
@@ -183,7 +271,9 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 		var userChangeCount uint64
 		var lowSequence uint64
 		var lateSequenceFeeds map[string]*lateSequenceFeed
-		var addedChannels base.Set // Tracks channels added to the user during changes processing.
+		var addedChannels base.Set          // Tracks channels added to the user during changes processing.
+		var lostChannels base.Set           // Tracks channels the user loses access to during changes processing.
+		var previousRoles channels.TimedSet // The user's roles before it lost access to lostChannels
 
 		// lowSequence is used to send composite keys to clients, so that they can obtain any currently
 		// skipped sequences in a future iteration or request.
@@ -313,6 +403,13 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 				}
 			}
 
+			// If the user has lost access to channels, create a pseudo-feed of removals from them:
+			if len(lostChannels) > 0 {
+				feeds = append(feeds, db.lostChannelsFeed(lostChannels, previousRoles, channelsSince, options))
+				names = append(names, "lost_channels")
+				lostChannels = nil
+			}
+
 			// If the user object has changed, create a special pseudo-feed for it:
 			if db.user != nil {
 				userSeq := SequenceID{Seq: db.user.Sequence()}
@@ -387,6 +484,19 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 					options.Since = minSeq
 				}
 
+				// Skip the entry if it's not one of the requested docs, or not active:
+				if options.DocIDs != nil && !options.DocIDs.Contains(minEntry.ID) {
+					continue
+				}
+				if options.ActiveOnly && (minEntry.Deleted || minEntry.Removed != nil) {
+					continue
+				}
+
+				// Skip the entry if it doesn't pass the filter function:
+				if options.Filter != nil && !db.changeEntryPassesFilter(minEntry, options.Filter) {
+					continue
+				}
+
 				// Add the doc body or the conflicting rev IDs, if those options are set:
 				if options.IncludeDocs || options.Conflicts {
 					db.addDocToChangeEntry(minEntry, options)
@@ -444,6 +554,7 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 
 				if db.user != nil {
 					previousChannels = db.user.InheritedChannels()
+					previousRoles = db.user.RoleNames()
 					if err := db.ReloadUser(); err != nil {
 						base.Warn("Error reloading user %q: %v", db.user.Name(), err)
 						change := makeErrorEntry("User not found during reload - terminating changes feed")
@@ -456,6 +567,15 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 					if len(addedChannels) > 0 {
 						base.LogTo("Changes+", "New channels found after user reload: %v", addedChannels)
 					}
+					lostChannels = base.Set{}
+					for channel := range previousChannels {
+						if !db.user.CanSeeChannel(channel) && (chans.Contains(channel) || chans.Contains(channels.AllChannelWildcard)) {
+							lostChannels[channel] = struct{}{}
+						}
+					}
+					if len(lostChannels) > 0 {
+						base.LogTo("Changes+", "Channels lost after user reload: %v", lostChannels)
+					}
 				}
 
 			}
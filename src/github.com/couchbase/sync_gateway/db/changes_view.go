@@ -22,9 +22,24 @@ type channelsViewRow struct {
 	Value struct {
 		Rev   string
 		Flags uint8
+		Exp   *time.Time
 	}
 }
 
+// Gets a range of sequences of a single channel as LogEntries, from the channel index if the
+// database has one that covers the range, else from the 'channels' view.
+func (dbc *DatabaseContext) getChangesInChannelFromStorage(
+	channelName string, endSeq uint64, options ChangesOptions) (LogEntries, error) {
+	if dbc.ChannelIndex != nil {
+		entries, err := dbc.ChannelIndex.GetChanges(channelName, endSeq, options)
+		if err != errChannelIndexIncomplete {
+			return entries, err
+		}
+		base.LogTo("Cache", "  Channel index doesn't go back to #%d; querying view instead", options.Since.SafeSequence()+1)
+	}
+	return dbc.getChangesInChannelFromView(channelName, endSeq, options)
+}
+
 // Queries the 'channels' view to get a range of sequences of a single channel as LogEntries.
 func (dbc *DatabaseContext) getChangesInChannelFromView(
 	channelName string, endSeq uint64, options ChangesOptions) (LogEntries, error) {
@@ -52,6 +67,9 @@ func (dbc *DatabaseContext) getChangesInChannelFromView(
 			Flags:        row.Value.Flags,
 			TimeReceived: time.Now(),
 		}
+		if row.Value.Exp != nil {
+			entry.Expiry = *row.Value.Exp
+		}
 		// base.LogTo("Cache", "  Got view sequence #%d (%q / %q)", entry.Sequence, entry.DocID, entry.RevID)
 		entries = append(entries, entry)
 	}
@@ -109,6 +109,22 @@ func (c *channelCache) pruneCache() {
 	c.lock.Unlock()
 }
 
+// Removes a document's entry (if any) from the cache.
+func (c *channelCache) removeDoc(docID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, found := c.cachedDocIDs[docID]; !found {
+		return
+	}
+	for i := len(c.logs) - 1; i >= 0; i-- {
+		if c.logs[i].DocID == docID {
+			c.logs = append(c.logs[:i], c.logs[i+1:]...)
+			break
+		}
+	}
+	delete(c.cachedDocIDs, docID)
+}
+
 // Returns all of the cached entries for sequences greater than 'since' in the given channel.
 // Entries are returned in increasing-sequence order.
 func (c *channelCache) getCachedChanges(options ChangesOptions) (validFrom uint64, result []*LogEntry) {
@@ -145,7 +161,7 @@ func (c *channelCache) _getCachedChanges(options ChangesOptions) (validFrom uint
 }
 
 // Top-level method to get all the changes in a channel since the sequence 'since'.
-// If the cache doesn't go back far enough, the view will be queried.
+// If the cache doesn't go back far enough, the view (or channel index) will be queried.
 // View query results may be fed back into the cache if there's room.
 // initialSequence is used only if the cache is empty: it gives the max sequence to which the
 // view should be queried, because we don't want the view query to outrun the chanceCache's
@@ -182,9 +198,9 @@ func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
 		return resultFromCache, nil
 	}
 
-	// Now query the view. We set the max sequence equal to cacheValidFrom, so we'll get one
-	// overlap, which helps confirm that we've got everything.
-	resultFromView, err := c.context.getChangesInChannelFromView(c.channelName, cacheValidFrom,
+	// Now query the view (or the channel index.) We set the max sequence equal to cacheValidFrom,
+	// so we'll get one overlap, which helps confirm that we've got everything.
+	resultFromView, err := c.context.getChangesInChannelFromStorage(c.channelName, cacheValidFrom,
 		options)
 	if err != nil {
 		return nil, err
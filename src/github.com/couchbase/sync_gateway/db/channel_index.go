@@ -0,0 +1,801 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Number of sequences covered by each block of a channel index. A block only holds the
+// channel's entries within its range, so for most channels it's a lot smaller than this.
+const kChannelIndexBlockSize = 500
+
+// Max number of block ranges a channel's head doc lists. Past this, the two ranges with the
+// smallest gap between them are merged, so the head doc stays small even for a sparse channel.
+const kChannelIndexMaxBlockRanges = 100
+
+// Min time between updates of the root doc's checkpoint
+const kChannelIndexCheckpointInterval = 10 * time.Second
+
+// Keys of channel index docs. The root doc lists the indexed channels; each channel has a
+// head doc, whose key is the prefix plus the channel name, listing the channel's blocks; and
+// the block docs' keys append ":" and the block number to that.
+const kChannelIndexKeyPrefix = kSyncKeyPrefix + "chidx:"
+const kChannelIndexRootKey = kSyncKeyPrefix + "chidx"
+
+// Returned by ChannelIndex.GetChanges when the index doesn't cover the requested range.
+var errChannelIndexIncomplete = errors.New("channel index doesn't cover the requested sequences")
+
+// A persistent index of the changes in each channel, stored in a bucket as blocks of sequences.
+// The changeCache adds every change it receives to it, so channel caches can backfill from the
+// index instead of querying the 'channels' view. This object is thread-safe.
+type ChannelIndex struct {
+	bucket         base.Bucket                     // Bucket the index is stored in; may be the database's own bucket
+	context        *DatabaseContext                // Database being indexed; set by open()
+	pending        map[string][]*channelIndexEntry // Entries not written yet, by channel
+	writing        map[string][]*channelIndexEntry // Entries being written by flush(), by channel
+	lock           sync.Mutex                      // Protects 'pending', 'writing' and 'lastCheckpoint'
+	writeLock      sync.Mutex                      // Held while writing to or clearing the index
+	lastCheckpoint time.Time                       // When the root doc's checkpoint was last updated
+	wakeup         chan struct{}                   // Wakes up the writer goroutine
+	terminator     chan struct{}                   // Closed to stop the writer goroutine
+	writerDone     sync.WaitGroup                  // Tracks the writer goroutine
+}
+
+// JSON structure of a channel index block doc
+type channelIndexBlock struct {
+	Entries []*channelIndexEntry `json:"entries"` // Sorted by sequence
+}
+
+// One change in a channel index block
+type channelIndexEntry struct {
+	Sequence uint64     `json:"seq"`
+	DocID    string     `json:"id"`
+	RevID    string     `json:"rev"`
+	Flags    uint8      `json:"flags,omitempty"`
+	Expiry   *time.Time `json:"exp,omitempty"`
+	Purged   bool       `json:"purged,omitempty"` // Tombstone: the doc was purged, so hide it
+}
+
+// Sorts entries by sequence
+type channelIndexEntries []*channelIndexEntry
+
+func (e channelIndexEntries) Len() int           { return len(e) }
+func (e channelIndexEntries) Less(i, j int) bool { return e[i].Sequence < e[j].Sequence }
+func (e channelIndexEntries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// JSON structure of a channel index head doc
+type channelIndexHead struct {
+	Ranges [][2]uint64 `json:"ranges"` // Sorted ranges of block numbers [first, last]; not every block in one has to exist
+}
+
+// JSON structure of the channel index root doc
+type channelIndexRoot struct {
+	Channels   []string `json:"channels"`
+	ValidFrom  *uint64  `json:"valid_from,omitempty"` // Index has every change from here on; nil if incomplete
+	Checkpoint uint64   `json:"checkpoint,omitempty"` // Every change up to here has been written
+}
+
+// Creates a ChannelIndex stored in the given bucket.
+func NewChannelIndex(bucket base.Bucket) *ChannelIndex {
+	return &ChannelIndex{
+		bucket:     bucket,
+		pending:    map[string][]*channelIndexEntry{},
+		wakeup:     make(chan struct{}, 1),
+		terminator: make(chan struct{}),
+	}
+}
+
+// Called when the database opens, before the feed starts; firstSeq is the first sequence the
+// feed will deliver. If the index is new, it only covers changes from firstSeq on; earlier ones
+// are read from the view until the index is rebuilt. If it exists but its checkpoint is before
+// firstSeq, nodes may have stopped before writing all their changes to it, or the database may
+// have been used without the index for a while, so the changes since the checkpoint are indexed.
+func (index *ChannelIndex) open(context *DatabaseContext, firstSeq uint64) error {
+	index.context = context
+	var root channelIndexRoot
+	created := false
+	err := index.bucket.Update(kChannelIndexRootKey, 0, func(currentValue []byte) ([]byte, error) {
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &root); err != nil {
+				return nil, err
+			}
+			return nil, couchbase.UpdateCancel
+		}
+		created = true
+		return json.Marshal(channelIndexRoot{Channels: []string{}, ValidFrom: &firstSeq, Checkpoint: firstSeq - 1})
+	})
+	if err != nil && err != couchbase.UpdateCancel {
+		return err
+	}
+	if !created && root.ValidFrom != nil && root.Checkpoint+1 < firstSeq {
+		if err := index.catchUp(root.Checkpoint+1, firstSeq-1); err != nil {
+			return err
+		}
+	}
+	index.writerDone.Add(1)
+	go index.runWriter()
+	return nil
+}
+
+// Indexes the current state of the docs whose sequences are between fromSeq and toSeq, which
+// are found with the 'channels' view's "*" channel. If that isn't available, the index is marked
+// incomplete instead, until it's rebuilt.
+func (index *ChannelIndex) catchUp(fromSeq, toSeq uint64) error {
+	if !EnableStarChannelLog {
+		base.Warn("ChannelIndex: Index of %q is missing sequences #%d-#%d; it must be rebuilt",
+			index.context.Name, fromSeq, toSeq)
+		return index.setValidFrom(nil)
+	}
+	base.Logf("ChannelIndex: Indexing sequences #%d-#%d of %q, which the index is missing",
+		fromSeq, toSeq, index.context.Name)
+	opts := Body{"stale": false, "startkey": []interface{}{channels.UserStarChannel, fromSeq},
+		"endkey": []interface{}{channels.UserStarChannel, toSeq}}
+	var vres channelsViewResult
+	if err := index.context.Bucket.ViewCustom(DesignDocSyncGateway, ViewChannels, opts, &vres); err != nil {
+		return err
+	}
+	for _, row := range vres.Rows {
+		doc, err := index.context.GetDoc(row.ID)
+		if err != nil {
+			if !base.IsDocNotFoundError(err) {
+				base.Warn("ChannelIndex: Error reading doc %q: %v", row.ID, err)
+			}
+			continue
+		}
+		index.addDocument(doc)
+	}
+	if !index.flush() {
+		return fmt.Errorf("Couldn't write channel index of %q", index.context.Name)
+	}
+	return index.checkpoint(toSeq, true)
+}
+
+// Stops the writer goroutine after it writes the remaining entries, and updates the checkpoint.
+func (index *ChannelIndex) stop() {
+	close(index.terminator)
+	index.writerDone.Wait()
+	if index.context != nil {
+		if err := index.checkpoint(index.processedThrough(), true); err != nil {
+			base.Warn("ChannelIndex: Couldn't update checkpoint: %v", err)
+		}
+	}
+}
+
+func channelIndexHeadKey(channelName string) string {
+	return kChannelIndexKeyPrefix + channelName
+}
+
+func channelIndexBlockKey(channelName string, block uint64) string {
+	return fmt.Sprintf("%s%s:%d", kChannelIndexKeyPrefix, channelName, block)
+}
+
+// Adds a block number to the ranges; returns false if it's already in one. If there are then
+// too many ranges, the two closest ones are merged.
+func (head *channelIndexHead) addBlock(blockNum uint64) bool {
+	ranges := head.Ranges
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i][1]+1 >= blockNum })
+	if i < len(ranges) && ranges[i][0] <= blockNum && blockNum <= ranges[i][1] {
+		return false
+	} else if i < len(ranges) && ranges[i][1]+1 == blockNum {
+		ranges[i][1] = blockNum
+		if i+1 < len(ranges) && ranges[i+1][0] == blockNum+1 {
+			ranges[i][1] = ranges[i+1][1]
+			ranges = append(ranges[:i+1], ranges[i+2:]...)
+		}
+	} else if i < len(ranges) && ranges[i][0] == blockNum+1 {
+		ranges[i][0] = blockNum
+	} else {
+		ranges = append(ranges, [2]uint64{})
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = [2]uint64{blockNum, blockNum}
+	}
+	if len(ranges) > kChannelIndexMaxBlockRanges {
+		closest := 0
+		for j := 1; j < len(ranges)-1; j++ {
+			if ranges[j+1][0]-ranges[j][1] < ranges[closest+1][0]-ranges[closest][1] {
+				closest = j
+			}
+		}
+		ranges[closest][1] = ranges[closest+1][1]
+		ranges = append(ranges[:closest+1], ranges[closest+2:]...)
+	}
+	head.Ranges = ranges
+	return true
+}
+
+//////// WRITING:
+
+// Adds a change received from the feed to the index of each channel the changeCache would add
+// it to. Must be called before the changeCache processes the entry, which frees its Channels.
+func (index *ChannelIndex) AddChange(change *LogEntry) {
+	if change.DocID == "" {
+		return // this is a placeholder for an unused sequence
+	}
+	for channelName, removal := range change.Channels {
+		if removal == nil || removal.Seq == change.Sequence {
+			entry := newChannelIndexEntry(change)
+			if removal != nil {
+				entry.Flags |= channels.Removed
+			}
+			index.queueEntry(channelName, entry)
+		}
+	}
+	if EnableStarChannelLog {
+		index.queueEntry(channels.UserStarChannel, newChannelIndexEntry(change))
+	}
+}
+
+func newChannelIndexEntry(change *LogEntry) *channelIndexEntry {
+	entry := &channelIndexEntry{
+		Sequence: change.Sequence,
+		DocID:    change.DocID,
+		RevID:    change.RevID,
+		Flags:    change.Flags,
+	}
+	if !change.Expiry.IsZero() {
+		expiry := change.Expiry
+		entry.Expiry = &expiry
+	}
+	return entry
+}
+
+// Adds the entries a document's current sync data calls for, the same ones the 'channels'
+// view emits for it.
+func (index *ChannelIndex) addDocument(doc *document) {
+	for channelName, entry := range documentIndexEntries(doc) {
+		index.queueEntry(channelName, entry)
+	}
+}
+
+// Replaces a purged document's current entries with tombstones, which hide all of its entries
+// up to them, the same way a later entry of a doc supersedes its earlier ones.
+func (index *ChannelIndex) removeDocument(doc *document) {
+	for channelName, entry := range documentIndexEntries(doc) {
+		entry.Purged = true
+		index.queueEntry(channelName, entry)
+	}
+}
+
+// Returns the entries a document's current sync data calls for, by channel.
+func documentIndexEntries(doc *document) map[string]*channelIndexEntry {
+	entries := make(map[string]*channelIndexEntry, len(doc.Channels)+1)
+	newEntry := func() *channelIndexEntry {
+		return &channelIndexEntry{
+			Sequence: doc.Sequence,
+			DocID:    doc.ID,
+			RevID:    doc.CurrentRev,
+			Flags:    doc.Flags,
+			Expiry:   doc.Expiry,
+		}
+	}
+	if EnableStarChannelLog {
+		entries[channels.UserStarChannel] = newEntry()
+	}
+	for channelName, removal := range doc.Channels {
+		if removal == nil {
+			entries[channelName] = newEntry()
+		} else {
+			flags := uint8(channels.Removed)
+			if removal.Deleted {
+				flags |= channels.Deleted
+			}
+			entries[channelName] = &channelIndexEntry{
+				Sequence: removal.Seq,
+				DocID:    doc.ID,
+				RevID:    removal.RevID,
+				Flags:    flags,
+			}
+		}
+	}
+	return entries
+}
+
+// Queues an entry to be written to its channel's index by the writer goroutine, so the feed
+// doesn't wait for the writes.
+func (index *ChannelIndex) queueEntry(channelName string, entry *channelIndexEntry) {
+	index.lock.Lock()
+	index.pending[channelName] = append(index.pending[channelName], entry)
+	index.lock.Unlock()
+	select {
+	case index.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (index *ChannelIndex) runWriter() {
+	defer index.writerDone.Done()
+	for {
+		select {
+		case <-index.wakeup:
+			index.flush()
+		case <-index.terminator:
+			index.flush()
+			return
+		}
+	}
+}
+
+// Returns the sequence up to which the database's changeCache has received every change, so
+// they've all been queued.
+func (index *ChannelIndex) processedThrough() uint64 {
+	if next := index.context.changeCache.getNextSequence(); next > 0 {
+		return next - 1
+	}
+	return 0
+}
+
+// Writes all the queued entries, with one update per block. Entries queued while a flush is
+// running are written by the next one, as are any that failed to be written. Until they're
+// written, readers get them from memory. Returns false if any failed.
+func (index *ChannelIndex) flush() bool {
+	index.writeLock.Lock()
+	defer index.writeLock.Unlock()
+	through := index.processedThrough() // Everything up to here has been queued by now
+	index.lock.Lock()
+	pending := index.pending
+	if len(pending) == 0 {
+		index.lock.Unlock()
+		return true
+	}
+	index.pending = map[string][]*channelIndexEntry{}
+	index.writing = pending
+	index.lock.Unlock()
+
+	failed := map[string][]*channelIndexEntry{}
+	for channelName, entries := range pending {
+		blocks := map[uint64][]*channelIndexEntry{}
+		for _, entry := range entries {
+			blockNum := entry.Sequence / kChannelIndexBlockSize
+			blocks[blockNum] = append(blocks[blockNum], entry)
+		}
+		for blockNum, blockEntries := range blocks {
+			if !index.writeBlock(channelName, blockNum, blockEntries) {
+				failed[channelName] = append(failed[channelName], blockEntries...)
+			}
+		}
+	}
+
+	index.lock.Lock()
+	index.writing = nil
+	for channelName, entries := range failed {
+		index.pending[channelName] = append(entries, index.pending[channelName]...)
+	}
+	index.lock.Unlock()
+	if len(failed) > 0 {
+		return false
+	}
+	if err := index.checkpoint(through, false); err != nil {
+		base.Warn("ChannelIndex: Couldn't update checkpoint: %v", err)
+	}
+	return true
+}
+
+// Stores entries in a channel's block, replacing any existing entries with the same sequences,
+// except tombstones. The block is listed in the channel's head doc first, so readers never
+// miss it. Returns false if it failed.
+func (index *ChannelIndex) writeBlock(channelName string, blockNum uint64, newEntries []*channelIndexEntry) bool {
+	if err := index.registerBlock(channelName, blockNum); err != nil {
+		base.Warn("ChannelIndex: Couldn't add block %d of channel %q: %v", blockNum, channelName, err)
+		return false
+	}
+	err := index.bucket.Update(channelIndexBlockKey(channelName, blockNum), 0,
+		func(currentValue []byte) ([]byte, error) {
+			var block channelIndexBlock
+			if currentValue != nil {
+				if err := json.Unmarshal(currentValue, &block); err != nil {
+					return nil, err
+				}
+			}
+			entries := block.Entries
+			for _, entry := range newEntries {
+				i := sort.Search(len(entries), func(i int) bool {
+					return entries[i].Sequence >= entry.Sequence
+				})
+				if i < len(entries) && entries[i].Sequence == entry.Sequence {
+					// A sequence is never reused, so once it's purged, an entry for it arriving
+					// late from the feed is stale:
+					if !entries[i].Purged {
+						entries[i] = entry
+					}
+				} else {
+					entries = append(entries, nil)
+					copy(entries[i+1:], entries[i:])
+					entries[i] = entry
+				}
+			}
+			block.Entries = entries
+			return json.Marshal(block)
+		})
+	if err != nil {
+		base.Warn("ChannelIndex: Couldn't add %d entries to block %d of channel %q: %v",
+			len(newEntries), blockNum, channelName, err)
+		return false
+	}
+	changeCacheExpvars.Add("index_writes", 1)
+	return true
+}
+
+// Makes sure a block is listed in its channel's head doc, and if that's new, the channel in the
+// root doc. This always checks the head doc, since another node may have cleared the index.
+func (index *ChannelIndex) registerBlock(channelName string, blockNum uint64) error {
+	newChannel := false
+	err := index.bucket.Update(channelIndexHeadKey(channelName), 0, func(currentValue []byte) ([]byte, error) {
+		var head channelIndexHead
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &head); err != nil {
+				return nil, err
+			}
+		}
+		newChannel = currentValue == nil
+		if !head.addBlock(blockNum) {
+			return nil, couchbase.UpdateCancel
+		}
+		return json.Marshal(head)
+	})
+	if err != nil && err != couchbase.UpdateCancel {
+		return err
+	} else if !newChannel {
+		return nil
+	}
+
+	err = index.bucket.Update(kChannelIndexRootKey, 0, func(currentValue []byte) ([]byte, error) {
+		root := channelIndexRoot{Channels: []string{}}
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &root); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range root.Channels {
+			if name == channelName {
+				return nil, couchbase.UpdateCancel
+			}
+		}
+		root.Channels = append(root.Channels, channelName)
+		return json.Marshal(root)
+	})
+	if err != nil && err != couchbase.UpdateCancel {
+		return err
+	}
+	return nil
+}
+
+// Deletes the entire index, including entries that haven't been written yet. Until it's
+// rebuilt, GetChanges finds it incomplete.
+func (index *ChannelIndex) clear() error {
+	index.writeLock.Lock()
+	defer index.writeLock.Unlock()
+	index.lock.Lock()
+	index.pending = map[string][]*channelIndexEntry{}
+	index.lock.Unlock()
+	var root channelIndexRoot
+	if err := index.bucket.Get(kChannelIndexRootKey, &root); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	for _, channelName := range root.Channels {
+		var head channelIndexHead
+		if err := index.bucket.Get(channelIndexHeadKey(channelName), &head); err != nil {
+			if base.IsDocNotFoundError(err) {
+				continue
+			}
+			return err
+		}
+		for _, blockRange := range head.Ranges {
+			for blockNum := blockRange[0]; blockNum <= blockRange[1]; blockNum++ {
+				err := index.bucket.Delete(channelIndexBlockKey(channelName, blockNum))
+				if err != nil && !base.IsDocNotFoundError(err) {
+					return err
+				}
+			}
+		}
+		err := index.bucket.Delete(channelIndexHeadKey(channelName))
+		if err != nil && !base.IsDocNotFoundError(err) {
+			return err
+		}
+	}
+	if err := index.bucket.Delete(kChannelIndexRootKey); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// Marks the index as having every change from firstSeq on, or if it's nil, as incomplete.
+func (index *ChannelIndex) setValidFrom(firstSeq *uint64) error {
+	return index.updateRoot(func(root *channelIndexRoot) bool {
+		root.ValidFrom = firstSeq
+		return true
+	})
+}
+
+// Records in the root doc that every change up to 'through' has been written, unless it has a
+// later checkpoint. Unless 'force' is set, this is skipped if it was done recently.
+func (index *ChannelIndex) checkpoint(through uint64, force bool) error {
+	index.lock.Lock()
+	recent := time.Since(index.lastCheckpoint) < kChannelIndexCheckpointInterval
+	if force || !recent {
+		index.lastCheckpoint = time.Now()
+	}
+	index.lock.Unlock()
+	if recent && !force {
+		return nil
+	}
+	return index.updateRoot(func(root *channelIndexRoot) bool {
+		if root.Checkpoint >= through {
+			return false
+		}
+		root.Checkpoint = through
+		return true
+	})
+}
+
+// Updates the root doc with a function that returns false if it made no changes.
+func (index *ChannelIndex) updateRoot(fn func(root *channelIndexRoot) bool) error {
+	err := index.bucket.Update(kChannelIndexRootKey, 0, func(currentValue []byte) ([]byte, error) {
+		root := channelIndexRoot{Channels: []string{}}
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &root); err != nil {
+				return nil, err
+			}
+		}
+		if !fn(&root) {
+			return nil, couchbase.UpdateCancel
+		}
+		return json.Marshal(root)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return err
+}
+
+//////// READING:
+
+// Gets a range of sequences of a single channel as LogEntries, with the same results as
+// getChangesInChannelFromView: sequences after options.Since up to endSeq (or the end of the
+// channel if it's 0), only the latest entry of each document, and at most options.Limit of them.
+// Returns errChannelIndexIncomplete if the index doesn't have all the changes after options.Since.
+func (index *ChannelIndex) GetChanges(channelName string, endSeq uint64, options ChangesOptions) (LogEntries, error) {
+	start := time.Now()
+	startSeq := options.Since.SafeSequence() + 1
+	var root channelIndexRoot
+	if err := index.bucket.Get(kChannelIndexRootKey, &root); err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	} else if root.ValidFrom == nil || startSeq < *root.ValidFrom {
+		return nil, errChannelIndexIncomplete
+	}
+	// Entries that haven't been written yet come from memory. This has to be read before the
+	// blocks, since entries are removed from memory once they're written:
+	unwritten := index.unwrittenEntries(channelName, startSeq)
+
+	base.LogTo("Cache", "  Reading channel index of %q (start=#%d, end=#%d, limit=%d)", channelName, startSeq, endSeq, options.Limit)
+	var head channelIndexHead
+	if err := index.bucket.Get(channelIndexHeadKey(channelName), &head); err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+
+	// A doc's entry is superseded by any later entry of it, so without a limit, every block from
+	// startSeq on has to be read, even past endSeq. With a limit, reading stops once there are
+	// enough entries to return, checking against the docs whether they're still current.
+	var indexed []*channelIndexEntry
+	current := map[uint64]bool{}
+	var entries LogEntries
+	done := false
+	startBlock := startSeq / kChannelIndexBlockSize
+	for _, blockRange := range head.Ranges {
+		for blockNum := blockRange[0]; blockNum <= blockRange[1] && !done; blockNum++ {
+			if blockNum < startBlock {
+				continue
+			}
+			var block channelIndexBlock
+			if err := index.bucket.Get(channelIndexBlockKey(channelName, blockNum), &block); err != nil {
+				if base.IsDocNotFoundError(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, entry := range block.Entries {
+				if entry.Sequence >= startSeq {
+					indexed = append(indexed, entry)
+				}
+			}
+			if options.Limit > 0 {
+				var err error
+				beforeSeq := (blockNum + 1) * kChannelIndexBlockSize
+				entries, done, err = index.firstEntries(channelName, indexed, unwritten, endSeq, beforeSeq, options.Limit, current)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if done {
+			break
+		}
+	}
+	if !done {
+		entries = latestEntries(indexed, unwritten, endSeq, 0)
+		if options.Limit > 0 && len(entries) > options.Limit {
+			entries = entries[:options.Limit]
+		}
+	}
+
+	base.LogTo("Cache", "    Got %d entries from channel index of %q", len(entries), channelName)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		base.Logf("ChannelIndex: Reading %q took %v to return %d entries", channelName, elapsed, len(entries))
+	}
+	changeCacheExpvars.Add("index_queries", 1)
+	return entries, nil
+}
+
+// Returns a channel's queued and being-written entries from startSeq on, sorted by sequence.
+func (index *ChannelIndex) unwrittenEntries(channelName string, startSeq uint64) []*channelIndexEntry {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	var entries []*channelIndexEntry
+	for _, queued := range [][]*channelIndexEntry{index.writing[channelName], index.pending[channelName]} {
+		for _, entry := range queued {
+			if entry.Sequence >= startSeq {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	sort.Stable(channelIndexEntries(entries))
+	return entries
+}
+
+// Returns the first 'limit' of latestEntries before beforeSeq that are still current, and true;
+// or false if there aren't enough of them yet. 'current' caches which sequences are current.
+func (index *ChannelIndex) firstEntries(channelName string, indexed, unwritten []*channelIndexEntry,
+	endSeq, beforeSeq uint64, limit int, current map[uint64]bool) (LogEntries, bool, error) {
+	candidates := latestEntries(indexed, unwritten, endSeq, beforeSeq)
+	if len(candidates) < limit {
+		return nil, false, nil
+	}
+	entries := make(LogEntries, 0, limit)
+	for _, entry := range candidates {
+		isCurrent, checked := current[entry.Sequence]
+		if !checked {
+			var err error
+			if isCurrent, err = index.isCurrent(channelName, entry); err != nil {
+				return nil, false, err
+			}
+			current[entry.Sequence] = isCurrent
+		}
+		if isCurrent {
+			if entries = append(entries, entry); len(entries) == limit {
+				return entries, true, nil
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// Returns true if an entry is the one the 'channels' view would return for its doc, i.e. it
+// hasn't been superseded by a later change or a purge.
+func (index *ChannelIndex) isCurrent(channelName string, entry *LogEntry) (bool, error) {
+	data, err := index.context.Bucket.GetRaw(entry.DocID)
+	if base.IsDocNotFoundError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	doc, err := unmarshalDocumentSyncData(data, false)
+	if err != nil || !doc.hasValidSyncData() {
+		return false, nil
+	}
+	if channelName == channels.UserStarChannel {
+		return doc.Sequence == entry.Sequence, nil
+	}
+	removal, found := doc.Channels[channelName]
+	if !found {
+		return false, nil
+	} else if removal == nil {
+		return doc.Sequence == entry.Sequence, nil
+	}
+	return removal.Seq == entry.Sequence, nil
+}
+
+// Merges the entries read from blocks with the unwritten ones (which replace any with the same
+// sequences, unless those are tombstones), and returns the latest entry of each doc as
+// LogEntries, in sequence order. Entries after endSeq (if nonzero) supersede earlier ones but
+// aren't returned, and neither are entries at or after beforeSeq (if nonzero) or purged docs.
+func latestEntries(indexed, unwritten []*channelIndexEntry, endSeq, beforeSeq uint64) LogEntries {
+	all := make([]*channelIndexEntry, 0, len(indexed)+len(unwritten))
+	all = append(append(all, indexed...), unwritten...)
+	sort.Stable(channelIndexEntries(all))
+	purgedSeqs := map[uint64]bool{}
+	for _, entry := range all {
+		if entry.Purged {
+			purgedSeqs[entry.Sequence] = true
+		}
+	}
+
+	// Convert the latest entry of each doc to a LogEntry, working backwards:
+	seenDocs := map[string]bool{}
+	entries := make(LogEntries, 0, len(all))
+	for i := len(all) - 1; i >= 0; i-- {
+		entry := all[i]
+		if i+1 < len(all) && all[i+1].Sequence == entry.Sequence {
+			continue // replaced by an unwritten entry
+		} else if seenDocs[entry.DocID] {
+			continue
+		}
+		seenDocs[entry.DocID] = true
+		if purgedSeqs[entry.Sequence] || (endSeq > 0 && entry.Sequence > endSeq) || (beforeSeq > 0 && entry.Sequence >= beforeSeq) {
+			continue
+		}
+		logEntry := &LogEntry{
+			Sequence:     entry.Sequence,
+			DocID:        entry.DocID,
+			RevID:        entry.RevID,
+			Flags:        entry.Flags,
+			TimeReceived: time.Now(),
+		}
+		if entry.Expiry != nil {
+			logEntry.Expiry = *entry.Expiry
+		}
+		entries = append(entries, logEntry)
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+//////// REBUILDING:
+
+// Rebuilds the channel index from scratch out of the current documents. This is needed when
+// the index is first enabled on an existing database, and after a resync, which changes docs'
+// channels without giving them new sequences. Returns the number of documents indexed.
+func (db *Database) RebuildChannelIndex() (int, error) {
+	index := db.ChannelIndex
+	if index == nil {
+		return 0, fmt.Errorf("Database %q has no channel index", db.Name)
+	}
+	// Clear the index first, so changes that arrive while the docs are read are indexed too:
+	through := db.changeCache.LastSequence()
+	if err := index.clear(); err != nil {
+		return 0, err
+	}
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewImport,
+		Body{"stale": false, "reduce": false, "startkey": []interface{}{true}})
+	if err != nil {
+		return 0, err
+	}
+
+	base.Logf("Rebuilding channel index of %q from %d documents...", db.Name, len(vres.Rows))
+	docCount := 0
+	for _, row := range vres.Rows {
+		docid := row.Key.([]interface{})[1].(string)
+		doc, err := db.GetDoc(docid)
+		if err != nil {
+			if !base.IsDocNotFoundError(err) {
+				base.Warn("ChannelIndex: Error reading doc %q: %v", docid, err)
+			}
+			continue
+		}
+		index.addDocument(doc)
+		docCount++
+	}
+	if !index.flush() {
+		return docCount, fmt.Errorf("Couldn't write channel index of %q", db.Name)
+	}
+	var firstSeq uint64
+	if err := index.setValidFrom(&firstSeq); err != nil {
+		return docCount, err
+	} else if err := index.checkpoint(through, true); err != nil {
+		return docCount, err
+	}
+	base.Logf("Finished rebuilding channel index of %q: %d docs", db.Name, docCount)
+	return docCount, nil
+}
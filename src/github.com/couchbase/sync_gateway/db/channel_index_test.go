@@ -0,0 +1,224 @@
+package db
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// Each test gets its own index bucket, so it can't see another test's index.
+func setupTestDBWithChannelIndex(t *testing.T, bucketName string) *Database {
+	options := shortWaitCache()
+	options.ChannelIndex = NewChannelIndex(testIndexBucket(t, bucketName))
+	return setupTestDBWithCacheOptions(t, options)
+}
+
+func testIndexBucket(t *testing.T, bucketName string) base.Bucket {
+	indexBucket, err := base.GetBucket(base.BucketSpec{
+		Server:     kTestURL,
+		BucketName: bucketName})
+	assertNoError(t, err, "Couldn't open index bucket")
+	return indexBucket
+}
+
+func indexedSequences(t *testing.T, db *Database, channelName string, endSeq uint64, options ChangesOptions) []uint64 {
+	entries, err := db.ChannelIndex.GetChanges(channelName, endSeq, options)
+	assertNoError(t, err, "Couldn't read channel index")
+	sequences := []uint64{}
+	for _, entry := range entries {
+		sequences = append(sequences, entry.Sequence)
+	}
+	return sequences
+}
+
+func TestChannelIndex(t *testing.T) {
+	db := setupTestDBWithChannelIndex(t, "sync_gateway_index_tests")
+	defer tearDownTestDB(t, db)
+
+	WriteDirect(db, []string{"ABC", "NBC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 2)
+	WriteDirect(db, []string{"NBC"}, 3)
+	// Update doc-1, removing it from NBC:
+	db.Bucket.Set("doc-1", 0, Body{"key": "doc-1", "_sync": &syncData{
+		CurrentRev: "2-a",
+		Sequence:   4,
+		Channels: channels.ChannelMap{
+			"ABC": nil,
+			"NBC": &channels.ChannelRemoval{Seq: 4, RevID: "2-a"}},
+		TimeSaved: time.Now(),
+	}})
+	db.changeCache.waitForSequence(4)
+
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{}), []uint64{2, 4})
+	assert.DeepEquals(t, indexedSequences(t, db, "NBC", 0, ChangesOptions{}), []uint64{3, 4})
+	assert.DeepEquals(t, indexedSequences(t, db, "*", 0, ChangesOptions{}), []uint64{2, 3, 4})
+	assert.DeepEquals(t, indexedSequences(t, db, "CBS", 0, ChangesOptions{}), []uint64{})
+
+	// Superseded entries aren't returned even if the range ends before the newer entry:
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 3, ChangesOptions{}), []uint64{2})
+	assert.DeepEquals(t, indexedSequences(t, db, "*", 0, ChangesOptions{Since: SequenceID{Seq: 2}}), []uint64{3, 4})
+	assert.DeepEquals(t, indexedSequences(t, db, "*", 0, ChangesOptions{Limit: 2}), []uint64{2, 3})
+
+	entries, err := db.ChannelIndex.GetChanges("NBC", 0, ChangesOptions{})
+	assertNoError(t, err, "Couldn't read channel index")
+	assert.Equals(t, entries[1].DocID, "doc-1")
+	assert.Equals(t, entries[1].RevID, "2-a")
+	assert.Equals(t, entries[1].Flags, uint8(channels.Removed))
+
+	// A channel cache that doesn't go back far enough should backfill from the index:
+	queries := changeCacheExpvars.Get("index_queries").(*expvar.Int).Value()
+	cache := newChannelCache(db.DatabaseContext, "ABC", 5)
+	backfill, err := cache.GetChanges(ChangesOptions{Since: SequenceID{Seq: 0}})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(backfill), 2)
+	assert.Equals(t, backfill[0].DocID, "doc-2")
+	assert.Equals(t, backfill[1].DocID, "doc-1")
+	assert.True(t, changeCacheExpvars.Get("index_queries").(*expvar.Int).Value() > queries)
+
+	// An index created after these changes doesn't cover them, so they're read from the view:
+	index := db.ChannelIndex
+	db.ChannelIndex = NewChannelIndex(testIndexBucket(t, "sync_gateway_index_tests_new"))
+	assertNoError(t, db.ChannelIndex.open(db.DatabaseContext, 5), "Couldn't open channel index")
+	defer func() {
+		db.ChannelIndex.stop()
+		db.ChannelIndex.bucket.Close()
+		db.ChannelIndex = index
+	}()
+	_, err = db.ChannelIndex.GetChanges("ABC", 0, ChangesOptions{})
+	assert.Equals(t, err, errChannelIndexIncomplete)
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{Since: SequenceID{Seq: 4}}), []uint64{})
+	fromStorage, err := db.getChangesInChannelFromStorage("ABC", 0, ChangesOptions{})
+	assertNoError(t, err, "Couldn't get changes from storage")
+	assert.Equals(t, len(fromStorage), 2)
+}
+
+func TestChannelIndexCatchUp(t *testing.T) {
+	db := setupTestDBWithChannelIndex(t, "sync_gateway_index_tests_catchup")
+	defer tearDownTestDB(t, db)
+
+	WriteDirect(db, []string{"ABC", "NBC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 2)
+	db.changeCache.waitForSequence(2)
+
+	// An index whose checkpoint is behind, as if its node stopped before writing these changes,
+	// indexes them when it's opened:
+	index := NewChannelIndex(testIndexBucket(t, "sync_gateway_index_tests_behind"))
+	defer index.bucket.Close()
+	var firstSeq uint64
+	assertNoError(t, index.setValidFrom(&firstSeq), "Couldn't set up channel index")
+	assertNoError(t, index.open(db.DatabaseContext, 3), "Couldn't open channel index")
+	entries, err := index.GetChanges("ABC", 0, ChangesOptions{})
+	assertNoError(t, err, "Couldn't read channel index")
+	assert.Equals(t, len(entries), 2)
+	entries, err = index.GetChanges("NBC", 0, ChangesOptions{})
+	assertNoError(t, err, "Couldn't read channel index")
+	assert.Equals(t, len(entries), 1)
+
+	index.stop()
+	var root channelIndexRoot
+	assertNoError(t, index.bucket.Get(kChannelIndexRootKey, &root), "Couldn't read root doc")
+	assert.Equals(t, root.Checkpoint, uint64(2))
+}
+
+func TestChannelIndexPurge(t *testing.T) {
+	db := setupTestDBWithChannelIndex(t, "sync_gateway_index_tests_purge")
+	defer tearDownTestDB(t, db)
+
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 2)
+	db.changeCache.waitForSequence(2)
+	db.ChannelIndex.flush()
+
+	_, err := db.Purge("doc-1", []string{"*"})
+	assertNoError(t, err, "Couldn't purge doc")
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{}), []uint64{2})
+	assert.DeepEquals(t, indexedSequences(t, db, "*", 0, ChangesOptions{}), []uint64{2})
+	db.ChannelIndex.flush()
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{}), []uint64{2})
+
+	// An entry for the purged doc arriving late doesn't bring it back:
+	db.ChannelIndex.queueEntry("ABC", &channelIndexEntry{Sequence: 1, DocID: "doc-1", RevID: "1-a"})
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{}), []uint64{2})
+	db.ChannelIndex.flush()
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{}), []uint64{2})
+}
+
+func TestChannelIndexLimit(t *testing.T) {
+	db := setupTestDBWithChannelIndex(t, "sync_gateway_index_tests_limit")
+	defer tearDownTestDB(t, db)
+
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 2)
+	WriteDirect(db, []string{"ABC"}, kChannelIndexBlockSize+1)
+	// Update doc-1 in a later block:
+	lastSeq := uint64(2*kChannelIndexBlockSize + 1)
+	db.Bucket.Set("doc-1", 0, Body{"key": "doc-1", "_sync": &syncData{
+		CurrentRev: "2-a",
+		Sequence:   lastSeq,
+		Channels:   channels.ChannelMap{"ABC": nil},
+		TimeSaved:  time.Now(),
+	}})
+	db.changeCache.waitForSequence(lastSeq)
+	db.ChannelIndex.flush()
+
+	// Corrupt the last block; reads that stop at the limit never get to it:
+	err := db.ChannelIndex.bucket.SetRaw(channelIndexBlockKey("ABC", 2), 0, []byte("{"))
+	assertNoError(t, err, "Couldn't write block")
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{Limit: 1}), []uint64{2})
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{Limit: 2}),
+		[]uint64{2, kChannelIndexBlockSize + 1})
+	_, err = db.ChannelIndex.GetChanges("ABC", 0, ChangesOptions{Limit: 3})
+	assert.True(t, err != nil)
+}
+
+func TestChannelIndexHeadRanges(t *testing.T) {
+	var head channelIndexHead
+	for _, blockNum := range []uint64{5, 0, 1, 3, 7, 2} {
+		assert.True(t, head.addBlock(blockNum))
+	}
+	assert.False(t, head.addBlock(2))
+	assert.DeepEquals(t, head.Ranges, [][2]uint64{{0, 3}, {5, 5}, {7, 7}})
+
+	// The head doc stays small however many ranges the blocks are spread over:
+	head = channelIndexHead{}
+	for i := uint64(0); i < 2*kChannelIndexMaxBlockRanges; i++ {
+		head.addBlock(10 * i)
+	}
+	head.addBlock(10*kChannelIndexMaxBlockRanges + 1)
+	assert.Equals(t, len(head.Ranges), kChannelIndexMaxBlockRanges)
+	assert.Equals(t, head.Ranges[0][0], uint64(0))
+	assert.Equals(t, head.Ranges[len(head.Ranges)-1][1], uint64(10*(2*kChannelIndexMaxBlockRanges-1)))
+	assert.False(t, head.addBlock(10*kChannelIndexMaxBlockRanges+1))
+}
+
+func TestRebuildChannelIndex(t *testing.T) {
+	db := setupTestDBWithChannelIndex(t, "sync_gateway_index_tests_rebuild")
+	defer tearDownTestDB(t, db)
+
+	WriteDirect(db, []string{"ABC", "NBC"}, 1)
+	WriteDirect(db, []string{"ABC"}, 2)
+	db.changeCache.waitForSequence(2)
+
+	// Add a bogus entry, which the rebuild should get rid of:
+	db.ChannelIndex.queueEntry("PBS", &channelIndexEntry{Sequence: 2, DocID: "doc-2", RevID: "1-a"})
+	assert.DeepEquals(t, indexedSequences(t, db, "PBS", 0, ChangesOptions{}), []uint64{2})
+
+	count, err := db.RebuildChannelIndex()
+	assertNoError(t, err, "RebuildChannelIndex failed")
+	assert.True(t, count >= 2)
+	assert.DeepEquals(t, indexedSequences(t, db, "PBS", 0, ChangesOptions{}), []uint64{})
+	assert.DeepEquals(t, indexedSequences(t, db, "ABC", 0, ChangesOptions{}), []uint64{1, 2})
+	assert.DeepEquals(t, indexedSequences(t, db, "NBC", 0, ChangesOptions{}), []uint64{1})
+
+	// A database without an index can't rebuild one:
+	index := db.ChannelIndex
+	db.ChannelIndex = nil
+	_, err = db.RebuildChannelIndex()
+	assert.True(t, err != nil)
+	db.ChannelIndex = index
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Outcomes of a conflict resolution, as reported by ConflictResolvedEvent
+const (
+	ConflictPicked = "picked" // One of the conflicting revisions was kept, the others were deleted
+	ConflictMerged = "merged" // A merged (or modified) revision was added, the other branches were deleted
+)
+
+// A thread-safe wrapper around the JavaScript conflict resolver function from the database
+// config. The function is called as resolve(conflicts), where conflicts is an array of the
+// conflicting revision bodies (the current winning revision first). It returns one of them to
+// keep it, a new body to merge them, or null/undefined to leave the conflict alone.
+type ConflictResolver struct {
+	*sgbucket.JSServer
+}
+
+func NewConflictResolver(fnSource string, modules *channels.JSModules) *ConflictResolver {
+	return &ConflictResolver{
+		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return newJsEventTask(fnSource, modules)
+			}),
+	}
+}
+
+// Calls the resolver function on a set of conflicting revisions. Returns nil if the function
+// didn't resolve the conflict.
+func (resolver *ConflictResolver) Resolve(conflicts []Body) (Body, error) {
+	conflictsJSON, err := json.Marshal(conflicts)
+	if err != nil {
+		return nil, err
+	}
+	result, err := resolver.Call(sgbucket.JSONString(conflictsJSON))
+	if err != nil {
+		return nil, err
+	}
+	switch result := result.(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return Body(result), nil
+	default:
+		return nil, fmt.Errorf("Conflict resolver returned %T; expected an object or null", result)
+	}
+}
+
+// Runs the database's conflict resolver on a document that has just gone into conflict.
+// The resolution is saved as regular new revisions (a merged revision and/or tombstones of the
+// losing branches) so that it replicates like any other change. They're all added in one update.
+func (db *Database) resolveConflicts(docid string) {
+	// Resolution isn't limited by the access of the user whose update caused the conflict:
+	resolverDB, _ := CreateDatabase(db.DatabaseContext)
+	doc, err := resolverDB.GetDoc(docid)
+	if err != nil {
+		base.Warn("Conflict resolver: couldn't load doc %q: %v", docid, err)
+		return
+	}
+
+	// Collect the conflicting (non-deleted) leaf revisions, with the current winner first:
+	leaves := []string{doc.CurrentRev}
+	doc.History.forEachLeaf(func(rev *RevInfo) {
+		if rev.ID != doc.CurrentRev && !rev.Deleted {
+			leaves = append(leaves, rev.ID)
+		}
+	})
+	if len(leaves) < 2 {
+		return
+	}
+	conflicts := make([]Body, 0, len(leaves))
+	for _, revid := range leaves {
+		body, err := resolverDB.getRevFromDoc(doc, revid, false)
+		if err != nil {
+			base.Warn("Conflict resolver: couldn't load %q / %q: %v", docid, revid, err)
+			return
+		}
+		body["_id"] = docid
+		body["_rev"] = revid
+		conflicts = append(conflicts, body)
+	}
+
+	resolved, err := db.ConflictResolver.Resolve(conflicts)
+	if err != nil {
+		base.Warn("Conflict resolver failed on doc %q: %v", docid, err)
+		return
+	} else if resolved == nil {
+		base.LogTo("CRUD", "Conflict resolver left doc %q in conflict", docid)
+		return
+	}
+
+	// If the function returned one of the conflicting revisions unchanged, keep that one;
+	// otherwise the result is a merged body to add as a child of the revision it names (or of
+	// the current revision):
+	outcome := ConflictMerged
+	keepRev := doc.CurrentRev
+	if revid, ok := resolved["_rev"].(string); ok {
+		for i, leaf := range leaves {
+			if leaf == revid {
+				keepRev = revid
+				if sameRevisionBody(resolved, conflicts[i]) {
+					outcome = ConflictPicked
+				}
+				break
+			}
+		}
+	}
+
+	// Add the merged revision (if any) and tombstone the other branches in a single update, so
+	// the doc is never left half-resolved:
+	var tombstones []string
+	winningRev := keepRev
+	newRev, err := resolverDB.updateDoc(docid, false, nil, func(doc *document) (Body, error) {
+		// (Be careful: this block can be invoked multiple times if there are races!)
+		for _, revid := range leaves {
+			if !doc.History.isLeaf(revid) || doc.History[revid].Deleted {
+				return nil, base.HTTPErrorf(http.StatusConflict, "Document changed during conflict resolution")
+			}
+		}
+		var newBody Body
+		tombstones = make([]string, 0, len(leaves)-1)
+		for _, revid := range leaves {
+			if revid == keepRev {
+				continue
+			}
+			generation, _ := parseRevID(revid)
+			tombstone := Body{"_deleted": true}
+			tombstoneRev := createRevID(generation+1, revid, tombstone)
+			tombstone["_rev"] = tombstoneRev
+			doc.History.addRevision(RevInfo{ID: tombstoneRev, Parent: revid, Deleted: true})
+			doc.setRevision(tombstoneRev, tombstone)
+			tombstones = append(tombstones, tombstoneRev)
+			newBody = tombstone
+		}
+		if outcome == ConflictMerged {
+			merged := stripSpecialProperties(resolved)
+			deleted, _ := merged["_deleted"].(bool)
+			generation, _ := parseRevID(keepRev)
+			if err := resolverDB.storeAttachments(doc, merged, generation+1, keepRev); err != nil {
+				return nil, err
+			}
+			mergedRev := createRevID(generation+1, keepRev, merged)
+			merged["_rev"] = mergedRev
+			doc.History.addRevision(RevInfo{ID: mergedRev, Parent: keepRev, Deleted: deleted})
+			newBody = merged
+		}
+		// updateDoc stores, and runs the sync function on, the body returned here: the merged
+		// revision, or else the last tombstone. The others were stored above.
+		return newBody, nil
+	})
+	if err != nil {
+		base.Warn("Conflict resolver: couldn't save resolution of %q: %v", docid, err)
+		return
+	} else if outcome == ConflictMerged {
+		winningRev = newRev
+	}
+	base.LogTo("CRUD", "Conflict resolver %s doc %q: winning rev %q, deleted %v",
+		outcome, docid, winningRev, tombstones)
+
+	if db.EventMgr.HasHandlerForEvent(ConflictResolved) {
+		body, err := resolverDB.GetRev(docid, winningRev, false, nil)
+		if err != nil {
+			base.Warn("Conflict resolver: couldn't load %q / %q: %v", docid, winningRev, err)
+			return
+		}
+		db.EventMgr.RaiseConflictResolvedEvent(body, outcome, leaves, tombstones)
+	}
+}
+
+// Returns true if a resolver's result has the same contents as the revision it was given.
+func sameRevisionBody(result, original Body) bool {
+	resultJSON, _ := json.Marshal(stripSpecialProperties(result))
+	originalJSON, _ := json.Marshal(stripSpecialProperties(original))
+	return bytes.Equal(resultJSON, originalJSON)
+}
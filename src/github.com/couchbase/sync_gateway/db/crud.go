@@ -11,6 +11,7 @@ package db
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 	"time"
@@ -45,6 +46,7 @@ func (db *DatabaseContext) GetDoc(docid string) (*document, error) {
 		return nil, base.HTTPErrorf(400, "Invalid doc ID")
 	}
 	dbExpvars.Add("document_gets", 1)
+	db.DbStats.Add("document_gets", 1)
 	doc := newDocument(docid)
 	err := db.Bucket.Get(key, doc)
 	if err != nil {
@@ -63,12 +65,19 @@ func (context *DatabaseContext) revCacheLoader(id IDAndRev) (body Body, history
 		return
 	}
 
+	if doc.isExpired() {
+		err = base.HTTPErrorf(404, "expired")
+		return
+	}
 	if body, err = context.getRevision(doc, id.RevID); err != nil {
 		return
 	}
 	if doc.History[id.RevID].Deleted {
 		body["_deleted"] = true
 	}
+	if doc.Expiry != nil {
+		body["_exp"] = *doc.Expiry // the cache stops returning the revision after this
+	}
 	history = encodeRevisions(doc.History.getHistory(id.RevID))
 	channels = doc.History[id.RevID].Channels
 	return
@@ -102,6 +111,8 @@ func (db *Database) GetRev(docid, revid string, listRevisions bool, attachmentsS
 		// No rev ID given, so load doc and get its current revision:
 		if doc, err = db.GetDoc(docid); doc == nil {
 			return nil, err
+		} else if doc.isExpired() {
+			return nil, base.HTTPErrorf(404, "expired")
 		}
 		revid = doc.CurrentRev
 		if body, err = db.getRevision(doc, revid); err != nil {
@@ -343,6 +354,57 @@ func (db *Database) backupAncestorRevs(doc *document, revid string) error {
 
 //////// UPDATING DOCUMENTS:
 
+// Expiry values larger than this (30 days, in seconds) are absolute Unix times rather than
+// relative ones; this is the same convention Couchbase Server uses.
+const kMaxRelativeExpiry = 30 * 24 * 60 * 60
+
+// Interprets the "_exp" property of a document body, which can be a number of seconds from now,
+// an absolute Unix time, or an ISO-8601 date string. Returns nil if the body has no "_exp",
+// meaning the doc keeps its current expiry, or a zero time if it's null or 0, meaning the doc's
+// expiry is cleared.
+func parseExpiry(body Body) (*time.Time, error) {
+	var expiry time.Time
+	value, found := body["_exp"]
+	if !found {
+		return nil, nil
+	} else if value == nil {
+		return &expiry, nil
+	} else if str, ok := value.(string); ok {
+		var err error
+		if expiry, err = time.Parse(time.RFC3339, str); err != nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid _exp date %q", str)
+		}
+	} else if secs, ok := base.ToInt64(value); ok && secs >= 0 {
+		if secs == 0 {
+			return &expiry, nil
+		} else if secs <= kMaxRelativeExpiry {
+			expiry = time.Now().Add(time.Duration(secs) * time.Second)
+		} else {
+			expiry = time.Unix(secs, 0)
+		}
+	} else {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid _exp value")
+	}
+	// Whole seconds in UTC, so the stored times sort in the doc_expiry view:
+	expiry = expiry.UTC().Truncate(time.Second)
+	return &expiry, nil
+}
+
+// Bucket items are given a TTL this long after their doc's expiry, so the expiry sweep can write
+// a tombstone revision (which the _changes feed shows) before the bucket purges the doc.
+const kExpiryPurgeDelay = time.Hour
+
+// Returns the TTL to give the bucket item of a doc with the given expiry.
+func expiryTTL(expiry *time.Time) int {
+	if expiry == nil || expiry.IsZero() {
+		return 0
+	}
+	return int(expiry.Add(kExpiryPurgeDelay).Unix())
+}
+
+// Returned by updateDoc's write callback to retry the write with a different TTL.
+var errExpiryChanged = errors.New("expiry changed")
+
 // Initializes the gateway-specific "_sync_" metadata of a new document.
 // Used when importing an existing Couchbase doc that hasn't been seen by the gateway before.
 func (db *Database) initializeSyncData(doc *document) (err error) {
@@ -367,8 +429,13 @@ func (db *Database) Put(docid string, body Body) (string, error) {
 	}
 	generation++
 	deleted, _ := body["_deleted"].(bool)
+	expiry, err := parseExpiry(body)
+	if err != nil {
+		return "", err
+	}
+	delete(body, "_exp")
 
-	return db.updateDoc(docid, false, func(doc *document) (Body, error) {
+	return db.updateDoc(docid, false, expiry, func(doc *document) (Body, error) {
 		// (Be careful: this block can be invoked multiple times if there are races!)
 		// First, make sure matchRev matches an existing leaf revision:
 		if matchRev == "" {
@@ -409,7 +476,13 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid revision ID")
 	}
 	deleted, _ := body["_deleted"].(bool)
-	_, err := db.updateDoc(docid, false, func(doc *document) (Body, error) {
+	expiry, err := parseExpiry(body)
+	if err != nil {
+		return err
+	}
+	delete(body, "_exp")
+
+	_, err = db.updateDoc(docid, false, expiry, func(doc *document) (Body, error) {
 		// (Be careful: this block can be invoked multiple times if there are races!)
 		// Find the point where this doc's history branches from the current rev:
 		currentRevIndex := len(docHistory)
@@ -448,7 +521,9 @@ func (db *Database) PutExistingRev(docid string, body Body, docHistory []string)
 
 // Common subroutine of Put and PutExistingRev: a shell that loads the document, lets the caller
 // make changes to it in a callback and supply a new body, then saves the body and document.
-func (db *Database) updateDoc(docid string, allowImport bool, callback func(*document) (Body, error)) (string, error) {
+// A non-nil expiry replaces the doc's expiry (a zero time clears it); nil keeps the current one.
+// The expiry is stored in the sync metadata, and determines the bucket item's TTL.
+func (db *Database) updateDoc(docid string, allowImport bool, expiry *time.Time, callback func(*document) (Body, error)) (string, error) {
 	key := realDocID(docid)
 	if key == "" {
 		return "", base.HTTPErrorf(400, "Invalid doc ID")
@@ -461,14 +536,26 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	var changedPrincipals, changedRoleUsers []string
 	var docSequence uint64
 	var unusedSequences []uint64
+	var newConflict bool
 
-	err := db.Bucket.WriteUpdate(key, 0, func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, err error) {
+	// The TTL has to be given before the doc is read; if the doc turns out to have an expiry
+	// that this update keeps, the write is retried with the TTL for that.
+	exp := expiryTTL(expiry)
+	writeFunc := func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, err error) {
 		// Be careful: this block can be invoked multiple times if there are races!
 		if doc, err = unmarshalDocument(docid, currentValue); err != nil {
 			return
 		} else if !allowImport && currentValue != nil && !doc.hasValidSyncData() {
 			err = base.HTTPErrorf(409, "Not imported")
 			return
+		} else if doc.isExpired() && !db.keepExpired {
+			// The bucket hasn't purged the expired doc yet, but treat it as though it had:
+			doc = newDocument(docid)
+		}
+		if ttl := expiryTTL(doc.Expiry); expiry == nil && ttl != exp {
+			exp = ttl
+			err = errExpiryChanged
+			return
 		}
 
 		// Invoke the callback to update the document and return a new revision body:
@@ -487,8 +574,10 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 		newRevID = body["_rev"].(string)
 		parentRevID = doc.History[newRevID].Parent
 		prevCurrentRev := doc.CurrentRev
+		wasInConflict := doc.hasFlag(channels.Conflict)
 		var branched, inConflict bool
 		doc.CurrentRev, branched, inConflict = doc.History.winningRevision()
+		newConflict = inConflict && !wasInConflict
 		doc.setFlag(channels.Deleted, doc.History[doc.CurrentRev].Deleted)
 		doc.setFlag(channels.Conflict, inConflict)
 		doc.setFlag(channels.Branched, branched)
@@ -516,12 +605,21 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			}
 		}
 
+		// Check the new revision against the database's JSON schemas:
+		if err = db.Schemas.Validate(docid, body); err != nil {
+			return
+		}
+
 		// Run the sync function, to validate the update and compute its channels/access:
 		body["_id"] = doc.ID
-		channels, access, roles, err := db.getChannelsAndAccess(doc, body, newRevID)
+		channels, access, roles, accessExpiry, err := db.getChannelsAndAccess(doc, body, newRevID)
 		if err != nil {
 			return
 		}
+		if db.validateOnly {
+			err = errValidateOnly
+			return
+		}
 		if len(channels) > 0 {
 			doc.History[newRevID].Channels = channels
 		}
@@ -593,7 +691,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 				if curBody, err = db.getAvailableRev(doc, doc.CurrentRev); curBody != nil {
 					base.LogTo("CRUD+", "updateDoc(%q): Rev %q causes %q to become current again",
 						docid, newRevID, doc.CurrentRev)
-					channels, access, roles, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
+					channels, access, roles, accessExpiry, err = db.getChannelsAndAccess(doc, curBody, doc.CurrentRev)
 					if err != nil {
 						return
 					}
@@ -604,6 +702,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 					channels = nil
 					access = nil
 					roles = nil
+					accessExpiry = nil
 				}
 			}
 
@@ -612,6 +711,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			changedChannels = doc.updateChannels(channels) //FIX: Incorrect if new rev is not current!
 			changedPrincipals = doc.Access.updateAccess(doc, access)
 			changedRoleUsers = doc.RoleAccess.updateAccess(doc, roles)
+			changedPrincipals, changedRoleUsers = doc.updateAccessExpiry(accessExpiry, changedPrincipals, changedRoleUsers)
 
 			if len(changedPrincipals) > 0 || len(changedRoleUsers) > 0 {
 				if cbb, ok := db.Bucket.(base.CouchbaseBucket); ok { //Backing store is Couchbase Server
@@ -641,13 +741,22 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 			base.LogTo("CRUD+", "updateDoc(%q): Pruned %d old revisions", docid, pruned)
 		}
 
+		if expiry != nil && expiry.IsZero() {
+			doc.Expiry = nil
+		} else if expiry != nil {
+			doc.Expiry = expiry
+		}
 		doc.TimeSaved = time.Now()
 
 		// Return the new raw document value for the bucket to store.
 		raw, err = json.Marshal(doc)
 		base.LogTo("Cache", "SAVING #%d", doc.Sequence) //TEMP?
 		return
-	})
+	}
+	err := db.Bucket.WriteUpdate(key, exp, writeFunc)
+	for err == errExpiryChanged {
+		err = db.Bucket.WriteUpdate(key, exp, writeFunc)
+	}
 
 	if err == couchbase.UpdateCancel {
 		return "", nil
@@ -660,6 +769,8 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	}
 
 	dbExpvars.Add("revs_added", 1)
+	db.DbStats.Add("revs_added", 1)
+	db.DbStats.Add("document_writes", 1)
 
 	// Store the new revision in the cache
 	history := doc.History.getHistory(newRevID)
@@ -667,7 +778,12 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 		body["_deleted"] = true
 	}
 	revChannels := doc.History[newRevID].Channels
-	db.revisionCache.Put(body, encodeRevisions(history), revChannels)
+	cacheBody := body
+	if doc.Expiry != nil {
+		cacheBody = body.ShallowCopy()
+		cacheBody["_exp"] = *doc.Expiry
+	}
+	db.revisionCache.Put(cacheBody, encodeRevisions(history), revChannels)
 
 	// Raise event
 	if db.EventMgr.HasHandlerForEvent(DocumentChange) {
@@ -677,6 +793,11 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	// Now that the document has successfully been stored, we can make other db changes:
 	base.LogTo("CRUD", "Stored doc %q / %q", docid, newRevID)
 
+	// Make sure the users/roles lose this document's temporary grants when they expire:
+	if len(changedPrincipals) > 0 || len(changedRoleUsers) > 0 {
+		db.scheduleAccessExpiry(doc.AccessExpiry)
+	}
+
 	// Mark affected users/roles as needing to recompute their channel access:
 	if len(changedPrincipals) > 0 {
 		base.LogTo("Access", "Rev %q/%q invalidates channels of %s", docid, newRevID, changedPrincipals)
@@ -697,7 +818,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 	if len(changedRoleUsers) > 0 {
 		base.LogTo("Access", "Rev %q/%q invalidates roles of %s", docid, newRevID, changedRoleUsers)
 		for _, name := range changedRoleUsers {
-			db.invalUserRoles(name)
+			db.invalUserOrRoleRoles(name)
 			//If this is the current in memory db.user, reload to generate updated roles
 			if db.user != nil && db.user.Name() == name {
 				user, err := db.Authenticator().GetUser(db.user.Name())
@@ -710,6 +831,11 @@ func (db *Database) updateDoc(docid string, allowImport bool, callback func(*doc
 		}
 	}
 
+	// If this update put the document into conflict, give the conflict resolver a chance to fix it:
+	if newConflict && db.ConflictResolver != nil {
+		db.resolveConflicts(docid)
+	}
+
 	return newRevID, nil
 }
 
@@ -742,7 +868,7 @@ func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 
 // Calls the JS sync function to assign the doc to channels, grant users
 // access to channels, and reject invalid documents.
-func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string) (result base.Set, access channels.AccessMap, roles channels.AccessMap, err error) {
+func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string) (result base.Set, access channels.AccessMap, roles channels.AccessMap, accessExpiry channels.ExpiryMap, err error) {
 	base.LogTo("CRUD+", "Invoking sync on doc %q rev %s", doc.ID, body["_rev"])
 
 	// Get the parent revision, to pass to the sync function:
@@ -762,6 +888,7 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 			if !doc.hasFlag(channels.Deleted) { // deleted docs can't grant access
 				access = output.Access
 				roles = output.Roles
+				accessExpiry = output.Expiry
 			}
 			err = output.Rejection
 			if err != nil {
@@ -770,6 +897,11 @@ func (db *Database) getChannelsAndAccess(doc *document, body Body, revID string)
 				err = base.HTTPErrorf(500, "Error in JS sync function")
 			}
 
+		} else if err == channels.ErrSyncFnTimeout {
+			base.Warn("Sync fn timed out on doc %q", doc.ID)
+			dbExpvars.Add("sync_function_timeouts", 1)
+			db.DbStats.Add("sync_function_timeouts", 1)
+			err = base.HTTPErrorf(500, "JS sync function timed out")
 		} else {
 			base.Warn("Sync fn exception: %+v; doc = %s", err, body)
 			err = base.HTTPErrorf(500, "Exception in JS sync function")
@@ -799,7 +931,7 @@ func makeUserCtx(user auth.User) map[string]interface{} {
 	}
 	return map[string]interface{}{
 		"name":     user.Name(),
-		"roles":    user.RoleNames(),
+		"roles":    user.InheritedRoles(),
 		"channels": user.InheritedChannels().AllChannels(),
 	}
 }
@@ -841,18 +973,12 @@ func (context *DatabaseContext) ComputeChannelsForPrincipal(princ auth.Principal
 		key = "role:" + key // Roles are identified in access view by a "role:" prefix
 	}
 
-	var vres struct {
-		Rows []struct {
-			Value channels.TimedSet
-		}
-	}
-
-	opts := map[string]interface{}{"stale": false, "key": key}
-	if verr := context.Bucket.ViewCustom(DesignDocSyncGateway, ViewAccess, opts, &vres); verr != nil {
+	rows, verr := context.queryAccessView(ViewAccess, key, "")
+	if verr != nil {
 		return nil, verr
 	}
 	channelSet := channels.TimedSet{}
-	for _, row := range vres.Rows {
+	for _, row := range rows {
 		channelSet.Add(row.Value)
 	}
 	return channelSet, nil
@@ -861,19 +987,25 @@ func (context *DatabaseContext) ComputeChannelsForPrincipal(princ auth.Principal
 // Recomputes the set of roles a User has been granted access to by sync() functions.
 // This is part of the ChannelComputer interface defined by the Authenticator.
 func (context *DatabaseContext) ComputeRolesForUser(user auth.User) (channels.TimedSet, error) {
-	var vres struct {
-		Rows []struct {
-			Value channels.TimedSet
-		}
-	}
+	return context.computeRoles(user.Name())
+}
 
-	opts := map[string]interface{}{"stale": false, "key": user.Name()}
-	if verr := context.Bucket.ViewCustom(DesignDocSyncGateway, ViewRoleAccess, opts, &vres); verr != nil {
+// Recomputes the set of roles a Role has been granted access to by sync() functions.
+// This is part of the RoleComputer interface defined by the Authenticator.
+func (context *DatabaseContext) ComputeRolesForRole(role auth.Role) (channels.TimedSet, error) {
+	// Roles are identified in role_access view by a "role:" prefix
+	return context.computeRoles("role:" + role.Name())
+}
+
+// Merges the roles that documents have granted to a key of the role_access view.
+func (context *DatabaseContext) computeRoles(key string) (channels.TimedSet, error) {
+	rows, verr := context.queryAccessView(ViewRoleAccess, key, "role:")
+	if verr != nil {
 		return nil, verr
 	}
 	// Merge the TimedSets from the view result:
 	var result channels.TimedSet
-	for _, row := range vres.Rows {
+	for _, row := range rows {
 		if result == nil {
 			result = row.Value
 		} else {
@@ -883,6 +1015,66 @@ func (context *DatabaseContext) ComputeRolesForUser(user auth.User) (channels.Ti
 	return result, nil
 }
 
+// A row of the access or role_access view: one document's grants to a user or role.
+type accessViewRow struct {
+	ID     string            // ID of the document that made the grants
+	Value  channels.TimedSet // Granted channels or roles, with the sequences they were granted at
+	Expiry map[string]int64  `json:"-"` // Expiration times of the unexpired temporary grants
+}
+
+// Queries the access or role_access view for the grants that documents have made to a user or
+// role, leaving out the ones that have expired. The temporary grants' expiration times come from
+// the grant_expiry view, whose keys are the granted names plus expiryPrefix.
+func (context *DatabaseContext) queryAccessView(viewName string, key string, expiryPrefix string) ([]accessViewRow, error) {
+	var vres struct {
+		Rows []accessViewRow
+	}
+	opts := map[string]interface{}{"stale": false, "key": key}
+	if err := context.Bucket.ViewCustom(DesignDocSyncGateway, viewName, opts, &vres); err != nil {
+		return nil, err
+	} else if len(vres.Rows) == 0 {
+		return nil, nil
+	}
+
+	var expiryRes struct {
+		Rows []struct {
+			ID    string
+			Value map[string]int64
+		}
+	}
+	if err := context.Bucket.ViewCustom(DesignDocSyncGateway, ViewGrantExpiry, opts, &expiryRes); err != nil {
+		return nil, err
+	} else if len(expiryRes.Rows) == 0 {
+		return vres.Rows, nil
+	}
+	expiryByDoc := make(map[string]map[string]int64, len(expiryRes.Rows))
+	for _, row := range expiryRes.Rows {
+		expiryByDoc[row.ID] = row.Value
+	}
+	now := context.timeNow().Unix()
+	for i, row := range vres.Rows {
+		docExpiry := expiryByDoc[row.ID]
+		if len(docExpiry) == 0 {
+			continue
+		}
+		grants := make(channels.TimedSet, len(row.Value))
+		for name, sequence := range row.Value {
+			expiry, found := docExpiry[expiryPrefix+name]
+			if !found {
+				grants[name] = sequence
+			} else if expiry > now {
+				grants[name] = sequence
+				if vres.Rows[i].Expiry == nil {
+					vres.Rows[i].Expiry = map[string]int64{}
+				}
+				vres.Rows[i].Expiry[name] = expiry
+			}
+		}
+		vres.Rows[i].Value = grants
+	}
+	return vres.Rows, nil
+}
+
 //////// REVS_DIFF:
 
 // Given a document ID and a set of revision IDs, looks up which ones are not known.
@@ -17,6 +17,7 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/couchbase/go-couchbase"
@@ -36,6 +37,12 @@ type DatabaseContext struct {
 	tapListener        changeListener          // Listens on server Tap feed
 	sequences          *sequenceAllocator      // Source of new sequence numbers
 	ChannelMapper      *channels.ChannelMapper // Runs JS 'sync' function
+	ConflictResolver   *ConflictResolver       // Runs JS 'conflict_resolver' function
+	ChangesFilters     map[string]*JSFilter    // The "sync_gateway/" _changes filters, from config
+	Schemas            *SchemaSet              // JSON Schemas that documents must conform to
+	JSModules          *channels.JSModules     // Shared JS libraries for the sync & other JS fns
+	OIDCProvider       *auth.OIDCProvider      // OpenID Connect identity provider, if any
+	JWTVerifier        *auth.JWTVerifier       // Verifies bearer JWTs signed with configured keys
 	StartTime          time.Time               // Timestamp when context was instantiated
 	ChangesClientStats Statistics              // Tracks stats of # of changes connections
 	RevsLimit          uint32                  // Max depth a document's revision tree can grow to
@@ -43,8 +50,21 @@ type DatabaseContext struct {
 	Shadower           *Shadower               // Tracks an external Couchbase bucket
 	revisionCache      *RevisionCache          // Cache of recently-accessed doc revisions
 	changeCache        changeCache             //
+	ChannelIndex       *ChannelIndex           // Persistent index of channels' changes, if any
 	EventMgr           *EventManager           // Manages notification events
 	AllowEmptyPassword bool                    // Allow empty passwords?  Defaults to false
+	TombstoneRetention time.Duration           // How long deleted docs are kept before being purged
+	SyncFunctionTimes  *base.Histogram         // Latency of sync function calls
+	SyncWaitTimes      *base.Histogram         // Time sync function calls wait for a JS runner
+	SyncTimeout        time.Duration           // Max time a sync function call can run (0 = no limit)
+	SyncPoolSize       int                     // Max concurrent sync function calls (0 = default)
+	DbStats            *expvar.Map             // This database's share of the dbExpvars counters
+	compactTerminator  chan bool               // Closed to stop the background tombstone compaction
+	compactRunning     sync.WaitGroup          // Tracks the background tombstone compaction task
+	sweepTerminator    chan bool               // Closed to stop the background sweeps of expired grants & docs
+	sweepsRunning      sync.WaitGroup          // Tracks the background sweeps
+	accessExpiry       accessExpirySchedule    // When to sweep expired access grants next
+	timeNow            func() time.Time        // Current time that access grants expire by; tests fake it
 }
 
 const DefaultRevsLimit = 1000
@@ -56,7 +76,9 @@ const RevisionCacheCapacity = 5000
 // so this struct does not have to be thread-safe.
 type Database struct {
 	*DatabaseContext
-	user auth.User
+	user         auth.User
+	validateOnly bool // If true, updates only run the sync function (see PutAllOrNothing)
+	keepExpired  bool // If true, updates see expired docs instead of treating them as missing
 }
 
 // All special/internal documents the gateway creates have this prefix in their keys.
@@ -96,10 +118,17 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, cach
 		StartTime:  time.Now(),
 		RevsLimit:  DefaultRevsLimit,
 		autoImport: autoImport,
+		timeNow:    time.Now,
 	}
-	context.revisionCache = NewRevisionCache(RevisionCacheCapacity, context.revCacheLoader)
+	context.DbStats = new(expvar.Map).Init()
+	context.revisionCache = NewRevisionCache(RevisionCacheCapacity, context.revCacheLoader, context.DbStats)
+	context.SyncFunctionTimes = base.NewHistogram(base.DefaultLatencyBuckets)
+	context.SyncWaitTimes = base.NewHistogram(base.DefaultLatencyBuckets)
 
 	context.EventMgr = NewEventManager()
+	context.Schemas = NewSchemaSet()
+	context.JSModules = channels.NewJSModules()
+	context.ChannelIndex = cacheOptions.ChannelIndex
 
 	var err error
 	context.sequences, err = newSequenceAllocator(bucket)
@@ -110,6 +139,11 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, cach
 	if err != nil {
 		return nil, err
 	}
+	if context.ChannelIndex != nil {
+		if err = context.ChannelIndex.open(context, lastSeq+1); err != nil {
+			return nil, err
+		}
+	}
 	context.changeCache.Init(context, lastSeq, func(changedChannels base.Set) {
 		context.tapListener.Notify(changedChannels)
 	}, cacheOptions)
@@ -119,6 +153,8 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, cach
 		return nil, err
 	}
 	go context.watchDocChanges()
+	context.startAccessExpirySweep()
+	context.startDocExpirySweep()
 	return context, nil
 }
 
@@ -126,6 +162,20 @@ func (context *DatabaseContext) Close() {
 	context.tapListener.Stop()
 	context.changeCache.Stop()
 	context.Shadower.Stop()
+	if context.compactTerminator != nil {
+		close(context.compactTerminator)
+		context.compactRunning.Wait()
+	}
+	if context.sweepTerminator != nil {
+		close(context.sweepTerminator)
+		context.sweepsRunning.Wait()
+	}
+	if context.ChannelIndex != nil {
+		context.ChannelIndex.stop()
+		if context.ChannelIndex.bucket != context.Bucket {
+			context.ChannelIndex.bucket.Close()
+		}
+	}
 	context.Bucket.Close()
 	context.Bucket = nil
 }
@@ -152,11 +202,11 @@ func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 
 // Makes a Database object given its name and bucket.
 func GetDatabase(context *DatabaseContext, user auth.User) (*Database, error) {
-	return &Database{context, user}, nil
+	return &Database{DatabaseContext: context, user: user}, nil
 }
 
 func CreateDatabase(context *DatabaseContext) (*Database, error) {
-	return &Database{context, nil}, nil
+	return &Database{DatabaseContext: context}, nil
 }
 
 func (db *Database) SameAs(otherdb *Database) bool {
@@ -228,6 +278,41 @@ func installViews(bucket base.Bucket) error {
                      if (meta.id.substring(0,10) == "_sync:rev:")
 	                     emit("",null); }`
 
+	// View for tombstone compaction -- finds all deleted docs
+	// Key is docid; value is the time the tombstone was saved
+	tombstones_map := `function (doc, meta) {
+	                    var sync = doc._sync;
+	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+	                        return;
+	                    if ((sync.flags & %d) || sync.deleted) // channels.Deleted
+	                        emit(meta.id, sync.time_saved); }`
+	tombstones_map = fmt.Sprintf(tombstones_map, channels.Deleted)
+
+	// View for the sweep of expired access grants -- finds temporary access() & role() grants
+	// Key is the grant's expiration time; value is [user or role name, channel or "role:"+role]
+	access_expiry_map := `function (doc, meta) {
+	                    var sync = doc._sync;
+	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+	                        return;
+	                    var expiry = sync.access_expiry;
+	                    if (expiry) {
+	                        for (var name in expiry) {
+	                            for (var granted in expiry[name])
+	                                emit(expiry[name][granted], [name, granted]);
+	                        }
+	                    }
+	               }`
+
+	// View for the sweep of expired docs -- finds live docs that have an expiry
+	// Key is the expiration time; value is ignored
+	doc_expiry_map := `function (doc, meta) {
+	                    var sync = doc._sync;
+	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+	                        return;
+	                    if (sync.exp && !((sync.flags & %d) || sync.deleted)) // channels.Deleted
+	                        emit(sync.exp, null); }`
+	doc_expiry_map = fmt.Sprintf(doc_expiry_map, channels.Deleted)
+
 	// Sessions view - used for session delete
 	// Key is username; value is docid
 	sessions_map := `function (doc, meta) {
@@ -256,6 +341,8 @@ func installViews(bucket base.Bucket) error {
 	                    if (sequence === undefined)
 	                        return;
 	                    var value = {rev:sync.rev};
+	                    if (sync.exp)
+	                    	value.exp = sync.exp;
 	                    if (sync.flags) {
 	                    	value.flags = sync.flags
 	                    } else if (sync.deleted) {
@@ -291,8 +378,8 @@ func installViews(bucket base.Bucket) error {
 	                        }
 	                    }
 	               }`
-	// Role access view, used by ComputeRolesForUser()
-	// Key is username; value is array of role names
+	// Role access view, used by ComputeRolesForUser() and ComputeRolesForRole()
+	// Key is username; value is dictionary roleName->firstSequence (compatible with TimedSet)
 	roleAccess_map := `function (doc, meta) {
 	                    var sync = doc._sync;
 	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
@@ -304,25 +391,42 @@ func installViews(bucket base.Bucket) error {
 	                        }
 	                    }
 	               }`
+	// Grant expiry view, used alongside the access and role_access views to leave out expired grants
+	// Key is username; value is dictionary channelName or "role:"+roleName->expiration time
+	grantExpiry_map := `function (doc, meta) {
+	                    var sync = doc._sync;
+	                    if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+	                        return;
+	                    var expiry = sync.access_expiry;
+	                    if (expiry) {
+	                        for (var name in expiry) {
+	                            emit(name, expiry[name]);
+	                        }
+	                    }
+	               }`
 
 	designDocMap := map[string]walrus.DesignDoc{}
 
 	designDocMap[DesignDocSyncGateway] = walrus.DesignDoc{
 		Views: walrus.ViewMap{
-			ViewPrincipals: walrus.ViewDef{Map: principals_map},
-			ViewChannels:   walrus.ViewDef{Map: channels_map},
-			ViewAccess:     walrus.ViewDef{Map: access_map},
-			ViewRoleAccess: walrus.ViewDef{Map: roleAccess_map},
+			ViewPrincipals:  walrus.ViewDef{Map: principals_map},
+			ViewChannels:    walrus.ViewDef{Map: channels_map},
+			ViewAccess:      walrus.ViewDef{Map: access_map},
+			ViewRoleAccess:  walrus.ViewDef{Map: roleAccess_map},
+			ViewGrantExpiry: walrus.ViewDef{Map: grantExpiry_map},
 		},
 	}
 
 	designDocMap[DesignDocSyncHousekeeping] = walrus.DesignDoc{
 		Views: walrus.ViewMap{
-			ViewAllBits:  walrus.ViewDef{Map: allbits_map},
-			ViewAllDocs:  walrus.ViewDef{Map: alldocs_map, Reduce: "_count"},
-			ViewImport:   walrus.ViewDef{Map: import_map, Reduce: "_count"},
-			ViewOldRevs:  walrus.ViewDef{Map: oldrevs_map, Reduce: "_count"},
-			ViewSessions: walrus.ViewDef{Map: sessions_map},
+			ViewAllBits:      walrus.ViewDef{Map: allbits_map},
+			ViewAllDocs:      walrus.ViewDef{Map: alldocs_map, Reduce: "_count"},
+			ViewImport:       walrus.ViewDef{Map: import_map, Reduce: "_count"},
+			ViewOldRevs:      walrus.ViewDef{Map: oldrevs_map, Reduce: "_count"},
+			ViewSessions:     walrus.ViewDef{Map: sessions_map},
+			ViewTombstones:   walrus.ViewDef{Map: tombstones_map},
+			ViewAccessExpiry: walrus.ViewDef{Map: access_expiry_map},
+			ViewDocExpiry:    walrus.ViewDef{Map: doc_expiry_map},
 		},
 	}
 
@@ -516,7 +620,13 @@ func (context *DatabaseContext) UpdateSyncFun(syncFun string) (changed bool, err
 	} else if context.ChannelMapper != nil {
 		_, err = context.ChannelMapper.SetFunction(syncFun)
 	} else {
-		context.ChannelMapper = channels.NewChannelMapper(syncFun)
+		context.ChannelMapper = channels.NewChannelMapperWithOptions(syncFun, channels.ChannelMapperOptions{
+			PoolSize:  context.SyncPoolSize,
+			Timeout:   context.SyncTimeout,
+			WaitTimes: context.SyncWaitTimes,
+			RunTimes:  context.SyncFunctionTimes,
+			Modules:   context.JSModules,
+		})
 	}
 	if err != nil {
 		base.Warn("Error setting sync function: %s", err)
@@ -618,18 +728,20 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 			changed := 0
 			doc.History.forEachLeaf(func(rev *RevInfo) {
 				body, _ := db.getRevFromDoc(doc, rev.ID, false)
-				channels, access, roles, err := db.getChannelsAndAccess(doc, body, rev.ID)
+				channels, access, roles, accessExpiry, err := db.getChannelsAndAccess(doc, body, rev.ID)
 				if err != nil {
 					// Probably the validator rejected the doc
 					base.Warn("Error calling sync() on doc %q: %v", docid, err)
 					access = nil
 					channels = nil
+					accessExpiry = nil
 				}
 				rev.Channels = channels
 
 				if rev.ID == doc.CurrentRev {
-					changed = len(doc.Access.updateAccess(doc, access)) +
-						len(doc.RoleAccess.updateAccess(doc, roles)) +
+					changedPrincipals, changedRoleUsers := doc.updateAccessExpiry(accessExpiry,
+						doc.Access.updateAccess(doc, access), doc.RoleAccess.updateAccess(doc, roles))
+					changed = len(changedPrincipals) + len(changedRoleUsers) +
 						len(doc.updateChannels(channels))
 				}
 			})
@@ -670,6 +782,21 @@ func (db *Database) invalUserRoles(username string) {
 	}
 }
 
+func (db *Database) invalRoleRoles(rolename string) {
+	authr := db.Authenticator()
+	if role, _ := authr.GetRole(rolename); role != nil {
+		authr.InvalidateRoles(role)
+	}
+}
+
+func (db *Database) invalUserOrRoleRoles(name string) {
+	if strings.HasPrefix(name, "role:") {
+		db.invalRoleRoles(name[5:])
+	} else {
+		db.invalUserRoles(name)
+	}
+}
+
 func (db *Database) invalUserChannels(username string) {
 	authr := db.Authenticator()
 	if user, _ := authr.GetUser(username); user != nil {
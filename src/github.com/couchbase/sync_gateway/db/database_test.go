@@ -12,6 +12,7 @@ package db
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -501,6 +502,239 @@ func TestConflicts(t *testing.T) {
 		branched: true})
 }
 
+func TestConflictResolver(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Merge conflicts by adding up "n":
+	db.ConflictResolver = NewConflictResolver(`function(conflicts) {
+		var total = 0;
+		for (var i = 0; i < conflicts.length; i++)
+			total += conflicts[i].n;
+		return {n: total, merged: true};
+	}`, nil)
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 1}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 2}, []string{"2-b", "1-a"}), "add 2-b")
+	assertNoError(t, db.PutExistingRev("doc", Body{"n": 3}, []string{"2-a", "1-a"}), "add 2-a")
+
+	// The merged revision is a child of the winner, and the losing branch is deleted:
+	doc, err := db.GetDoc("doc")
+	assertNoError(t, err, "GetDoc")
+	assert.False(t, doc.hasFlag(channels.Conflict))
+	assert.Equals(t, doc.History[doc.CurrentRev].Parent, "2-b")
+	gotBody, err := db.Get("doc")
+	assertNoError(t, err, "Get")
+	assert.Equals(t, gotBody["n"], int64(5))
+	assert.Equals(t, gotBody["merged"], true)
+	leaves := doc.History.GetLeaves()
+	assert.Equals(t, len(leaves), 2)
+	for _, leaf := range leaves {
+		if leaf != doc.CurrentRev {
+			assert.Equals(t, doc.History[leaf].Parent, "2-a")
+			assert.True(t, doc.History[leaf].Deleted)
+		}
+	}
+
+	// Pick the losing side:
+	db.ConflictResolver = NewConflictResolver(`function(conflicts) {
+		return conflicts[conflicts.length - 1];
+	}`, nil)
+	assertNoError(t, db.PutExistingRev("doc2", Body{"n": 1}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("doc2", Body{"n": 2}, []string{"2-b", "1-a"}), "add 2-b")
+	assertNoError(t, db.PutExistingRev("doc2", Body{"n": 3}, []string{"2-a", "1-a"}), "add 2-a")
+	doc, err = db.GetDoc("doc2")
+	assertNoError(t, err, "GetDoc")
+	assert.False(t, doc.hasFlag(channels.Conflict))
+	assert.Equals(t, doc.CurrentRev, "2-a")
+
+	// Picking a revision but changing its body adds a new revision with the changes:
+	db.ConflictResolver = NewConflictResolver(`function(conflicts) {
+		var picked = conflicts[1];
+		picked.n = 42;
+		return picked;
+	}`, nil)
+	assertNoError(t, db.PutExistingRev("doc4", Body{"n": 1}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("doc4", Body{"n": 2}, []string{"2-b", "1-a"}), "add 2-b")
+	assertNoError(t, db.PutExistingRev("doc4", Body{"n": 3}, []string{"2-a", "1-a"}), "add 2-a")
+	doc, err = db.GetDoc("doc4")
+	assertNoError(t, err, "GetDoc")
+	assert.False(t, doc.hasFlag(channels.Conflict))
+	assert.Equals(t, doc.History[doc.CurrentRev].Parent, "2-a")
+	gotBody, err = db.Get("doc4")
+	assertNoError(t, err, "Get")
+	assert.Equals(t, gotBody["n"], int64(42))
+	assert.Equals(t, len(doc.History.GetLeaves()), 2)
+
+	// Returning null leaves the conflict alone:
+	db.ConflictResolver = NewConflictResolver(`function(conflicts) {return null;}`, nil)
+	assertNoError(t, db.PutExistingRev("doc3", Body{"n": 1}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("doc3", Body{"n": 2}, []string{"2-b", "1-a"}), "add 2-b")
+	assertNoError(t, db.PutExistingRev("doc3", Body{"n": 3}, []string{"2-a", "1-a"}), "add 2-a")
+	doc, err = db.GetDoc("doc3")
+	assertNoError(t, err, "GetDoc")
+	assert.True(t, doc.hasFlag(channels.Conflict))
+	assert.Equals(t, doc.CurrentRev, "2-b")
+}
+
+func TestDocExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	// A relative expiry is stored as an absolute time in the sync metadata:
+	_, err := db.Put("doc1", Body{"_exp": 3600, "channels": []string{"all"}})
+	assertNoError(t, err, "Put doc1")
+	doc, err := db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc doc1")
+	assert.True(t, doc.Expiry != nil)
+	assert.True(t, doc.Expiry.After(time.Now().Add(59*time.Minute)))
+	body, err := db.Get("doc1")
+	assertNoError(t, err, "Get doc1")
+	assert.Equals(t, body["_exp"], nil)
+
+	// Updating the doc without an _exp keeps the expiry; a null _exp clears it:
+	expiry := *doc.Expiry
+	rev, err := db.Put("doc1", Body{"_rev": body["_rev"], "channels": []string{"all"}})
+	assertNoError(t, err, "Update doc1")
+	doc, _ = db.GetDoc("doc1")
+	assert.True(t, doc.Expiry != nil && doc.Expiry.Equal(expiry))
+	_, err = db.Put("doc1", Body{"_rev": rev, "_exp": nil, "channels": []string{"all"}})
+	assertNoError(t, err, "Update doc1")
+	doc, _ = db.GetDoc("doc1")
+	assert.True(t, doc.Expiry == nil)
+
+	// An expired doc can't be read, and shows up in the changes feed as removed:
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	rev2, err := db.Put("doc2", Body{"_exp": past, "channels": []string{"all"}})
+	assertNoError(t, err, "Put doc2")
+	_, err = db.Get("doc2")
+	assertHTTPError(t, err, 404)
+	_, err = db.GetRev("doc2", rev2, false, nil)
+	assertHTTPError(t, err, 404)
+
+	db.changeCache.waitForSequence(4)
+	changes, err := db.GetChanges(channels.SetOf("all"), ChangesOptions{})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 2)
+	assert.Equals(t, changes[0].ID, "doc1")
+	assert.False(t, changes[0].Deleted)
+	assert.Equals(t, changes[1].ID, "doc2")
+	assert.True(t, changes[1].Deleted)
+	assert.DeepEquals(t, changes[1].Removed, channels.SetOf("all"))
+
+	// The expiry sweep gives the expired doc a tombstone revision, which a feed continuing from
+	// the last sequence sees:
+	count, err := db.ExpireDocs()
+	assertNoError(t, err, "ExpireDocs")
+	assert.Equals(t, count, 1)
+	db.changeCache.waitForSequence(5)
+	changes, err = db.GetChanges(channels.SetOf("all"), ChangesOptions{Since: SequenceID{Seq: 4}})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc2")
+	assert.Equals(t, changes[0].Seq, SequenceID{Seq: 5})
+	assert.True(t, changes[0].Deleted)
+	doc, _ = db.GetDoc("doc2")
+	assert.True(t, doc.hasFlag(channels.Deleted))
+	assert.True(t, doc.Expiry == nil)
+	_, err = db.GetRev("doc2", rev2, false, nil)
+	assertHTTPError(t, err, 404)
+	count, err = db.ExpireDocs()
+	assertNoError(t, err, "ExpireDocs")
+	assert.Equals(t, count, 0)
+
+	_, err = db.Put("doc3", Body{"_exp": "tomorrow"})
+	assertHTTPError(t, err, 400)
+}
+
+func TestPurge(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	// Purging a whole doc removes it and its archived revisions, and evicts it from the caches:
+	rev1, err := db.Put("doc1", Body{"channels": []string{"all"}})
+	assertNoError(t, err, "Put doc1")
+	_, err = db.Put("doc1", Body{"_rev": rev1, "channels": []string{"all"}})
+	assertNoError(t, err, "Update doc1")
+	db.changeCache.waitForSequence(2)
+	assert.Equals(t, len(db.GetChangeLog("all", 0)), 1)
+	purged, err := db.Purge("doc1", []string{"*"})
+	assertNoError(t, err, "Purge doc1")
+	assert.Equals(t, len(purged), 2)
+	_, err = db.GetDoc("doc1")
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, err = db.GetRev("doc1", rev1, false, nil)
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, err = db.getOldRevisionJSON("doc1", rev1)
+	assertHTTPError(t, err, 404)
+	assert.Equals(t, len(db.GetChangeLog("all", 0)), 0)
+
+	// Purging the winning branch of a conflict makes the other branch current:
+	assertNoError(t, db.PutExistingRev("doc2", Body{"n": 1}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("doc2", Body{"n": 2}, []string{"2-a", "1-a"}), "add 2-a")
+	assertNoError(t, db.PutExistingRev("doc2", Body{"n": 3}, []string{"3-b", "2-b", "1-a"}), "add 3-b")
+	purged, err = db.Purge("doc2", []string{"3-b", "1-a"})
+	assertNoError(t, err, "Purge doc2 branch")
+	assert.DeepEquals(t, purged, []string{"3-b", "2-b"})
+	doc, err := db.GetDoc("doc2")
+	assertNoError(t, err, "GetDoc doc2")
+	assert.Equals(t, doc.CurrentRev, "2-a")
+	assert.Equals(t, len(doc.History), 2)
+	assert.False(t, doc.hasFlag(channels.Conflict))
+	body, err := db.Get("doc2")
+	assertNoError(t, err, "Get doc2")
+	assert.Equals(t, body["n"], int64(2))
+
+	// A branch can't be purged if the revision that would become current has no body:
+	assertNoError(t, db.PutExistingRev("doc3", Body{"n": 1}, []string{"1-a"}), "add 1-a")
+	assertNoError(t, db.PutExistingRev("doc3", Body{"n": 2}, []string{"2-a", "1-a"}), "add 2-a")
+	assertNoError(t, db.PutExistingRev("doc3", Body{"n": 3}, []string{"3-b", "2-b", "1-a"}), "add 3-b")
+	doc, _ = db.GetDoc("doc3")
+	doc.History.setRevisionBody("2-a", nil)
+	assertNoError(t, db.Bucket.Set("doc3", 0, doc), "Set doc3")
+	_, err = db.Purge("doc3", []string{"3-b"})
+	assertHTTPError(t, err, 409)
+	doc, _ = db.GetDoc("doc3")
+	assert.Equals(t, doc.CurrentRev, "3-b")
+
+	_, err = db.Purge("nosuchdoc", []string{"*"})
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestCompactTombstones(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db) // (also stops the background compaction)
+	db.StartTombstoneCompaction(time.Hour)
+
+	rev1, err := db.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Put doc1")
+	_, err = db.DeleteDoc("doc1", rev1)
+	assertNoError(t, err, "Delete doc1")
+	_, err = db.Put("doc2", Body{"n": 2})
+	assertNoError(t, err, "Put doc2")
+
+	// The tombstone isn't old enough yet:
+	purged, err := db.CompactTombstones(time.Hour, false)
+	assertNoError(t, err, "CompactTombstones")
+	assert.DeepEquals(t, purged, []string{})
+
+	// A dry run lists the tombstone without purging it:
+	purged, err = db.CompactTombstones(0, true)
+	assertNoError(t, err, "CompactTombstones dry run")
+	assert.DeepEquals(t, purged, []string{"doc1"})
+	_, err = db.GetDoc("doc1")
+	assertNoError(t, err, "GetDoc doc1")
+
+	purged, err = db.CompactTombstones(0, false)
+	assertNoError(t, err, "CompactTombstones")
+	assert.DeepEquals(t, purged, []string{"doc1"})
+	_, err = db.GetDoc("doc1")
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, err = db.GetDoc("doc2")
+	assertNoError(t, err, "GetDoc doc2")
+}
+
 func TestSyncFnOnPush(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
@@ -618,6 +852,107 @@ func TestAccessFunction(t *testing.T) {
 	assert.DeepEquals(t, user.InheritedChannels(), expected)
 }
 
+func TestTemporaryAccessGrants(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		access(doc.user, doc.channel, {expiry: doc.expiry});
+		if (doc.role) role(doc.user, "role:" + doc.role, {expiry: doc.expiry});
+	}`)
+	now := time.Now().Unix()
+	setFakeClock(db, &now)
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("Netflix"))
+	assertNoError(t, authenticator.Save(user), "Save")
+
+	expiry := now + 60
+	_, err := db.Put("share", Body{"user": "naomi", "channel": "Hulu", "role": "viewer", "expiry": expiry})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("expired", Body{"user": "naomi", "channel": "HBO", "expiry": now - 10})
+	assertNoError(t, err, "Put")
+	user, _ = authenticator.GetUser("naomi")
+	assert.DeepEquals(t, user.Channels().AsSet(), channels.SetOf("Netflix", "Hulu", "!"))
+	assert.DeepEquals(t, user.RoleNames().AsSet(), channels.SetOf("viewer"))
+
+	// Once the grant expires, the sweep invalidates the user so it loses the access:
+	atomic.StoreInt64(&now, expiry+1)
+	since, err := db.SweepExpiredGrants(0, now)
+	assertNoError(t, err, "SweepExpiredGrants")
+	assert.Equals(t, since, expiry+1)
+	user, _ = authenticator.GetUser("naomi")
+	assert.DeepEquals(t, user.Channels().AsSet(), channels.SetOf("Netflix", "!"))
+	assert.Equals(t, len(user.RoleNames()), 0)
+}
+
+// A changes feed sends removals of the docs it's sent from a channel whose grant expires.
+func TestChangesAcrossGrantExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		channel(doc.channels);
+		if (doc.user) access(doc.user, doc.grant, {expiry: doc.expiry});
+	}`)
+	now := time.Now().Unix()
+	setFakeClock(db, &now)
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("Netflix"))
+	assertNoError(t, authenticator.Save(user), "Save")
+
+	expiry := now + 60
+	_, err := db.Put("share", Body{"user": "naomi", "grant": "HBO", "expiry": expiry})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("show1", Body{"channels": []string{"HBO"}})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("show2", Body{"channels": []string{"HBO", "Netflix"}})
+	assertNoError(t, err, "Put")
+	revid, err := db.Put("perm", Body{"user": "naomi", "grant": "Showtime"})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("show3", Body{"channels": []string{"Showtime"}})
+	assertNoError(t, err, "Put")
+	db.changeCache.waitForSequence(5)
+	db.user, _ = authenticator.GetUser("naomi")
+
+	options := ChangesOptions{Terminator: make(chan bool), Continuous: true, Wait: true}
+	defer close(options.Terminator)
+	feed, err := db.MultiChangesFeed(base.SetOf("*"), options)
+	assertNoError(t, err, "MultiChangesFeed")
+	var changes []*ChangeEntry
+	assertNoError(t, appendFromFeed(&changes, feed, 3), "appendFromFeed")
+	assert.Equals(t, changes[0].ID, "show1")
+	assert.Equals(t, changes[1].ID, "show2")
+	assert.Equals(t, changes[2].ID, "show3")
+
+	// Once the sweep notices the grant has expired, show1 is removed, with its own sequence.
+	// show2 is still in a channel the user can see:
+	atomic.StoreInt64(&now, expiry+1)
+	_, err = db.SweepExpiredGrants(0, now)
+	assertNoError(t, err, "SweepExpiredGrants")
+	assertNoError(t, appendFromFeed(&changes, feed, 1), "appendFromFeed")
+	assert.Equals(t, len(changes), 4)
+	assert.Equals(t, changes[3].ID, "show1")
+	assert.DeepEquals(t, changes[3].Removed, channels.SetOf("HBO"))
+	assert.Equals(t, changes[3].Seq, SequenceID{Seq: 2})
+	assert.True(t, appendFromFeed(&changes, feed, 1) != nil)
+
+	// Access that's revoked rather than expired doesn't send removals:
+	admin, _ := CreateDatabase(db.DatabaseContext)
+	_, err = admin.Put("perm", Body{"_rev": revid})
+	assertNoError(t, err, "Put")
+	db.changeCache.waitForSequence(6)
+	user, _ = authenticator.GetUser("naomi")
+	assert.False(t, user.CanSeeChannel("Showtime"))
+	assert.True(t, appendFromFeed(&changes, feed, 1) != nil)
+	assert.Equals(t, len(changes), 4)
+}
+
+// Makes the database's clock, which access grants expire by, read the Unix time in 'now'.
+// Tests move the clock with atomic.StoreInt64, since feeds may be reading it.
+func setFakeClock(db *Database, now *int64) {
+	db.timeNow = func() time.Time {
+		return time.Unix(atomic.LoadInt64(now), 0)
+	}
+}
+
 func TestDocIDs(t *testing.T) {
 	assert.Equals(t, realDocID(""), "")
 	assert.Equals(t, realDocID("_"), "")
@@ -829,3 +1164,17 @@ func BenchmarkDatabase(b *testing.B) {
 		db.Close()
 	}
 }
+
+func TestSyncFnTimeout(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.SyncTimeout = 50 * time.Millisecond
+	db.ChannelMapper = nil
+	_, err := db.UpdateSyncFun(`function(doc) {while (doc.loop) {} channel(doc.channels);}`)
+	assertNoError(t, err, "Couldn't set sync function")
+
+	_, err = db.Put("doc1", Body{"loop": true})
+	assertHTTPError(t, err, 500)
+	_, err = db.Put("doc1", Body{"channels": []string{"ABC"}})
+	assertNoError(t, err, "Couldn't create document")
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Revision deltas describe how to turn one JSON object into another:
+// * A delta is an object containing only the properties that differ.
+// * A property that was removed has the value [] (an empty array.)
+// * A property whose value is an object in both revisions has a nested delta as its value.
+// * Any other property has its new value, except that an array value is wrapped in a
+//   one-element array, to tell it apart from a removal.
+
+// Computes the delta that turns the object 'old' into 'new'.
+func DiffBodies(old, new map[string]interface{}) map[string]interface{} {
+	delta := map[string]interface{}{}
+	for key, oldValue := range old {
+		if _, exists := new[key]; !exists {
+			delta[key] = []interface{}{}
+		} else if !reflect.DeepEqual(oldValue, new[key]) {
+			oldObject, oldIsObject := asJSONObject(oldValue)
+			newObject, newIsObject := asJSONObject(new[key])
+			if oldIsObject && newIsObject {
+				delta[key] = DiffBodies(oldObject, newObject)
+			} else {
+				delta[key] = deltaValue(new[key])
+			}
+		}
+	}
+	for key, newValue := range new {
+		if _, exists := old[key]; !exists {
+			delta[key] = deltaValue(newValue)
+		}
+	}
+	return delta
+}
+
+func deltaValue(value interface{}) interface{} {
+	if value != nil && reflect.TypeOf(value).Kind() == reflect.Slice {
+		return []interface{}{value}
+	}
+	return value
+}
+
+// Bodies stored by Put may contain Body values as well as unmarshaled JSON objects.
+func asJSONObject(value interface{}) (map[string]interface{}, bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return value, true
+	case Body:
+		return value, true
+	}
+	return nil, false
+}
+
+// Applies a delta made by DiffBodies to the object 'old', returning the new object. The old
+// object isn't modified.
+func ApplyDelta(old, delta map[string]interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(old)+len(delta))
+	for key, value := range old {
+		result[key] = value
+	}
+	for key, change := range delta {
+		switch change := change.(type) {
+		case []interface{}:
+			switch len(change) {
+			case 0:
+				delete(result, key)
+			case 1:
+				result[key] = change[0]
+			default:
+				return nil, fmt.Errorf("Invalid delta of property %q", key)
+			}
+		case map[string]interface{}:
+			if oldObject, ok := asJSONObject(result[key]); ok {
+				newObject, err := ApplyDelta(oldObject, change)
+				if err != nil {
+					return nil, err
+				}
+				result[key] = newObject
+			} else {
+				result[key] = change
+			}
+		default:
+			result[key] = change
+		}
+	}
+	return result, nil
+}
+
+// Gets a revision like GetRev; but if one of the revisions in deltasFrom is an ancestor of it,
+// presumably because the client already has it, returns a delta from that ancestor instead of
+// the full body. A delta body has the properties "_id", "_rev", "_deltaSrc" (the ancestor's rev
+// ID) and "_delta", plus "_revisions" if listRevisions is true. Attachments in the delta are
+// stubs. Falls back to the full revision if no ancestor's body is available, e.g. because it's
+// been compacted.
+func (db *Database) GetRevWithDelta(docid, revid string, listRevisions bool, attachmentsSince []string, deltasFrom []string) (Body, error) {
+	if len(deltasFrom) > 0 {
+		delta, err := db.getRevDelta(docid, revid, listRevisions, deltasFrom)
+		if err != nil || delta != nil {
+			return delta, err
+		}
+	}
+	return db.GetRev(docid, revid, listRevisions, attachmentsSince)
+}
+
+// Returns a delta body for GetRevWithDelta, or nil if the full revision should be sent.
+func (db *Database) getRevDelta(docid, revid string, listRevisions bool, deltasFrom []string) (Body, error) {
+	body, err := db.GetRev(docid, revid, true, nil)
+	if err != nil {
+		return nil, err
+	} else if body["_removed"] != nil || body["_deleted"] != nil {
+		return nil, nil // the full body is tiny anyway
+	}
+	revid = body["_rev"].(string)
+	revisions := body["_revisions"].(Body)
+	start, ids := revisions["start"].(int), revisions["ids"].([]string)
+	fromRevID := ""
+findAncestor:
+	for i := 1; i < len(ids); i++ {
+		ancestor := fmt.Sprintf("%d-%s", start-i, ids[i])
+		for _, known := range deltasFrom {
+			if ancestor == known {
+				fromRevID = ancestor
+				break findAncestor
+			}
+		}
+	}
+	if fromRevID == "" {
+		return nil, nil
+	}
+
+	delta, fromChannels := db.revisionCache.GetDelta(docid, revid, fromRevID)
+	if delta == nil {
+		fromBody, _, channels, err := db.revisionCache.Get(docid, fromRevID)
+		if fromBody == nil {
+			base.LogTo("CRUD+", "No body of %q / %q to make a delta from: %v", docid, fromRevID, err)
+			return nil, nil
+		}
+		delta = DiffBodies(stripSpecialProperties(fromBody), stripSpecialProperties(body))
+		fromChannels = channels
+		db.revisionCache.PutDelta(docid, revid, fromRevID, delta, fromChannels)
+	}
+	// Don't let the delta reveal anything about an ancestor the user can't access:
+	if db.user != nil && db.user.AuthorizeAnyChannel(fromChannels) != nil {
+		return nil, nil
+	}
+
+	result := Body{"_id": docid, "_rev": revid, "_deltaSrc": fromRevID, "_delta": delta}
+	if listRevisions {
+		result["_revisions"] = revisions
+	}
+	dbExpvars.Add("deltas_sent", 1)
+	db.DbStats.Add("deltas_sent", 1)
+	return result, nil
+}
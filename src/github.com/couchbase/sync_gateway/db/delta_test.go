@@ -0,0 +1,71 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDiffBodies(t *testing.T) {
+	var old, new map[string]interface{}
+	json.Unmarshal([]byte(`{"same":1, "changed":"a", "removed":true, "list":[1,2],
+		"nested":{"x":1, "y":{"z":2}}, "toObject":5}`), &old)
+	json.Unmarshal([]byte(`{"same":1, "changed":"b", "added":null, "list":[1,2,3],
+		"nested":{"x":1, "y":{"z":3}, "w":[]}, "toObject":{"a":[1]}}`), &new)
+
+	delta := DiffBodies(old, new)
+	deltaJSON, _ := json.Marshal(delta)
+	assert.Equals(t, string(deltaJSON), `{"added":null,"changed":"b","list":[[1,2,3]],"nested":{"w":[[]],"y":{"z":3}},"removed":[],"toObject":{"a":[1]}}`)
+
+	result, err := ApplyDelta(old, delta)
+	assertNoError(t, err, "ApplyDelta failed")
+	assert.DeepEquals(t, result, new)
+	assert.Equals(t, old["removed"], true) // unchanged
+
+	assert.DeepEquals(t, DiffBodies(old, old), map[string]interface{}{})
+
+	_, err = ApplyDelta(old, map[string]interface{}{"list": []interface{}{1, 2}})
+	assert.True(t, err != nil)
+}
+
+func TestGetRevWithDelta(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("doc1", Body{"greeting": "hi", "tags": []string{"a"}, "big": "unchanged"})
+	assertNoError(t, err, "Couldn't create document")
+	rev2id, err := db.Put("doc1", Body{"_rev": rev1id, "greeting": "hello", "tags": []string{"a", "b"}, "big": "unchanged"})
+	assertNoError(t, err, "Couldn't update document")
+
+	body, err := db.GetRevWithDelta("doc1", rev2id, false, nil, []string{"1-bogus", rev1id})
+	assertNoError(t, err, "GetRevWithDelta failed")
+	assert.Equals(t, body["_deltaSrc"], rev1id)
+	assert.Equals(t, body["_rev"], rev2id)
+	assert.Equals(t, body["greeting"], nil)
+	deltaJSON, _ := json.Marshal(body["_delta"])
+	assert.Equals(t, string(deltaJSON), `{"greeting":"hello","tags":[["a","b"]]}`)
+
+	// Second time, the delta comes from the revision cache:
+	cached, _ := db.revisionCache.GetDelta("doc1", rev2id, rev1id)
+	assert.True(t, cached != nil)
+	body, err = db.GetRevWithDelta("doc1", "", true, nil, []string{rev1id})
+	assertNoError(t, err, "GetRevWithDelta failed")
+	assert.Equals(t, body["_deltaSrc"], rev1id)
+	assert.True(t, body["_revisions"] != nil)
+
+	// Without a known ancestor, the full body is returned:
+	body, err = db.GetRevWithDelta("doc1", rev2id, false, nil, []string{rev2id, "1-bogus"})
+	assertNoError(t, err, "GetRevWithDelta failed")
+	assert.Equals(t, body["_delta"], nil)
+	assert.Equals(t, body["greeting"], "hello")
+
+	// If the ancestor's body is gone, the full body is returned:
+	db.revisionCache.Remove("doc1", rev2id)
+	db.revisionCache.Remove("doc1", rev1id)
+	db.Bucket.Delete(oldRevisionKey("doc1", rev1id))
+	body, err = db.GetRevWithDelta("doc1", rev2id, false, nil, []string{rev1id})
+	assertNoError(t, err, "GetRevWithDelta failed")
+	assert.Equals(t, body["_delta"], nil)
+	assert.Equals(t, body["greeting"], "hello")
+}
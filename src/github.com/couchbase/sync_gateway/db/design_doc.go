@@ -10,7 +10,15 @@ import (
 	ch "github.com/couchbase/sync_gateway/channels"
 )
 
-type DesignDoc sgbucket.DesignDoc
+// A design doc as exchanged with clients. Buckets can only store views in design docs, so the
+// "filters" section is saved in a separate document.
+type DesignDoc struct {
+	sgbucket.DesignDoc
+	Filters map[string]string `json:"filters,omitempty"` // _changes filter functions, by name
+}
+
+// Key prefix of the documents holding design docs' filter functions
+const kDesignDocFiltersKeyPrefix = kSyncKeyPrefix + "filters:"
 
 const (
 	DesignDocSyncGateway      = "sync_gateway"
@@ -19,11 +27,15 @@ const (
 	ViewChannels              = "channels"
 	ViewAccess                = "access"
 	ViewRoleAccess            = "role_access"
+	ViewGrantExpiry           = "grant_expiry"
 	ViewAllBits               = "all_bits"
 	ViewAllDocs               = "all_docs"
 	ViewImport                = "import"
 	ViewOldRevs               = "old_revs"
 	ViewSessions              = "sessions"
+	ViewTombstones            = "tombstones"
+	ViewAccessExpiry          = "access_expiry"
+	ViewDocExpiry             = "doc_expiry"
 )
 
 func isInternalDDoc(ddocName string) bool {
@@ -42,6 +54,20 @@ func (db *Database) GetDesignDoc(ddocName string, result interface{}) (err error
 	if err = db.checkDDocAccess(ddocName); err == nil {
 		err = db.Bucket.GetDDoc(ddocName, result)
 	}
+	if err != nil {
+		return
+	}
+	filters, err := db.getDesignDocFilters(ddocName)
+	if err == nil && len(filters) > 0 {
+		switch result := result.(type) {
+		case *DesignDoc:
+			result.Filters = filters
+		case *interface{}:
+			if ddoc, ok := (*result).(map[string]interface{}); ok {
+				ddoc["filters"] = filters
+			}
+		}
+	}
 	return
 }
 
@@ -79,7 +105,14 @@ func (db *Database) PutDesignDoc(ddocName string, ddoc DesignDoc) (err error) {
 	}
 
 	if err = db.checkDDocAccess(ddocName); err == nil {
-		err = db.Bucket.PutDDoc(ddocName, ddoc)
+		err = db.Bucket.PutDDoc(ddocName, ddoc.DesignDoc)
+	}
+	if err == nil {
+		if len(ddoc.Filters) > 0 {
+			err = db.Bucket.Set(kDesignDocFiltersKeyPrefix+ddocName, 0, ddoc.Filters)
+		} else {
+			err = db.deleteDesignDocFilters(ddocName)
+		}
 	}
 	return
 }
@@ -88,9 +121,29 @@ func (db *Database) DeleteDesignDoc(ddocName string) (err error) {
 	if err = db.checkDDocAccess(ddocName); err == nil {
 		err = db.Bucket.DeleteDDoc(ddocName)
 	}
+	if err == nil {
+		err = db.deleteDesignDocFilters(ddocName)
+	}
+	return
+}
+
+// Returns a design doc's filter functions, or nil if it has none.
+func (db *Database) getDesignDocFilters(ddocName string) (filters map[string]string, err error) {
+	err = db.Bucket.Get(kDesignDocFiltersKeyPrefix+ddocName, &filters)
+	if base.IsDocNotFoundError(err) {
+		err = nil
+	}
 	return
 }
 
+func (db *Database) deleteDesignDocFilters(ddocName string) error {
+	err := db.Bucket.Delete(kDesignDocFiltersKeyPrefix + ddocName)
+	if base.IsDocNotFoundError(err) {
+		err = nil
+	}
+	return err
+}
+
 func (db *Database) QueryDesignDoc(ddocName string, viewName string, options map[string]interface{}) (*sgbucket.ViewResult, error) {
 	// Query has slightly different access control than checkDDocAccess():
 	// * Admins can query any design doc including the internal ones
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// How often the background task looks for documents whose expiry ("_exp") has passed
+const kDocExpirySweepInterval = time.Minute
+
+// Max number of rows read from the doc_expiry view at once
+const kDocExpirySweepBatchSize = 1000
+
+// Starts a background task that periodically writes a tombstone revision to each document whose
+// expiry has passed. The tombstone has a sequence number, so the expiry reaches _changes feeds
+// and replications as a deletion. (The bucket purges the doc kExpiryPurgeDelay later.)
+func (context *DatabaseContext) startDocExpirySweep() {
+	context.sweepsRunning.Add(1)
+	go func(terminator chan bool) {
+		defer context.sweepsRunning.Done()
+		ticker := time.NewTicker(kDocExpirySweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := context.ExpireDocs(); err != nil {
+					base.Warn("Sweep of expired docs of %q failed: %v", context.Name, err)
+				}
+			case <-terminator:
+				return
+			}
+		}
+	}(context.sweepTerminator)
+}
+
+// Writes tombstone revisions to all the documents whose expiry has passed. Returns the number of
+// documents tombstoned.
+func (context *DatabaseContext) ExpireDocs() (int, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	var startKey string
+	skip := 0
+	count := 0
+	for {
+		var vres struct {
+			Rows []struct {
+				ID  string
+				Key string
+			}
+		}
+		opts := Body{"endkey": now, "limit": kDocExpirySweepBatchSize}
+		if startKey != "" {
+			opts["startkey"] = startKey
+			opts["skip"] = skip
+		}
+		if err := context.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewDocExpiry, opts, &vres); err != nil {
+			base.Warn("doc_expiry view returned %v", err)
+			return count, err
+		}
+
+		for _, row := range vres.Rows {
+			if err := context.expireDoc(row.ID); err != nil {
+				base.Warn("Couldn't write expiry tombstone of %q: %v", row.ID, err)
+			} else {
+				count++
+			}
+			// The next page starts after the rows with this key that have been seen:
+			if row.Key == startKey {
+				skip++
+			} else {
+				startKey = row.Key
+				skip = 1
+			}
+		}
+		if len(vres.Rows) < kDocExpirySweepBatchSize {
+			break
+		}
+	}
+	if count > 0 {
+		base.LogTo("CRUD", "Wrote expiry tombstones of %d docs in %q", count, context.Name)
+	}
+	return count, nil
+}
+
+// Deletes an expired document by adding a tombstone revision to each of its live branches.
+// Does nothing if the doc isn't expired (any more.)
+func (context *DatabaseContext) expireDoc(docid string) error {
+	db := &Database{DatabaseContext: context, keepExpired: true}
+	var expiredRevs []string
+	_, err := db.updateDoc(docid, false, &time.Time{}, func(doc *document) (Body, error) {
+		// (Be careful: this block can be invoked multiple times if there are races!)
+		if !doc.isExpired() || doc.hasFlag(ch.Deleted) {
+			return nil, couchbase.UpdateCancel
+		}
+		var newBody Body
+		expiredRevs = nil
+		for _, revid := range doc.History.GetLeaves() {
+			if doc.History[revid].Deleted {
+				continue
+			}
+			generation, _ := parseRevID(revid)
+			tombstone := Body{"_deleted": true}
+			tombstoneRev := createRevID(generation+1, revid, tombstone)
+			tombstone["_rev"] = tombstoneRev
+			doc.History.addRevision(RevInfo{ID: tombstoneRev, Parent: revid, Deleted: true})
+			doc.setRevision(tombstoneRev, tombstone)
+			newBody = tombstone
+			expiredRevs = append(expiredRevs, revid)
+		}
+		// updateDoc stores, and runs the sync function on, the last tombstone. The others were
+		// stored above.
+		return newBody, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Don't let the expired revisions be read back from the cache or their backups:
+	for _, revid := range expiredRevs {
+		context.revisionCache.Remove(docid, revid)
+		context.Bucket.Delete(oldRevisionKey(docid, revid))
+	}
+	return nil
+}
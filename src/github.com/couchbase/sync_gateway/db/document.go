@@ -11,6 +11,7 @@ package db
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -32,6 +33,8 @@ type syncData struct {
 	Channels        channels.ChannelMap `json:"channels,omitempty"`
 	Access          UserAccessMap       `json:"access,omitempty"`
 	RoleAccess      UserAccessMap       `json:"role_access,omitempty"`
+	AccessExpiry    channels.ExpiryMap  `json:"access_expiry,omitempty"` // Expiry times of temporary grants
+	Expiry          *time.Time          `json:"exp,omitempty"`           // Time the doc expires (from its "_exp" property)
 
 	// Fields used by bucket-shadowing:
 	UpstreamCAS *uint64 `json:"upstream_cas,omitempty"` // CAS value of remote doc
@@ -94,6 +97,12 @@ func (doc *syncData) hasValidSyncData() bool {
 	return doc != nil && doc.CurrentRev != "" && doc.Sequence > 0
 }
 
+// Returns true if the document has an expiry time that has passed. (The bucket may not have
+// purged it yet.)
+func (doc *syncData) isExpired() bool {
+	return doc.Expiry != nil && !doc.Expiry.After(time.Now())
+}
+
 func (doc *document) hasFlag(flag uint8) bool {
 	return doc.Flags&flag != 0
 }
@@ -222,6 +231,37 @@ func (accessMap *UserAccessMap) updateAccess(doc *document, newAccess channels.A
 	return changedUsers
 }
 
+// Updates the expiration times of the document's temporary access and role grants. Adds the
+// names of the users/roles whose access has changed as a result to changedPrincipals, and of
+// the users whose roles have changed to changedRoleUsers.
+func (doc *document) updateAccessExpiry(expiry channels.ExpiryMap, changedPrincipals, changedRoleUsers []string) ([]string, []string) {
+	addName := func(names []string, name string) []string {
+		for _, n := range names {
+			if n == name {
+				return names
+			}
+		}
+		return append(names, name)
+	}
+	checkChanges := func(a, b channels.ExpiryMap) {
+		for name, grants := range a {
+			for granted, exp := range grants {
+				if b[name][granted] != exp {
+					if strings.HasPrefix(granted, "role:") {
+						changedRoleUsers = addName(changedRoleUsers, name)
+					} else {
+						changedPrincipals = addName(changedPrincipals, name)
+					}
+				}
+			}
+		}
+	}
+	checkChanges(doc.AccessExpiry, expiry)
+	checkChanges(expiry, doc.AccessExpiry)
+	doc.AccessExpiry = expiry
+	return changedPrincipals, changedRoleUsers
+}
+
 //////// MARSHALING ////////
 
 type documentRoot struct {
@@ -7,6 +7,7 @@ import (
 
 	"github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/robertkrimen/otto"
 )
 
@@ -16,6 +17,7 @@ type EventType uint8
 const (
 	DocumentChange EventType = iota
 	UserAdd
+	ConflictResolved
 )
 
 // An event that can be raised during SG processing.
@@ -55,6 +57,21 @@ func (dce *DocumentChangeEvent) String() string {
 	return fmt.Sprintf("Document change event for doc id: %s", dce.Doc["_id"])
 }
 
+// ConflictResolvedEvent is raised when the conflict resolver function has resolved a document
+// conflict.  Event has the winning revision body, the outcome (ConflictPicked or ConflictMerged),
+// the revisions that were in conflict, and the tombstone revisions created for the losers.
+type ConflictResolvedEvent struct {
+	AsyncEvent
+	Doc        Body
+	Outcome    string
+	Conflicts  []string
+	Tombstones []string
+}
+
+func (cre *ConflictResolvedEvent) String() string {
+	return fmt.Sprintf("Conflict resolved event for doc id: %s", cre.Doc["_id"])
+}
+
 // Javascript function handling for events
 const kTaskCacheSize = 4
 
@@ -69,15 +86,19 @@ const (
 type jsEventTask struct {
 	sgbucket.JSRunner
 	responseType ResponseType
+	modules      *channels.JSModulesLoader // Loads shared JS modules into the interpreter
 }
 
-// Compiles a JavaScript event function to a jsEventTask object.
-func newJsEventTask(funcSource string) (sgbucket.JSServerTask, error) {
+// Compiles a JavaScript event function to a jsEventTask object. The modules may be nil.
+func newJsEventTask(funcSource string, modules *channels.JSModules) (sgbucket.JSServerTask, error) {
 	eventTask := &jsEventTask{}
-	err := eventTask.Init(funcSource)
+	vm, err := channels.InitJSRunner(&eventTask.JSRunner)
 	if err != nil {
 		return nil, err
+	} else if _, err = eventTask.SetFunction(funcSource); err != nil {
+		return nil, err
 	}
+	eventTask.modules = channels.NewJSModulesLoader(modules, vm)
 
 	eventTask.After = func(result otto.Value, err error) (interface{}, error) {
 		nativeValue, _ := result.Export()
@@ -102,6 +123,14 @@ func newJsEventTask(funcSource string) (sgbucket.JSServerTask, error) {
 	return eventTask, nil
 }
 
+// Calls the function, first loading any changes to the shared JS modules.
+func (eventTask *jsEventTask) Call(inputs ...interface{}) (interface{}, error) {
+	if err := eventTask.modules.Load(); err != nil {
+		return nil, err
+	}
+	return eventTask.JSRunner.Call(inputs...)
+}
+
 //////// JSEventFunction
 
 // A thread-safe wrapper around a jsEventTask, i.e. an event function.
@@ -109,13 +138,13 @@ type JSEventFunction struct {
 	*sgbucket.JSServer
 }
 
-func NewJSEventFunction(fnSource string) *JSEventFunction {
+func NewJSEventFunction(fnSource string, modules *channels.JSModules) *JSEventFunction {
 
 	base.LogTo("Events", "Creating new JSEventFunction")
 	return &JSEventFunction{
 		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
 			func(fnSource string) (sgbucket.JSServerTask, error) {
-				return newJsEventTask(fnSource)
+				return newJsEventTask(fnSource, modules)
 			}),
 	}
 }
@@ -131,6 +160,8 @@ func (ef *JSEventFunction) CallFunction(event Event) (interface{}, error) {
 
 	case *DocumentChangeEvent:
 		result, err = ef.Call(event.Doc)
+	case *ConflictResolvedEvent:
+		result, err = ef.Call(event.Doc)
 	}
 
 	if err != nil {
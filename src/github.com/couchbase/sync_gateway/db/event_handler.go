@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -46,7 +47,7 @@ func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, e
 		url: url,
 	}
 	if filterFnString != "" {
-		wh.filter = NewJSEventFunction(filterFnString)
+		wh.filter = NewJSEventFunction(filterFnString, nil)
 	}
 
 	if timeout != nil {
@@ -62,6 +63,13 @@ func NewWebhook(url string, filterFnString string, timeout *uint64) (*Webhook, e
 	return wh, err
 }
 
+// Makes the shared JS modules available to the webhook's filter function.
+func (wh *Webhook) SetJSModules(modules *channels.JSModules) {
+	if wh.filter != nil {
+		wh.filter = NewJSEventFunction(wh.filter.Function(), modules)
+	}
+}
+
 // Performs an HTTP POST to the url defined for the handler.  If a filter function is defined,
 // calls it to determine whether to POST.  The payload for the POST is depends
 // on the event type.
@@ -93,6 +101,21 @@ func (wh *Webhook) HandleEvent(event Event) {
 		}
 		contentType = "application/json"
 		payload = bytes.NewBuffer(jsonOut)
+	case *ConflictResolvedEvent:
+		// for ConflictResolvedEvent, post the resolution along with the winning body
+		jsonOut, err := json.Marshal(map[string]interface{}{
+			"id":         event.Doc["_id"],
+			"outcome":    event.Outcome,
+			"conflicts":  event.Conflicts,
+			"tombstones": event.Tombstones,
+			"doc":        event.Doc,
+		})
+		if err != nil {
+			base.Warn("Error marshalling conflict resolution for webhook post")
+			return
+		}
+		contentType = "application/json"
+		payload = bytes.NewBuffer(jsonOut)
 	default:
 		base.Warn("Webhook invoked for unsupported event type.")
 		return
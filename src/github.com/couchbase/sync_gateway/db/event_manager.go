@@ -33,6 +33,11 @@ func NewEventManager() *EventManager {
 	return em
 }
 
+// Returns the number of async events waiting to be processed.
+func (em *EventManager) QueueLength() int {
+	return len(em.asyncEventChannel)
+}
+
 // Starts the listener queue for the event manager
 func (em *EventManager) Start(maxProcesses uint, waitTime int) {
 
@@ -129,3 +134,22 @@ func (em *EventManager) RaiseDocumentChangeEvent(body Body, channels base.Set) e
 	return em.raiseEvent(event)
 
 }
+
+// Raises a conflict resolved event.  If the event manager doesn't have a listener for this event,
+// ignores.
+func (em *EventManager) RaiseConflictResolvedEvent(body Body, outcome string, conflicts []string, tombstones []string) error {
+
+	if !em.activeEventTypes[ConflictResolved] {
+		return nil
+	}
+	event := &ConflictResolvedEvent{
+		Doc:        body,
+		Outcome:    outcome,
+		Conflicts:  conflicts,
+		Tombstones: tombstones,
+	}
+	event.eventType = ConflictResolved
+
+	return em.raiseEvent(event)
+
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Sources of access, as reported in an AccessGrant
+const (
+	GrantSourceAdminChannels = "admin_channels" // The principal's admin_channels
+	GrantSourceAdminRoles    = "admin_roles"    // The admin_roles of the user or a role
+	GrantSourceDocument      = "document"       // An access() or role() call of the sync function
+	GrantSourcePublic        = "public"         // Every user can see the public "!" channel
+)
+
+// Where a user's access to a channel or role came from.
+type AccessGrant struct {
+	Source       string `json:"source"`                // One of the GrantSource constants
+	Role         string `json:"role,omitempty"`        // The role the channel or role is inherited from, if any
+	DocID        string `json:"doc_id,omitempty"`      // The document whose sync function made the grant
+	CurrentRevID string `json:"current_rev,omitempty"` // That document's current revision (not necessarily the granting one)
+	Sequence     uint64 `json:"seq,omitempty"`         // The sequence at which access was granted
+	Expiry       int64  `json:"expiry,omitempty"`      // Unix time a temporary grant expires
+}
+
+// Every channel and role a user has, with the source(s) of each. Returned by ExplainAccess.
+type AccessExplanation struct {
+	Channels map[string][]AccessGrant `json:"channels"`
+	Roles    map[string][]AccessGrant `json:"roles"`
+}
+
+// Explains a user's access: lists the channels and roles it has, each with every grant that
+// gives it to the user, whether directly or through a (possibly inherited) role. Expired grants
+// aren't included.
+func (db *Database) ExplainAccess(username string) (*AccessExplanation, error) {
+	authr := db.Authenticator()
+	user, err := authr.GetUser(username)
+	if err != nil {
+		return nil, err
+	} else if user == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "No such user %q", username)
+	}
+	explanation := &AccessExplanation{
+		Channels: map[string][]AccessGrant{},
+		Roles:    map[string][]AccessGrant{},
+	}
+
+	for role, sequence := range user.ExplicitRoles() {
+		explanation.Roles[role] = append(explanation.Roles[role],
+			AccessGrant{Source: GrantSourceAdminRoles, Sequence: sequence})
+	}
+	if err = db.explainDocGrants(ViewRoleAccess, user.Name(), "role:", "", explanation.Roles); err != nil {
+		return nil, err
+	}
+
+	// Follow the roles' own roles, which the user inherits:
+	roles := map[string]auth.Role{}
+	pending := make([]string, 0, len(explanation.Roles))
+	for roleName := range explanation.Roles {
+		pending = append(pending, roleName)
+	}
+	for len(pending) > 0 {
+		roleName := pending[0]
+		pending = pending[1:]
+		if _, found := roles[roleName]; found {
+			continue
+		}
+		role, err := authr.GetRole(roleName)
+		if err != nil {
+			return nil, err
+		}
+		roles[roleName] = role
+		if role == nil {
+			continue
+		}
+		parents := map[string][]AccessGrant{}
+		for parent, sequence := range role.ExplicitRoles() {
+			parents[parent] = append(parents[parent],
+				AccessGrant{Source: GrantSourceAdminRoles, Role: roleName, Sequence: sequence})
+		}
+		if err = db.explainDocGrants(ViewRoleAccess, "role:"+roleName, "role:", roleName, parents); err != nil {
+			return nil, err
+		}
+		for parent, grants := range parents {
+			explanation.Roles[parent] = append(explanation.Roles[parent], grants...)
+			pending = append(pending, parent)
+		}
+	}
+
+	if err = db.explainPrincipalChannels(user, "", explanation.Channels); err != nil {
+		return nil, err
+	}
+	explanation.Channels[channels.DocumentStarChannel] = append(
+		explanation.Channels[channels.DocumentStarChannel],
+		AccessGrant{Source: GrantSourcePublic, Sequence: 1})
+	for roleName, role := range roles {
+		if role != nil {
+			if err = db.explainPrincipalChannels(role, roleName, explanation.Channels); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return explanation, nil
+}
+
+// Adds the channels a user or role has been granted, by the admin API or by documents.
+func (db *Database) explainPrincipalChannels(princ auth.Principal, viaRole string, grants map[string][]AccessGrant) error {
+	for channel, sequence := range princ.ExplicitChannels() {
+		grants[channel] = append(grants[channel],
+			AccessGrant{Source: GrantSourceAdminChannels, Role: viaRole, Sequence: sequence})
+	}
+	key := princ.Name()
+	if viaRole != "" {
+		key = "role:" + key // Roles are identified in access view by a "role:" prefix
+	}
+	return db.explainDocGrants(ViewAccess, key, "", viaRole, grants)
+}
+
+// Adds the unexpired grants that documents have made to a user or role, according to an access
+// view. Expiry keys are the granted names plus expiryPrefix.
+func (db *Database) explainDocGrants(viewName, key, expiryPrefix, viaRole string, grants map[string][]AccessGrant) error {
+	rows, err := db.queryAccessView(viewName, key, expiryPrefix)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var currentRevID string
+		if doc, err := db.GetDoc(row.ID); err == nil {
+			currentRevID = doc.CurrentRev
+		}
+		for name, sequence := range row.Value {
+			grants[name] = append(grants[name], AccessGrant{
+				Source:       GrantSourceDocument,
+				Role:         viaRole,
+				DocID:        row.ID,
+				CurrentRevID: currentRevID,
+				Sequence:     sequence,
+				Expiry:       row.Expiry[name],
+			})
+		}
+	}
+	return nil
+}
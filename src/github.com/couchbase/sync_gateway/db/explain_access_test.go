@@ -0,0 +1,63 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/channels"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestExplainAccess(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc) {
+		if (doc.access) access(doc.access.to, doc.access.channel);
+		if (doc.role) role(doc.role.to, "role:" + doc.role.name);
+	}`)
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("Netflix"))
+	user.SetExplicitRoles(channels.TimedSet{"animefan": 1})
+	assertNoError(t, authenticator.Save(user), "Save")
+	role, _ := authenticator.NewRole("animefan", channels.SetOf("Crunchyroll"))
+	role.SetExplicitRoles(channels.TimedSet{"otaku": 1})
+	assertNoError(t, authenticator.Save(role), "Save")
+	role, _ = authenticator.NewRole("otaku", channels.SetOf("Funimation"))
+	assertNoError(t, authenticator.Save(role), "Save")
+	role, _ = authenticator.NewRole("critic", nil)
+	assertNoError(t, authenticator.Save(role), "Save")
+
+	rev1, err := db.Put("hulu", Body{"access": Body{"to": "naomi", "channel": "Hulu"}})
+	assertNoError(t, err, "Put")
+	// A later revision that still makes the grant is reported, with the original grant's sequence:
+	rev1, err = db.Put("hulu", Body{"_rev": rev1, "access": Body{"to": "naomi", "channel": "Hulu"},
+		"note": "still shared"})
+	assertNoError(t, err, "Put")
+	rev2, err := db.Put("critics", Body{"role": Body{"to": "naomi", "name": "critic"},
+		"access": Body{"to": "role:critic", "channel": "Netflix"}})
+	assertNoError(t, err, "Put")
+
+	explanation, err := db.ExplainAccess("naomi")
+	assertNoError(t, err, "ExplainAccess")
+	assert.DeepEquals(t, explanation.Roles, map[string][]AccessGrant{
+		"animefan": {{Source: GrantSourceAdminRoles, Sequence: 1}},
+		"critic":   {{Source: GrantSourceDocument, DocID: "critics", CurrentRevID: rev2, Sequence: 3}},
+		"otaku":    {{Source: GrantSourceAdminRoles, Role: "animefan", Sequence: 1}},
+	})
+	assert.Equals(t, len(explanation.Channels), 5)
+	assert.DeepEquals(t, explanation.Channels["Hulu"], []AccessGrant{
+		{Source: GrantSourceDocument, DocID: "hulu", CurrentRevID: rev1, Sequence: 1}})
+	assert.DeepEquals(t, explanation.Channels["Crunchyroll"], []AccessGrant{
+		{Source: GrantSourceAdminChannels, Role: "animefan", Sequence: 1}})
+	assert.DeepEquals(t, explanation.Channels["Funimation"], []AccessGrant{
+		{Source: GrantSourceAdminChannels, Role: "otaku", Sequence: 1}})
+	assert.DeepEquals(t, explanation.Channels["!"], []AccessGrant{{Source: GrantSourcePublic, Sequence: 1}})
+	netflix := explanation.Channels["Netflix"]
+	assert.Equals(t, len(netflix), 2)
+	assert.DeepEquals(t, netflix[0], AccessGrant{Source: GrantSourceAdminChannels, Sequence: 1})
+	assert.DeepEquals(t, netflix[1], AccessGrant{Source: GrantSourceDocument, Role: "critic",
+		DocID: "critics", CurrentRevID: rev2, Sequence: 3})
+
+	_, err = db.ExplainAccess("nobody")
+	assertHTTPError(t, err, 404)
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// A thread-safe wrapper around a CouchDB-style JavaScript filter function. The function is
+// called as filter(doc, req), where req has the properties "query" (the request's parameters)
+// and "userCtx" (the requesting user, or null for an admin.) It returns true to let the doc
+// through.
+type JSFilter struct {
+	*sgbucket.JSServer
+}
+
+func NewJSFilter(fnSource string, modules *channels.JSModules) *JSFilter {
+	return &JSFilter{
+		JSServer: sgbucket.NewJSServer(fnSource, kTaskCacheSize,
+			func(fnSource string) (sgbucket.JSServerTask, error) {
+				return newJsEventTask(fnSource, modules)
+			}),
+	}
+}
+
+// Calls the filter function on a document body.
+func (filter *JSFilter) Passes(doc Body, req map[string]interface{}) (bool, error) {
+	docJSON, err := json.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	result, err := filter.Call(sgbucket.JSONString(docJSON), sgbucket.JSONString(reqJSON))
+	if err != nil {
+		return false, err
+	}
+	return result == true, nil
+}
+
+// A filter function together with the parameters of the _changes request using it.
+type DocFilter struct {
+	Function *JSFilter
+	Query    map[string]interface{} // Request parameters, passed to the function as req.query
+}
+
+// Looks up a _changes filter function by its CouchDB-style name "ddoc/filter". The filters of
+// the "sync_gateway" design doc come from the database config; others are saved with design docs.
+func (db *Database) GetChangesFilter(name string) (*JSFilter, error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid filter name %q", name)
+	}
+	if parts[0] == DesignDocSyncGateway {
+		if filter := db.ChangesFilters[parts[1]]; filter != nil {
+			return filter, nil
+		}
+	} else {
+		filters, err := db.getDesignDocFilters(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if source, found := filters[parts[1]]; found {
+			return NewJSFilter(source, db.JSModules), nil
+		}
+	}
+	return nil, base.HTTPErrorf(http.StatusNotFound, "No such filter %q", name)
+}
+
+// Runs a change entry's document through a filter. Entries that don't represent a revision,
+// such as removals from the user's channels and changes to the user, always pass.
+func (db *Database) changeEntryPassesFilter(entry *ChangeEntry, filter *DocFilter) bool {
+	if entry.Removed != nil || len(entry.Changes) == 0 {
+		return true
+	}
+	body := entry.Doc
+	if body == nil {
+		var err error
+		if body, err = db.GetRev(entry.ID, entry.Changes[0]["rev"], false, nil); err != nil {
+			base.Warn("Changes feed: error getting doc %q to filter it: %v", entry.ID, err)
+			return false
+		}
+	}
+	req := map[string]interface{}{"query": filter.Query, "userCtx": makeUserCtx(db.user)}
+	passes, err := filter.Function.Passes(body, req)
+	if err != nil {
+		base.Warn("Changes feed: filter function failed on doc %q: %v", entry.ID, err)
+		return false
+	}
+	return passes
+}
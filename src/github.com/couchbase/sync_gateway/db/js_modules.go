@@ -0,0 +1,28 @@
+package db
+
+import (
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Key of the document that stores the JS modules set through the admin API
+const kJSModulesKey = kSyncKeyPrefix + "js_modules"
+
+// Loads the JS modules saved by SetJSModules. Returns false if none were ever saved.
+func (context *DatabaseContext) LoadJSModules() (bool, error) {
+	var sources map[string]string
+	if err := context.Bucket.Get(kJSModulesKey, &sources); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, context.JSModules.Set(sources)
+}
+
+// Replaces all the JS modules, and saves them so they're loaded when the database restarts.
+func (context *DatabaseContext) SetJSModules(sources map[string]string) error {
+	if err := context.JSModules.Set(sources); err != nil {
+		return err
+	}
+	return context.Bucket.Set(kJSModulesKey, 0, sources)
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/channels"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestSavedJSModules(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	found, err := db.LoadJSModules()
+	assertNoError(t, err, "LoadJSModules failed")
+	assert.False(t, found)
+
+	sources := map[string]string{"util": `exports.double = function(n) {return 2 * n;};`}
+	assertNoError(t, db.SetJSModules(sources), "SetJSModules failed")
+	assert.True(t, db.SetJSModules(map[string]string{"bad": `exports.x = ;`}) != nil)
+
+	// A restarted database loads the saved modules:
+	db.JSModules = channels.NewJSModules()
+	found, err = db.LoadJSModules()
+	assertNoError(t, err, "LoadJSModules failed")
+	assert.True(t, found)
+	assert.DeepEquals(t, db.JSModules.Sources(), sources)
+}
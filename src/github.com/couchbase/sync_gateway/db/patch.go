@@ -0,0 +1,323 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// One operation of a JSON Patch (RFC 6902.)
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`    // "add", "remove", "replace", "move", "copy" or "test"
+	Path  string      `json:"path"`  // JSON Pointer (RFC 6901) to the target location
+	From  string      `json:"from"`  // JSON Pointer to the source location, for "move" & "copy"
+	Value interface{} `json:"value"` // Value to add/replace/test
+}
+
+// Returned by Patch's update callback when the patched body sets a different expiry than the
+// one the update was started with.
+var errPatchExpiry = errors.New("patch changes expiry")
+
+// Updates the current revision of a document by applying a patch function to a copy of its
+// body, creating a new revision. If matchRev is nonempty, it must be the current revision.
+// Like Put, this is atomic: if another writer changes the doc concurrently, the patch is applied
+// again to the new current revision (unless matchRev was given; then that's a conflict.)
+// The doc keeps its expiry unless the patched body has an "_exp" property.
+func (db *Database) Patch(docid, matchRev string, patch func(Body) (Body, error)) (string, error) {
+	// updateDoc needs the expiry before the patch can be applied, so if the patch sets one, the
+	// update is retried with it:
+	var expiry *time.Time
+	for {
+		var patchedExpiry *time.Time
+		newRev, err := db.updateDoc(docid, false, expiry, func(doc *document) (Body, error) {
+			// (Be careful: this block can be invoked multiple times if there are races!)
+			parentRev := doc.CurrentRev
+			if parentRev == "" {
+				return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+			} else if doc.History[parentRev].Deleted {
+				return nil, base.HTTPErrorf(http.StatusNotFound, "deleted")
+			} else if matchRev != "" && matchRev != parentRev {
+				return nil, base.HTTPErrorf(http.StatusConflict, "Document revision conflict")
+			}
+
+			// Patch a deep copy of the current body, so the document is untouched if this is retried:
+			var body Body
+			bodyJSON, err := json.Marshal(doc.body)
+			if err == nil {
+				err = json.Unmarshal(bodyJSON, &body)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if body, err = patch(stripSpecialProperties(body)); err != nil {
+				return nil, err
+			}
+
+			// The patched body has to be valid as a PUT body:
+			if patchedExpiry, err = parseExpiry(body); err != nil {
+				return nil, err
+			}
+			delete(body, "_exp")
+			if containsUserSpecialProperties(body) {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "user defined top level properties beginning with '_' are not allowed in document body")
+			}
+			if patchedExpiry != nil && (expiry == nil || !patchedExpiry.Equal(*expiry)) {
+				return nil, errPatchExpiry
+			}
+			deleted, _ := body["_deleted"].(bool)
+
+			generation, _ := parseRevID(parentRev)
+			generation++
+			if err := db.storeAttachments(doc, body, generation, parentRev); err != nil {
+				return nil, err
+			}
+			newRev := createRevID(generation, parentRev, body)
+			body["_rev"] = newRev
+			doc.History.addRevision(RevInfo{ID: newRev, Parent: parentRev, Deleted: deleted})
+			return body, nil
+		})
+		if err != errPatchExpiry {
+			return newRev, err
+		}
+		expiry = patchedExpiry
+	}
+}
+
+// Applies a JSON Merge Patch (RFC 7396) to a value, returning the result. Objects in the target
+// are modified in place.
+func ApplyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := asJSONObject(target)
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = ApplyMergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// Applies a JSON Patch (RFC 6902) to a document body, returning the result. The body may be
+// modified in place. Returns a 409 error if a "test" operation fails, or a 422 error if an
+// operation's path doesn't exist.
+func ApplyJSONPatch(body Body, operations []JSONPatchOperation) (Body, error) {
+	var doc interface{} = map[string]interface{}(body)
+	for _, op := range operations {
+		path, err := parseJSONPointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		switch op.Op {
+		case "add":
+			doc, err = jsonPointerAdd(doc, path, op.Value)
+		case "remove":
+			doc, _, err = jsonPointerRemove(doc, path)
+		case "replace":
+			if doc, _, err = jsonPointerRemove(doc, path); err == nil {
+				doc, err = jsonPointerAdd(doc, path, op.Value)
+			}
+		case "move", "copy":
+			var from []string
+			if from, err = parseJSONPointer(op.From); err != nil {
+				return nil, err
+			}
+			if op.Op == "move" {
+				doc, value, err = jsonPointerRemove(doc, from)
+			} else if value, err = jsonPointerGet(doc, from); err == nil {
+				value = copyJSONValue(value)
+			}
+			if err == nil {
+				doc, err = jsonPointerAdd(doc, path, value)
+			}
+		case "test":
+			if value, err = jsonPointerGet(doc, path); err == nil && !jsonValuesEqual(value, op.Value) {
+				err = base.HTTPErrorf(http.StatusConflict, "JSON Patch test of %q failed", op.Path)
+			}
+		default:
+			err = base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON Patch operation %q", op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	result, ok := asJSONObject(doc)
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusUnprocessableEntity, "JSON Patch result is not an object")
+	}
+	return result, nil
+}
+
+// Parses a JSON Pointer (RFC 6901) into its reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	} else if pointer[0] != '/' {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid JSON Pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func jsonPointerError(path []string) error {
+	return base.HTTPErrorf(http.StatusUnprocessableEntity, "JSON Pointer /%s doesn't exist",
+		strings.Join(path, "/"))
+}
+
+// Parses a JSON Pointer token as an index into an array. If forInsert is true, the index may be
+// the array's length, which can also be given as "-".
+func jsonArrayIndex(token string, length int, forInsert bool) (int, bool) {
+	if forInsert && token == "-" {
+		return length, true
+	} else if len(token) > 1 && token[0] == '0' {
+		return 0, false // leading zeroes aren't allowed
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !forInsert) {
+		return 0, false
+	}
+	return i, true
+}
+
+// Returns the value a JSON Pointer refers to.
+func jsonPointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		if object, ok := asJSONObject(doc); ok {
+			if doc, ok = object[token]; !ok {
+				return nil, jsonPointerError(path)
+			}
+		} else if array, ok := doc.([]interface{}); ok {
+			i, ok := jsonArrayIndex(token, len(array), false)
+			if !ok {
+				return nil, jsonPointerError(path)
+			}
+			doc = array[i]
+		} else {
+			return nil, jsonPointerError(path)
+		}
+	}
+	return doc, nil
+}
+
+// Calls 'update' on the object or array containing the location a JSON Pointer refers to, and
+// stores the container it returns (arrays may be reallocated) back in its parent.
+func jsonPointerUpdate(doc interface{}, path []string, i int, update func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if i == len(path)-1 {
+		return update(doc, path[i])
+	}
+	if object, ok := asJSONObject(doc); ok {
+		child, found := object[path[i]]
+		if !found {
+			return nil, jsonPointerError(path)
+		}
+		newChild, err := jsonPointerUpdate(child, path, i+1, update)
+		if err != nil {
+			return nil, err
+		}
+		object[path[i]] = newChild
+		return object, nil
+	} else if array, ok := doc.([]interface{}); ok {
+		index, ok := jsonArrayIndex(path[i], len(array), false)
+		if !ok {
+			return nil, jsonPointerError(path)
+		}
+		newChild, err := jsonPointerUpdate(array[index], path, i+1, update)
+		if err != nil {
+			return nil, err
+		}
+		array[index] = newChild
+		return array, nil
+	}
+	return nil, jsonPointerError(path)
+}
+
+// Adds a value at a JSON Pointer's location, returning the updated document.
+func jsonPointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdate(doc, path, 0, func(container interface{}, token string) (interface{}, error) {
+		if object, ok := asJSONObject(container); ok {
+			object[token] = value
+			return object, nil
+		} else if array, ok := container.([]interface{}); ok {
+			i, ok := jsonArrayIndex(token, len(array), true)
+			if !ok {
+				return nil, jsonPointerError(path)
+			}
+			array = append(array, nil)
+			copy(array[i+1:], array[i:])
+			array[i] = value
+			return array, nil
+		}
+		return nil, jsonPointerError(path)
+	})
+}
+
+// Removes the value at a JSON Pointer's location, returning the updated document and the value.
+func jsonPointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, base.HTTPErrorf(http.StatusUnprocessableEntity, "Can't remove the entire document")
+	}
+	var removed interface{}
+	doc, err := jsonPointerUpdate(doc, path, 0, func(container interface{}, token string) (interface{}, error) {
+		if object, ok := asJSONObject(container); ok {
+			var found bool
+			if removed, found = object[token]; !found {
+				return nil, jsonPointerError(path)
+			}
+			delete(object, token)
+			return object, nil
+		} else if array, ok := container.([]interface{}); ok {
+			i, ok := jsonArrayIndex(token, len(array), false)
+			if !ok {
+				return nil, jsonPointerError(path)
+			}
+			removed = array[i]
+			return append(array[:i], array[i+1:]...), nil
+		}
+		return nil, jsonPointerError(path)
+	})
+	return doc, removed, err
+}
+
+// Makes a deep copy of an unmarshaled JSON value.
+func copyJSONValue(value interface{}) interface{} {
+	if object, ok := asJSONObject(value); ok {
+		copied := make(map[string]interface{}, len(object))
+		for key, item := range object {
+			copied[key] = copyJSONValue(item)
+		}
+		return copied
+	} else if array, ok := value.([]interface{}); ok {
+		copied := make([]interface{}, len(array))
+		for i, item := range array {
+			copied[i] = copyJSONValue(item)
+		}
+		return copied
+	}
+	return value
+}
+
+// Compares two values by their JSON encodings, so numbers of different Go types can match.
+func jsonValuesEqual(a, b interface{}) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aJSON, bJSON)
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func parseJSONBody(t *testing.T, jsonStr string) Body {
+	var body Body
+	assertNoError(t, json.Unmarshal([]byte(jsonStr), &body), "Bad JSON")
+	return body
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	body := parseJSONBody(t, `{"a":"b", "c":{"d":"e", "f":"g"}, "list":[1,2]}`)
+	var patch interface{}
+	json.Unmarshal([]byte(`{"a":"z", "c":{"f":null, "h":1}, "list":[3], "new":{"x":null, "y":2}}`), &patch)
+	result := ApplyMergePatch(map[string]interface{}(body), patch)
+	assert.DeepEquals(t, result, map[string]interface{}(parseJSONBody(t,
+		`{"a":"z", "c":{"d":"e", "h":1}, "list":[3], "new":{"y":2}}`)))
+	assert.Equals(t, ApplyMergePatch(body, "scalar"), "scalar")
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	var tests = []struct {
+		patch    string
+		expected string
+		status   int
+	}{
+		{`[{"op":"add", "path":"/baz", "value":"qux"}]`, `{"foo":"bar", "list":[1,2], "obj":{"a/b":1, "m~n":2}, "baz":"qux"}`, 0},
+		{`[{"op":"add", "path":"/list/1", "value":9}]`, `{"foo":"bar", "list":[1,9,2], "obj":{"a/b":1, "m~n":2}}`, 0},
+		{`[{"op":"add", "path":"/list/-", "value":9}]`, `{"foo":"bar", "list":[1,2,9], "obj":{"a/b":1, "m~n":2}}`, 0},
+		{`[{"op":"remove", "path":"/obj/a~1b"}]`, `{"foo":"bar", "list":[1,2], "obj":{"m~n":2}}`, 0},
+		{`[{"op":"replace", "path":"/obj/m~0n", "value":3}]`, `{"foo":"bar", "list":[1,2], "obj":{"a/b":1, "m~n":3}}`, 0},
+		{`[{"op":"replace", "path":"/list/0", "value":0}]`, `{"foo":"bar", "list":[0,2], "obj":{"a/b":1, "m~n":2}}`, 0},
+		{`[{"op":"move", "from":"/foo", "path":"/obj/foo"}]`, `{"list":[1,2], "obj":{"a/b":1, "m~n":2, "foo":"bar"}}`, 0},
+		{`[{"op":"copy", "from":"/list", "path":"/list2"}, {"op":"add", "path":"/list2/-", "value":3}]`,
+			`{"foo":"bar", "list":[1,2], "list2":[1,2,3], "obj":{"a/b":1, "m~n":2}}`, 0},
+		{`[{"op":"test", "path":"/list/1", "value":2}, {"op":"remove", "path":"/list"}]`, `{"foo":"bar", "obj":{"a/b":1, "m~n":2}}`, 0},
+		{`[{"op":"test", "path":"/foo", "value":"baz"}]`, ``, 409},
+		{`[{"op":"remove", "path":"/nothing"}]`, ``, 422},
+		{`[{"op":"replace", "path":"/list/2", "value":3}]`, ``, 422},
+		{`[{"op":"add", "path":"/list/01", "value":3}]`, ``, 422},
+		{`[{"op":"add", "path":"", "value":[]}]`, ``, 422},
+		{`[{"op":"add", "path":"foo", "value":1}]`, ``, 400},
+		{`[{"op":"frob", "path":"/foo"}]`, ``, 400},
+	}
+	for _, test := range tests {
+		body := parseJSONBody(t, `{"foo":"bar", "list":[1,2], "obj":{"a/b":1, "m~n":2}}`)
+		var operations []JSONPatchOperation
+		assertNoError(t, json.Unmarshal([]byte(test.patch), &operations), "Bad patch")
+		result, err := ApplyJSONPatch(body, operations)
+		if test.status == 0 {
+			assertNoError(t, err, "ApplyJSONPatch failed: "+test.patch)
+			assert.DeepEquals(t, result, parseJSONBody(t, test.expected))
+		} else {
+			assertHTTPError(t, err, test.status)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	rev1id, err := db.Put("doc1", Body{"count": 1, "name": "x"})
+	assertNoError(t, err, "Couldn't create document")
+
+	increment := func(body Body) (Body, error) {
+		body["count"] = body["count"].(float64) + 1
+		return body, nil
+	}
+	rev2id, err := db.Patch("doc1", "", increment)
+	assertNoError(t, err, "Patch failed")
+	gen, _ := parseRevID(rev2id)
+	assert.Equals(t, gen, 2)
+	body, err := db.Get("doc1")
+	assertNoError(t, err, "Couldn't get document")
+	assert.True(t, jsonValuesEqual(body["count"], 2))
+	assert.Equals(t, body["name"], "x")
+
+	_, err = db.Patch("doc1", rev1id, increment)
+	assertHTTPError(t, err, 409)
+	_, err = db.Patch("doc1", rev2id, increment)
+	assertNoError(t, err, "Patch with matching rev failed")
+
+	_, err = db.Patch("nosuchdoc", "", increment)
+	assertHTTPError(t, err, 404)
+	_, err = db.Patch("doc1", "", func(body Body) (Body, error) {
+		return nil, base.HTTPErrorf(422, "nope")
+	})
+	assertHTTPError(t, err, 422)
+
+	// The doc keeps its expiry unless the patch sets "_exp":
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = db.Put("doc2", Body{"count": 1, "_exp": expiry.Format(time.RFC3339)})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Patch("doc2", "", increment)
+	assertNoError(t, err, "Patch failed")
+	doc, err := db.GetDoc("doc2")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.True(t, doc.Expiry != nil && doc.Expiry.Equal(expiry))
+	_, err = db.Patch("doc2", "", func(body Body) (Body, error) {
+		body["_exp"] = "2031-01-01T00:00:00Z"
+		return body, nil
+	})
+	assertNoError(t, err, "Patch of _exp failed")
+	doc, err = db.GetDoc("doc2")
+	assertNoError(t, err, "Couldn't get doc")
+	assert.True(t, doc.Expiry != nil && doc.Expiry.Year() == 2031)
+	body, err = db.Get("doc2")
+	assertNoError(t, err, "Couldn't get document")
+	assert.Equals(t, body["_exp"], nil)
+	assert.True(t, jsonValuesEqual(body["count"], 2))
+
+	_, err = db.Patch("doc2", "", func(body Body) (Body, error) {
+		body["_foo"] = 1
+		return body, nil
+	})
+	assertHTTPError(t, err, 400)
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Purges revisions of a document. Unlike a deletion, a purge leaves no trace behind, so it isn't
+// replicated. If revids contains "*", the entire document is purged, including its sync metadata
+// and archived revision bodies. Otherwise each of the given leaf revisions is purged along with
+// any ancestors it doesn't share with another branch. Returns the IDs of the purged revisions.
+func (db *Database) Purge(docid string, revids []string) ([]string, error) {
+	for _, revid := range revids {
+		if revid == "*" {
+			return db.purgeDoc(docid)
+		}
+	}
+	return db.purgeRevisions(docid, revids)
+}
+
+// Removes a document, its archived revisions and cached revisions/changes from the database.
+func (db *Database) purgeDoc(docid string) ([]string, error) {
+	key := realDocID(docid)
+	if key == "" {
+		return nil, base.HTTPErrorf(400, "Invalid doc ID")
+	}
+
+	// Delete the doc in an update (returning nil deletes it), so that if it changes after being
+	// read, it's read again; the revisions and access cleaned up below are the deleted ones.
+	var doc *document
+	err := db.Bucket.Update(key, 0, func(currentValue []byte) (updated []byte, err error) {
+		if currentValue == nil {
+			return nil, base.HTTPErrorf(404, "missing")
+		} else if doc, err = unmarshalDocument(docid, currentValue); err != nil {
+			return nil, err
+		} else if !doc.hasValidSyncData() {
+			return nil, base.HTTPErrorf(404, "Not imported")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	purged := make([]string, 0, len(doc.History))
+	for revid := range doc.History {
+		purged = append(purged, revid)
+	}
+	db.purgeRevisionBodies(docid, purged)
+	db.changeCache.removeDoc(docid)
+	if db.ChannelIndex != nil {
+		db.ChannelIndex.removeDocument(doc)
+	}
+	base.LogTo("CRUD", "Purged doc %q", docid)
+
+	// Users and roles the doc granted access to have to recompute their access:
+	for name := range doc.Access {
+		db.invalUserOrRoleChannels(name)
+	}
+	for name := range doc.RoleAccess {
+		db.invalUserOrRoleRoles(name)
+	}
+	return purged, nil
+}
+
+// Purges branches of a document's revision tree. If this changes the current revision, the doc
+// gets a new sequence number and its channels and access are recomputed.
+func (db *Database) purgeRevisions(docid string, revids []string) ([]string, error) {
+	key := realDocID(docid)
+	if key == "" {
+		return nil, base.HTTPErrorf(400, "Invalid doc ID")
+	}
+
+	var purged []string
+	var purgeAll bool
+	var changedPrincipals, changedRoleUsers []string
+	var docSequence uint64
+	var unusedSequences []uint64
+
+	err := db.Bucket.WriteUpdate(key, 0, func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, err error) {
+		// Be careful: this block can be invoked multiple times if there are races!
+		doc, err := unmarshalDocument(docid, currentValue)
+		if err != nil {
+			return
+		} else if !doc.hasValidSyncData() {
+			err = base.HTTPErrorf(404, "missing")
+			return
+		}
+
+		purged = nil
+		for _, revid := range revids {
+			purged = append(purged, doc.History.purgeLeaf(revid)...)
+		}
+		if len(purged) == 0 {
+			err = couchbase.UpdateCancel // Nothing to purge
+			return
+		} else if len(doc.History) == 0 {
+			purgeAll = true // Every revision was purged; purgeDoc will take care of it
+			err = couchbase.UpdateCancel
+			return
+		}
+
+		if doc.NewestRev != "" && !doc.History.contains(doc.NewestRev) {
+			doc.NewestRev = ""
+		}
+		prevCurrentRev := doc.CurrentRev
+		var branched, inConflict bool
+		doc.CurrentRev, branched, inConflict = doc.History.winningRevision()
+		doc.setFlag(channels.Deleted, doc.History[doc.CurrentRev].Deleted)
+		doc.setFlag(channels.Conflict, inConflict)
+		doc.setFlag(channels.Branched, branched)
+		doc.setFlag(channels.Hidden, doc.NewestRev != "")
+
+		if doc.CurrentRev != prevCurrentRev {
+			// Another revision has become current, so move its body to the top level. The doc
+			// can't be left without a current body, so the purge fails if it's not available:
+			curBody := doc.History.getParsedRevisionBody(doc.CurrentRev)
+			if curBody == nil {
+				if data, _ := db.getOldRevisionJSON(docid, doc.CurrentRev); data != nil {
+					json.Unmarshal(data, &curBody)
+				}
+			}
+			if curBody == nil {
+				err = base.HTTPErrorf(http.StatusConflict, "Can't purge: the body of revision %q, which would become current, is not available", doc.CurrentRev)
+				return
+			}
+			doc.body = curBody
+			doc.History.setRevisionBody(doc.CurrentRev, nil)
+
+			// Get the new current revision's channels & access:
+			body := curBody.ShallowCopy()
+			body["_id"] = docid
+			body["_rev"] = doc.CurrentRev
+			if doc.hasFlag(channels.Deleted) {
+				body["_deleted"] = true
+			}
+			channelSet, access, roles, accessExpiry, err := db.getChannelsAndAccess(doc, body, doc.CurrentRev)
+			if err != nil {
+				return nil, writeOpts, err
+			}
+
+			// Assign a new sequence so the change shows up in the _changes feed:
+			if docSequence <= doc.Sequence {
+				if docSequence > 0 {
+					unusedSequences = append(unusedSequences, docSequence)
+				}
+				if docSequence, err = db.sequences.nextSequence(); err != nil {
+					return nil, writeOpts, err
+				}
+			}
+			doc.Sequence = docSequence
+			doc.UnusedSequences = unusedSequences
+			doc.RecentSequences = append(doc.RecentSequences, unusedSequences...)
+			doc.RecentSequences = append(doc.RecentSequences, docSequence)
+
+			doc.updateChannels(channelSet)
+			changedPrincipals = doc.Access.updateAccess(doc, access)
+			changedRoleUsers = doc.RoleAccess.updateAccess(doc, roles)
+			changedPrincipals, changedRoleUsers = doc.updateAccessExpiry(accessExpiry, changedPrincipals, changedRoleUsers)
+			if len(changedPrincipals) > 0 || len(changedRoleUsers) > 0 {
+				writeOpts |= sgbucket.Indexable
+			}
+			doc.TimeSaved = time.Now()
+		}
+
+		raw, err = json.Marshal(doc)
+		return
+	})
+
+	if purgeAll {
+		return db.purgeDoc(docid)
+	} else if err == couchbase.UpdateCancel {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	db.DbStats.Add("document_writes", 1)
+	db.purgeRevisionBodies(docid, purged)
+	base.LogTo("CRUD", "Purged revisions %v of doc %q", purged, docid)
+
+	for _, name := range changedPrincipals {
+		db.invalUserOrRoleChannels(name)
+	}
+	for _, name := range changedRoleUsers {
+		db.invalUserOrRoleRoles(name)
+	}
+	return purged, nil
+}
+
+// Removes purged revisions from the revision cache, and deletes their archived bodies.
+func (db *Database) purgeRevisionBodies(docid string, revids []string) {
+	for _, revid := range revids {
+		db.revisionCache.Remove(docid, revid)
+		if err := db.Bucket.Delete(oldRevisionKey(docid, revid)); err != nil && !base.IsDocNotFoundError(err) {
+			base.Warn("Purge: Couldn't delete old revision %q / %q: %v", docid, revid, err)
+		}
+	}
+}
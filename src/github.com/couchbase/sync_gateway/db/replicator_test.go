@@ -0,0 +1,129 @@
+package db
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+func setupReplicationTargetDB(t *testing.T) *Database {
+	bucket, err := ConnectToBucket(base.BucketSpec{
+		Server:     kTestURL,
+		BucketName: "sync_gateway_tests_target"})
+	assertNoError(t, err, "Couldn't connect to target bucket")
+	context, err := NewDatabaseContext("target", bucket, false, CacheOptions{})
+	assertNoError(t, err, "Couldn't create context for database 'target'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'target'")
+	return db
+}
+
+func TestLocalReplication(t *testing.T) {
+	source := setupTestDB(t)
+	defer tearDownTestDB(t, source)
+	target := setupReplicationTargetDB(t)
+	defer tearDownTestDB(t, target)
+
+	rev1, err := source.Put("doc1", Body{"n": 1})
+	assertNoError(t, err, "Put doc1")
+	_, err = source.Put("doc1", Body{"n": "two", "_rev": rev1})
+	assertNoError(t, err, "Update doc1")
+	_, err = source.Put("doc2", Body{"n": 3})
+	assertNoError(t, err, "Put doc2")
+	source.changeCache.waitForSequence(3)
+
+	replicator := NewReplicator()
+	from, err := NewLocalReplicationEndpoint(source.DatabaseContext)
+	assertNoError(t, err, "Create source endpoint")
+	to, err := NewLocalReplicationEndpoint(target.DatabaseContext)
+	assertNoError(t, err, "Create target endpoint")
+	replication, err := replicator.Replicate(from, to, false)
+	assertNoError(t, err, "Replicate")
+	status, err := replication.Wait()
+	assertNoError(t, err, "Replication failed")
+	assert.Equals(t, status.State, ReplicationStateCompleted)
+	assert.Equals(t, status.DocsWritten, 2)
+	assert.Equals(t, status.DocWriteFailures, 0)
+
+	body, err := target.Get("doc1")
+	assertNoError(t, err, "Get replicated doc1")
+	assert.Equals(t, body["n"], "two")
+	missing, _ := target.RevDiff("doc1", []string{rev1})
+	assert.Equals(t, len(missing), 0)
+
+	// The checkpoint should be saved in the target:
+	checkpoint, err := target.GetSpecial("local", kReplicationCheckpointPrefix+ReplicationID(from, to))
+	assertNoError(t, err, "Get checkpoint")
+	assert.Equals(t, checkpoint["last_seq"], "3")
+
+	// Running it again should resume from the checkpoint and copy only new revisions:
+	_, err = source.Put("doc3", Body{"n": 4})
+	assertNoError(t, err, "Put doc3")
+	source.changeCache.waitForSequence(4)
+	replication, err = replicator.Replicate(from, to, false)
+	assertNoError(t, err, "Replicate")
+	status, err = replication.Wait()
+	assertNoError(t, err, "Second replication failed")
+	assert.Equals(t, status.DocsRead, 1)
+	assert.Equals(t, status.DocsWritten, 1)
+
+	// The completed replication is still listed:
+	tasks := replicator.ActiveTasks()
+	assert.Equals(t, len(tasks), 1)
+	assert.Equals(t, tasks[0].State, ReplicationStateCompleted)
+}
+
+func TestCancelContinuousReplication(t *testing.T) {
+	source := setupTestDB(t)
+	defer tearDownTestDB(t, source)
+	target := setupReplicationTargetDB(t)
+	defer tearDownTestDB(t, target)
+
+	replicator := NewReplicator()
+	from, err := NewLocalReplicationEndpoint(source.DatabaseContext)
+	assertNoError(t, err, "Create source endpoint")
+	to, err := NewLocalReplicationEndpoint(target.DatabaseContext)
+	assertNoError(t, err, "Create target endpoint")
+	replication, err := replicator.Replicate(from, to, true)
+	assertNoError(t, err, "Replicate")
+	assert.Equals(t, len(replicator.ActiveTasks()), 1)
+
+	// Starting it again with different parameters is a conflict:
+	_, err = replicator.Replicate(from, to, false)
+	assertHTTPError(t, err, 409)
+
+	assertNoError(t, replicator.Cancel(replication.ID), "Cancel")
+	status, err := replication.Wait()
+	assertNoError(t, err, "Cancelled replication returned error")
+	assert.Equals(t, status.State, ReplicationStateCancelled)
+	assertHTTPError(t, replicator.Cancel("bogus"), 404)
+}
+
+func TestCancelStalledRemoteRequest(t *testing.T) {
+	stall := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stall
+	}))
+	defer server.Close()
+	defer close(stall)
+
+	endpoint := NewRemoteReplicationEndpoint(server.URL+"/db", nil)
+	terminator := make(chan bool)
+	result := make(chan error, 1)
+	go func() {
+		_, err := endpoint.RevsDiff(map[string][]string{"doc": {"1-a"}}, terminator)
+		result <- err
+	}()
+	close(terminator)
+	select {
+	case err := <-result:
+		assertHTTPError(t, err, 502)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("RevsDiff wasn't aborted by its terminator")
+	}
+}
@@ -2,7 +2,10 @@ package db
 
 import (
 	"container/list"
+	"expvar"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/couchbase/sync_gateway/base"
 )
@@ -13,28 +16,42 @@ type RevisionCache struct {
 	lruList    *list.List                 // List ordered by most recent access (Front is newest)
 	capacity   int                        // Max number of revisions to cache
 	loaderFunc RevisionCacheLoaderFunc
-	lock       sync.Mutex // For thread-safety
+	lock       sync.Mutex  // For thread-safety
+	stats      *expvar.Map // Gets this cache's share of the dbExpvars revisionCache counters
 }
 
 type RevisionCacheLoaderFunc func(id IDAndRev) (body Body, history Body, channels base.Set, err error)
 
 // The cache payload data. Stored as the Value of a list Element.
 type revCacheValue struct {
-	key      IDAndRev   // doc/rev IDs
-	body     Body       // Revision body (a pristine shallow copy)
-	history  Body       // Rev history encoded like a "_revisions" property
-	channels base.Set   // Set of channels that have access
-	err      error      // Error from loaderFunc if it failed
-	lock     sync.Mutex // Synchronizes access to this struct
+	key      IDAndRev                  // doc/rev IDs
+	body     Body                      // Revision body (a pristine shallow copy)
+	history  Body                      // Rev history encoded like a "_revisions" property
+	channels base.Set                  // Set of channels that have access
+	err      error                     // Error from loaderFunc if it failed
+	deltas   map[string]*revCacheDelta // Deltas to this revision, keyed by ancestor rev ID
+	expiry   time.Time                 // When the doc expires (zero if it doesn't)
+	lock     sync.Mutex                // Synchronizes access to this struct
 }
 
-// Creates a revision cache with the given capacity and an optional loader function.
-func NewRevisionCache(capacity int, loaderFunc RevisionCacheLoaderFunc) *RevisionCache {
+// A delta to a cached revision from one of its ancestors. (See DiffBodies.)
+type revCacheDelta struct {
+	delta        Body     // The delta
+	fromChannels base.Set // Set of channels that have access to the ancestor
+}
+
+// Creates a revision cache with the given capacity and an optional loader function. Its hit and
+// miss counts are added to 'stats', such as a database's DbStats; if nil, it gets its own map.
+func NewRevisionCache(capacity int, loaderFunc RevisionCacheLoaderFunc, stats *expvar.Map) *RevisionCache {
+	if stats == nil {
+		stats = new(expvar.Map).Init()
+	}
 	return &RevisionCache{
 		cache:      map[IDAndRev]*list.Element{},
 		lruList:    list.New(),
 		capacity:   capacity,
 		loaderFunc: loaderFunc,
+		stats:      stats,
 	}
 }
 
@@ -42,12 +59,19 @@ func NewRevisionCache(capacity int, loaderFunc RevisionCacheLoaderFunc) *Revisio
 // Returns the body of the revision, its history, and the set of channels it's in.
 // If the cache has a loaderFunction, it will be called if the revision isn't in the cache;
 // any error returned by the loaderFunction will be returned from Get.
+// Bodies given to the cache (by Put or the loaderFunction) may have an "_exp" property holding
+// the doc's expiry time; the cache strips it, and returns a 404 error once that time has passed.
 func (rc *RevisionCache) Get(docid, revid string) (Body, Body, base.Set, error) {
 	value := rc.getValue(docid, revid, rc.loaderFunc != nil)
 	if value == nil {
 		return nil, nil, nil, nil
 	}
-	body, history, channels, err := value.load(rc.loaderFunc)
+	body, history, channels, hit, err := value.load(rc.loaderFunc)
+	if hit {
+		rc.addStat("revisionCache_hits")
+	} else {
+		rc.addStat("revisionCache_misses")
+	}
 	if err != nil {
 		rc.removeValue(value) // don't keep failed loads in the cache
 	}
@@ -64,6 +88,72 @@ func (rc *RevisionCache) Put(body Body, history Body, channels base.Set) {
 	value.store(body, history, channels)
 }
 
+// Increments a revisionCache counter, both the global one and this cache's share of it.
+func (rc *RevisionCache) addStat(key string) {
+	dbExpvars.Add(key, 1)
+	rc.stats.Add(key, 1)
+}
+
+// Looks up a cached delta to a revision from an ancestor revision, returning it and the
+// ancestor's channels, or nil if it's not cached.
+func (rc *RevisionCache) GetDelta(docid, revid, fromRevID string) (Body, base.Set) {
+	value := rc.getValue(docid, revid, false)
+	if value == nil {
+		return nil, nil
+	}
+	value.lock.Lock()
+	defer value.lock.Unlock()
+	if cached := value.deltas[fromRevID]; cached != nil {
+		return cached.delta, cached.fromChannels
+	}
+	return nil, nil
+}
+
+// Caches a delta to a revision from an ancestor revision. Deltas are only kept as long as
+// the revision itself is cached.
+func (rc *RevisionCache) PutDelta(docid, revid, fromRevID string, delta Body, fromChannels base.Set) {
+	value := rc.getValue(docid, revid, false)
+	if value == nil {
+		return
+	}
+	value.lock.Lock()
+	if value.deltas == nil {
+		value.deltas = map[string]*revCacheDelta{}
+	}
+	value.deltas[fromRevID] = &revCacheDelta{delta: delta, fromChannels: fromChannels}
+	value.lock.Unlock()
+}
+
+// Returns the number of revisions in the cache, and the number of cache hits and misses so far.
+func (rc *RevisionCache) Statistics() (size int, hits uint64, misses uint64) {
+	rc.lock.Lock()
+	size = len(rc.cache)
+	rc.lock.Unlock()
+	count := func(key string) uint64 {
+		if value, ok := rc.stats.Get(key).(*expvar.Int); ok {
+			return uint64(value.Value())
+		}
+		return 0
+	}
+	return size, count("revisionCache_hits"), count("revisionCache_misses")
+}
+
+// Returns the number of revisions in the database's revision cache, and its hit and miss counts.
+func (context *DatabaseContext) RevisionCacheStatistics() (size int, hits uint64, misses uint64) {
+	return context.revisionCache.Statistics()
+}
+
+// Removes a revision from the cache, if present.
+func (rc *RevisionCache) Remove(docid, revid string) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	key := IDAndRev{DocID: docid, RevID: revid}
+	if element := rc.cache[key]; element != nil {
+		rc.lruList.Remove(element)
+		delete(rc.cache, key)
+	}
+}
+
 func (rc *RevisionCache) getValue(docid, revid string, create bool) (value *revCacheValue) {
 	if docid == "" || revid == "" {
 		panic("RevisionCache: invalid empty doc/rev id")
@@ -100,23 +190,26 @@ func (rc *RevisionCache) purgeOldest_() {
 
 // Gets the body etc. out of a revCacheValue. If they aren't present already, the loader func
 // will be called. This is synchronized so that the loader will only be called once even if
-// multiple goroutines try to load at the same time.
-func (value *revCacheValue) load(loaderFunc RevisionCacheLoaderFunc) (Body, Body, base.Set, error) {
+// multiple goroutines try to load at the same time. The 'hit' result is false if it was loaded.
+func (value *revCacheValue) load(loaderFunc RevisionCacheLoaderFunc) (Body, Body, base.Set, bool, error) {
 	value.lock.Lock()
 	defer value.lock.Unlock()
+	hit := true
 	if value.body == nil && value.err == nil {
-		dbExpvars.Add("revisionCache_misses", 1)
+		hit = false
 		if loaderFunc != nil {
 			value.body, value.history, value.channels, value.err = loaderFunc(value.key)
+			value.takeExpiry()
 		}
-	} else {
-		dbExpvars.Add("revisionCache_hits", 1)
+	}
+	if !value.expiry.IsZero() && !value.expiry.After(time.Now()) {
+		return nil, nil, nil, hit, base.HTTPErrorf(http.StatusNotFound, "expired")
 	}
 	body := value.body
 	if body != nil {
 		body = body.ShallowCopy() // Never let the caller mutate the stored body
 	}
-	return body, value.history, value.channels, value.err
+	return body, value.history, value.channels, hit, value.err
 }
 
 // Stores a body etc. into a revCacheValue if there isn't one already.
@@ -127,7 +220,16 @@ func (value *revCacheValue) store(body Body, history Body, channels base.Set) {
 		value.history = history
 		value.channels = channels
 		value.err = nil
+		value.takeExpiry()
 		dbExpvars.Add("revisionCache_adds", 1)
 	}
 	value.lock.Unlock()
 }
+
+// Moves the doc expiry time, if any, out of the body's "_exp" property.
+func (value *revCacheValue) takeExpiry() {
+	if expiry, ok := value.body["_exp"].(time.Time); ok {
+		value.expiry = expiry
+		delete(value.body, "_exp")
+	}
+}
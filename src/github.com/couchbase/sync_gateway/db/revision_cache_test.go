@@ -33,7 +33,7 @@ func TestRevisionCache(t *testing.T) {
 		assert.DeepEquals(t, channels, base.Set(nil))
 	}
 
-	cache := NewRevisionCache(10, nil)
+	cache := NewRevisionCache(10, nil, nil)
 	for i := 0; i < 10; i++ {
 		body, history, channels := revForTest(i)
 		cache.Put(body, history, channels)
@@ -75,7 +75,7 @@ func TestLoaderFunction(t *testing.T) {
 		}
 		return
 	}
-	cache := NewRevisionCache(10, loader)
+	cache := NewRevisionCache(10, loader, nil)
 
 	body, history, channels, err := cache.Get("Jens", "1")
 	assert.Equals(t, body["_id"], "Jens")
@@ -100,4 +100,9 @@ func TestLoaderFunction(t *testing.T) {
 	assert.DeepEquals(t, body, Body(nil))
 	assert.DeepEquals(t, err, base.HTTPErrorf(404, "missing"))
 	assert.Equals(t, callsToLoader, 3)
+
+	size, hits, misses := cache.Statistics()
+	assert.Equals(t, size, 1)
+	assert.Equals(t, hits, uint64(1))
+	assert.Equals(t, misses, uint64(3))
 }
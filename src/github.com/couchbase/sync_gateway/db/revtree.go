@@ -189,6 +189,33 @@ func (tree RevTree) isLeaf(revid string) bool {
 	return true
 }
 
+// Removes a leaf revision from the tree, along with any of its ancestors that aren't also
+// ancestors of another leaf. Returns the IDs of the removed revisions (none if revid isn't a leaf.)
+func (tree RevTree) purgeLeaf(revid string) (purged []string) {
+	if !tree.isLeaf(revid) {
+		return nil
+	}
+	children := map[string]int{}
+	for _, info := range tree {
+		if info.Parent != "" {
+			children[info.Parent]++
+		}
+	}
+	for revid != "" && children[revid] == 0 {
+		info := tree[revid]
+		if info == nil {
+			break
+		}
+		delete(tree, revid)
+		purged = append(purged, revid)
+		if info.Parent != "" {
+			children[info.Parent]--
+		}
+		revid = info.Parent
+	}
+	return
+}
+
 // Finds the "winning" revision, the one that should be treated as the default.
 // This is the leaf revision whose (!deleted, generation, hash) tuple compares the highest.
 func (tree RevTree) winningRevision() (winner string, branched bool, inConflict bool) {
@@ -190,6 +190,15 @@ func TestPruneRevisions(t *testing.T) {
 	assert.Equals(t, tempmap.pruneRevisions(2, ""), 1)
 }
 
+func TestRevTreePurgeLeaf(t *testing.T) {
+	tempmap := branchymap.copy()
+	assert.DeepEquals(t, tempmap.purgeLeaf("2-two"), []string(nil)) // not a leaf
+	assert.DeepEquals(t, tempmap.purgeLeaf("3-drei"), []string{"3-drei"})
+	assert.Equals(t, len(tempmap), 3)
+	assert.DeepEquals(t, tempmap.purgeLeaf("3-three"), []string{"3-three", "2-two", "1-one"})
+	assert.Equals(t, len(tempmap), 0)
+}
+
 func TestParseRevisions(t *testing.T) {
 	type testCase struct {
 		json string
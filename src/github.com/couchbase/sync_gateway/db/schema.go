@@ -0,0 +1,481 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Configuration of a JSON Schema that documents must conform to. The schema applies to docs
+// whose "type" property equals Type (if given) and whose ID matches DocID (if given.)
+type DocSchemaConfig struct {
+	Type   string      `json:"type,omitempty"`   // Value of the "type" property of docs to validate
+	DocID  string      `json:"doc_id,omitempty"` // Regex that IDs of docs to validate must match
+	Schema interface{} `json:"schema"`           // The JSON Schema
+}
+
+type docSchema struct {
+	config DocSchemaConfig
+	docID  *regexp.Regexp
+	schema *jsonSchema
+}
+
+// A database's set of document schemas, by name. Thread-safe, so schemas can be changed while
+// the database is in use.
+type SchemaSet struct {
+	schemas map[string]*docSchema
+	lock    sync.RWMutex
+}
+
+func NewSchemaSet() *SchemaSet {
+	return &SchemaSet{schemas: map[string]*docSchema{}}
+}
+
+// Adds or replaces a schema. Returns true if it replaced an existing one.
+func (set *SchemaSet) Set(name string, config DocSchemaConfig) (bool, error) {
+	schema := &docSchema{config: config}
+	if config.DocID != "" {
+		var err error
+		if schema.docID, err = regexp.Compile(config.DocID); err != nil {
+			return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid doc_id of schema %q: %v", name, err)
+		}
+	}
+	var err error
+	if schema.schema, err = compileJSONSchema(config.Schema); err != nil {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid schema %q: %v", name, err)
+	}
+
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	_, replaced := set.schemas[name]
+	set.schemas[name] = schema
+	return replaced, nil
+}
+
+// Removes a schema. Returns false if there was no such schema.
+func (set *SchemaSet) Delete(name string) bool {
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	_, found := set.schemas[name]
+	delete(set.schemas, name)
+	return found
+}
+
+// Returns the configuration of a schema, or nil if there's no such schema.
+func (set *SchemaSet) Get(name string) *DocSchemaConfig {
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+	if schema := set.schemas[name]; schema != nil {
+		config := schema.config
+		return &config
+	}
+	return nil
+}
+
+// Returns the configurations of all the schemas, by name.
+func (set *SchemaSet) All() map[string]DocSchemaConfig {
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+	all := make(map[string]DocSchemaConfig, len(set.schemas))
+	for name, schema := range set.schemas {
+		all[name] = schema.config
+	}
+	return all
+}
+
+// Key of the document that stores the schemas set through the admin API
+const kSchemasKey = kSyncKeyPrefix + "schemas"
+
+// Loads the schemas saved by PutSchema and DeleteSchema. Returns false if none were ever saved.
+func (context *DatabaseContext) LoadSchemas() (bool, error) {
+	var configs map[string]DocSchemaConfig
+	if err := context.Bucket.Get(kSchemasKey, &configs); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for name, config := range configs {
+		if _, err := context.Schemas.Set(name, config); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Adds or replaces a schema, and saves it so it's loaded when the database restarts.
+// Returns true if it replaced an existing one.
+func (context *DatabaseContext) PutSchema(name string, config DocSchemaConfig) (bool, error) {
+	replaced, err := context.Schemas.Set(name, config)
+	if err != nil {
+		return false, err
+	}
+	return replaced, context.saveSchema(name, &config)
+}
+
+// Removes a schema, and saves the removal. Returns false if there was no such schema.
+func (context *DatabaseContext) DeleteSchema(name string) (bool, error) {
+	if !context.Schemas.Delete(name) {
+		return false, nil
+	}
+	return true, context.saveSchema(name, nil)
+}
+
+// Updates one schema (nil to remove it) in the saved schemas. The first time, the saved
+// schemas start out as the current ones, i.e. the ones from the config.
+func (context *DatabaseContext) saveSchema(name string, config *DocSchemaConfig) error {
+	return context.Bucket.Update(kSchemasKey, 0, func(currentValue []byte) ([]byte, error) {
+		configs := context.Schemas.All()
+		if currentValue != nil {
+			configs = map[string]DocSchemaConfig{}
+			if err := json.Unmarshal(currentValue, &configs); err != nil {
+				return nil, err
+			}
+		}
+		if config != nil {
+			configs[name] = *config
+		} else {
+			delete(configs, name)
+		}
+		return json.Marshal(configs)
+	})
+}
+
+// Validates a revision body against every schema that applies to it. Properties whose names
+// begin with "_" aren't validated, and neither are deletions. Returns a 400 error listing the
+// JSON Pointer paths of the parts of the body that don't conform.
+func (set *SchemaSet) Validate(docid string, body Body) error {
+	if deleted, _ := body["_deleted"].(bool); deleted {
+		return nil
+	}
+	set.lock.RLock()
+	defer set.lock.RUnlock()
+	var names []string
+	var value interface{}
+	for name, schema := range set.schemas {
+		if schema.config.Type != "" && body["type"] != schema.config.Type {
+			continue
+		} else if schema.docID != nil && !schema.docID.MatchString(docid) {
+			continue
+		}
+		if value == nil {
+			// Validate a plain JSON copy of the body, since it may contain other Go types:
+			var err error
+			if value, err = userPropertiesAsJSON(body); err != nil {
+				return err
+			}
+		}
+		if failures := schema.schema.validate(value, ""); len(failures) > 0 {
+			sort.Strings(failures)
+			names = append(names, fmt.Sprintf("%q (%s)", name, strings.Join(failures, "; ")))
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return base.HTTPErrorf(http.StatusBadRequest, "Document doesn't match schema %s",
+			strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func userPropertiesAsJSON(body Body) (interface{}, error) {
+	props := make(map[string]interface{}, len(body))
+	for key, value := range body {
+		if key == "" || key[0] != '_' {
+			props[key] = value
+		}
+	}
+	var value interface{}
+	bodyJSON, err := json.Marshal(props)
+	if err == nil {
+		err = json.Unmarshal(bodyJSON, &value)
+	}
+	return value, err
+}
+
+//////// JSON SCHEMA:
+
+// A compiled JSON Schema. Supports these keywords of JSON Schema (draft 6): type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, allOf, anyOf,
+// oneOf and not. Other keywords are ignored.
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"` // A type name or an array of them
+	Enum                 []interface{}          `json:"enum"`
+	Const                *json.RawMessage       `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *json.RawMessage       `json:"additionalProperties"` // Boolean or schema
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	ExclusiveMinimum     *float64               `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64               `json:"exclusiveMaximum"`
+	MultipleOf           *float64               `json:"multipleOf"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	Not                  *jsonSchema            `json:"not"`
+
+	types            []string
+	constValue       interface{}
+	pattern          *regexp.Regexp
+	noAdditional     bool
+	additionalSchema *jsonSchema
+}
+
+var kJSONSchemaTypes = map[string]bool{"array": true, "boolean": true, "integer": true,
+	"null": true, "number": true, "object": true, "string": true}
+
+// Parses and checks a JSON Schema, given as an unmarshaled JSON object.
+func compileJSONSchema(schemaJSON interface{}) (*jsonSchema, error) {
+	if _, ok := asJSONObject(schemaJSON); !ok {
+		return nil, fmt.Errorf("schema must be an object")
+	}
+	data, err := json.Marshal(schemaJSON)
+	if err != nil {
+		return nil, err
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	return &schema, schema.compile()
+}
+
+func (schema *jsonSchema) compile() error {
+	switch t := schema.Type.(type) {
+	case nil:
+	case string:
+		schema.types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				schema.types = append(schema.types, name)
+			} else {
+				return fmt.Errorf("invalid type %v", item)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid type %v", t)
+	}
+	for _, name := range schema.types {
+		if !kJSONSchemaTypes[name] {
+			return fmt.Errorf("unknown type %q", name)
+		}
+	}
+
+	if schema.Const != nil {
+		if err := json.Unmarshal(*schema.Const, &schema.constValue); err != nil {
+			return err
+		}
+	}
+	if schema.Pattern != "" {
+		var err error
+		if schema.pattern, err = regexp.Compile(schema.Pattern); err != nil {
+			return err
+		}
+	}
+	if schema.AdditionalProperties != nil {
+		var allowed bool
+		if err := json.Unmarshal(*schema.AdditionalProperties, &allowed); err == nil {
+			schema.noAdditional = !allowed
+		} else if err := json.Unmarshal(*schema.AdditionalProperties, &schema.additionalSchema); err != nil {
+			return fmt.Errorf("invalid additionalProperties")
+		} else if err := schema.additionalSchema.compile(); err != nil {
+			return err
+		}
+	}
+
+	subschemas := []*jsonSchema{schema.Items, schema.Not}
+	for _, sub := range schema.Properties {
+		subschemas = append(subschemas, sub)
+	}
+	subschemas = append(subschemas, schema.AllOf...)
+	subschemas = append(subschemas, schema.AnyOf...)
+	subschemas = append(subschemas, schema.OneOf...)
+	for _, sub := range subschemas {
+		if sub != nil {
+			if err := sub.compile(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the JSON type name of an unmarshaled JSON value.
+func jsonTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func (schema *jsonSchema) hasType(value interface{}) bool {
+	if len(schema.types) == 0 {
+		return true
+	}
+	valueType := jsonTypeOf(value)
+	for _, t := range schema.types {
+		if t == valueType {
+			return true
+		} else if t == "integer" && valueType == "number" {
+			if n := value.(float64); n == math.Trunc(n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validates an unmarshaled JSON value, whose JSON Pointer path is 'path'. Returns a description
+// of each failure, prefixed with the path of the value that failed.
+func (schema *jsonSchema) validate(value interface{}, path string) (failures []string) {
+	fail := func(format string, args ...interface{}) {
+		location := path
+		if location == "" {
+			location = "/"
+		}
+		failures = append(failures, location+": "+fmt.Sprintf(format, args...))
+	}
+
+	if !schema.hasType(value) {
+		fail("must be of type %s", strings.Join(schema.types, " or "))
+		return
+	}
+	if schema.Enum != nil {
+		found := false
+		for _, item := range schema.Enum {
+			if jsonValuesEqual(item, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of the enumerated values")
+		}
+	}
+	if schema.Const != nil && !jsonValuesEqual(schema.constValue, value) {
+		fail("must equal %s", string(*schema.Const))
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			fail("must be at least %d characters long", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			fail("must be at most %d characters long", *schema.MaxLength)
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(value) {
+			fail("must match pattern %q", schema.Pattern)
+		}
+	case float64:
+		if schema.Minimum != nil && value < *schema.Minimum {
+			fail("must be >= %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && value > *schema.Maximum {
+			fail("must be <= %v", *schema.Maximum)
+		}
+		if schema.ExclusiveMinimum != nil && value <= *schema.ExclusiveMinimum {
+			fail("must be > %v", *schema.ExclusiveMinimum)
+		}
+		if schema.ExclusiveMaximum != nil && value >= *schema.ExclusiveMaximum {
+			fail("must be < %v", *schema.ExclusiveMaximum)
+		}
+		if schema.MultipleOf != nil && *schema.MultipleOf > 0 {
+			if q := value / *schema.MultipleOf; q != math.Trunc(q) {
+				fail("must be a multiple of %v", *schema.MultipleOf)
+			}
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(value) < *schema.MinItems {
+			fail("must have at least %d items", *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(value) > *schema.MaxItems {
+			fail("must have at most %d items", *schema.MaxItems)
+		}
+		if schema.Items != nil {
+			for i, item := range value {
+				failures = append(failures, schema.Items.validate(item, fmt.Sprintf("%s/%d", path, i))...)
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range schema.Required {
+			if _, found := value[key]; !found {
+				failures = append(failures, jsonPointerAppend(path, key)+": is required")
+			}
+		}
+		for key, item := range value {
+			itemPath := jsonPointerAppend(path, key)
+			if sub := schema.Properties[key]; sub != nil {
+				failures = append(failures, sub.validate(item, itemPath)...)
+			} else if schema.noAdditional {
+				failures = append(failures, itemPath+": is not allowed")
+			} else if schema.additionalSchema != nil {
+				failures = append(failures, schema.additionalSchema.validate(item, itemPath)...)
+			}
+		}
+	}
+
+	for _, sub := range schema.AllOf {
+		failures = append(failures, sub.validate(value, path)...)
+	}
+	if len(schema.AnyOf) > 0 {
+		matched := false
+		for _, sub := range schema.AnyOf {
+			if len(sub.validate(value, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match a schema in anyOf")
+		}
+	}
+	if len(schema.OneOf) > 0 {
+		matches := 0
+		for _, sub := range schema.OneOf {
+			if len(sub.validate(value, path)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			fail("must match exactly one schema in oneOf")
+		}
+	}
+	if schema.Not != nil && len(schema.Not.validate(value, path)) == 0 {
+		fail("must not match the schema in not")
+	}
+	return
+}
+
+// Appends a property name to a JSON Pointer, escaping it.
+func jsonPointerAppend(path, key string) string {
+	return path + "/" + strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
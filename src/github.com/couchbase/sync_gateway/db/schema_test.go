@@ -0,0 +1,119 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestJSONSchema(t *testing.T) {
+	var schemaJSON interface{}
+	json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["qty", "items"],
+		"properties": {
+			"qty": {"type": "integer", "minimum": 1},
+			"status": {"enum": ["open", "closed"]},
+			"items": {"type": "array", "minItems": 1, "items": {
+				"type": "object", "additionalProperties": false,
+				"properties": {"sku": {"type": "string", "pattern": "^[A-Z]+$"}, "price": {"type": "number"}}}},
+			"a/b": {"not": {"type": "null"}}
+		}
+	}`), &schemaJSON)
+	schema, err := compileJSONSchema(schemaJSON)
+	assertNoError(t, err, "Couldn't compile schema")
+
+	var tests = []struct {
+		doc      string
+		failures []string
+	}{
+		{`{"qty": 2, "items": [{"sku": "ABC", "price": 1.5}], "status": "open"}`, nil},
+		{`{"qty": 2.5, "items": [{"sku": "ABC"}]}`, []string{"/qty: must be of type integer"}},
+		{`{"qty": 0, "items": []}`, []string{"/items: must have at least 1 items", "/qty: must be >= 1"}},
+		{`{"items": [{"sku": "abc", "color": "red"}], "status": "new"}`, []string{
+			"/items/0/color: is not allowed", "/items/0/sku: must match pattern \"^[A-Z]+$\"",
+			"/qty: is required", "/status: must be one of the enumerated values"}},
+		{`{"qty": 1, "items": [{}], "a/b": null}`, []string{"/a~1b: must not match the schema in not"}},
+		{`[]`, []string{"/: must be of type object"}},
+	}
+	for _, test := range tests {
+		var doc interface{}
+		json.Unmarshal([]byte(test.doc), &doc)
+		failures := schema.validate(doc, "")
+		sort.Strings(failures)
+		assert.DeepEquals(t, failures, test.failures)
+	}
+
+	for _, bad := range []string{`{"type": "thing"}`, `{"pattern": "["}`, `{"additionalProperties": 3}`, `[]`} {
+		json.Unmarshal([]byte(bad), &schemaJSON)
+		_, err = compileJSONSchema(schemaJSON)
+		assert.True(t, err != nil)
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	var schema interface{}
+	json.Unmarshal([]byte(`{"required": ["total"], "properties": {"total": {"type": "number"}}}`), &schema)
+	_, err := db.Schemas.Set("order", DocSchemaConfig{Type: "order", Schema: schema})
+	assertNoError(t, err, "Couldn't set schema")
+	json.Unmarshal([]byte(`{"additionalProperties": false, "properties": {"n": {}}}`), &schema)
+	_, err = db.Schemas.Set("counter", DocSchemaConfig{DocID: "^counter:", Schema: schema})
+	assertNoError(t, err, "Couldn't set schema")
+	_, err = db.Schemas.Set("bad", DocSchemaConfig{DocID: "(", Schema: schema})
+	assertHTTPError(t, err, 400)
+
+	_, err = db.Put("o1", Body{"type": "order", "total": "lots"})
+	assertHTTPError(t, err, 400)
+	assert.Equals(t, err.Error(), `400 Document doesn't match schema "order" (/total: must be of type number)`)
+	rev1id, err := db.Put("o1", Body{"type": "order", "total": 10})
+	assertNoError(t, err, "Valid order was rejected")
+	_, err = db.Put("other", Body{"total": "lots"})
+	assertNoError(t, err, "Doc without a schema was rejected")
+	_, err = db.Put("counter:1", Body{"n": 1, "m": 2})
+	assertHTTPError(t, err, 400)
+
+	// Deletions aren't validated, and schemas can be removed:
+	_, err = db.DeleteDoc("o1", rev1id)
+	assertNoError(t, err, "Couldn't delete order")
+	assert.True(t, db.Schemas.Delete("counter"))
+	assert.False(t, db.Schemas.Delete("counter"))
+	_, err = db.Put("counter:1", Body{"n": 1, "m": 2})
+	assertNoError(t, err, "Doc was validated by a deleted schema")
+	assert.Equals(t, len(db.Schemas.All()), 1)
+}
+
+func TestSavedSchemas(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Schemas from the config aren't saved until one is changed:
+	_, err := db.Schemas.Set("order", DocSchemaConfig{Type: "order", Schema: map[string]interface{}{}})
+	assertNoError(t, err, "Couldn't set schema")
+	found, err := db.LoadSchemas()
+	assertNoError(t, err, "LoadSchemas failed")
+	assert.False(t, found)
+
+	replaced, err := db.PutSchema("item", DocSchemaConfig{DocID: "^item", Schema: map[string]interface{}{}})
+	assertNoError(t, err, "PutSchema failed")
+	assert.False(t, replaced)
+	found, err = db.DeleteSchema("order")
+	assertNoError(t, err, "DeleteSchema failed")
+	assert.True(t, found)
+	found, err = db.DeleteSchema("order")
+	assertNoError(t, err, "DeleteSchema failed")
+	assert.False(t, found)
+
+	// A restarted database loads the saved schemas:
+	db.Schemas = NewSchemaSet()
+	found, err = db.LoadSchemas()
+	assertNoError(t, err, "LoadSchemas failed")
+	assert.True(t, found)
+	all := db.Schemas.All()
+	assert.Equals(t, len(all), 1)
+	assert.Equals(t, all["item"].DocID, "^item")
+}
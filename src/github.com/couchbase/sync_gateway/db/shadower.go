@@ -101,7 +101,7 @@ func (s *Shadower) pullDocument(key string, value []byte, isDeletion bool, cas u
 	}
 
 	db, _ := CreateDatabase(s.context)
-	_, err := db.updateDoc(key, false, func(doc *document) (Body, error) {
+	_, err := db.updateDoc(key, false, nil, func(doc *document) (Body, error) {
 		// (Be careful: this block can be invoked multiple times if there are races!)
 		if doc.UpstreamCAS != nil && *doc.UpstreamCAS == cas {
 			return nil, couchbase.UpdateCancel // we already have this doc revision
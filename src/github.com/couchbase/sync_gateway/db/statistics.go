@@ -28,6 +28,12 @@ func (stats *Statistics) Decrement() {
 	stats.lock.Unlock()
 }
 
+func (stats *Statistics) CurrentCount() uint32 {
+	stats.lock.RLock()
+	defer stats.lock.RUnlock()
+	return stats.currentCount
+}
+
 func (stats *Statistics) TotalCount() uint32 {
 	stats.lock.RLock()
 	defer stats.lock.RUnlock()
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Input to DryRunSyncFunction.
+type SyncFnDryRun struct {
+	DocID  string `json:"docid,omitempty"`  // ID of an existing doc
+	Doc    Body   `json:"doc,omitempty"`    // The new revision; defaults to the doc's current one
+	OldDoc Body   `json:"oldDoc,omitempty"` // The old revision; defaults to the new one's parent
+	User   string `json:"user,omitempty"`   // Name of the user making the change; else an admin
+	Sync   string `json:"sync,omitempty"`   // Sync function source; defaults to the database's
+}
+
+// Results of DryRunSyncFunction.
+type SyncFnDryRunResult struct {
+	Channels  base.Set           `json:"channels"`
+	Access    channels.AccessMap `json:"access"`
+	Roles     channels.AccessMap `json:"roles"`
+	Expiry    channels.ExpiryMap `json:"expiry,omitempty"`    // Expiration times of temporary grants
+	Status    int                `json:"status,omitempty"`    // Status code of a rejection
+	Reason    string             `json:"reason,omitempty"`    // Message of a rejection
+	Exception string             `json:"exception,omitempty"` // Error thrown by the function
+	Log       []string           `json:"log,omitempty"`       // Messages the function logged
+}
+
+// Runs the sync function on a revision without saving anything, for debugging sync functions.
+// If a DocID is given, the new revision defaults to that doc's current revision and the old one
+// to its parent, as when it was saved; if a new revision is given, the old one defaults to the
+// doc's current revision, as if the new one were replacing it.
+func (db *Database) DryRunSyncFunction(input SyncFnDryRun) (*SyncFnDryRunResult, error) {
+	// Use a separate mapper that captures the function's log output, with the database's limits:
+	syncFn := input.Sync
+	if syncFn != "" {
+		// Compile the function first, so syntax errors can be reported as such:
+		if _, err := channels.NewSyncRunner(syncFn); err != nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid sync function: %v", err)
+		}
+	} else if db.ChannelMapper != nil {
+		syncFn = db.ChannelMapper.Function()
+	} else {
+		syncFn = channels.DefaultSyncFunction
+	}
+	mapper := channels.NewChannelMapperWithOptions(syncFn, channels.ChannelMapperOptions{
+		PoolSize:  1,
+		Timeout:   db.SyncTimeout,
+		Modules:   db.JSModules,
+		LogOutput: true,
+	})
+
+	var userCtx map[string]interface{}
+	if input.User != "" {
+		user, err := db.Authenticator().GetUser(input.User)
+		if err != nil {
+			return nil, err
+		} else if user == nil {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "No such user %q", input.User)
+		}
+		userCtx = makeUserCtx(user)
+	}
+
+	body := input.Doc
+	var oldJSON []byte
+	if input.OldDoc != nil {
+		var err error
+		if oldJSON, err = json.Marshal(input.OldDoc); err != nil {
+			return nil, err
+		}
+	}
+	if input.DocID != "" {
+		doc, err := db.GetDoc(input.DocID)
+		if body != nil && base.IsDocNotFoundError(err) {
+			// The new revision would create the doc, so there's no old one:
+			err = nil
+		} else if err != nil {
+			return nil, err
+		} else if body == nil {
+			if body, err = db.getRevision(doc, doc.CurrentRev); err != nil {
+				return nil, err
+			}
+			if oldJSON == nil {
+				oldJSON, err = db.getAncestorJSON(doc, doc.CurrentRev)
+			}
+		} else if oldJSON == nil {
+			oldJSON, err = db.getRevisionJSON(doc, doc.CurrentRev)
+		}
+		if err != nil {
+			return nil, err
+		}
+		body["_id"] = input.DocID
+	} else if body == nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Missing doc or docid")
+	}
+
+	result := &SyncFnDryRunResult{}
+	output, err := mapper.MapToChannelsAndAccess(body, string(oldJSON), userCtx)
+	if err != nil {
+		result.Exception = err.Error()
+		return result, nil
+	}
+	result.Channels = output.Channels
+	result.Access = output.Access
+	result.Roles = output.Roles
+	result.Expiry = output.Expiry
+	result.Log = output.Log
+	if output.Rejection != nil {
+		result.Status, result.Reason = base.ErrorAsHTTPStatus(output.Rejection)
+	}
+	return result, nil
+}
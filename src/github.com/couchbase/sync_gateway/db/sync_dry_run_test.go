@@ -0,0 +1,81 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDryRunSyncFunction(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewChannelMapper(`function(doc, oldDoc) {
+		if (oldDoc && oldDoc.owner != doc.owner) throw({forbidden: "can't change owner"});
+		requireAccess(doc.channel);
+		channel(doc.channel);
+		access(doc.owner, doc.channel);
+		log("owner", doc.owner);
+	}`)
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("alice", "letmein", channels.SetOf("ABC"))
+	authenticator.Save(user)
+
+	rev1id, err := db.Put("doc1", Body{"channel": "ABC", "owner": "alice"})
+	assertNoError(t, err, "Couldn't create document")
+
+	// Re-run the sync function on the doc's current revision:
+	result, err := db.DryRunSyncFunction(SyncFnDryRun{DocID: "doc1", User: "alice"})
+	assertNoError(t, err, "DryRunSyncFunction failed")
+	assert.DeepEquals(t, result.Channels, channels.SetOf("ABC"))
+	assert.DeepEquals(t, result.Access, channels.AccessMap{"alice": channels.SetOf("ABC")})
+	assert.Equals(t, result.Status, 0)
+	assert.DeepEquals(t, result.Log, []string{"owner alice"})
+
+	// A new revision is run against the doc's current revision:
+	result, err = db.DryRunSyncFunction(SyncFnDryRun{DocID: "doc1", Doc: Body{"channel": "ABC", "owner": "bob"}})
+	assertNoError(t, err, "DryRunSyncFunction failed")
+	assert.Equals(t, result.Status, 403)
+	assert.Equals(t, result.Reason, "can't change owner")
+
+	result, err = db.DryRunSyncFunction(SyncFnDryRun{Doc: Body{"channel": "XYZ"}, User: "alice"})
+	assertNoError(t, err, "DryRunSyncFunction failed")
+	assert.Equals(t, result.Status, 403)
+
+	// A candidate sync function:
+	result, err = db.DryRunSyncFunction(SyncFnDryRun{Doc: Body{"n": 1}, Sync: `function(doc) {channel("N" + doc.n);}`})
+	assertNoError(t, err, "DryRunSyncFunction failed")
+	assert.DeepEquals(t, result.Channels, channels.SetOf("N1"))
+	result, err = db.DryRunSyncFunction(SyncFnDryRun{Doc: Body{}, Sync: `function(doc) {throw("oops");}`})
+	assertNoError(t, err, "DryRunSyncFunction failed")
+	assert.True(t, result.Exception != "")
+	_, err = db.DryRunSyncFunction(SyncFnDryRun{Doc: Body{}, Sync: `function(doc) {`})
+	assertHTTPError(t, err, 400)
+
+	// A new revision of a doc that doesn't exist yet has no old revision:
+	result, err = db.DryRunSyncFunction(SyncFnDryRun{DocID: "doc2", Doc: Body{"channel": "ABC", "owner": "bob"}})
+	assertNoError(t, err, "DryRunSyncFunction failed")
+	assert.Equals(t, result.Status, 0)
+	assert.DeepEquals(t, result.Channels, channels.SetOf("ABC"))
+	_, err = db.DryRunSyncFunction(SyncFnDryRun{DocID: "doc2"})
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// A candidate sync function is limited by the database's timeout:
+	db.SyncTimeout = 100 * time.Millisecond
+	result, err = db.DryRunSyncFunction(SyncFnDryRun{Doc: Body{}, Sync: `function(doc) {while (true) {}}`})
+	assertNoError(t, err, "DryRunSyncFunction failed")
+	assert.Equals(t, result.Exception, channels.ErrSyncFnTimeout.Error())
+
+	_, err = db.DryRunSyncFunction(SyncFnDryRun{DocID: "doc1", User: "nobody"})
+	assertHTTPError(t, err, 404)
+	_, err = db.DryRunSyncFunction(SyncFnDryRun{})
+	assertHTTPError(t, err, 400)
+
+	// Nothing was saved:
+	body, err := db.Get("doc1")
+	assertNoError(t, err, "Couldn't get document")
+	assert.Equals(t, body["_rev"], rev1id)
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Time between runs of the background tombstone compaction
+const kTombstoneCompactionInterval = time.Hour
+
+// Max number of rows read from the tombstones view at once
+const kTombstoneCompactionBatchSize = 1000
+
+// Starts a background task that periodically purges tombstones older than the retention period.
+func (context *DatabaseContext) StartTombstoneCompaction(retention time.Duration) {
+	context.TombstoneRetention = retention
+	context.compactTerminator = make(chan bool)
+	context.compactRunning.Add(1)
+	go func(terminator chan bool) {
+		defer context.compactRunning.Done()
+		ticker := time.NewTicker(kTombstoneCompactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db, _ := CreateDatabase(context)
+				if _, err := db.compactTombstones(retention, false, terminator); err != nil {
+					base.Warn("Tombstone compaction of %q failed: %v", context.Name, err)
+				}
+			case <-terminator:
+				return
+			}
+		}
+	}(context.compactTerminator)
+}
+
+// Purges deleted documents whose tombstones were saved longer ago than the retention period.
+// If dryRun is true, nothing is purged. Returns the IDs of the (to be) purged documents.
+func (db *Database) CompactTombstones(retention time.Duration, dryRun bool) ([]string, error) {
+	return db.compactTombstones(retention, dryRun, nil)
+}
+
+// Implementation of CompactTombstones. Stops early if the terminator channel is closed.
+func (db *Database) compactTombstones(retention time.Duration, dryRun bool, terminator chan bool) ([]string, error) {
+	cutoff := time.Now().Add(-retention)
+	purged := []string{}
+	opts := Body{"stale": false, "limit": kTombstoneCompactionBatchSize}
+	for {
+		var vres struct {
+			Rows []struct {
+				ID    string
+				Value time.Time
+			}
+		}
+		if err := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewTombstones, opts, &vres); err != nil {
+			base.Warn("tombstones view returned %v", err)
+			return purged, err
+		}
+
+		for _, row := range vres.Rows {
+			if row.Value.After(cutoff) {
+				continue
+			}
+			// The view may be stale, so make sure the doc is still an old tombstone:
+			doc, err := db.GetDoc(row.ID)
+			if err != nil || !doc.hasFlag(channels.Deleted) || doc.TimeSaved.After(cutoff) {
+				continue
+			}
+			if !dryRun {
+				if _, err := db.purgeDoc(row.ID); err != nil {
+					base.Warn("Error purging tombstone %q: %v", row.ID, err)
+					continue
+				}
+			}
+			purged = append(purged, row.ID)
+		}
+		if len(vres.Rows) < kTombstoneCompactionBatchSize {
+			break
+		}
+
+		select {
+		case <-terminator:
+			base.Logf("Tombstone compaction of %q stopped", db.Name)
+			return purged, nil
+		default:
+		}
+		// The view's keys are doc IDs, so the next page starts after the last one read. The
+		// index was brought up to date by the first query.
+		opts = Body{"stale": "ok", "limit": kTombstoneCompactionBatchSize,
+			"startkey": vres.Rows[len(vres.Rows)-1].ID, "skip": 1}
+	}
+	if dryRun {
+		base.Logf("Tombstone compaction of %q (dry run) would purge %d docs", db.Name, len(purged))
+	} else {
+		base.Logf("Tombstone compaction of %q purged %d docs", db.Name, len(purged))
+	}
+	return purged, nil
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"net/http"
+	"sort"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
@@ -12,15 +13,15 @@ import (
 // Also used in the rest package as a JSON object that defines a User/Role within a DbConfig
 // and structures the request/response body in the admin REST API for /db/_user/*
 type PrincipalConfig struct {
-	Name             *string  `json:"name,omitempty"`
-	ExplicitChannels base.Set `json:"admin_channels,omitempty"`
-	Channels         base.Set `json:"all_channels"`
-	// Fields below only apply to Users, not Roles:
-	Email             string   `json:"email,omitempty"`
-	Disabled          bool     `json:"disabled,omitempty"`
-	Password          *string  `json:"password,omitempty"`
+	Name              *string  `json:"name,omitempty"`
+	ExplicitChannels  base.Set `json:"admin_channels,omitempty"`
+	Channels          base.Set `json:"all_channels"`
 	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
-	RoleNames         []string `json:"roles,omitempty"`
+	RoleNames         []string `json:"roles,omitempty"` // For a user, includes inherited roles
+	// Fields below only apply to Users, not Roles:
+	Email    string  `json:"email,omitempty"`
+	Disabled bool    `json:"disabled,omitempty"`
+	Password *string `json:"password,omitempty"`
 }
 
 // Check if the password in this PrincipalConfig is valid.  Only allow
@@ -58,14 +59,16 @@ func (dbc *DatabaseContext) GetPrincipal(name string, isUser bool) (info *Princi
 	info = new(PrincipalConfig)
 	info.Name = &name
 	info.ExplicitChannels = princ.ExplicitChannels().AsSet()
+	info.ExplicitRoleNames = princ.ExplicitRoles().AllChannels()
 	if user, ok := princ.(auth.User); ok {
 		info.Channels = user.InheritedChannels().AsSet()
 		info.Email = user.Email()
 		info.Disabled = user.Disabled()
-		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
-		info.RoleNames = user.RoleNames().AllChannels()
+		info.RoleNames = user.InheritedRoles().AllChannels()
+		sort.Strings(info.RoleNames)
 	} else {
 		info.Channels = princ.Channels().AsSet()
+		info.RoleNames = princ.RoleNames().AllChannels()
 	}
 	return
 }
@@ -118,9 +121,22 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		changed = true
 	}
 
-	var updatedRoles ch.TimedSet
+	updatedRoles := princ.ExplicitRoles()
+	if updatedRoles == nil {
+		updatedRoles = ch.TimedSet{}
+	}
+	newRoles := base.SetFromArray(newInfo.ExplicitRoleNames)
+	if !updatedRoles.Equals(newRoles) {
+		if !isUser {
+			// A role mustn't end up inheriting from itself:
+			if err = authenticator.CheckRoleCycle(princ.Name(), newRoles); err != nil {
+				return
+			}
+		}
+		changed = true
+	}
 
-	// Then the user-specific fields like roles:
+	// Then the user-specific fields:
 	if isUser {
 		if newInfo.Email != user.Email() {
 			user.SetEmail(newInfo.Email)
@@ -134,15 +150,6 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 			user.SetDisabled(newInfo.Disabled)
 			changed = true
 		}
-
-		updatedRoles = user.ExplicitRoles()
-		if updatedRoles == nil {
-			updatedRoles = ch.TimedSet{}
-		}
-		if !updatedRoles.Equals(base.SetFromArray(newInfo.ExplicitRoleNames)) {
-			changed = true
-		}
-
 	}
 
 	// And finally save the Principal:
@@ -159,10 +166,8 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 			princ.SetExplicitChannels(updatedChannels)
 		}
 
-		if isUser {
-			if updatedRoles.UpdateAtSequence(base.SetFromArray(newInfo.ExplicitRoleNames), nextSeq) {
-				user.SetExplicitRoles(updatedRoles)
-			}
+		if updatedRoles.UpdateAtSequence(newRoles, nextSeq) {
+			princ.SetExplicitRoles(updatedRoles)
 		}
 		err = authenticator.Save(princ)
 	}
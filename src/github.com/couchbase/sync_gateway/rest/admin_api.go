@@ -12,6 +12,7 @@ package rest
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
 
 	"github.com/gorilla/mux"
 
@@ -110,17 +111,19 @@ func externalUserName(name string) string {
 func marshalPrincipal(princ auth.Principal) ([]byte, error) {
 	name := externalUserName(princ.Name())
 	info := db.PrincipalConfig{
-		Name:             &name,
-		ExplicitChannels: princ.ExplicitChannels().AsSet(),
+		Name:              &name,
+		ExplicitChannels:  princ.ExplicitChannels().AsSet(),
+		ExplicitRoleNames: princ.ExplicitRoles().AllChannels(),
 	}
 	if user, ok := princ.(auth.User); ok {
 		info.Channels = user.InheritedChannels().AsSet()
 		info.Email = user.Email()
 		info.Disabled = user.Disabled()
-		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
-		info.RoleNames = user.RoleNames().AllChannels()
+		info.RoleNames = user.InheritedRoles().AllChannels()
+		sort.Strings(info.RoleNames)
 	} else {
 		info.Channels = princ.Channels().AsSet()
+		info.RoleNames = princ.RoleNames().AllChannels()
 	}
 	return json.Marshal(info)
 }
@@ -206,6 +209,90 @@ func (h *handler) deleteRole() error {
 	return h.db.Authenticator().Delete(role)
 }
 
+// Handles GET /{db}/_schema/ -- returns all the database's JSON schemas, by name
+func (h *handler) getSchemas() error {
+	h.writeJSON(h.db.Schemas.All())
+	return nil
+}
+
+func (h *handler) getSchema() error {
+	config := h.db.Schemas.Get(h.PathVar("name"))
+	if config == nil {
+		return kNotFoundError
+	}
+	h.writeJSON(config)
+	return nil
+}
+
+// Handles PUT /{db}/_schema/{name} -- adds or replaces a JSON schema. It applies to all
+// documents saved from then on, and is saved in the database, overriding the config's schemas.
+func (h *handler) putSchema() error {
+	var config db.DocSchemaConfig
+	if err := h.readJSONInto(&config); err != nil {
+		return err
+	}
+	replaced, err := h.db.PutSchema(h.PathVar("name"), config)
+	if err != nil {
+		return err
+	} else if replaced {
+		h.writeStatus(http.StatusOK, "OK")
+	} else {
+		h.writeStatus(http.StatusCreated, "Created")
+	}
+	return nil
+}
+
+func (h *handler) deleteSchema() error {
+	found, err := h.db.DeleteSchema(h.PathVar("name"))
+	if err != nil {
+		return err
+	} else if !found {
+		return kNotFoundError
+	}
+	return nil
+}
+
+// Handles GET /{db}/_js_modules -- returns the shared JS modules, by name, in the same form as
+// the "js_modules" config property
+func (h *handler) getJSModules() error {
+	sources := h.db.JSModules.Sources()
+	modules := make(map[string]*JSModuleConfig, len(sources))
+	for name, source := range sources {
+		modules[name] = &JSModuleConfig{Source: source}
+	}
+	h.writeJSON(modules)
+	return nil
+}
+
+// Handles PUT /{db}/_js_modules -- replaces all the shared JS modules, given in the same form as
+// the "js_modules" config property (but only with "source".) The JS functions pick up the new
+// modules the next time they're called, and the modules replace the config's on restart.
+func (h *handler) putJSModules() error {
+	var modules map[string]*JSModuleConfig
+	if err := h.readJSONInto(&modules); err != nil {
+		return err
+	}
+	sources := make(map[string]string, len(modules))
+	for name, module := range modules {
+		if module == nil || module.File != "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "JS module %q must have a source", name)
+		}
+		sources[name] = module.Source
+	}
+	return h.db.SetJSModules(sources)
+}
+
+// Handles GET /{db}/_user/{name}/_explain -- lists the user's channels and roles, with the
+// source of each: the admin API, a role, or the document whose sync function granted it.
+func (h *handler) explainUserAccess() error {
+	explanation, err := h.db.ExplainAccess(internalUserName(h.PathVar("name")))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(explanation)
+	return nil
+}
+
 func (h *handler) getUserInfo() error {
 	h.assertAdminOnly()
 	user, err := h.db.Authenticator().GetUser(internalUserName(mux.Vars(h.rq)["name"]))
@@ -16,6 +16,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -478,6 +480,337 @@ func TestFlush(t *testing.T) {
 	assertStatus(t, rt.sendRequest("GET", "/db/doc2", ""), 404)
 }
 
+func TestReplicate(t *testing.T) {
+	var rt restTester
+	rt.createDoc(t, "doc1")
+	rt.createDoc(t, "doc2")
+	rt.ServerContext().Database("db").WaitForPendingChanges()
+
+	// Local database --> local database:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/", `{"server":"walrus:", "bucket":"sync_gateway_test_replicate"}`), 201)
+	response := rt.sendAdminRequest("POST", "/_replicate", `{"source":"db", "target":"db2"}`)
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["ok"], true)
+	assert.Equals(t, body["docs_written"], float64(2))
+	assertStatus(t, rt.sendAdminRequest("GET", "/db2/doc1", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db2/doc2", ""), 200)
+
+	// Remote database --> local database (with a doc ID that needs escaping in a URL path):
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/my%20doc", `{"n":3}`), 201)
+	rt.ServerContext().Database("db").WaitForPendingChanges()
+	server := httptest.NewServer(CreateAdminHandler(rt.ServerContext()))
+	defer server.Close()
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db3/", `{"server":"walrus:", "bucket":"sync_gateway_test_replicate_remote"}`), 201)
+	response = rt.sendAdminRequest("POST", "/_replicate", fmt.Sprintf(`{"source":"%s/db", "target":"db3"}`, server.URL))
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["docs_written"], float64(3))
+	assertStatus(t, rt.sendAdminRequest("GET", "/db3/doc2", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db3/my%20doc", ""), 200)
+
+	// Errors:
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"db"}`), 400)
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"db", "target":"nosuchdb"}`), 404)
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"replication_id":"bogus", "cancel":true}`), 404)
+
+	// A continuous replication shows up in _active_tasks, along with the completed ones:
+	response = rt.sendAdminRequest("POST", "/_replicate", `{"source":"db2", "target":"db", "continuous":true}`)
+	assertStatus(t, response, 202)
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"db2", "target":"db"}`), 409)
+	var tasks []db.ReplicationStatus
+	response = rt.sendAdminRequest("GET", "/_active_tasks", "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &tasks)
+	assert.Equals(t, len(tasks), 3)
+	states := map[string]int{}
+	for _, task := range tasks {
+		states[task.State]++
+		if task.State != db.ReplicationStateCompleted {
+			assert.Equals(t, task.Continuous, true)
+		}
+	}
+	assert.Equals(t, states[db.ReplicationStateCompleted], 2)
+	assertStatus(t, rt.sendAdminRequest("POST", "/_replicate", `{"source":"db2", "target":"db", "cancel":true}`), 200)
+}
+
+func TestPurge(t *testing.T) {
+	var rt restTester
+	rt.createDoc(t, "doc1")
+	rt.createDoc(t, "doc2")
+
+	response := rt.sendAdminRequest("POST", "/db/_purge", `{"doc1":["*"], "nosuchdoc":["*"]}`)
+	assertStatus(t, response, 200)
+	var body struct {
+		Purged map[string][]string
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, len(body.Purged), 1)
+	assert.Equals(t, len(body.Purged["doc1"]), 1)
+
+	// The purged doc is completely gone, so it can be created again from scratch:
+	assertStatus(t, rt.sendRequest("GET", "/db/doc1", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_raw/doc1", ""), 404)
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{"new":true}`), 201)
+	assertStatus(t, rt.sendRequest("GET", "/db/doc2", ""), 200)
+
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_purge", `{"doc1":"*"}`), 400)
+}
+
+func TestCompactTombstones(t *testing.T) {
+	var rt restTester
+	response := rt.sendRequest("PUT", "/db/doc1", `{"n":1}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assertStatus(t, rt.sendRequest("DELETE", "/db/doc1?rev="+body["rev"].(string), ""), 200)
+
+	// There's no configured retention, and a retention of 0 has to be forced:
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_compact?type=tombstones", ""), 400)
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_compact?type=tombstones&retention=0", ""), 400)
+
+	response = rt.sendAdminRequest("POST", "/db/_compact?type=tombstones&retention=3600", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body, db.Body{"purged": []interface{}{}, "dry_run": false})
+
+	response = rt.sendAdminRequest("POST", "/db/_compact?type=tombstones&retention=0&force=true&dry_run=true", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body, db.Body{"purged": []interface{}{"doc1"}, "dry_run": true})
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_raw/doc1", ""), 200)
+
+	response = rt.sendAdminRequest("POST", "/db/_compact?type=tombstones&retention=0&force=true", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body, db.Body{"purged": []interface{}{"doc1"}, "dry_run": false})
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_raw/doc1", ""), 404)
+}
+
+func TestRebuildChannelIndex(t *testing.T) {
+	var rt restTester
+	rt.createDoc(t, "doc1")
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_rebuild_channel_index", ""), 404)
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/", `{"server":"walrus:", "bucket":"sync_gateway_test_chidx",
+		"channel_index":{"bucket":"sync_gateway_test_chidx_index"}}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/doc1", `{"channels":["ABC"]}`), 201)
+	response := rt.sendAdminRequest("POST", "/db2/_rebuild_channel_index", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body, db.Body{"docs": float64(1)})
+	assertStatus(t, rt.sendAdminRequest("GET", "/db2/_changes?filter=sync_gateway/bychannel&channels=ABC", ""), 200)
+}
+
+func TestSchemas(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/", `{"server":"walrus:", "bucket":"sync_gateway_test_schemas",
+		"schemas":{"order":{"type":"order", "schema":{"required":["total"]}}}}`), 201)
+	response := rt.sendAdminRequest("PUT", "/db2/o1", `{"type":"order"}`)
+	assertStatus(t, response, 400)
+	assert.True(t, strings.Contains(response.Body.String(), "/total: is required"))
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/o1", `{"type":"order", "total":1}`), 201)
+
+	// Change the schema without restarting:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/_schema/order",
+		`{"type":"order", "schema":{"properties":{"total":{"type":"string"}}}}`), 200)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/o2", `{"type":"order", "total":1}`), 400)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/_schema/item", `{"doc_id":"^item", "schema":{"type":"object"}}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/_schema/bad", `{"schema":{"type":"thing"}}`), 400)
+
+	response = rt.sendAdminRequest("GET", "/db2/_schema/", "")
+	assertStatus(t, response, 200)
+	var schemas map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &schemas)
+	assert.Equals(t, len(schemas), 2)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db2/_schema/item", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db2/_schema/order", ""), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db2/_schema/order", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/o2", `{"type":"order", "total":1}`), 201)
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db3/", `{"server":"walrus:", "bucket":"sync_gateway_test_schemas3",
+		"schemas":{"order":null}}`), 500)
+}
+
+func TestJSModules(t *testing.T) {
+	var rt restTester
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/", `{"server":"walrus:", "bucket":"sync_gateway_test_modules",
+		"js_modules":{"rules":{"source":"exports.isValid = function(doc) {return doc.n > 0;}; exports.limit = 1;"}},
+		"sync":"function(doc) {if (!isValid(doc)) throw({forbidden: 'invalid'}); channel('all');}",
+		"filters":{"big":"function(doc, req) {return doc.n > limit;}"}}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/d1", `{"n":1}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/d2", `{"n":2}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/d0", `{"n":0}`), 403)
+
+	// Change the modules without restarting:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/_js_modules",
+		`{"rules": {"source": "exports.isValid = function(doc) {return doc.n > 2;}; exports.limit = 2;"}}`), 200)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/d3", `{"n":3}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/d4", `{"n":2}`), 403)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/_js_modules", `{"bad": {"source": "exports.x = ;"}}`), 400)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/_js_modules", `{"bad": {"source": "exports.role = 1;"}}`), 400)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/_js_modules", `{"bad": {"file": "/etc/passwd"}}`), 400)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db2/_js_modules", `{"bad": "exports.x = 1;"}`), 400)
+
+	rt.ServerContext().Database("db2").WaitForPendingChanges()
+	response := rt.sendAdminRequest("GET", "/db2/_changes?filter=sync_gateway/big", "")
+	assertStatus(t, response, 200)
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].ID, "d3")
+
+	response = rt.sendAdminRequest("GET", "/db2/_js_modules", "")
+	assertStatus(t, response, 200)
+	var modules map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &modules)
+	assert.DeepEquals(t, modules, map[string]interface{}{"rules": map[string]interface{}{
+		"source": "exports.isValid = function(doc) {return doc.n > 2;}; exports.limit = 2;"}})
+}
+
+func TestExplainUserAccess(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {access(doc.owner, doc.channels);}`}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_role/hipster", `{"admin_channels":["fedoras"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/snej",
+		`{"password":"letmein", "admin_channels":["foo"], "admin_roles":["hipster"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/doc1", `{"owner":"snej", "channels":["bar"]}`), 201)
+
+	response := rt.sendAdminRequest("GET", "/db/_user/snej/_explain", "")
+	assertStatus(t, response, 200)
+	var explanation db.AccessExplanation
+	json.Unmarshal(response.Body.Bytes(), &explanation)
+	assert.Equals(t, len(explanation.Channels), 4)
+	assert.Equals(t, explanation.Channels["foo"][0].Source, "admin_channels")
+	assert.Equals(t, explanation.Channels["fedoras"][0].Role, "hipster")
+	assert.Equals(t, explanation.Channels["bar"][0].DocID, "doc1")
+	assert.Equals(t, explanation.Roles["hipster"][0].Source, "admin_roles")
+
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_user/nobody/_explain", ""), 404)
+}
+
+func TestRoleHierarchy(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {channel(doc.channels); if (doc.member) role(doc.member, doc.roles);}`}
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_role/member", `{"admin_channels":["docs"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_role/lead",
+		`{"admin_channels":["plans"], "admin_roles":["member"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_role/boss", `{"admin_channels":["budget"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/alice",
+		`{"password":"letmein", "admin_roles":["lead"]}`), 201)
+
+	response := rt.sendAdminRequest("GET", "/db/_user/alice", "")
+	assertStatus(t, response, 200)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["roles"], []interface{}{"lead", "member"})
+	assert.DeepEquals(t, body["all_channels"], []interface{}{"!", "docs", "plans"})
+
+	response = rt.sendAdminRequest("GET", "/db/_role/lead", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["admin_roles"], []interface{}{"member"})
+
+	// A role can't inherit from itself:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_role/member", `{"admin_roles":["lead"]}`), 400)
+
+	// The sync function can give a role to a role; the user's _changes feed backfills its channel:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/doc1", `{"channels":["budget"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/grant", `{"member":"role:lead", "roles":["role:boss"]}`), 201)
+	rt.ServerContext().Database("db").WaitForPendingChanges()
+	response = rt.send(requestByUser("GET", "/db/_changes", "", "alice"))
+	assertStatus(t, response, 200)
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 2)
+	assert.Equals(t, changes.Results[1].ID, "doc1")
+
+	// The sync function can make a cycle (boss -> lead -> boss), which is logged but harmless:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/cycle", `{"member":"role:boss", "roles":["role:lead"]}`), 201)
+	response = rt.sendAdminRequest("GET", "/db/_user/alice", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["roles"], []interface{}{"boss", "lead", "member"})
+}
+
+func TestSyncTest(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {channel(doc.channels); log("channels:", doc.channels);}`}
+	response := rt.sendAdminRequest("POST", "/db/_sync_test", `{"doc": {"channels": ["ABC"]}}`)
+	assertStatus(t, response, 200)
+	var result map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.DeepEquals(t, result["channels"], []interface{}{"ABC"})
+	assert.DeepEquals(t, result["log"], []interface{}{"channels: ABC"})
+
+	response = rt.sendAdminRequest("POST", "/db/_sync_test",
+		`{"doc": {"n": 1}, "sync": "function(doc) {reject(418, 'teapot');}"}`)
+	assertStatus(t, response, 200)
+	result = nil
+	json.Unmarshal(response.Body.Bytes(), &result)
+	assert.Equals(t, result["status"], 418.0)
+	assert.Equals(t, result["reason"], "teapot")
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_sync_test", `{"docid": "nosuchdoc"}`), 404)
+}
+
+func TestMetrics(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {channel(doc.channels);}`}
+	rt.createDoc(t, "doc1")
+	assertStatus(t, rt.sendRequest("GET", "/db/doc1", ""), 200)
+
+	response := rt.sendAdminRequest("GET", "/_metrics", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.HeaderMap.Get("Content-Type"), "text/plain; version=0.0.4")
+	metrics := response.Body.String()
+	for _, line := range []string{
+		"# TYPE sync_gateway_http_request_duration_seconds histogram",
+		`sync_gateway_changes_feeds_active{database="db"} 0`,
+		`sync_gateway_revision_cache_size{database="db"} 1`,
+		`sync_gateway_sync_function_duration_seconds_bucket{database="db",le="+Inf"} 1`,
+		`sync_gateway_sync_function_duration_seconds_count{database="db"} 1`,
+		`sync_gateway_event_queue_length{database="db"} 0`,
+	} {
+		assert.True(t, strings.Contains(metrics, line+"\n"))
+	}
+}
+
+func TestDBStats(t *testing.T) {
+	var rt restTester
+	revid := rt.createDoc(t, "doc1")
+	assertStatus(t, rt.sendRequest("GET", "/db/doc1?rev="+revid, ""), 200)
+	assertStatus(t, rt.sendRequest("GET", "/db/_stats", ""), 404)
+
+	// Reading the stats mustn't reset them, so both responses should match:
+	for i := 0; i < 2; i++ {
+		response := rt.sendAdminRequest("GET", "/db/_stats", "")
+		assertStatus(t, response, 200)
+		var stats struct {
+			DBName        string `json:"db_name"`
+			Documents     map[string]int
+			RevisionCache struct {
+				Size, Capacity, Hits int
+			} `json:"revision_cache"`
+			EventQueueLength int `json:"event_queue_length"`
+		}
+		assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &stats), nil)
+		assert.Equals(t, stats.DBName, "db")
+		assert.Equals(t, stats.Documents["revs_added"], 1)
+		assert.Equals(t, stats.Documents["document_writes"], 1)
+		assert.Equals(t, stats.RevisionCache.Size, 1)
+		assert.Equals(t, stats.RevisionCache.Capacity, db.RevisionCacheCapacity)
+		assert.Equals(t, stats.RevisionCache.Hits, 1)
+		assert.Equals(t, stats.EventQueueLength, 0)
+	}
+}
+
 func (rt *restTester) createSession(t *testing.T, username string) string {
 
 	response := rt.sendAdminRequest("POST", "/db/_session", fmt.Sprintf(`{"name":%q}`, username))
@@ -19,6 +19,7 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
@@ -74,7 +75,30 @@ func (h *handler) handleAllDbs() error {
 	return nil
 }
 
+// ADMIN API to compact the database. By default this deletes obsolete revision bodies; with
+// ?type=tombstones it purges deleted docs older than the retention period (the 'retention' query
+// param, in seconds, or else the db's tombstone_retention.) A retention of 0, which purges every
+// tombstone, also needs ?force=true. With ?dry_run=true it only lists the docs that would be purged.
 func (h *handler) handleCompact() error {
+	if h.getQuery("type") == "tombstones" {
+		retention := h.db.TombstoneRetention
+		if h.getQuery("retention") != "" {
+			retention = time.Duration(h.getIntQuery("retention", 0)) * time.Second
+			if retention == 0 && !h.getBoolQuery("force") {
+				return base.HTTPErrorf(http.StatusBadRequest, "retention=0 purges all tombstones; add force=true to do that")
+			}
+		} else if retention == 0 {
+			return base.HTTPErrorf(http.StatusBadRequest, "No tombstone retention configured; give a retention period")
+		}
+		dryRun := h.getBoolQuery("dry_run")
+		purged, err := h.db.CompactTombstones(retention, dryRun)
+		if err != nil {
+			return err
+		}
+		h.writeJSON(db.Body{"purged": purged, "dry_run": dryRun})
+		return nil
+	}
+
 	revsDeleted, err := h.db.Compact()
 	if err != nil {
 		return err
@@ -83,6 +107,28 @@ func (h *handler) handleCompact() error {
 	return nil
 }
 
+// ADMIN API to purge documents or revisions. The request body maps doc IDs to arrays of leaf
+// revision IDs to purge; a revision ID of "*" purges the entire document.
+func (h *handler) handlePurge() error {
+	var input map[string][]string
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	purged := map[string][]string{}
+	for docid, revids := range input {
+		revs, err := h.db.Purge(docid, revids)
+		if err != nil {
+			if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusNotFound {
+				continue // Ignore missing docs, like CouchDB does
+			}
+			return err
+		}
+		purged[docid] = revs
+	}
+	h.writeJSON(db.Body{"purged": purged})
+	return nil
+}
+
 func (h *handler) handleVacuum() error {
 	attsDeleted, err := db.VacuumAttachments(h.db.Bucket)
 	if err != nil {
@@ -117,6 +163,32 @@ func (h *handler) handleResync() error {
 	return nil
 }
 
+func (h *handler) handleRebuildChannelIndex() error {
+	if h.db.ChannelIndex == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "Database has no channel index")
+	}
+	docsIndexed, err := h.db.RebuildChannelIndex()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"docs": docsIndexed})
+	return nil
+}
+
+// Handles POST /{db}/_sync_test -- runs the sync function on a revision without saving it
+func (h *handler) handleSyncTest() error {
+	var input db.SyncFnDryRun
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	result, err := h.db.DryRunSyncFunction(input)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
 func (h *handler) instanceStartTime() json.Number {
 	return json.Number(strconv.FormatInt(h.db.StartTime.UnixNano()/1000, 10))
 }
@@ -267,13 +339,17 @@ func (h *handler) handlePprofThreadcreate() error {
 }
 
 type stats struct {
-	MemStats runtime.MemStats
+	MemStats  runtime.MemStats
+	Throttled map[string]uint64 `json:",omitempty"` // Requests rejected by rate limits
 }
 
 // ADMIN API to expose runtime and other stats
 func (h *handler) handleStats() error {
 	st := stats{}
 	runtime.ReadMemStats(&st.MemStats)
+	if h.server.throttle != nil {
+		st.Throttled = h.server.throttle.stats()
+	}
 
 	h.writeJSON(st)
 	return nil
@@ -20,12 +20,14 @@ import (
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/couchbaselabs/go.assert"
 	"github.com/robertkrimen/otto/underscore"
+	"golang.org/x/net/websocket"
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
@@ -636,6 +638,29 @@ func TestBulkDocsChangeToAccess(t *testing.T) {
 		map[string]interface{}{"rev": "1-4d79588b9fe9c38faae61f0c1b9471c0", "id": "bulk2"})
 }
 
+func TestBulkDocsAllOrNothing(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {if (doc.n < 0) throw({forbidden: "negative"});}`}
+	input := `{"all_or_nothing": true, "docs": [{"_id": "aon1", "n": 1}, {"_id": "aon2", "n": -1}]}`
+	response := rt.sendRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 417)
+	var docs []interface{}
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.DeepEquals(t, docs, []interface{}{map[string]interface{}{
+		"id": "aon2", "status": 403.0, "error": "forbidden", "reason": "negative"}})
+	assertStatus(t, rt.sendRequest("GET", "/db/aon1", ""), 404)
+
+	input = `{"all_or_nothing": true, "docs": [{"_id": "aon1", "n": 1}, {"_id": "aon2", "n": 2}]}`
+	response = rt.sendRequest("POST", "/db/_bulk_docs", input)
+	assertStatus(t, response, 201)
+	json.Unmarshal(response.Body.Bytes(), &docs)
+	assert.DeepEquals(t, docs, []interface{}{
+		map[string]interface{}{"rev": "1-50133ddd8e49efad34ad9ecae4cb9907", "id": "aon1"},
+		map[string]interface{}{"rev": "1-035168c88bd4b80fb098a8da72f881ce", "id": "aon2"}})
+
+	input = `{"all_or_nothing": true, "new_edits": false, "docs": []}`
+	assertStatus(t, rt.sendRequest("POST", "/db/_bulk_docs", input), 400)
+}
+
 func TestBulkDocsNoEdits(t *testing.T) {
 	var rt restTester
 	input := `{"new_edits":false, "docs": [
@@ -837,6 +862,14 @@ func TestReadChangesOptionsFromJSON(t *testing.T) {
 	assert.Equals(t, filter, "Melitta")
 	assert.DeepEquals(t, channelsArray, []string{"ABC", "BBC"})
 
+	// The _doc_ids filter, and active_only
+	optStr = `{"feed":"normal", "filter":"_doc_ids", "doc_ids":["d1","d2"], "active_only":true}`
+	feed, options, filter, channelsArray, err = h.readChangesOptionsFromJSON([]byte(optStr))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, filter, "_doc_ids")
+	assert.DeepEquals(t, options.DocIDs, base.SetOf("d1", "d2"))
+	assert.Equals(t, options.ActiveOnly, true)
+
 	// Attempt to set heartbeat, timeout to valid values
 	optStr = `{"feed":"longpoll", "since": "1", "heartbeat":30000, "timeout":60000}`
 	feed, options, filter, channelsArray, err = h.readChangesOptionsFromJSON([]byte(optStr))
@@ -872,6 +905,344 @@ func TestReadChangesOptionsFromJSON(t *testing.T) {
 	assert.Equals(t, options.HeartbeatMs, uint64(60000))
 }
 
+// Returns the entries of a _changes response.
+func readChanges(t *testing.T, response *testResponse) []db.ChangeEntry {
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	return changes.Results
+}
+
+// Returns the doc IDs of the entries of a _changes response.
+func changedIDs(t *testing.T, response *testResponse) []string {
+	ids := []string{}
+	for _, entry := range readChanges(t, response) {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func TestChangesFilterFunctions(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {channel("all");}`}
+	a := rt.ServerContext().Database("db").Authenticator()
+	alice, err := a.NewUser("alice", "letmein", channels.SetOf("all"))
+	assert.Equals(t, err, nil)
+	a.Save(alice)
+
+	// A design doc filter that uses the requesting user, and a config filter that uses a parameter:
+	response := rt.sendAdminRequest("PUT", "/db/_design/app",
+		`{"filters": {"mine": "function(doc, req) {return doc.assignee == req.userCtx.name;}"}}`)
+	assertStatus(t, response, 201)
+	response = rt.sendAdminRequest("GET", "/db/_design/app", "")
+	assertStatus(t, response, 200)
+	var ddoc db.DesignDoc
+	json.Unmarshal(response.Body.Bytes(), &ddoc)
+	assert.Equals(t, len(ddoc.Filters), 1)
+	rt.ServerContext().Database("db").ChangesFilters = map[string]*db.JSFilter{
+		"bytype": db.NewJSFilter(`function(doc, req) {return doc.type == req.query.type;}`, nil),
+	}
+
+	assertStatus(t, rt.send(request("PUT", "/db/t1", `{"type":"task", "assignee":"alice"}`)), 201)
+	assertStatus(t, rt.send(request("PUT", "/db/t2", `{"type":"task", "assignee":"bob"}`)), 201)
+	assertStatus(t, rt.send(request("PUT", "/db/n1", `{"type":"note", "assignee":"alice"}`)), 201)
+
+	assert.DeepEquals(t, changedIDs(t, rt.send(requestByUser("GET", "/db/_changes?filter=app/mine", "", "alice"))),
+		[]string{"t1", "n1"})
+	assert.DeepEquals(t, changedIDs(t, rt.send(requestByUser("GET", "/db/_changes?filter=app/mine&feed=longpoll", "", "alice"))),
+		[]string{"t1", "n1"})
+	results := readChanges(t, rt.sendAdminRequest("GET", "/db/_changes?filter=sync_gateway/bytype&type=note", ""))
+	assert.Equals(t, len(results), 1)
+	assert.Equals(t, results[0].ID, "n1")
+	since := results[0].Seq.String()
+	assert.DeepEquals(t, changedIDs(t, rt.sendAdminRequest("POST", "/db/_changes", `{"filter":"sync_gateway/bytype", "type":"task", "limit":1}`)),
+		[]string{"t1"})
+
+	// Filtered-out changes don't end a longpoll feed:
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		rt.send(request("PUT", "/db/n2", `{"type":"note"}`))
+		rt.send(request("PUT", "/db/t3", `{"type":"task"}`))
+	}()
+	assert.DeepEquals(t, changedIDs(t, rt.sendAdminRequest("GET", "/db/_changes?feed=longpoll&filter=sync_gateway/bytype&type=task&since="+since, "")),
+		[]string{"t3"})
+
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_changes?filter=app/nope", ""), 404)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_changes?filter=nope", ""), 400)
+}
+
+func TestChangesDocIDsFilter(t *testing.T) {
+	rt := restTester{syncFn: `function(doc) {channel(doc.channels);}`}
+	a := rt.ServerContext().Database("db").Authenticator()
+	alice, err := a.NewUser("alice", "letmein", channels.SetOf("a"))
+	assert.Equals(t, err, nil)
+	a.Save(alice)
+
+	assertStatus(t, rt.send(request("PUT", "/db/d1", `{"channels":"a"}`)), 201)
+	assertStatus(t, rt.send(request("PUT", "/db/d2", `{"channels":"b"}`)), 201)
+	response := rt.send(request("PUT", "/db/d3", `{"channels":"a"}`))
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assertStatus(t, rt.send(request("DELETE", "/db/d3?rev="+body["rev"].(string), "")), 200)
+	assertStatus(t, rt.send(request("PUT", "/db/d4", `{"channels":"a"}`)), 201)
+
+	// Users only see the listed docs they have access to:
+	docIDs := `doc_ids=["d1","d2","d3"]`
+	assert.DeepEquals(t, changedIDs(t, rt.send(requestByUser("GET", "/db/_changes?filter=_doc_ids&"+docIDs, "", "alice"))),
+		[]string{"d1", "d3"})
+	assert.DeepEquals(t, changedIDs(t, rt.send(requestByUser("GET", "/db/_changes?filter=_doc_ids&active_only=true&"+docIDs, "", "alice"))),
+		[]string{"d1"})
+	assert.DeepEquals(t, changedIDs(t, rt.sendAdminRequest("POST", "/db/_changes", `{"filter":"_doc_ids", "doc_ids":["d2","d3"]}`)),
+		[]string{"d2", "d3"})
+	assert.DeepEquals(t, changedIDs(t, rt.sendAdminRequest("POST", "/db/_changes", `{"active_only":true}`)),
+		[]string{"d1", "d2", "d4"})
+
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_changes?filter=_doc_ids", ""), 400)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_changes?filter=_doc_ids&doc_ids=d1", ""), 400)
+}
+
+func TestChangesEventSourceFeed(t *testing.T) {
+	var rt restTester
+	rt.createDoc(t, "doc1")
+	rt.createDoc(t, "doc2")
+
+	response := rt.sendAdminRequest("GET", "/db/_changes?feed=eventsource&limit=2", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Header().Get("Content-Type"), "text/event-stream")
+	body := response.Body.String()
+	assert.True(t, strings.Contains(body, "id: 1\ndata: {\"seq\":1,\"id\":\"doc1\","))
+	assert.True(t, strings.Contains(body, "\n\nid: 2\ndata: {\"seq\":2,\"id\":\"doc2\","))
+
+	// Reconnecting with Last-Event-ID resumes after that sequence:
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/_changes?feed=eventsource&limit=1", "",
+		map[string]string{"Last-Event-ID": "1"})
+	assertStatus(t, response, 200)
+	body = response.Body.String()
+	assert.True(t, strings.Contains(body, "id: 2\n"))
+	assert.False(t, strings.Contains(body, "id: 1\n"))
+}
+
+func TestPatchDoc(t *testing.T) {
+	var rt restTester
+	rev1 := rt.createDoc(t, "doc1")
+	mergePatch := map[string]string{"Content-Type": "application/merge-patch+json"}
+	jsonPatch := map[string]string{"Content-Type": "application/json-patch+json"}
+
+	response := rt.sendRequestWithHeaders("PATCH", "/db/doc1", `{"prop":null, "a":{"b":1}}`, mergePatch)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev2 := body["rev"].(string)
+	assert.Equals(t, response.Header().Get("Etag"), strconv.Quote(rev2))
+
+	response = rt.sendRequestWithHeaders("PATCH", "/db/doc1?rev="+rev2,
+		`[{"op":"add", "path":"/a/c", "value":[1]}, {"op":"add", "path":"/a/c/-", "value":2}]`, jsonPatch)
+	assertStatus(t, response, 201)
+	response = rt.sendRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.DeepEquals(t, body["a"], map[string]interface{}{"b": 1.0, "c": []interface{}{1.0, 2.0}})
+	assert.Equals(t, body["prop"], nil)
+
+	// Stale revision, failed test, bad patch, unknown content type, missing doc:
+	assertStatus(t, rt.sendRequestWithHeaders("PATCH", "/db/doc1?rev="+rev1, `{"x":1}`, mergePatch), 409)
+	assertStatus(t, rt.sendRequestWithHeaders("PATCH", "/db/doc1", `[{"op":"test", "path":"/a/b", "value":2}]`, jsonPatch), 409)
+	assertStatus(t, rt.sendRequestWithHeaders("PATCH", "/db/doc1", `[{"op":"remove", "path":"/zzz"}]`, jsonPatch), 422)
+	assertStatus(t, rt.sendRequestWithHeaders("PATCH", "/db/doc1", `{"op":"remove"}`, jsonPatch), 400)
+	assertStatus(t, rt.sendRequestWithHeaders("PATCH", "/db/doc1", `[1]`, mergePatch), 400)
+	assertStatus(t, rt.sendRequest("PATCH", "/db/doc1", `{"x":1}`), 415)
+	assertStatus(t, rt.sendRequestWithHeaders("PATCH", "/db/doc2", `{"x":1}`, mergePatch), 404)
+	assertStatus(t, rt.sendRequestWithHeaders("PATCH", "/db/doc1", `{"_foo":1}`, mergePatch), 400)
+}
+
+func TestRevisionDeltas(t *testing.T) {
+	var rt restTester
+	rev1 := rt.createDoc(t, "doc1")
+	response := rt.sendRequest("PUT", "/db/doc1", `{"_rev":"`+rev1+`", "n":2, "list":[1,2]}`)
+	assertStatus(t, response, 201)
+	var body db.Body
+	json.Unmarshal(response.Body.Bytes(), &body)
+	rev2 := body["rev"].(string)
+
+	response = rt.sendRequest("GET", `/db/doc1?revs=true&deltas_from=["`+rev1+`"]`, "")
+	assertStatus(t, response, 200)
+	body = nil
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body["_rev"], rev2)
+	assert.Equals(t, body["_deltaSrc"], rev1)
+	assert.DeepEquals(t, body["_delta"], map[string]interface{}{"n": 2.0, "list": []interface{}{[]interface{}{1.0, 2.0}}, "prop": []interface{}{}})
+	assert.True(t, body["_revisions"] != nil)
+	assertStatus(t, rt.sendRequest("GET", "/db/doc1?deltas_from=bogus", ""), 400)
+
+	response = rt.sendRequest("POST", "/db/_bulk_get", `{"docs":[{"id":"doc1", "deltas_from":["`+rev1+`"]}]}`)
+	assertStatus(t, response, 200)
+	assert.True(t, strings.Contains(response.Body.String(), `"_deltaSrc":"`+rev1+`"`))
+	assertStatus(t, rt.sendRequest("POST", "/db/_bulk_get", `{"docs":[{"id":"doc1", "deltas_from":[1]}]}`), 200)
+
+	var changes struct {
+		Results []db.ChangeEntry
+	}
+	rt.ServerContext().Database("db").WaitForPendingChanges()
+	response = rt.sendAdminRequest("GET", `/db/_changes?include_docs=true&deltas_from={"doc1":["`+rev1+`"]}`, "")
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].Doc["_deltaSrc"], rev1)
+	changes.Results = nil
+	response = rt.sendAdminRequest("POST", "/db/_changes", `{"include_docs":true, "deltas_from":{"doc2":["`+rev1+`"]}}`)
+	assertStatus(t, response, 200)
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, changes.Results[0].Doc["_deltaSrc"], nil)
+	assert.Equals(t, changes.Results[0].Doc["n"], 2.0)
+}
+
+func TestSyncSocket(t *testing.T) {
+	var rt restTester
+	server := httptest.NewServer(CreatePublicHandler(rt.ServerContext()))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/db/_sync_socket?compress=true"
+	conn, err := websocket.Dial(wsURL, "", server.URL)
+	assert.Equals(t, err, nil)
+	defer conn.Close()
+	codec := socketCodec(false)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Sends a request and returns the reply, handling any requests from the server meanwhile:
+	var serverRequests []*socketMessage
+	call := func(n uint64, profile, props, body string) *socketMessage {
+		msg := socketMessage{Type: kSocketRequest, Number: n, Profile: profile}
+		json.Unmarshal([]byte(props), &msg.Properties)
+		msg.Body = json.RawMessage(body)
+		assert.Equals(t, codec.Send(conn, msg), nil)
+		for {
+			var reply socketMessage
+			assert.Equals(t, codec.Receive(conn, &reply), nil)
+			if reply.Type == kSocketRequest {
+				serverRequests = append(serverRequests, &reply)
+			} else if reply.Number == n {
+				return &reply
+			}
+		}
+	}
+
+	// Push a revision:
+	reply := call(1, "rev", "", `{"_id":"doc1", "_rev":"1-abc", "_revisions":{"start":1, "ids":["abc"]},
+		"_attachments":{"hi.txt":{"data":"aGVsbG8="}}}`)
+	assert.Equals(t, reply.Type, kSocketResponse)
+	assert.Equals(t, string(reply.Body), `{"id":"doc1","rev":"1-abc"}`)
+	reply = call(2, "rev", "", `{"_id":"doc2"}`)
+	assert.Equals(t, reply.Type, kSocketError)
+	assert.Equals(t, reply.Status, 400)
+
+	reply = call(3, "revsDiff", "", `{"doc1":["1-abc","2-def"]}`)
+	assert.Equals(t, string(reply.Body), `{"doc1":{"missing":["2-def"]}}`)
+	reply = call(4, "getAttachment", `{"id":"doc1", "name":"hi.txt"}`, "")
+	assert.Equals(t, string(reply.Body), `"aGVsbG8="`)
+	reply = call(5, "bogus", "", "")
+	assert.Equals(t, reply.Status, 404)
+
+	// Pull: subscribe to changes, and ask for the revision in them:
+	reply = call(6, "subChanges", "", `{"since":0}`)
+	assert.Equals(t, reply.Type, kSocketResponse)
+	for len(serverRequests) < 2 {
+		var msg socketMessage
+		assert.Equals(t, codec.Receive(conn, &msg), nil)
+		serverRequests = append(serverRequests, &msg)
+	}
+	assert.Equals(t, serverRequests[0].Profile, "changes")
+	var changes []db.ChangeEntry
+	json.Unmarshal(serverRequests[0].Body, &changes)
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].ID, "doc1")
+	assert.Equals(t, serverRequests[1].Profile, "changes")
+	assert.Equals(t, string(serverRequests[1].Body), `[]`)
+	assert.Equals(t, codec.Send(conn, socketMessage{Type: kSocketResponse, Number: serverRequests[0].Number,
+		Body: json.RawMessage(`[["1-abc"]]`)}), nil)
+
+	var rev socketMessage
+	assert.Equals(t, codec.Receive(conn, &rev), nil)
+	assert.Equals(t, rev.Profile, "rev")
+	assert.Equals(t, rev.NoReply, true)
+	var body db.Body
+	json.Unmarshal(rev.Body, &body)
+	assert.Equals(t, body["_id"], "doc1")
+	assert.DeepEquals(t, db.ParseRevisions(body), []string{"1-abc"})
+}
+
+func TestSyncSocketOrigin(t *testing.T) {
+	var rt restTester
+	rt.ServerContext().config.CORS.Origin = []string{"http://example.com"}
+	server := httptest.NewServer(CreatePublicHandler(rt.ServerContext()))
+	defer server.Close()
+	adminServer := httptest.NewServer(CreateAdminHandler(rt.ServerContext()))
+	defer adminServer.Close()
+
+	dial := func(serverURL, origin string) error {
+		conn, err := websocket.Dial("ws"+strings.TrimPrefix(serverURL, "http")+"/db/_sync_socket", "", origin)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	// The server's own origin and the CORS origins are allowed; other sites aren't:
+	assert.Equals(t, dial(server.URL, server.URL), nil)
+	assert.Equals(t, dial(server.URL, "http://example.com"), nil)
+	assert.True(t, dial(server.URL, "http://hack0r.com") != nil)
+	// The admin port doesn't allow CORS:
+	assert.Equals(t, dial(adminServer.URL, adminServer.URL), nil)
+	assert.True(t, dial(adminServer.URL, "http://example.com") != nil)
+	runtime.KeepAlive(&rt) // Its finalizer would close the server context
+}
+
+func TestSyncSocketCompression(t *testing.T) {
+	msg := socketMessage{Type: kSocketRequest, Number: 1, Profile: "rev",
+		Body: json.RawMessage(`"` + strings.Repeat("x", 2000) + `"`)}
+	data, payloadType, err := socketCodec(true).Marshal(msg)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, payloadType, byte(websocket.BinaryFrame))
+	assert.True(t, len(data) < 1000)
+	var decoded socketMessage
+	assert.Equals(t, socketCodec(false).Unmarshal(data, payloadType, &decoded), nil)
+	assert.DeepEquals(t, decoded, msg)
+
+	_, payloadType, _ = socketCodec(true).Marshal(socketMessage{Type: kSocketResponse, Number: 1})
+	assert.Equals(t, payloadType, byte(websocket.TextFrame))
+
+	// A message that decompresses to more than the max size is rejected:
+	msg.Body = json.RawMessage(`"` + strings.Repeat("x", kSocketMaxMessageSize) + `"`)
+	data, payloadType, _ = socketCodec(true).Marshal(msg)
+	assert.True(t, len(data) < kSocketMaxMessageSize)
+	assert.Equals(t, socketCodec(false).Unmarshal(data, payloadType, &decoded), websocket.ErrFrameTooLarge)
+}
+
+func TestSyncSocketRateLimit(t *testing.T) {
+	var rt restTester
+	rt.ServerContext().throttle = newThrottler(&ThrottleConfig{
+		Writes: &RateLimit{IPRate: 0.01, Burst: 1},
+	})
+	server := httptest.NewServer(CreatePublicHandler(rt.ServerContext()))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/db/_sync_socket"
+	conn, err := websocket.Dial(wsURL, "", server.URL)
+	assert.Equals(t, err, nil)
+	defer conn.Close()
+	codec := socketCodec(false)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// Each "rev" request counts as a write:
+	for n, status := range []int{0, http.StatusTooManyRequests} {
+		msg := socketMessage{Type: kSocketRequest, Number: uint64(n + 1), Profile: "rev",
+			Body: json.RawMessage(`{"_id":"doc1", "_rev":"1-abc", "_revisions":{"start":1, "ids":["abc"]}}`)}
+		assert.Equals(t, codec.Send(conn, msg), nil)
+		var reply socketMessage
+		assert.Equals(t, codec.Receive(conn, &reply), nil)
+		assert.Equals(t, reply.Status, status)
+	}
+}
+
 func TestAccessControl(t *testing.T) {
 	type allDocsRow struct {
 		ID    string `json:"id"`
@@ -288,10 +288,11 @@ func (h *handler) handleDumpChannel() error {
 // Request looks like POST /db/_bulk_get?revs=___&attachments=___
 // where the boolean ?revs parameter adds a revision history to each doc
 // and the boolean ?attachments parameter includes attachment bodies.
+// A doc's optional "deltas_from" lists revisions the client has, to send a delta from.
 // The body of the request is JSON and looks like:
 // {
 //   "docs": [
-//		{"id": "docid", "rev": "revid", "atts_since": [12,...]}, ...
+//		{"id": "docid", "rev": "revid", "atts_since": [12,...], "deltas_from": [...]}, ...
 // 	 ]
 // }
 func (h *handler) handleBulkGet() error {
@@ -306,7 +307,7 @@ func (h *handler) handleBulkGet() error {
 	err = h.writeMultipart("mixed", func(writer *multipart.Writer) error {
 		for _, item := range body["docs"].([]interface{}) {
 			var body db.Body
-			var attsSince []string
+			var attsSince, deltasFrom []string
 			var err error
 
 			doc := item.(map[string]interface{})
@@ -338,10 +339,24 @@ func (h *handler) handleBulkGet() error {
 						attsSince = []string{}
 					}
 				}
+				if doc["deltas_from"] != nil {
+					raw, ok := doc["deltas_from"].([]interface{})
+					if ok {
+						deltasFrom = make([]string, len(raw))
+						for i := 0; i < len(raw); i++ {
+							if deltasFrom[i], ok = raw[i].(string); !ok {
+								break
+							}
+						}
+					}
+					if !ok {
+						err = base.HTTPErrorf(http.StatusBadRequest, "Invalid deltas_from")
+					}
+				}
 			}
 
 			if err == nil {
-				body, err = h.db.GetRev(docid, revid, includeRevs, attsSince)
+				body, err = h.db.GetRevWithDelta(docid, revid, includeRevs, attsSince, deltasFrom)
 			}
 
 			if err != nil {
@@ -374,6 +389,12 @@ func (h *handler) handleBulkDocs() error {
 	}
 
 	docs := body["docs"].([]interface{})
+	if allOrNothing, _ := body["all_or_nothing"].(bool); allOrNothing {
+		if !newEdits {
+			return base.HTTPErrorf(http.StatusBadRequest, "all_or_nothing can't be used with new_edits=false")
+		}
+		return h.bulkDocsAllOrNothing(docs)
+	}
 	h.db.ReserveSequences(uint64(len(docs)))
 
 	result := make([]db.Body, 0, len(docs))
@@ -398,23 +419,57 @@ func (h *handler) handleBulkDocs() error {
 			}
 		}
 
-		status := db.Body{}
-		if docid != "" {
-			status["id"] = docid
-		}
-		if err != nil {
-			code, msg := base.ErrorAsHTTPStatus(err)
-			status["status"] = code
-			status["error"] = base.CouchHTTPErrorName(code)
-			status["reason"] = msg
-			base.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
-			err = nil // wrote it to output already; not going to return it
-		} else {
-			status["rev"] = revid
+		result = append(result, bulkDocStatus(docid, revid, err))
+	}
+
+	h.writeJSONStatus(http.StatusCreated, result)
+	return nil
+}
+
+// Handles a _bulk_docs request with "all_or_nothing":true. If any doc can't be saved then none
+// are, and the response has status 417 and lists the docs that failed.
+func (h *handler) bulkDocsAllOrNothing(docs []interface{}) error {
+	bodies := make([]db.Body, len(docs))
+	for i, item := range docs {
+		bodies[i] = item.(map[string]interface{})
+	}
+	h.db.ReserveSequences(uint64(len(bodies)))
+
+	revids, errs := h.db.PutAllOrNothing(bodies)
+	if errs != nil {
+		failures := []db.Body{}
+		for i, err := range errs {
+			if err != nil {
+				docid, _ := bodies[i]["_id"].(string)
+				failures = append(failures, bulkDocStatus(docid, "", err))
+			}
 		}
-		result = append(result, status)
+		h.writeJSONStatus(http.StatusExpectationFailed, failures)
+		return nil
 	}
 
+	result := make([]db.Body, len(bodies))
+	for i, revid := range revids {
+		result[i] = bulkDocStatus(bodies[i]["_id"].(string), revid, nil)
+	}
 	h.writeJSONStatus(http.StatusCreated, result)
 	return nil
 }
+
+// Returns the status of one doc in a _bulk_docs response.
+func bulkDocStatus(docid, revid string, err error) db.Body {
+	status := db.Body{}
+	if docid != "" {
+		status["id"] = docid
+	}
+	if err != nil {
+		code, msg := base.ErrorAsHTTPStatus(err)
+		status["status"] = code
+		status["error"] = base.CouchHTTPErrorName(code)
+		status["reason"] = msg
+		base.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
+	} else {
+		status["rev"] = revid
+	}
+	return status
+}
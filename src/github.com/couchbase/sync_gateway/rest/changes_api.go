@@ -76,6 +76,7 @@ func (h *handler) handleChanges() error {
 	var options db.ChangesOptions
 	var filter string
 	var channelsArray []string
+	var query map[string]interface{} // Request parameters, for a filter function
 	if h.rq.Method == "GET" {
 		// GET request has parameters in URL:
 		feed = h.getQuery("feed")
@@ -86,13 +87,30 @@ func (h *handler) handleChanges() error {
 		options.Limit = int(h.getIntQuery("limit", 0))
 		options.Conflicts = (h.getQuery("style") == "all_docs")
 		options.IncludeDocs = (h.getBoolQuery("include_docs"))
+		options.ActiveOnly = h.getBoolQuery("active_only")
 		filter = h.getQuery("filter")
 		channelsParam := h.getQuery("channels")
 		if channelsParam != "" {
 			channelsArray = strings.Split(channelsParam, ",")
 		}
+		if docIDsParam := h.getQuery("doc_ids"); filter == "_doc_ids" && docIDsParam != "" {
+			var docIDs []string
+			if err := json.Unmarshal([]byte(docIDsParam), &docIDs); err != nil {
+				return base.HTTPErrorf(http.StatusBadRequest, "Bad doc_ids parameter; must be a JSON array")
+			}
+			options.DocIDs = base.SetFromArray(docIDs)
+		}
+		if deltasParam := h.getQuery("deltas_from"); deltasParam != "" {
+			if err := json.Unmarshal([]byte(deltasParam), &options.DeltasFrom); err != nil {
+				return base.HTTPErrorf(http.StatusBadRequest, "Bad deltas_from parameter; must be a JSON object")
+			}
+		}
 		options.HeartbeatMs = getRestrictedIntQuery(h.rq.URL.Query(), "heartbeat", kDefaultHeartbeatMS, kMinHeartbeatMS, h.server.config.MaxHeartbeat*1000, true)
 		options.TimeoutMs = getRestrictedIntQuery(h.rq.URL.Query(), "timeout", kDefaultTimeoutMS, 0, kMaxTimeoutMS, true)
+		query = map[string]interface{}{}
+		for key, values := range h.rq.URL.Query() {
+			query[key] = values[0]
+		}
 
 	} else {
 		// POST request has parameters in JSON body:
@@ -104,26 +122,12 @@ func (h *handler) handleChanges() error {
 		if err != nil {
 			return err
 		}
+		json.Unmarshal(body, &query)
 	}
 
-	// Get the channels as parameters to an imaginary "bychannel" filter.
-	// The default is all channels the user can access.
-	userChannels := channels.SetOf(channels.AllChannelWildcard)
-	if filter != "" {
-		if filter != "sync_gateway/bychannel" {
-			return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel")
-		}
-		if channelsArray == nil {
-			return base.HTTPErrorf(http.StatusBadRequest, "Missing 'channels' filter parameter")
-		}
-		var err error
-		userChannels, err = channels.SetFromArray(channelsArray, channels.ExpandStar)
-		if err != nil {
-			return err
-		}
-		if len(userChannels) == 0 {
-			return base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
-		}
+	userChannels, err := h.applyChangesFilter(filter, channelsArray, query, &options)
+	if err != nil {
+		return err
 	}
 
 	h.db.ChangesClientStats.Increment()
@@ -142,6 +146,14 @@ func (h *handler) handleChanges() error {
 		return h.sendContinuousChangesByHTTP(userChannels, options)
 	case "websocket":
 		return h.sendContinuousChangesByWebSocket(userChannels, options)
+	case "eventsource":
+		// A reconnecting EventSource sends the ID of the last event it got, i.e. a sequence:
+		if lastEventID := h.rq.Header.Get("Last-Event-ID"); lastEventID != "" {
+			if options.Since, err = db.ParseSequenceID(lastEventID); err != nil {
+				return err
+			}
+		}
+		return h.sendContinuousChangesByEventSource(userChannels, options)
 	default:
 		return base.HTTPErrorf(http.StatusBadRequest, "Unknown feed type")
 	}
@@ -361,6 +373,29 @@ func (h *handler) sendContinuousChangesByHTTP(inChannels base.Set, options db.Ch
 	})
 }
 
+// Sends a continuous changes feed as Server-Sent Events, for the browser EventSource API. Each
+// change is a "data:" message whose ID is the change's sequence; heartbeats are SSE comments.
+func (h *handler) sendContinuousChangesByEventSource(inChannels base.Set, options db.ChangesOptions) error {
+	h.setHeader("Content-Type", "text/event-stream")
+	h.setHeader("Cache-Control", "no-cache")
+	h.logStatus(http.StatusOK, "sending eventsource feed")
+	return h.generateContinuousChanges(inChannels, options, func(changes []*db.ChangeEntry) error {
+		var err error
+		if changes != nil {
+			for _, change := range changes {
+				data, _ := json.Marshal(change)
+				if _, err = fmt.Fprintf(h.response, "id: %s\ndata: %s\n\n", change.Seq, data); err != nil {
+					break
+				}
+			}
+		} else {
+			_, err = h.response.Write([]byte(":\n\n"))
+		}
+		h.flush()
+		return err
+	})
+}
+
 func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options db.ChangesOptions) error {
 	handler := func(conn *websocket.Conn) {
 		h.logStatus(101, "Upgraded to WebSocket protocol")
@@ -373,12 +408,20 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 		if msg, err := readWebSocketMessage(conn); err != nil {
 			return
 		} else {
+			var filter string
 			var channelNames []string
 			var err error
-			if _, options, _, channelNames, err = h.readChangesOptionsFromJSON(msg); err != nil {
+			if _, options, filter, channelNames, err = h.readChangesOptionsFromJSON(msg); err != nil {
 				return
 			}
-			if channelNames != nil {
+			if filter != "" {
+				var query map[string]interface{}
+				json.Unmarshal(msg, &query)
+				if inChannels, err = h.applyChangesFilter(filter, channelNames, query, &options); err != nil {
+					base.LogTo("HTTP", "#%03d:     --> WebSocket changes filter error: %v", h.serialNumber, err)
+					return
+				}
+			} else if channelNames != nil {
 				inChannels, _ = channels.SetFromArray(channelNames, channels.ExpandStar)
 			}
 		}
@@ -409,17 +452,56 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 	return nil
 }
 
+// Sets up the filtering of a _changes request, returning the channels to include. The built-in
+// "sync_gateway/bychannel" filter selects the channels given as its parameter, and "_doc_ids"
+// restricts the feed to the docs in options.DocIDs. Any other filter is a JavaScript function,
+// which is added to the options along with the request parameters in 'query'. The default is
+// all channels the user can access.
+func (h *handler) applyChangesFilter(filter string, channelsArray []string, query map[string]interface{}, options *db.ChangesOptions) (base.Set, error) {
+	userChannels := channels.SetOf(channels.AllChannelWildcard)
+	if filter == "" {
+		return userChannels, nil
+	} else if filter == "_doc_ids" {
+		if options.DocIDs == nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Missing 'doc_ids' filter parameter")
+		}
+		return userChannels, nil
+	} else if filter != "sync_gateway/bychannel" {
+		function, err := h.db.GetChangesFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		options.Filter = &db.DocFilter{Function: function, Query: query}
+		return userChannels, nil
+	}
+	// Get the channels as parameters to an imaginary "bychannel" filter.
+	if channelsArray == nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Missing 'channels' filter parameter")
+	}
+	userChannels, err := channels.SetFromArray(channelsArray, channels.ExpandStar)
+	if err != nil {
+		return nil, err
+	}
+	if len(userChannels) == 0 {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
+	}
+	return userChannels, nil
+}
+
 func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, options db.ChangesOptions, filter string, channelsArray []string, err error) {
 	var input struct {
-		Feed        string        `json:"feed"`
-		Since       db.SequenceID `json:"since"`
-		Limit       int           `json:"limit"`
-		Style       string        `json:"style"`
-		IncludeDocs bool          `json:"include_docs"`
-		Filter      string        `json:"filter"`
-		Channels    string        `json:"channels"` // a filter query param, so it has to be a string
-		HeartbeatMs *uint64       `json:"heartbeat"`
-		TimeoutMs   *uint64       `json:"timeout"`
+		Feed        string              `json:"feed"`
+		Since       db.SequenceID       `json:"since"`
+		Limit       int                 `json:"limit"`
+		Style       string              `json:"style"`
+		IncludeDocs bool                `json:"include_docs"`
+		Filter      string              `json:"filter"`
+		Channels    string              `json:"channels"` // a filter query param, so it has to be a string
+		DocIDs      []string            `json:"doc_ids"`  // parameter of the _doc_ids filter
+		ActiveOnly  bool                `json:"active_only"`
+		DeltasFrom  map[string][]string `json:"deltas_from"` // known revs of docs, to send deltas from
+		HeartbeatMs *uint64             `json:"heartbeat"`
+		TimeoutMs   *uint64             `json:"timeout"`
 	}
 	if err = json.Unmarshal(jsonData, &input); err != nil {
 		return
@@ -429,7 +511,12 @@ func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, opti
 	options.Limit = input.Limit
 	options.Conflicts = (input.Style == "all_docs")
 	options.IncludeDocs = input.IncludeDocs
+	options.ActiveOnly = input.ActiveOnly
+	options.DeltasFrom = input.DeltasFrom
 	filter = input.Filter
+	if filter == "_doc_ids" && input.DocIDs != nil {
+		options.DocIDs = base.SetFromArray(input.DocIDs)
+	}
 
 	if input.Channels != "" {
 		channelsArray = strings.Split(input.Channels, ",")
@@ -14,12 +14,14 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
 	"strings"
 
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/db"
 )
@@ -59,6 +61,7 @@ type ServerConfig struct {
 	Persona                        *PersonaConfig  // Configuration for Mozilla Persona validation
 	Facebook                       *FacebookConfig // Configuration for Facebook validation
 	CORS                           *CORSConfig     // Configuration for allowing CORS
+	Throttle                       *ThrottleConfig // Per-user and per-IP rate limits on the public API
 	Log                            []string        // Log keywords to enable
 	LogFilePath                    *string         // Path to log file, if missing write to stderr
 	Pretty                         bool            // Pretty-print JSON responses?
@@ -84,6 +87,8 @@ type DbConfig struct {
 	Bucket             *string                        `json:"bucket"`                         // Bucket name on server; defaults to same as 'name'
 	Pool               *string                        `json:"pool"`                           // Couchbase pool name, default "default"
 	Sync               *string                        `json:"sync"`                           // Sync function defines which users can see which data
+	SyncTimeout        *uint32                        `json:"sync_timeout,omitempty"`         // Max milliseconds a sync function call can run
+	SyncPoolSize       *int                           `json:"sync_pool_size,omitempty"`       // Max number of concurrent sync function calls
 	Users              map[string]*db.PrincipalConfig `json:"users,omitempty"`                // Initial user accounts
 	Roles              map[string]*db.PrincipalConfig `json:"roles,omitempty"`                // Initial roles
 	RevsLimit          *uint32                        `json:"revs_limit,omitempty"`           // Max depth a document's revision tree can grow to
@@ -93,6 +98,14 @@ type DbConfig struct {
 	FeedType           string                         `json:"feed_type,omitempty"`            // Feed type - "DCP" or "TAP"; defaults based on Couchbase server version
 	AllowEmptyPassword bool                           `json:"allow_empty_password,omitempty"` // Allow empty passwords?  Defaults to false
 	CacheConfig        *CacheConfig                   `json:"cache,omitempty"`                // Cache settings
+	ConflictResolver   *string                        `json:"conflict_resolver,omitempty"`    // JS function that resolves document conflicts
+	Filters            map[string]string              `json:"filters,omitempty"`              // JS _changes filter functions, used as "sync_gateway/<name>"
+	TombstoneRetention *uint32                        `json:"tombstone_retention,omitempty"`  // Seconds to keep deleted docs before purging them
+	OIDC               *OIDCConfig                    `json:"oidc,omitempty"`                 // OpenID Connect identity provider
+	JWT                *JWTConfig                     `json:"jwt,omitempty"`                  // Keys for bearer JWT authentication
+	ChannelIndex       *ChannelIndexConfig            `json:"channel_index,omitempty"`        // Persistent channel index for changes backfills
+	Schemas            map[string]*db.DocSchemaConfig `json:"schemas,omitempty"`              // Initial JSON schemas of docs, by name (until changed via the admin API)
+	JSModules          map[string]*JSModuleConfig     `json:"js_modules,omitempty"`           // Shared JS libraries for the sync & other JS fns (until changed via the admin API)
 }
 
 type DbConfigMap map[string]*DbConfig
@@ -106,6 +119,102 @@ type FacebookConfig struct {
 	Register bool // If true, server will register new user accounts
 }
 
+type OIDCConfig struct {
+	Issuer        string  `json:"issuer"`                   // Provider's issuer URL, used for discovery
+	ClientID      string  `json:"client_id"`                // Client ID registered with the provider
+	ClientSecret  string  `json:"client_secret,omitempty"`  // Client secret, for the authorization code flow
+	JWKSURL       *string `json:"jwks_uri,omitempty"`       // URL of signing keys; defaults to discovered one
+	CallbackURL   *string `json:"callback_url,omitempty"`   // This server's /{db}/_oidc_callback URL, for the login flow
+	Register      bool    `json:"register,omitempty"`       // If true, server will register new user accounts
+	UsernameClaim *string `json:"username_claim,omitempty"` // Claim to use as username; defaults to "sub"
+	RolesClaim    *string `json:"roles_claim,omitempty"`    // Claim listing roles to grant the user
+	ChannelsClaim *string `json:"channels_claim,omitempty"` // Claim listing channels to grant the user
+}
+
+// Creates the OpenID Connect provider this config describes.
+func (oidc *OIDCConfig) Provider() *auth.OIDCProvider {
+	provider := &auth.OIDCProvider{
+		Issuer:       oidc.Issuer,
+		ClientID:     oidc.ClientID,
+		ClientSecret: oidc.ClientSecret,
+		Register:     oidc.Register,
+	}
+	if oidc.JWKSURL != nil {
+		provider.JWKSURL = *oidc.JWKSURL
+	}
+	if oidc.CallbackURL != nil {
+		provider.CallbackURL = *oidc.CallbackURL
+	}
+	if oidc.UsernameClaim != nil {
+		provider.UsernameClaim = *oidc.UsernameClaim
+	}
+	if oidc.RolesClaim != nil {
+		provider.RolesClaim = *oidc.RolesClaim
+	}
+	if oidc.ChannelsClaim != nil {
+		provider.ChannelsClaim = *oidc.ChannelsClaim
+	}
+	return provider
+}
+
+type JWTConfig struct {
+	Keys          []JWTKeyConfig `json:"keys"`                     // Keys that tokens may be signed with
+	Issuer        *string        `json:"issuer,omitempty"`         // If set, tokens' "iss" claim must match
+	Audience      *string        `json:"audience,omitempty"`       // If set, tokens' "aud" claim must contain it
+	Register      bool           `json:"register,omitempty"`       // If true, server will register new user accounts
+	RolesClaim    *string        `json:"roles_claim,omitempty"`    // Claim listing roles to grant for the request
+	ChannelsClaim *string        `json:"channels_claim,omitempty"` // Claim listing channels to grant for the request
+}
+
+type JWTKeyConfig struct {
+	KeyID     string `json:"kid,omitempty"` // If set, only tokens with this "kid" header use this key
+	Algorithm string `json:"alg"`           // "HS256", "RS256" or "ES256"
+	Key       string `json:"key"`           // Shared secret for HS256, else a PEM-encoded public key
+}
+
+// A shared JavaScript library; its exports are available to the sync function, filters,
+// webhook filters and conflict resolver. The source is given either inline or as a file path.
+type JSModuleConfig struct {
+	Source string `json:"source,omitempty"` // The module's JavaScript source
+	File   string `json:"file,omitempty"`   // Path of a file containing the source
+}
+
+// Returns the module's source, reading it from its file if necessary.
+func (config *JSModuleConfig) ReadSource() (string, error) {
+	if config.File == "" {
+		return config.Source, nil
+	} else if config.Source != "" {
+		return "", fmt.Errorf("JS module can't have both a source and a file")
+	}
+	source, err := ioutil.ReadFile(config.File)
+	return string(source), err
+}
+
+// Creates the bearer JWT verifier this config describes.
+func (config *JWTConfig) Verifier() (*auth.JWTVerifier, error) {
+	verifier := &auth.JWTVerifier{Register: config.Register}
+	for _, keyConfig := range config.Keys {
+		key, err := auth.NewJWTKey(keyConfig.KeyID, keyConfig.Algorithm, keyConfig.Key)
+		if err != nil {
+			return nil, err
+		}
+		verifier.Keys = append(verifier.Keys, key)
+	}
+	if config.Issuer != nil {
+		verifier.Issuer = *config.Issuer
+	}
+	if config.Audience != nil {
+		verifier.Audience = *config.Audience
+	}
+	if config.RolesClaim != nil {
+		verifier.RolesClaim = *config.RolesClaim
+	}
+	if config.ChannelsClaim != nil {
+		verifier.ChannelsClaim = *config.ChannelsClaim
+	}
+	return verifier, nil
+}
+
 type CORSConfig struct {
 	Origin      []string // List of allowed origins, use ["*"] to allow access from everywhere
 	LoginOrigin []string // List of allowed login origins
@@ -113,6 +222,26 @@ type CORSConfig struct {
 	MaxAge      int      // Maximum age of the CORS Options request
 }
 
+type ThrottleConfig struct {
+	Reads   *RateLimit // Limits on requests that only read data
+	Writes  *RateLimit // Limits on requests that change data
+	Changes *RateLimit // Limits on _changes feed requests
+}
+
+type RateLimit struct {
+	UserRate float64 // Requests per second allowed for each user (0 for no limit)
+	IPRate   float64 // Requests per second allowed from each IP address (0 for no limit)
+	Burst    int     // Max requests allowed in a burst; defaults to the rate
+}
+
+// Returns the burst size to use for the given rate.
+func (limit *RateLimit) burst(rate float64) int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return int(math.Ceil(rate))
+}
+
 type ShadowConfig struct {
 	Server       *string `json:"server"`                 // Couchbase server URL
 	Pool         *string `json:"pool,omitempty"`         // Couchbase pool name, default "default"
@@ -123,10 +252,19 @@ type ShadowConfig struct {
 	FeedType     string  `json:"feed_type,omitempty"`    // Feed type - "DCP" or "TAP"; defaults to TAP
 }
 
+type ChannelIndexConfig struct {
+	Server   *string `json:"server,omitempty"`   // Couchbase server URL; defaults to the database's
+	Pool     *string `json:"pool,omitempty"`     // Couchbase pool name, default "default"
+	Bucket   *string `json:"bucket,omitempty"`   // Bucket to store the index in; defaults to the database's
+	Username string  `json:"username,omitempty"` // Username for authenticating to server
+	Password string  `json:"password,omitempty"` // Password for authenticating to server
+}
+
 type EventHandlerConfig struct {
-	MaxEventProc    uint           `json:"max_processes,omitempty"`    // Max concurrent event handling goroutines
-	WaitForProcess  string         `json:"wait_for_process,omitempty"` // Max wait time when event queue is full (ms)
-	DocumentChanged []*EventConfig `json:"document_changed,omitempty"` // Document Commit
+	MaxEventProc     uint           `json:"max_processes,omitempty"`     // Max concurrent event handling goroutines
+	WaitForProcess   string         `json:"wait_for_process,omitempty"`  // Max wait time when event queue is full (ms)
+	DocumentChanged  []*EventConfig `json:"document_changed,omitempty"`  // Document Commit
+	ConflictResolved []*EventConfig `json:"conflict_resolved,omitempty"` // Conflict resolved by the conflict_resolver
 }
 
 type EventConfig struct {
@@ -202,6 +340,11 @@ func (shadowConfig *ShadowConfig) GetCredentials() (string, string, string) {
 	return shadowConfig.Username, shadowConfig.Password, shadowConfig.Bucket
 }
 
+// Implementation of AuthHandler interface for ChannelIndexConfig
+func (indexConfig *ChannelIndexConfig) GetCredentials() (string, string, string) {
+	return indexConfig.Username, indexConfig.Password, *indexConfig.Bucket
+}
+
 // Reads a ServerConfig from raw data
 func ReadServerConfigFromData(data []byte) (*ServerConfig, error) {
 
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/db"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"strconv"
@@ -41,9 +42,17 @@ func (h *handler) handleGetDoc() error {
 		}
 	}
 
+	// Which revisions does the client have, that it'd like a delta from?
+	var deltasFrom []string
+	if deltas := h.getQuery("deltas_from"); deltas != "" {
+		if err := json.Unmarshal([]byte(deltas), &deltasFrom); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "bad deltas_from")
+		}
+	}
+
 	if openRevs == "" {
 		// Single-revision GET:
-		value, err := h.db.GetRev(docid, revid, includeRevs, attachmentsSince)
+		value, err := h.db.GetRevWithDelta(docid, revid, includeRevs, attachmentsSince, deltasFrom)
 		if err != nil {
 			return err
 		}
@@ -245,6 +254,53 @@ func (h *handler) handlePutDoc() error {
 	return nil
 }
 
+// HTTP handler for a PATCH of a document. The request body is a JSON Merge Patch (RFC 7396)
+// or a JSON Patch (RFC 6902), depending on its Content-Type, which is applied to the current
+// revision to create a new one. A "rev" query or If-Match header makes the update conditional.
+func (h *handler) handlePatchDoc() error {
+	docid := h.PathVar("docid")
+	matchRev := h.getQuery("rev")
+	if matchRev == "" {
+		matchRev = h.rq.Header.Get("If-Match")
+	}
+	data, err := h.readBody()
+	if err != nil {
+		return err
+	}
+
+	var patch func(db.Body) (db.Body, error)
+	contentType, _, _ := mime.ParseMediaType(h.rq.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/merge-patch+json":
+		var mergePatch map[string]interface{}
+		if err := json.Unmarshal(data, &mergePatch); err != nil || mergePatch == nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Merge patch must be a JSON object")
+		}
+		patch = func(body db.Body) (db.Body, error) {
+			return db.ApplyMergePatch(map[string]interface{}(body), mergePatch).(map[string]interface{}), nil
+		}
+	case "application/json-patch+json":
+		var operations []db.JSONPatchOperation
+		if err := json.Unmarshal(data, &operations); err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "JSON Patch must be an array of operations")
+		}
+		patch = func(body db.Body) (db.Body, error) {
+			return db.ApplyJSONPatch(body, operations)
+		}
+	default:
+		return base.HTTPErrorf(http.StatusUnsupportedMediaType,
+			"PATCH requires application/merge-patch+json or application/json-patch+json")
+	}
+
+	newRev, err := h.db.Patch(docid, matchRev, patch)
+	if err != nil {
+		return err
+	}
+	h.setHeader("Etag", strconv.Quote(newRev))
+	h.writeJSONStatus(http.StatusCreated, db.Body{"ok": true, "id": docid, "rev": newRev})
+	return nil
+}
+
 // HTTP handler for a POST to a database (creating a document)
 func (h *handler) handlePostDoc() error {
 	body, err := h.readDocument()
@@ -45,6 +45,9 @@ var lastSerialNum uint64 = 0
 
 var restExpvars = expvar.NewMap("syncGateway_rest")
 
+// Latency of all (non-continuous) HTTP requests
+var requestDurations = base.NewHistogram(base.DefaultLatencyBuckets)
+
 func init() {
 	DebugMultipart = (os.Getenv("GatewayDebugMultipart") != "")
 }
@@ -138,12 +141,20 @@ func (h *handler) invoke(method handlerMethod) error {
 		}
 	}
 
-	// Authenticate, if not on admin port:
+	// Authenticate, if not on admin port, and apply rate limits:
 	if h.privs != adminPrivs {
+		if err = h.checkRateLimit(false); err != nil {
+			h.logRequestLine()
+			return err
+		}
 		if err = h.checkAuth(dbContext); err != nil {
 			h.logRequestLine()
 			return err
 		}
+		if err = h.checkRateLimit(true); err != nil {
+			h.logRequestLine()
+			return err
+		}
 	}
 
 	h.logRequestLine()
@@ -183,6 +194,7 @@ func (h *handler) logDuration(realTime bool) {
 		duration = time.Since(h.startTime)
 		bin := int(duration/(100*time.Millisecond)) * 100
 		restExpvars.Add(fmt.Sprintf("requests_%04dms", bin), 1)
+		requestDurations.Observe(duration)
 	}
 
 	logKey := "HTTP+"
@@ -217,8 +229,18 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 		return nil
 	}
 
-	// Check cookie
+	// Check bearer token (JWT or OpenID Connect ID token)
 	var err error
+	if token := h.getBearerToken(); token != "" && (context.JWTVerifier != nil || context.OIDCProvider != nil) {
+		if h.user, err = authenticateBearerToken(context, token); err != nil {
+			base.LogTo("Auth", "Bearer token auth failed: %v", err)
+			h.response.Header().Set("WWW-Authenticate", `Bearer realm="Couchbase Sync Gateway"`)
+			return err
+		}
+		return nil
+	}
+
+	// Check cookie
 	h.user, err = context.Authenticator().AuthenticateCookie(h.rq, h.response)
 	if err != nil {
 		return err
@@ -238,6 +260,22 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 	return nil
 }
 
+// Authenticates a bearer token: a JWT signed with one of the database's configured keys, or else
+// an ID token from its OpenID Connect provider.
+func authenticateBearerToken(context *db.DatabaseContext, token string) (auth.User, error) {
+	if context.JWTVerifier != nil {
+		user, err := context.Authenticator().AuthenticateJWT(context.JWTVerifier, token)
+		if err != auth.ErrUnknownJWTKey || context.OIDCProvider == nil {
+			return user, err
+		}
+	}
+	claims, err := context.OIDCProvider.VerifyIDToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return context.Authenticator().AuthenticateOIDC(context.OIDCProvider, claims)
+}
+
 func (h *handler) assertAdminOnly() {
 	if h.privs != adminPrivs {
 		panic("Admin-only handler called without admin privileges, on " + h.rq.RequestURI)
@@ -363,6 +401,15 @@ func (h *handler) setHeader(name string, value string) {
 	h.response.Header().Set(name, value)
 }
 
+// Returns the token from an "Authorization: Bearer" header, if any.
+func (h *handler) getBearerToken() string {
+	auth := h.rq.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
 func (h *handler) setStatus(status int, message string) {
 	h.status = status
 	h.statusMessage = message
@@ -1,6 +1,7 @@
 package rest
 
 import (
+	"net/http"
 	"net/url"
 	"testing"
 
@@ -97,3 +98,38 @@ func TestGetRestrictedIntQuery(t *testing.T) {
 	)
 	assert.Equals(t, restricted, minValue)
 }
+
+func TestThrottleClass(t *testing.T) {
+	for _, test := range []struct{ method, path, class string }{
+		{"GET", "/db/doc", kThrottleReads},
+		{"POST", "/db/_bulk_get", kThrottleReads},
+		{"POST", "/db/_bulk_docs", kThrottleWrites},
+		{"PUT", "/db/doc", kThrottleWrites},
+		{"GET", "/db/_changes", kThrottleChanges},
+		{"POST", "/db/_changes", kThrottleChanges},
+	} {
+		rq, _ := http.NewRequest(test.method, "http://localhost"+test.path, nil)
+		assert.Equals(t, throttleClass(rq), test.class)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	var rt restTester
+	rt.ServerContext().throttle = newThrottler(&ThrottleConfig{
+		Reads:  &RateLimit{IPRate: 0.01, Burst: 2},
+		Writes: &RateLimit{UserRate: 0.01, Burst: 1},
+	})
+	assertStatus(t, rt.sendRequest("GET", "/db/", ""), 200)
+	assertStatus(t, rt.sendRequest("GET", "/db/", ""), 200)
+	response := rt.sendRequest("GET", "/db/", "")
+	assertStatus(t, response, 429)
+	assert.True(t, response.HeaderMap.Get("Retry-After") != "")
+
+	// Writes have a separate budget, and the admin API isn't limited:
+	assertStatus(t, rt.sendRequest("PUT", "/db/doc1", `{}`), 201)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/", ""), 200)
+
+	stats := rt.ServerContext().throttle.stats()
+	assert.Equals(t, stats["reads_by_ip"], uint64(1))
+	assert.Equals(t, stats["writes_by_user"], uint64(0))
+}
@@ -9,12 +9,24 @@
 package rest
 
 import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbaselabs/go.assert"
 	"github.com/tleyden/fakehttp"
 	"log"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestVerifyFacebook(t *testing.T) {
@@ -50,3 +62,113 @@ func TestVerifyHTTPSSupport(t *testing.T) {
 		log.Panicf("Error making HTTPS connection: %v", err)
 	}
 }
+
+func TestOIDCBearerAuth(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(auth.JWKSet{Keys: []auth.JWK{{
+			KeyType: "RSA",
+			KeyID:   "k",
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwksServer.Close()
+
+	rt := restTester{noAdminParty: true}
+	provider := &auth.OIDCProvider{
+		Issuer:        "https://accounts.example.com",
+		ClientID:      "sgw",
+		JWKSURL:       jwksServer.URL,
+		ChannelsClaim: "channels",
+	}
+	rt.ServerContext().Database("db").OIDCProvider = provider
+
+	makeToken := func(claims auth.JWTClaims) map[string]string {
+		claims["iss"] = provider.Issuer
+		claims["aud"] = provider.ClientID
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		header, _ := json.Marshal(auth.JWTHeader{Algorithm: "RS256", KeyID: "k"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		hash := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		token := signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	// Unknown users are rejected unless registration is enabled:
+	token := makeToken(auth.JWTClaims{"sub": "alice", "channels": []string{"ch1"}})
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/_session", "", token), 401)
+	provider.Register = true
+	response := rt.sendRequestWithHeaders("GET", "/db/_session", "", token)
+	assertStatus(t, response, 200)
+	var body struct {
+		UserCtx struct {
+			Name     string
+			Channels map[string]interface{}
+		}
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body.UserCtx.Name, "alice")
+	assert.True(t, body.UserCtx.Channels["ch1"] != nil)
+
+	// The token's channels are only granted for the request, not saved:
+	response = rt.sendAdminRequest("GET", "/db/_user/alice", "")
+	assertStatus(t, response, 200)
+	var user map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &user)
+	assert.Equals(t, user["admin_channels"], nil)
+	assert.DeepEquals(t, user["all_channels"], []interface{}{"!"})
+
+	// The login flow needs a configured callback URL:
+	assertStatus(t, rt.sendRequest("GET", "/db/_oidc", ""), 404)
+
+	// A token with a bad signature is rejected:
+	token["Authorization"] += "x"
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/_session", "", token), 401)
+
+	// OIDC login isn't available on a database without a provider:
+	rt.ServerContext().Database("db").OIDCProvider = nil
+	assertStatus(t, rt.sendRequest("GET", "/db/_oidc", ""), 404)
+}
+
+func TestJWTBearerAuth(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	channelsClaim := "sg_channels"
+	verifier, err := (&JWTConfig{
+		Keys:          []JWTKeyConfig{{Algorithm: "HS256", Key: "sekrit"}},
+		ChannelsClaim: &channelsClaim,
+	}).Verifier()
+	assert.Equals(t, err, nil)
+	rt.ServerContext().Database("db").JWTVerifier = verifier
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_user/bob", `{"password":"letmein"}`), 201)
+
+	header, _ := json.Marshal(auth.JWTHeader{Algorithm: "HS256"})
+	payload, _ := json.Marshal(auth.JWTClaims{"sub": "bob", "sg_channels": []string{"ch1"},
+		"exp": time.Now().Add(time.Hour).Unix()})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte("sekrit"))
+	mac.Write([]byte(signed))
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	response := rt.sendRequestWithHeaders("GET", "/db/_session", "", map[string]string{"Authorization": "Bearer " + token})
+	assertStatus(t, response, 200)
+	var body struct {
+		UserCtx struct {
+			Name     string
+			Channels map[string]interface{}
+		}
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	assert.Equals(t, body.UserCtx.Name, "bob")
+	assert.True(t, body.UserCtx.Channels["ch1"] != nil)
+
+	// The channel grant only lasts for the request; it isn't saved to the user:
+	response = rt.sendAdminRequest("GET", "/db/_user/bob", "")
+	assertStatus(t, response, 200)
+	assert.False(t, strings.Contains(response.Body.String(), "ch1"))
+
+	response = rt.sendRequestWithHeaders("GET", "/db/_session", "", map[string]string{"Authorization": "Bearer " + token + "x"})
+	assertStatus(t, response, 401)
+}
@@ -0,0 +1,185 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Prefix of the names of all metrics
+const kMetricsPrefix = "sync_gateway_"
+
+// ADMIN API that exports gateway and per-database metrics in the Prometheus text format.
+func (h *handler) handleMetrics() error {
+	var out metricsWriter
+
+	out.family("http_request_duration_seconds", "histogram", "Latency of HTTP requests")
+	out.histogram("http_request_duration_seconds", "", requestDurations.Snapshot())
+
+	databases := h.server.AllDatabases()
+	names := make([]string, 0, len(databases))
+	for name := range databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out.family("changes_feeds_active", "gauge", "Number of open _changes feeds")
+	for _, name := range names {
+		out.value("changes_feeds_active", dbLabel(name), float64(databases[name].ChangesClientStats.CurrentCount()))
+	}
+	out.family("changes_feeds_total", "counter", "Number of _changes feeds opened")
+	for _, name := range names {
+		out.value("changes_feeds_total", dbLabel(name), float64(databases[name].ChangesClientStats.TotalCount()))
+	}
+
+	cacheStats := make(map[string]db.ChangeCacheStats, len(names))
+	for _, name := range names {
+		cacheStats[name] = databases[name].ChangeCacheStats()
+	}
+	out.family("change_cache_pending_sequences", "gauge", "Sequences waiting for earlier sequences to arrive")
+	for _, name := range names {
+		out.value("change_cache_pending_sequences", dbLabel(name), float64(cacheStats[name].PendingSequences))
+	}
+	out.family("change_cache_skipped_sequences", "gauge", "Skipped sequences that may still arrive late")
+	for _, name := range names {
+		out.value("change_cache_skipped_sequences", dbLabel(name), float64(cacheStats[name].SkippedSequences))
+	}
+	out.family("change_cache_entries", "gauge", "Number of entries in the channel caches")
+	for _, name := range names {
+		entries := 0
+		for _, length := range cacheStats[name].ChannelLengths {
+			entries += length
+		}
+		out.value("change_cache_entries", dbLabel(name), float64(entries))
+	}
+
+	out.family("revision_cache_size", "gauge", "Number of revisions in the revision cache")
+	for _, name := range names {
+		size, _, _ := databases[name].RevisionCacheStatistics()
+		out.value("revision_cache_size", dbLabel(name), float64(size))
+	}
+	out.family("revision_cache_hits_total", "counter", "Revision cache lookups that found the revision")
+	for _, name := range names {
+		_, hits, _ := databases[name].RevisionCacheStatistics()
+		out.value("revision_cache_hits_total", dbLabel(name), float64(hits))
+	}
+	out.family("revision_cache_misses_total", "counter", "Revision cache lookups that had to load the revision")
+	for _, name := range names {
+		_, _, misses := databases[name].RevisionCacheStatistics()
+		out.value("revision_cache_misses_total", dbLabel(name), float64(misses))
+	}
+
+	out.family("sync_function_duration_seconds", "histogram", "Latency of sync function calls")
+	for _, name := range names {
+		out.histogram("sync_function_duration_seconds", dbLabel(name), databases[name].SyncFunctionTimes.Snapshot())
+	}
+	out.family("sync_function_wait_seconds", "histogram", "Time sync function calls wait for a free JS runner")
+	for _, name := range names {
+		out.histogram("sync_function_wait_seconds", dbLabel(name), databases[name].SyncWaitTimes.Snapshot())
+	}
+
+	out.family("event_queue_length", "gauge", "Number of events waiting to be sent to event handlers")
+	for _, name := range names {
+		out.value("event_queue_length", dbLabel(name), float64(databases[name].EventMgr.QueueLength()))
+	}
+
+	h.setHeader("Content-Type", "text/plain; version=0.0.4")
+	h.response.Write(out.Bytes())
+	return nil
+}
+
+// ADMIN API that returns the current counters and cache/feed state of a single database.
+// Unlike ServerContext.Stats, reading these doesn't reset anything.
+func (h *handler) handleDBStats() error {
+	context := h.db.DatabaseContext
+	cacheStats := context.ChangeCacheStats()
+	revCacheSize, hits, misses := context.RevisionCacheStatistics()
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = float64(hits) / float64(hits+misses)
+	}
+
+	h.writeJSON(db.Body{
+		"db_name":   context.Name,
+		"documents": json.RawMessage(context.DbStats.String()),
+		"changes_feeds": db.Body{
+			"active": context.ChangesClientStats.CurrentCount(),
+			"max":    context.ChangesClientStats.MaxCount(),
+			"total":  context.ChangesClientStats.TotalCount(),
+		},
+		"revision_cache": db.Body{
+			"size":      revCacheSize,
+			"capacity":  db.RevisionCacheCapacity,
+			"hits":      hits,
+			"misses":    misses,
+			"hit_ratio": hitRatio,
+		},
+		"channel_cache": db.Body{
+			"channels": len(cacheStats.ChannelLengths),
+			"lengths":  cacheStats.ChannelLengths,
+		},
+		"sequences": db.Body{
+			"pending":               cacheStats.PendingSequences,
+			"skipped":               cacheStats.SkippedSequences,
+			"oldest_skipped_age_ms": int64(cacheStats.OldestSkippedAge / time.Millisecond),
+		},
+		"feed_lag_ms":        int64(cacheStats.FeedLag / time.Millisecond),
+		"event_queue_length": context.EventMgr.QueueLength(),
+	})
+	return nil
+}
+
+// Formats the label set identifying a database's metrics.
+func dbLabel(dbName string) string {
+	return fmt.Sprintf("database=%q", dbName)
+}
+
+// Writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+// Writes the HELP and TYPE lines that precede the samples of a metric.
+func (out *metricsWriter) family(name, metricType, help string) {
+	fmt.Fprintf(out, "# HELP %s%s %s\n", kMetricsPrefix, name, help)
+	fmt.Fprintf(out, "# TYPE %s%s %s\n", kMetricsPrefix, name, metricType)
+}
+
+// Writes a single sample.
+func (out *metricsWriter) value(name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(out, "%s%s%s %s\n", kMetricsPrefix, name, labels,
+		strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// Writes the bucket, sum and count samples of a histogram, with values in seconds.
+func (out *metricsWriter) histogram(name, labels string, snapshot base.HistogramSnapshot) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	for i, bound := range snapshot.Bounds {
+		le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+		out.value(name+"_bucket", fmt.Sprintf("%sle=%q", prefix, le), float64(snapshot.Counts[i]))
+	}
+	out.value(name+"_bucket", prefix+`le="+Inf"`, float64(snapshot.Count))
+	out.value(name+"_sum", labels, float64(snapshot.Sum)/float64(time.Second))
+	out.value(name+"_count", labels, float64(snapshot.Count))
+}
@@ -0,0 +1,106 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Cookie that remembers the 'state' parameter of an OpenID Connect login in progress
+const kOIDCStateCookieName = "SyncGatewayOIDCState"
+
+// How long a user has to complete an OpenID Connect login
+const kOIDCStateCookieMaxAge = 10 * 60
+
+// GET /_oidc starts an OpenID Connect login (authorization code flow) by redirecting to the
+// provider's login page, which will redirect back to /_oidc_callback.
+func (h *handler) handleOIDC() error {
+	provider := h.db.OIDCProvider
+	if provider == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "OpenID Connect is not configured")
+	}
+	callbackURL, err := h.oidcCallbackURL()
+	if err != nil {
+		return err
+	}
+	state := base.GenerateRandomSecret()
+	redirectURL, err := provider.AuthorizationRedirect(callbackURL, state)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(h.response, &http.Cookie{
+		Name:     kOIDCStateCookieName,
+		Value:    state,
+		Path:     "/" + h.db.Name + "/",
+		MaxAge:   kOIDCStateCookieMaxAge,
+		HttpOnly: true,
+	})
+	h.setHeader("Location", redirectURL)
+	h.response.WriteHeader(http.StatusFound)
+	h.setStatus(http.StatusFound, "Redirecting to OpenID Connect provider")
+	return nil
+}
+
+// GET /_oidc_callback completes an OpenID Connect login: it redeems the authorization code for
+// an ID token, and creates a login session for the user the token identifies. (The session
+// doesn't carry the channels and roles the token's claims grant; those only apply to requests
+// that send the ID token as a bearer token.)
+func (h *handler) handleOIDCCallback() error {
+	provider := h.db.OIDCProvider
+	if provider == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "OpenID Connect is not configured")
+	}
+	if errCode := h.getQuery("error"); errCode != "" {
+		return base.HTTPErrorf(http.StatusUnauthorized, "OpenID Connect login failed: %s", errCode)
+	}
+	cookie, _ := h.rq.Cookie(kOIDCStateCookieName)
+	if cookie == nil || cookie.Value == "" || cookie.Value != h.getQuery("state") {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid OpenID Connect state")
+	}
+	code := h.getQuery("code")
+	if code == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing authorization code")
+	}
+
+	callbackURL, err := h.oidcCallbackURL()
+	if err != nil {
+		return err
+	}
+	idToken, err := provider.RedeemCode(code, callbackURL)
+	if err != nil {
+		return err
+	}
+	claims, err := provider.VerifyIDToken(idToken)
+	if err != nil {
+		return err
+	}
+	user, err := h.db.Authenticator().AuthenticateOIDC(provider, claims)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(h.response, &http.Cookie{
+		Name:   kOIDCStateCookieName,
+		Path:   "/" + h.db.Name + "/",
+		MaxAge: -1,
+	})
+	return h.makeSession(user)
+}
+
+// The URL the provider redirects back to after a login; the same one must be used when
+// redeeming the authorization code. It comes from the configuration, since the request's Host
+// header can't be trusted.
+func (h *handler) oidcCallbackURL() (string, error) {
+	if h.db.OIDCProvider.CallbackURL == "" {
+		return "", base.HTTPErrorf(http.StatusNotFound, "OpenID Connect login needs a configured callback_url")
+	}
+	return h.db.OIDCProvider.CallbackURL, nil
+}
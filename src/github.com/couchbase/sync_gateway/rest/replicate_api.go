@@ -0,0 +1,112 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// JSON body of a POST to /_replicate
+type replicationParameters struct {
+	Source        string `json:"source"`
+	Target        string `json:"target"`
+	Continuous    bool   `json:"continuous"`
+	Cancel        bool   `json:"cancel"`
+	ReplicationID string `json:"replication_id"`
+}
+
+// ADMIN API to start or cancel a replication. A source or target is either the name of a
+// database in this gateway or the URL of a remote Sync Gateway database.
+// A one-shot replication responds when it's finished; a continuous one responds immediately.
+func (h *handler) handleReplicate() error {
+	var params replicationParameters
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+
+	if params.Cancel && params.ReplicationID != "" {
+		if err := h.server.replicator.Cancel(params.ReplicationID); err != nil {
+			return err
+		}
+		h.writeJSON(db.Body{"ok": true, "replication_id": params.ReplicationID})
+		return nil
+	}
+
+	if params.Source == "" || params.Target == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Missing 'source' or 'target'")
+	}
+	source, err := h.server.replicationEndpoint(params.Source)
+	if err != nil {
+		return err
+	}
+	target, err := h.server.replicationEndpoint(params.Target)
+	if err != nil {
+		return err
+	}
+	if source.String() == target.String() {
+		return base.HTTPErrorf(http.StatusBadRequest, "Source and target are the same")
+	}
+
+	if params.Cancel {
+		id := db.ReplicationID(source, target)
+		if err := h.server.replicator.Cancel(id); err != nil {
+			return err
+		}
+		h.writeJSON(db.Body{"ok": true, "replication_id": id})
+		return nil
+	}
+
+	replication, err := h.server.replicator.Replicate(source, target, params.Continuous)
+	if err != nil {
+		return err
+	}
+	if params.Continuous {
+		h.writeJSONStatus(http.StatusAccepted, db.Body{"ok": true, "replication_id": replication.ID})
+		return nil
+	}
+
+	status, err := replication.Wait()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{
+		"ok":                 status.State == db.ReplicationStateCompleted,
+		"replication_id":     status.ReplicationID,
+		"state":              status.State,
+		"source_last_seq":    status.LastSeq,
+		"docs_read":          status.DocsRead,
+		"docs_written":       status.DocsWritten,
+		"doc_write_failures": status.DocWriteFailures,
+	})
+	return nil
+}
+
+// ADMIN API that lists the replications, both running and stopped
+func (h *handler) handleActiveTasks() error {
+	h.writeJSON(h.server.replicator.ActiveTasks())
+	return nil
+}
+
+// Resolves the source or target of a replication: a URL is a remote database, anything else
+// names a database in this server.
+func (sc *ServerContext) replicationEndpoint(spec string) (db.ReplicationEndpoint, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return db.NewRemoteReplicationEndpoint(spec, sc.HTTPClient), nil
+	}
+	dbc, err := sc.GetDatabase(spec)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewLocalReplicationEndpoint(dbc)
+}
@@ -57,6 +57,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	dbr.Handle("/_design/{ddoc}/_view/{view}", makeHandler(sc, privs, (*handler).handleView)).Methods("GET")
 	dbr.Handle("/_ensure_full_commit", makeHandler(sc, privs, (*handler).handleEFC)).Methods("POST")
 	dbr.Handle("/_revs_diff", makeHandler(sc, privs, (*handler).handleRevsDiff)).Methods("POST")
+	dbr.Handle("/_sync_socket", makeHandler(sc, privs, (*handler).handleSyncSocket)).Methods("GET")
 
 	// Document URLs:
 	dbr.Handle("/_local/{docid}", makeHandler(sc, privs, (*handler).handleGetLocalDoc)).Methods("GET", "HEAD")
@@ -65,6 +66,7 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 
 	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handleGetDoc)).Methods("GET", "HEAD")
 	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handlePutDoc)).Methods("PUT")
+	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handlePatchDoc)).Methods("PATCH")
 	dbr.Handle("/{docid:"+docRegex+"}", makeHandler(sc, privs, (*handler).handleDeleteDoc)).Methods("DELETE")
 
 	dbr.Handle("/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, (*handler).handleGetAttachment)).Methods("GET", "HEAD")
@@ -81,6 +83,9 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 		dbr.Handle("/_facebook", makeHandler(sc, publicPrivs,
 			(*handler).handleFacebookPOST)).Methods("POST")
 	}
+	dbr.Handle("/_oidc", makeHandler(sc, publicPrivs, (*handler).handleOIDC)).Methods("GET")
+	dbr.Handle("/_oidc_callback", makeHandler(sc, publicPrivs,
+		(*handler).handleOIDCCallback)).Methods("GET")
 
 	return r, dbr
 }
@@ -136,6 +141,8 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 		makeHandler(sc, adminPrivs, (*handler).putUser)).Methods("PUT")
 	dbr.Handle("/_user/{name}",
 		makeHandler(sc, adminPrivs, (*handler).deleteUser)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_explain",
+		makeHandler(sc, adminPrivs, (*handler).explainUserAccess)).Methods("GET", "HEAD")
 
 	dbr.Handle("/_user/{name}/_session",
 		makeHandler(sc, adminPrivs, (*handler).deleteUserSessions)).Methods("DELETE")
@@ -153,6 +160,19 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 	dbr.Handle("/_role/{name}",
 		makeHandler(sc, adminPrivs, (*handler).deleteRole)).Methods("DELETE")
 
+	dbr.Handle("/_schema/",
+		makeHandler(sc, adminPrivs, (*handler).getSchemas)).Methods("GET", "HEAD")
+	dbr.Handle("/_schema/{name}",
+		makeHandler(sc, adminPrivs, (*handler).getSchema)).Methods("GET", "HEAD")
+	dbr.Handle("/_schema/{name}",
+		makeHandler(sc, adminPrivs, (*handler).putSchema)).Methods("PUT")
+	dbr.Handle("/_schema/{name}",
+		makeHandler(sc, adminPrivs, (*handler).deleteSchema)).Methods("DELETE")
+	dbr.Handle("/_js_modules",
+		makeHandler(sc, adminPrivs, (*handler).getJSModules)).Methods("GET", "HEAD")
+	dbr.Handle("/_js_modules",
+		makeHandler(sc, adminPrivs, (*handler).putJSModules)).Methods("PUT")
+
 	r.Handle("/_logging",
 		makeHandler(sc, adminPrivs, (*handler).handleGetLogging)).Methods("GET")
 	r.Handle("/_logging",
@@ -165,6 +185,12 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 		makeHandler(sc, adminPrivs, (*handler).handleHeapProfiling)).Methods("POST")
 	r.Handle("/_stats",
 		makeHandler(sc, adminPrivs, (*handler).handleStats)).Methods("GET")
+	r.Handle("/_metrics",
+		makeHandler(sc, adminPrivs, (*handler).handleMetrics)).Methods("GET")
+	r.Handle("/_replicate",
+		makeHandler(sc, adminPrivs, (*handler).handleReplicate)).Methods("POST")
+	r.Handle("/_active_tasks",
+		makeHandler(sc, adminPrivs, (*handler).handleActiveTasks)).Methods("GET")
 	r.Handle(kDebugURLPathPrefix,
 		makeHandler(sc, adminPrivs, (*handler).handleExpvar)).Methods("GET")
 
@@ -189,6 +215,10 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 		makeHandler(sc, adminPrivs, (*handler).handleGetDbConfig)).Methods("GET")
 	dbr.Handle("/_resync",
 		makeHandler(sc, adminPrivs, (*handler).handleResync)).Methods("POST")
+	dbr.Handle("/_rebuild_channel_index",
+		makeHandler(sc, adminPrivs, (*handler).handleRebuildChannelIndex)).Methods("POST")
+	dbr.Handle("/_sync_test",
+		makeHandler(sc, adminPrivs, (*handler).handleSyncTest)).Methods("POST")
 	dbr.Handle("/_vacuum",
 		makeHandler(sc, adminPrivs, (*handler).handleVacuum)).Methods("POST")
 	dbr.Handle("/_flush",
@@ -199,6 +229,8 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 		makeHandler(sc, adminPrivs, (*handler).handleView)).Methods("GET")
 	dbr.Handle("/_dumpchannel/{channel}",
 		makeHandler(sc, adminPrivs, (*handler).handleDumpChannel)).Methods("GET")
+	dbr.Handle("/_stats",
+		makeHandler(sc, adminPrivs, (*handler).handleDBStats)).Methods("GET")
 
 	// The routes below are part of the CouchDB REST API but should only be available to admins,
 	// so the handlers are moved to the admin port.
@@ -211,6 +243,8 @@ func CreateAdminHandler(sc *ServerContext) http.Handler {
 		makeHandler(sc, adminPrivs, (*handler).handleAllDbs)).Methods("GET", "HEAD")
 	dbr.Handle("/_compact",
 		makeHandler(sc, adminPrivs, (*handler).handleCompact)).Methods("POST")
+	dbr.Handle("/_purge",
+		makeHandler(sc, adminPrivs, (*handler).handlePurge)).Methods("POST")
 
 	return wrapRouter(sc, adminPrivs, r)
 }
@@ -241,7 +275,7 @@ func wrapRouter(sc *ServerContext, privs handlerPrivs, router *mux.Router) http.
 
 			// What methods would have matched?
 			var options []string
-			for _, method := range []string{"GET", "HEAD", "POST", "PUT", "DELETE"} {
+			for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
 				if wouldMatch(router, rq, method) {
 					options = append(options, method)
 				}
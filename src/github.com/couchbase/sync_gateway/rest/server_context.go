@@ -43,6 +43,8 @@ type ServerContext struct {
 	lock        sync.RWMutex
 	statsTicker *time.Ticker
 	HTTPClient  *http.Client
+	replicator  *db.Replicator
+	throttle    *throttler
 }
 
 func NewServerContext(config *ServerConfig) *ServerContext {
@@ -50,6 +52,8 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 		config:     config,
 		databases_: map[string]*db.DatabaseContext{},
 		HTTPClient: http.DefaultClient,
+		replicator: db.NewReplicator(),
+		throttle:   newThrottler(config.Throttle),
 	}
 	if config.Databases == nil {
 		config.Databases = DbConfigMap{}
@@ -82,6 +86,8 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 }
 
 func (sc *ServerContext) Close() {
+	sc.replicator.Stop()
+
 	sc.lock.Lock()
 	defer sc.lock.Unlock()
 
@@ -136,6 +142,18 @@ func (sc *ServerContext) AllDatabaseNames() []string {
 	return names
 }
 
+// Returns all the databases, keyed by name.
+func (sc *ServerContext) AllDatabases() map[string]*db.DatabaseContext {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+
+	databases := make(map[string]*db.DatabaseContext, len(sc.databases_))
+	for name, dbcontext := range sc.databases_ {
+		databases[name] = dbcontext
+	}
+	return databases
+}
+
 // Adds a database to the ServerContext.  Attempts a read after it gets the write
 // lock to see if it's already been added by another process. If so, returns either the
 // existing DatabaseContext or an error based on the useExisting flag.
@@ -226,6 +244,13 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 		return nil, err
 	}
 
+	if config.ChannelIndex != nil {
+		if cacheOptions.ChannelIndex, err = openChannelIndex(config.ChannelIndex, spec, bucket); err != nil {
+			bucket.Close()
+			return nil, err
+		}
+	}
+
 	dbcontext, err := db.NewDatabaseContext(dbName, bucket, autoImport, cacheOptions)
 	if err != nil {
 		return nil, err
@@ -235,10 +260,59 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 	if config.Sync != nil {
 		syncFn = *config.Sync
 	}
+	if config.SyncTimeout != nil {
+		dbcontext.SyncTimeout = time.Duration(*config.SyncTimeout) * time.Millisecond
+		dbcontext.JSModules.Timeout = dbcontext.SyncTimeout
+	}
+	if config.SyncPoolSize != nil {
+		dbcontext.SyncPoolSize = *config.SyncPoolSize
+	}
+	// JS modules changed through the admin API are saved in the database, and replace the config's:
+	if savedModules, err := dbcontext.LoadJSModules(); err != nil {
+		return nil, err
+	} else if !savedModules && len(config.JSModules) > 0 {
+		sources := make(map[string]string, len(config.JSModules))
+		for name, module := range config.JSModules {
+			if module == nil {
+				return nil, fmt.Errorf("JS module %q of database %q is null", name, dbName)
+			}
+			if sources[name], err = module.ReadSource(); err != nil {
+				return nil, err
+			}
+		}
+		if err = dbcontext.JSModules.Set(sources); err != nil {
+			return nil, err
+		}
+	}
 	if err := sc.applySyncFunction(dbcontext, syncFn); err != nil {
 		return nil, err
 	}
 
+	if config.ConflictResolver != nil && *config.ConflictResolver != "" {
+		dbcontext.ConflictResolver = db.NewConflictResolver(*config.ConflictResolver, dbcontext.JSModules)
+	}
+
+	if len(config.Filters) > 0 {
+		dbcontext.ChangesFilters = make(map[string]*db.JSFilter, len(config.Filters))
+		for name, fnSource := range config.Filters {
+			dbcontext.ChangesFilters[name] = db.NewJSFilter(fnSource, dbcontext.JSModules)
+		}
+	}
+
+	// Schemas changed through the admin API are saved in the database, and replace the config's:
+	if savedSchemas, err := dbcontext.LoadSchemas(); err != nil {
+		return nil, err
+	} else if !savedSchemas {
+		for name, schema := range config.Schemas {
+			if schema == nil {
+				return nil, fmt.Errorf("Schema %q of database %q is null", name, dbName)
+			}
+			if _, err := dbcontext.Schemas.Set(name, *schema); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	if importDocs {
 		db, _ := db.GetDatabase(dbcontext, nil)
 		if _, err := db.UpdateAllDocChannels(false, true); err != nil {
@@ -252,6 +326,19 @@ func (sc *ServerContext) getOrAddDatabaseFromConfig(config *DbConfig, useExistin
 
 	dbcontext.AllowEmptyPassword = config.AllowEmptyPassword
 
+	if config.OIDC != nil {
+		dbcontext.OIDCProvider = config.OIDC.Provider()
+	}
+	if config.JWT != nil {
+		if dbcontext.JWTVerifier, err = config.JWT.Verifier(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.TombstoneRetention != nil && *config.TombstoneRetention > 0 {
+		dbcontext.StartTombstoneCompaction(time.Duration(*config.TombstoneRetention) * time.Second)
+	}
+
 	if dbcontext.ChannelMapper == nil {
 		base.Logf("Using default sync function 'channel(doc.channels)' for database %q", dbName)
 	}
@@ -306,7 +393,7 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 
 		// validate event-related keys
 		for k, _ := range eventHandlersMap {
-			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" {
+			if k != "max_processes" && k != "wait_for_process" && k != "document_changed" && k != "conflict_resolved" {
 				return errors.New(fmt.Sprintf("Unsupported event property '%s' defined for db %s", k, dbcontext.Name))
 			}
 		}
@@ -323,6 +410,10 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 		if err = sc.processEventHandlersForEvent(eventHandlers.DocumentChanged, db.DocumentChange, dbcontext); err != nil {
 			return err
 		}
+		// Process conflict resolution event handlers
+		if err = sc.processEventHandlersForEvent(eventHandlers.ConflictResolved, db.ConflictResolved, dbcontext); err != nil {
+			return err
+		}
 		// WaitForProcess uses string, to support both omitempty and zero values
 		customWaitTime := int64(-1)
 		if eventHandlers.WaitForProcess != "" {
@@ -354,6 +445,7 @@ func (sc *ServerContext) processEventHandlersForEvent(events []*EventConfig, eve
 				base.Warn("Error creating webhook %v", err)
 				return err
 			}
+			wh.SetJSModules(dbcontext.JSModules)
 			dbcontext.EventMgr.RegisterEventHandler(wh, eventType)
 		default:
 			return errors.New(fmt.Sprintf("Unknown event handler type %s", event.HandlerType))
@@ -418,6 +510,35 @@ func (sc *ServerContext) startShadowing(dbcontext *db.DatabaseContext, shadow *S
 	return nil
 }
 
+// Opens the channel index a database config calls for. It's stored in the database's own bucket
+// unless the config names a different one.
+func openChannelIndex(indexConfig *ChannelIndexConfig, dbSpec base.BucketSpec, dbBucket base.Bucket) (*db.ChannelIndex, error) {
+	if indexConfig.Bucket == nil || *indexConfig.Bucket == dbSpec.BucketName {
+		return db.NewChannelIndex(dbBucket), nil
+	}
+	spec := base.BucketSpec{
+		Server:     dbSpec.Server,
+		PoolName:   dbSpec.PoolName,
+		BucketName: *indexConfig.Bucket,
+	}
+	if indexConfig.Server != nil {
+		spec.Server = *indexConfig.Server
+	}
+	if indexConfig.Pool != nil {
+		spec.PoolName = *indexConfig.Pool
+	}
+	if indexConfig.Username != "" {
+		spec.Auth = indexConfig
+	}
+	bucket, err := base.GetBucket(spec)
+	if err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadGateway,
+			"Unable to connect to channel index bucket: %s", err)
+	}
+	base.Logf("Storing channel index in bucket %q", spec.BucketName)
+	return db.NewChannelIndex(bucket), nil
+}
+
 func (sc *ServerContext) RemoveDatabase(dbName string) bool {
 	sc.lock.Lock()
 	defer sc.lock.Unlock()
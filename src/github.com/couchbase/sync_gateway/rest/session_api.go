@@ -309,6 +309,9 @@ func (h *handler) formatSessionResponse(user auth.User) db.Body {
 	if h.PersonaEnabled() {
 		handlers = append(handlers, "persona")
 	}
+	if h.db != nil && h.db.OIDCProvider != nil {
+		handlers = append(handlers, "oidc")
+	}
 	response := db.Body{"ok": true, "userCtx": userCtx, "authentication_handlers": handlers}
 	return response
 
@@ -0,0 +1,503 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// The replication socket (/db/_sync_socket) carries a replication in both directions over one
+// WebSocket. Each side can send requests to the other, which are numbered so that responses can
+// be matched up with them; requests are handled concurrently, so responses may arrive in any
+// order. Every WebSocket message is one socketMessage in JSON, sent as a text frame or, if it's
+// a binary frame, compressed with DEFLATE.
+//
+// Requests the client sends:
+//   subChanges    - Body is a set of _changes options as in a POST to _changes. The server
+//                   replies, then sends the changes as "changes" requests.
+//   revsDiff      - Body is as in a POST to _revs_diff, and so is the response body.
+//   rev           - Body is a revision with a "_revisions" history, which is saved as with
+//                   new_edits=false. The response body has its "id" and "rev".
+//   getAttachment - Properties "id", "rev" (optional) and "name" identify the attachment; the
+//                   response body is its data, base64-encoded.
+// Requests the server sends:
+//   changes       - Body is an array of changes, as in a _changes feed. The first empty array
+//                   means the feed has caught up with the existing changes. The client's response
+//                   body is an array with, for each change, an array of the revision IDs it wants
+//                   (or null); the server then sends those to it as "rev" requests.
+//   rev           - As above. The server doesn't ask for a response.
+
+// Types of socketMessage
+const (
+	kSocketRequest  = "req"
+	kSocketResponse = "res"
+	kSocketError    = "err"
+)
+
+// Kinds of requests, i.e. socketMessage profiles
+const (
+	kProfileSubChanges    = "subChanges"
+	kProfileChanges       = "changes"
+	kProfileRevsDiff      = "revsDiff"
+	kProfileRev           = "rev"
+	kProfileGetAttachment = "getAttachment"
+)
+
+// Messages at least this long are compressed, if the client accepts compression
+const kSocketCompressThreshold = 1024
+
+// Maximum number of "changes" requests the server has sent that the client hasn't answered yet
+const kSocketMaxPendingChanges = 4
+
+// Maximum number of the client's requests that are handled at once
+const kSocketMaxConcurrentRequests = 8
+
+// Maximum number of changes in one "changes" request
+const kSocketChangesBatchSize = 200
+
+// Maximum size of a message received, before and after decompression (the max size of a
+// Couchbase Server document)
+const kSocketMaxMessageSize = 20 * 1024 * 1024
+
+// A message of the replication socket protocol.
+type socketMessage struct {
+	Type       string                 `json:"type"`              // "req", "res" or "err"
+	Number     uint64                 `json:"n"`                 // Request number; a reply has its request's
+	Profile    string                 `json:"profile,omitempty"` // Kind of request
+	Properties map[string]interface{} `json:"props,omitempty"`   // Parameters of a request
+	Body       json.RawMessage        `json:"body,omitempty"`    // Request or response body
+	NoReply    bool                   `json:"noreply,omitempty"` // Sender of a request doesn't want a reply
+	Status     int                    `json:"status,omitempty"`  // HTTP status of an error
+	Error      string                 `json:"error,omitempty"`   // Message of an error
+}
+
+// WebSocket codec for socketMessages. If 'compress' is set, long messages are sent compressed.
+// Compressed messages received are rejected if they decompress to more than kSocketMaxMessageSize.
+func socketCodec(compress bool) websocket.Codec {
+	return websocket.Codec{
+		Marshal: func(v interface{}) ([]byte, byte, error) {
+			data, err := json.Marshal(v)
+			if err != nil || !compress || len(data) < kSocketCompressThreshold {
+				return data, websocket.TextFrame, err
+			}
+			var buf bytes.Buffer
+			writer, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+			writer.Write(data)
+			writer.Close()
+			return buf.Bytes(), websocket.BinaryFrame, nil
+		},
+		Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+			if payloadType == websocket.BinaryFrame {
+				var err error
+				reader := io.LimitReader(flate.NewReader(bytes.NewReader(data)), kSocketMaxMessageSize+1)
+				if data, err = ioutil.ReadAll(reader); err != nil {
+					return err
+				} else if len(data) > kSocketMaxMessageSize {
+					return websocket.ErrFrameTooLarge
+				}
+			}
+			return json.Unmarshal(data, v)
+		},
+	}
+}
+
+// The server side of a replication socket connection.
+type syncSocket struct {
+	h              *handler
+	conn           *websocket.Conn
+	codec          websocket.Codec
+	lastNumber     uint64                         // Number of the last request sent (atomic)
+	replies        map[uint64]chan *socketMessage // Awaits replies to requests sent, by number
+	repliesLock    sync.Mutex                     // Protects 'replies'
+	pendingChanges chan bool                      // Holds a token per unanswered "changes" request
+	activeRequests chan bool                      // Holds a token per client request being handled
+	subscribed     int32                          // Set to 1 once the client sends subChanges (atomic)
+	terminator     chan bool                      // Closed when the connection closes
+}
+
+// HTTP handler for the replication socket
+func (h *handler) handleSyncSocket() error {
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, rq *http.Request) error { return h.checkSocketOrigin(rq) },
+		Handler: func(conn *websocket.Conn) {
+			h.logStatus(101, "Upgraded to WebSocket protocol")
+			conn.MaxPayloadBytes = kSocketMaxMessageSize
+			defer func() {
+				conn.Close()
+				base.LogTo("HTTP+", "#%03d:     --> Replication socket closed", h.serialNumber)
+			}()
+			socket := &syncSocket{
+				h:              h,
+				conn:           conn,
+				codec:          socketCodec(h.getBoolQuery("compress")),
+				replies:        map[uint64]chan *socketMessage{},
+				pendingChanges: make(chan bool, kSocketMaxPendingChanges),
+				activeRequests: make(chan bool, kSocketMaxConcurrentRequests),
+				terminator:     make(chan bool),
+			}
+			socket.run()
+		},
+	}
+	server.ServeHTTP(h.response, h.rq)
+	return nil
+}
+
+// Browsers let any web page open a WebSocket, sending the user's cookies along, so unlike a
+// cross-origin XHR there's no preflight to stop a page from writing docs as the user. Instead the
+// socket is only accepted from the server's own origin or (on the public port) the CORS origins.
+// Requests without an Origin header don't come from browsers, so they're allowed.
+func (h *handler) checkSocketOrigin(rq *http.Request) error {
+	originHeader := rq.Header["Origin"]
+	if len(originHeader) == 0 {
+		return nil
+	}
+	if origin, err := url.Parse(originHeader[0]); err == nil && origin.Host == rq.Host {
+		return nil
+	}
+	cors := h.server.config.CORS
+	if h.privs != adminPrivs && cors != nil && matchedOrigin(cors.Origin, originHeader) != "" {
+		return nil
+	}
+	base.LogTo("HTTP", "#%03d: Replication socket rejected origin %q", h.serialNumber, originHeader[0])
+	return base.HTTPErrorf(http.StatusForbidden, "Origin not allowed")
+}
+
+// Reads and dispatches incoming messages until the connection closes.
+func (s *syncSocket) run() {
+	defer close(s.terminator)
+	for {
+		var msg socketMessage
+		if err := s.codec.Receive(s.conn, &msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case kSocketRequest:
+			// Stop reading while too many requests are in progress, so the client has to wait:
+			s.activeRequests <- true
+			go func() {
+				defer func() { <-s.activeRequests }()
+				s.handleRequest(&msg)
+			}()
+		case kSocketResponse, kSocketError:
+			s.repliesLock.Lock()
+			replyChan := s.replies[msg.Number]
+			delete(s.replies, msg.Number)
+			s.repliesLock.Unlock()
+			if replyChan != nil {
+				replyChan <- &msg
+			}
+		default:
+			base.LogTo("HTTP", "#%03d: Replication socket got unknown message type %q",
+				s.h.serialNumber, msg.Type)
+		}
+	}
+}
+
+// Handles a request from the client and sends the reply.
+func (s *syncSocket) handleRequest(msg *socketMessage) {
+	base.LogTo("HTTP", "#%03d:     --> Replication socket request #%d: %s",
+		s.h.serialNumber, msg.Number, msg.Profile)
+	var result interface{}
+	err := s.checkRateLimit(msg.Profile)
+	if err == nil {
+		switch msg.Profile {
+		case kProfileSubChanges:
+			err = s.handleSubChanges(msg)
+		case kProfileRevsDiff:
+			result, err = s.handleRevsDiff(msg)
+		case kProfileRev:
+			result, err = s.handleRev(msg)
+		case kProfileGetAttachment:
+			result, err = s.handleGetAttachment(msg)
+		default:
+			err = base.HTTPErrorf(http.StatusNotFound, "Unknown profile %q", msg.Profile)
+		}
+	}
+	if msg.NoReply {
+		return
+	}
+	reply := &socketMessage{Type: kSocketResponse, Number: msg.Number}
+	if err == nil && result != nil {
+		reply.Body, err = json.Marshal(result)
+	}
+	if err != nil {
+		base.LogTo("HTTP", "#%03d:     --> Replication socket request #%d failed: %v",
+			s.h.serialNumber, msg.Number, err)
+		reply = &socketMessage{Type: kSocketError, Number: msg.Number}
+		reply.Status, reply.Error = base.ErrorAsHTTPStatus(err)
+	}
+	s.send(reply)
+}
+
+// Applies the public API's rate limits to a request from the client, by its kind: "rev" requests
+// count as writes, "subChanges" as a changes feed, and the others as reads.
+func (s *syncSocket) checkRateLimit(profile string) error {
+	if s.h.privs == adminPrivs || s.h.server.throttle == nil {
+		return nil
+	}
+	class := kThrottleReads
+	switch profile {
+	case kProfileRev:
+		class = kThrottleWrites
+	case kProfileSubChanges:
+		class = kThrottleChanges
+	}
+	for _, byUser := range []bool{false, true} {
+		if retryAfter := s.h.throttle(class, byUser); retryAfter > 0 {
+			return base.HTTPErrorf(http.StatusTooManyRequests, "Too many requests; retry after %d sec",
+				int(math.Ceil(retryAfter.Seconds())))
+		}
+	}
+	return nil
+}
+
+// Sends a request to the client. Unless noReply is set, returns a channel that will receive
+// the reply.
+func (s *syncSocket) sendRequest(profile string, body interface{}, noReply bool) (<-chan *socketMessage, error) {
+	msg := &socketMessage{
+		Type:    kSocketRequest,
+		Number:  atomic.AddUint64(&s.lastNumber, 1),
+		Profile: profile,
+		NoReply: noReply,
+	}
+	var err error
+	if msg.Body, err = json.Marshal(body); err != nil {
+		return nil, err
+	}
+	var replyChan chan *socketMessage
+	if !noReply {
+		replyChan = make(chan *socketMessage, 1)
+		s.repliesLock.Lock()
+		s.replies[msg.Number] = replyChan
+		s.repliesLock.Unlock()
+	}
+	return replyChan, s.send(msg)
+}
+
+func (s *syncSocket) send(msg *socketMessage) error {
+	return s.codec.Send(s.conn, msg)
+}
+
+//////// HANDLERS:
+
+func (s *syncSocket) handleSubChanges(msg *socketMessage) error {
+	body := []byte(msg.Body)
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+	feed, options, filter, channelsArray, err := s.h.readChangesOptionsFromJSON(body)
+	if err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid subChanges options")
+	}
+	var query map[string]interface{}
+	if err := json.Unmarshal(body, &query); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid subChanges options")
+	}
+	inChannels, err := s.h.applyChangesFilter(filter, channelsArray, query, &options)
+	if err != nil {
+		return err
+	}
+	if !atomic.CompareAndSwapInt32(&s.subscribed, 0, 1) {
+		return base.HTTPErrorf(http.StatusConflict, "Already subscribed to changes")
+	}
+	if feed == "continuous" {
+		options.Wait = true
+		options.Continuous = true
+	}
+	options.Terminator = s.terminator
+
+	// The feed gets its own Database, since it reloads the user when its access changes:
+	changesDB, err := db.GetDatabase(s.h.db.DatabaseContext, s.h.user)
+	if err != nil {
+		atomic.StoreInt32(&s.subscribed, 0)
+		return err
+	}
+	go s.sendChanges(changesDB, inChannels, options)
+	return nil
+}
+
+// Sends the changes feed to the client as "changes" requests, in batches.
+func (s *syncSocket) sendChanges(changesDB *db.Database, inChannels base.Set, options db.ChangesOptions) {
+	s.h.db.ChangesClientStats.Increment()
+	defer s.h.db.ChangesClientStats.Decrement()
+
+	feed, err := changesDB.MultiChangesFeed(inChannels, options)
+	if err != nil {
+		base.Warn("Replication socket: error starting changes feed: %v", err)
+		return
+	}
+	var batch []*db.ChangeEntry
+	caughtUp := false
+	for {
+		// Read the next entry. If there's a batch in progress, send it when it's full or when
+		// no entry is ready yet; that says nothing about whether the backfill is done.
+		var entry *db.ChangeEntry
+		ok := true
+		if len(batch) == 0 {
+			entry, ok = <-feed
+		} else if len(batch) < kSocketChangesBatchSize {
+			select {
+			case entry, ok = <-feed:
+			default:
+				if !s.sendChangesBatch(changesDB, batch) {
+					return
+				}
+				batch = nil
+				continue
+			}
+		} else {
+			if !s.sendChangesBatch(changesDB, batch) {
+				return
+			}
+			batch = nil
+			continue
+		}
+		if ok && entry != nil {
+			if entry.Err != nil {
+				return // error returned by feed - end changes
+			}
+			batch = append(batch, entry)
+			continue
+		}
+
+		// The feed sends a nil entry when it's sent the existing changes and is waiting for new
+		// ones, and closes when it's done. Only then has the client caught up:
+		if len(batch) > 0 {
+			if !s.sendChangesBatch(changesDB, batch) {
+				return
+			}
+			batch = nil
+		}
+		if !caughtUp {
+			caughtUp = true
+			if !s.sendChangesBatch(changesDB, []*db.ChangeEntry{}) {
+				return
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// Sends a "changes" request once fewer than kSocketMaxPendingChanges are unanswered, and later
+// sends the client the revisions it asks for in its response. Returns false if the connection
+// has closed.
+func (s *syncSocket) sendChangesBatch(changesDB *db.Database, batch []*db.ChangeEntry) bool {
+	select {
+	case s.pendingChanges <- true:
+	case <-s.terminator:
+		return false
+	}
+	replyChan, err := s.sendRequest(kProfileChanges, batch, false)
+	if err != nil {
+		<-s.pendingChanges
+		return false
+	}
+	go func() {
+		defer func() { <-s.pendingChanges }()
+		var reply *socketMessage
+		select {
+		case reply = <-replyChan:
+		case <-s.terminator:
+			return
+		}
+		if reply.Type != kSocketResponse || len(reply.Body) == 0 {
+			return
+		}
+		var wanted [][]string
+		if err := json.Unmarshal(reply.Body, &wanted); err != nil {
+			base.LogTo("HTTP", "#%03d: Replication socket got invalid changes response: %v",
+				s.h.serialNumber, err)
+			return
+		}
+		for i, revids := range wanted {
+			if i >= len(batch) {
+				break
+			}
+			for _, revid := range revids {
+				body, err := changesDB.GetRev(batch[i].ID, revid, true, nil)
+				if err != nil {
+					base.Warn("Replication socket: error getting %q / %q: %v", batch[i].ID, revid, err)
+					continue
+				}
+				if _, err = s.sendRequest(kProfileRev, body, true); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return true
+}
+
+func (s *syncSocket) handleRevsDiff(msg *socketMessage) (interface{}, error) {
+	var input map[string][]string
+	if err := json.Unmarshal(msg.Body, &input); err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid revsDiff body")
+	}
+	output := map[string]interface{}{}
+	for docid, revs := range input {
+		missing, possible := s.h.db.RevDiff(docid, revs)
+		if missing != nil {
+			docOutput := map[string]interface{}{"missing": missing}
+			if possible != nil {
+				docOutput["possible_ancestors"] = possible
+			}
+			output[docid] = docOutput
+		}
+	}
+	return output, nil
+}
+
+func (s *syncSocket) handleRev(msg *socketMessage) (interface{}, error) {
+	var body db.Body
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid rev body")
+	}
+	docid, _ := body["_id"].(string)
+	revisions := db.ParseRevisions(body)
+	if docid == "" || revisions == nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Bad _id or _revisions")
+	}
+	if err := s.h.db.PutExistingRev(docid, body, revisions); err != nil {
+		return nil, err
+	}
+	return db.Body{"id": docid, "rev": revisions[0]}, nil
+}
+
+func (s *syncSocket) handleGetAttachment(msg *socketMessage) (interface{}, error) {
+	docid, _ := msg.Properties["id"].(string)
+	revid, _ := msg.Properties["rev"].(string)
+	name, _ := msg.Properties["name"].(string)
+	body, err := s.h.db.GetRev(docid, revid, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := db.BodyAttachments(body)[name].(map[string]interface{})
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "missing attachment %s", name)
+	}
+	digest, _ := meta["digest"].(string)
+	return s.h.db.GetAttachment(db.AttachmentKey(digest))
+}
@@ -0,0 +1,160 @@
+//  Copyright (c) 2015 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Classes of requests that have separate rate limits
+const (
+	kThrottleReads   = "reads"
+	kThrottleWrites  = "writes"
+	kThrottleChanges = "changes"
+)
+
+// Enforces the rate limits of a ThrottleConfig on the public API.
+type throttler struct {
+	classes map[string]*classThrottle
+}
+
+// The rate limiters for one class of requests.
+type classThrottle struct {
+	byUser          *base.RateLimiter // Limits each user; nil if unlimited
+	byIP            *base.RateLimiter // Limits each remote IP address; nil if unlimited
+	throttledByUser uint64            // Number of requests rejected by byUser (atomic)
+	throttledByIP   uint64            // Number of requests rejected by byIP (atomic)
+}
+
+// Creates a throttler for the given config, or returns nil if there are no limits.
+func newThrottler(config *ThrottleConfig) *throttler {
+	if config == nil {
+		return nil
+	}
+	t := &throttler{classes: map[string]*classThrottle{}}
+	for class, limit := range map[string]*RateLimit{
+		kThrottleReads:   config.Reads,
+		kThrottleWrites:  config.Writes,
+		kThrottleChanges: config.Changes,
+	} {
+		if limit == nil {
+			continue
+		}
+		ct := &classThrottle{}
+		if limit.UserRate > 0 {
+			ct.byUser = base.NewRateLimiter(limit.UserRate, limit.burst(limit.UserRate))
+		}
+		if limit.IPRate > 0 {
+			ct.byIP = base.NewRateLimiter(limit.IPRate, limit.burst(limit.IPRate))
+		}
+		t.classes[class] = ct
+	}
+	return t
+}
+
+// Checks whether a request of the given class may proceed, keyed by a user name if byUser is
+// true or else by an IP address. If not, returns false and how long the client should wait.
+func (t *throttler) allow(class, key string, byUser bool) (bool, time.Duration) {
+	ct := t.classes[class]
+	if ct == nil {
+		return true, 0
+	}
+	limiter, counter := ct.byIP, &ct.throttledByIP
+	if byUser {
+		limiter, counter = ct.byUser, &ct.throttledByUser
+	}
+	if limiter == nil {
+		return true, 0
+	}
+	ok, retryAfter := limiter.Allow(key)
+	if !ok {
+		atomic.AddUint64(counter, 1)
+		restExpvars.Add("requests_throttled", 1)
+	}
+	return ok, retryAfter
+}
+
+// Returns the number of requests rejected so far, by class and key type, e.g. "reads_by_ip".
+func (t *throttler) stats() map[string]uint64 {
+	stats := map[string]uint64{}
+	for class, ct := range t.classes {
+		stats[class+"_by_user"] = atomic.LoadUint64(&ct.throttledByUser)
+		stats[class+"_by_ip"] = atomic.LoadUint64(&ct.throttledByIP)
+	}
+	return stats
+}
+
+// Determines which rate limit class a request falls under.
+func throttleClass(rq *http.Request) string {
+	path := strings.TrimSuffix(rq.URL.Path, "/")
+	if strings.HasSuffix(path, "/_changes") {
+		return kThrottleChanges
+	}
+	switch rq.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return kThrottleReads
+	case "POST":
+		// These POSTs only read data:
+		for _, suffix := range []string{"/_all_docs", "/_bulk_get", "/_revs_diff"} {
+			if strings.HasSuffix(path, suffix) {
+				return kThrottleReads
+			}
+		}
+	}
+	return kThrottleWrites
+}
+
+// Applies the public API's rate limits to the request, keyed by the authenticated user if byUser
+// is true, else by the client's IP address. Returns a 429 error if the limit has been exceeded.
+func (h *handler) checkRateLimit(byUser bool) error {
+	if h.privs == adminPrivs || h.server.throttle == nil {
+		return nil
+	}
+	if retryAfter := h.throttle(throttleClass(h.rq), byUser); retryAfter > 0 {
+		h.setHeader("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return base.HTTPErrorf(http.StatusTooManyRequests, "Too many requests")
+	}
+	return nil
+}
+
+// Takes a token from the rate limit of the given class for this request's user (if byUser is
+// true) or client IP address. If the limit has been exceeded, returns how long the client should
+// wait; else 0.
+func (h *handler) throttle(class string, byUser bool) time.Duration {
+	var key string
+	if byUser {
+		if h.user == nil || h.user.Name() == "" {
+			return 0 // Guests are only limited by IP address
+		}
+		key = h.PathVar("db") + "/" + h.user.Name()
+	} else {
+		key = h.rq.RemoteAddr
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			key = host
+		}
+	}
+	ok, retryAfter := h.server.throttle.allow(class, key, byUser)
+	if !ok {
+		base.LogTo("HTTP", "#%03d: Rate limit exceeded by %q", h.serialNumber, key)
+		if retryAfter <= 0 {
+			retryAfter = time.Nanosecond
+		}
+		return retryAfter
+	}
+	return 0
+}
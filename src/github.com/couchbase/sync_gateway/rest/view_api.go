@@ -18,14 +18,16 @@ func (h *handler) handleGetDesignDoc() error {
 	var result interface{}
 	if ddocID == db.DesignDocSyncGateway {
 		// we serve this content here so that CouchDB 1.2 has something to
-		// hash into the replication-id, to correspond to our filter.
+		// hash into the replication-id, to correspond to our filters.
 		filter := "ok"
 		if h.db.DatabaseContext.ChannelMapper != nil {
-			hash := sha1.New()
-			io.WriteString(hash, h.db.DatabaseContext.ChannelMapper.Function())
-			filter = fmt.Sprint(hash.Sum(nil))
+			filter = hashFunction(h.db.DatabaseContext.ChannelMapper.Function())
 		}
-		result = db.Body{"filters": db.Body{"bychannel": filter}}
+		filters := db.Body{"bychannel": filter}
+		for name, changesFilter := range h.db.DatabaseContext.ChangesFilters {
+			filters[name] = hashFunction(changesFilter.Function())
+		}
+		result = db.Body{"filters": filters}
 	} else {
 		if err := h.db.GetDesignDoc(ddocID, &result); err != nil {
 			return err
@@ -35,6 +37,12 @@ func (h *handler) handleGetDesignDoc() error {
 	return nil
 }
 
+func hashFunction(fnSource string) string {
+	hash := sha1.New()
+	io.WriteString(hash, fnSource)
+	return fmt.Sprint(hash.Sum(nil))
+}
+
 // HTTP handler for PUT _design/$ddoc
 func (h *handler) handlePutDesignDoc() error {
 	ddocID := h.PathVar("ddoc")